@@ -0,0 +1,161 @@
+package keyvalue
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+)
+
+// append suffix to the value of an existing key as a single atomic step,
+// keeping its expiration. only suffix is written to the log, in a record that
+// replay adds to the value before it. fails with ErrKeyNotFound if the key
+// doesn't exist.
+func (s *Store) Append(key, suffix string) error {
+	return s.runFunc(Operation{Type: OpAppend, Ctx: context.Background(), Key: key, Value: suffix}, func(context.Context) error {
+		return s.appendSuffix(key, suffix)
+	})
+}
+
+func (s *Store) appendSuffix(key, suffix string) error {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%q: %w", key, ErrKeyNotFound)
+	}
+	return s.patchLocked(current, Entry{Key: key, Value: suffix, Append: true}, current.Value+suffix)
+}
+
+// write record, an append or list, set or hash operation that changes the value of
+// the existing entry current, leaving it with value. formats that can't hold
+// such records get the whole value written instead. the caller must hold the
+// write lock.
+func (s *Store) patchLocked(current, record Entry, value string) error {
+	if err := s.validate(current.Key, value); err != nil {
+		return err
+	}
+
+	var evicted []Entry
+	if s.useMemory {
+		if err := s.checkQuota(Entry{Key: current.Key, Value: value}); err != nil {
+			return err
+		}
+		var err error
+		newBytes := memSize(current.Key, value) - memSize(current.Key, current.Value)
+		if evicted, err = s.makeRoomLocked(0, newBytes, map[string]bool{current.Key: true}); err != nil {
+			return err
+		}
+	}
+
+	record.ExpiresAt = current.ExpiresAt
+	records := append(evicted, record)
+	if err := s.appendEntries(records...); err != nil {
+		return err
+	}
+
+	if s.useMemory {
+		for _, e := range evicted {
+			s.dropLocked(e.Key, RemovalEvicted)
+		}
+		s.putLocked(records[len(evicted)].whole(value))
+	}
+	// the search index, watchers and subscribers skip these records, they need
+	// the whole value
+	if record.partial() {
+		if s.search != nil {
+			s.search.set(record.Key, value)
+		}
+		s.notify(Event{Type: EventSet, Key: record.Key, Value: value})
+		s.feedEntries([]Entry{records[len(evicted)].whole(value)})
+	}
+	return nil
+}
+
+// whether the record changes its key's value rather than replacing it
+func (e Entry) partial() bool {
+	return e.Append || e.Op != ""
+}
+
+// the record as one that sets its key to value
+func (e Entry) whole(value string) Entry {
+	e.Value, e.Append, e.Op = value, false, ""
+	return e
+}
+
+// the value a partial record leaves its key with, given base, the value the
+// key had before it
+func (e Entry) applyTo(base string) (string, error) {
+	if e.Append {
+		return base + e.Value, nil
+	}
+	return applyContainerOp(e.Op, base, e.Value)
+}
+
+// where a record is in the log
+type recordRef struct {
+	path   string
+	offset int64
+}
+
+// turns partial records back into whole values while a log is replayed. the
+// record each key was last set by is remembered by position and read again
+// when a partial record needs it, so values are only held in memory for keys
+// that were changed by one.
+type appendResolver struct {
+	aead   cipher.AEAD
+	limit  int                  // Largest record read, see StoreConfig.MaxRecordSize
+	bases  map[string]recordRef // Record each key was last set by
+	values map[string]string    // Whole values of keys last changed by a partial record
+
+	// Values keys had before the first record replayed, nil when replay
+	// starts at the beginning of the log
+	before func(key string) (string, bool)
+}
+
+func newAppendResolver(aead cipher.AEAD, limit int) *appendResolver {
+	return &appendResolver{
+		aead:   aead,
+		limit:  limit,
+		bases:  make(map[string]recordRef),
+		values: make(map[string]string),
+	}
+}
+
+// the entry a record read from offset in path stands for, with a partial
+// record turned into the whole value it leaves the key with. records must be
+// passed in the order they are applied.
+func (r *appendResolver) resolve(entry Entry, path string, offset int64) (Entry, error) {
+	switch {
+	case entry.Deleted:
+		delete(r.bases, entry.Key)
+		delete(r.values, entry.Key)
+	case entry.partial():
+		value, ok := r.values[entry.Key]
+		ref, found := r.bases[entry.Key]
+		switch {
+		case !ok && found:
+			base, err := readSegmentRecord(ref.path, r.aead, r.limit, ref.offset)
+			if err != nil {
+				return Entry{}, fmt.Errorf("error reading record %q was last set by: %w", entry.Key, err)
+			}
+			value = base.Value
+		case !ok && r.before != nil:
+			value, _ = r.before(entry.Key)
+		}
+		value, err := entry.applyTo(value)
+		if err != nil {
+			return Entry{}, fmt.Errorf("error applying %q record for %q: %w", entry.Op, entry.Key, err)
+		}
+		entry = entry.whole(value)
+		r.values[entry.Key] = value
+	default:
+		r.bases[entry.Key] = recordRef{path, offset}
+		delete(r.values, entry.Key)
+	}
+	return entry, nil
+}
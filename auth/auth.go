@@ -0,0 +1,225 @@
+// Package auth checks the API tokens clients of the servers present and the
+// key prefixes each token may read and write, so several apps can share one
+// server. the tokens are listed in a JSON file:
+//
+//	{
+//		"tokens": [
+//			{"name": "admin", "token": "...", "admin": true},
+//			{"name": "app1", "token": "...", "grants": [
+//				{"prefix": "app1:", "access": "readwrite"},
+//				{"prefix": "shared:", "access": "read"}
+//			]}
+//		]
+//	}
+//
+// a token may use a key if any of its grants with a prefix of the key allows
+// it, and admin tokens may use every key and the server-wide operations like
+// compaction. the servers take an ACL from LoadFile with their UseACL
+// methods, and a TLS config from TLSConfig, which can also require client
+// certificates, with their UseTLS methods. clients of those servers, like
+// replicas, dial them with a config from ClientTLSConfig.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// the client sent no token, or one that isn't in the ACL
+	ErrUnauthenticated = errors.New("missing or unknown API token")
+	// the token isn't allowed to do what the client asked
+	ErrForbidden = errors.New("permission denied")
+)
+
+// what a grant allows on the keys under its prefix
+type Access int
+
+const (
+	Read Access = 1 << iota
+	Write
+
+	ReadWrite = Read | Write
+)
+
+func (a Access) String() string {
+	switch a {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case ReadWrite:
+		return "readwrite"
+	default:
+		return fmt.Sprintf("Access(%d)", int(a))
+	}
+}
+
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Access) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "read", "r":
+		*a = Read
+	case "write", "w":
+		*a = Write
+	case "readwrite", "rw":
+		*a = ReadWrite
+	default:
+		return fmt.Errorf("unknown access %q, expected read, write or readwrite", text)
+	}
+	return nil
+}
+
+// access to the keys starting with Prefix, an empty prefix covers every key
+type Grant struct {
+	Prefix string `json:"prefix"`
+	Access Access `json:"access"`
+}
+
+// a token in the ACL file
+type Token struct {
+	Name   string  `json:"name"`   // Shown in errors and logs instead of the token
+	Token  string  `json:"token"`  // The secret clients send
+	Admin  bool    `json:"admin"`  // Whether the token may do everything
+	Grants []Grant `json:"grants"` // The keys a token that isn't an admin may use
+}
+
+// the contents of an ACL file
+type Config struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// the tokens a server accepts and what they may do. it is safe for
+// concurrent use.
+type ACL struct {
+	// Principals by the SHA-256 of their token, so looking one up doesn't
+	// compare the secrets themselves
+	principals map[[sha256.Size]byte]*Principal
+}
+
+// create an ACL from a config, failing if a token is empty or listed twice
+func New(config Config) (*ACL, error) {
+	acl := &ACL{principals: make(map[[sha256.Size]byte]*Principal, len(config.Tokens))}
+	for i, token := range config.Tokens {
+		name := token.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i+1)
+		}
+		if token.Token == "" {
+			return nil, fmt.Errorf("%s has an empty token", name)
+		}
+		sum := sha256.Sum256([]byte(token.Token))
+		if _, ok := acl.principals[sum]; ok {
+			return nil, fmt.Errorf("%s has the same token as another", name)
+		}
+		for _, grant := range token.Grants {
+			if grant.Access&^ReadWrite != 0 || grant.Access == 0 {
+				return nil, fmt.Errorf("%s has a grant for %q without access", name, grant.Prefix)
+			}
+		}
+		acl.principals[sum] = &Principal{Name: name, admin: token.Admin, grants: token.Grants}
+	}
+	return acl, nil
+}
+
+// read an ACL file, see the package docs
+func LoadFile(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ACL file: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing ACL file: %w", err)
+	}
+	acl, err := New(config)
+	if err != nil {
+		return nil, fmt.Errorf("error in ACL file: %w", err)
+	}
+	return acl, nil
+}
+
+// the principal a token belongs to, or ErrUnauthenticated
+func (a *ACL) Authenticate(token string) (*Principal, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	p, ok := a.principals[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return p, nil
+}
+
+// the token from an Authorization header of the form "Bearer <token>"
+func BearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// a client that presented a known token
+type Principal struct {
+	Name   string
+	admin  bool
+	grants []Grant
+}
+
+// whether the principal may do everything
+func (p *Principal) Admin() bool {
+	return p.admin
+}
+
+// whether the principal has the given access to key
+func (p *Principal) Allowed(key string, access Access) bool {
+	if p.admin {
+		return true
+	}
+	var granted Access
+	for _, grant := range p.grants {
+		if strings.HasPrefix(key, grant.Prefix) {
+			granted |= grant.Access
+		}
+	}
+	return granted&access == access
+}
+
+// nil if the principal has the given access to key, otherwise ErrForbidden
+func (p *Principal) Check(key string, access Access) error {
+	if p.Allowed(key, access) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s has no %s access to %q", ErrForbidden, p.Name, access, key)
+}
+
+// nil if the principal is an admin, otherwise ErrForbidden
+func (p *Principal) CheckAdmin() error {
+	if p.admin {
+		return nil
+	}
+	return fmt.Errorf("%w: %s isn't an admin", ErrForbidden, p.Name)
+}
+
+type contextKey struct{}
+
+// a context carrying the principal making a request
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// the principal stored in ctx by NewContext
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
@@ -0,0 +1,143 @@
+// Package backup periodically snapshots a keyvalue.Store and uploads the
+// snapshots to a Sink, keeping only the most recent ones:
+//
+//	s := backup.New(store, backup.NewDirSink("backups"), backup.Config{
+//		Interval: time.Hour,
+//		Keep:     24,
+//	})
+//	go s.Run(ctx)
+//
+// a backup is a snapshot written by Store.Snapshot, restored with
+// Store.RestoreSnapshot.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// where backups are stored. names sort in the order the backups were taken.
+type Sink interface {
+	// start writing the backup called name
+	Create(ctx context.Context, name string) (Writer, error)
+	// the names of the stored backups starting with prefix, in any order
+	List(ctx context.Context, prefix string) ([]string, error)
+	// delete the backup called name
+	Delete(ctx context.Context, name string) error
+}
+
+// a backup being written to a Sink. it is only stored once Close returns
+// without error, Abort discards it instead.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// options for a Scheduler
+type Config struct {
+	Interval time.Duration // Time between backups, defaults to an hour
+	Keep     int           // Backups kept, older ones are deleted (0 or less keeps them all)
+	Prefix   string        // Start of backup names, defaults to "backup-"
+	Logger   *slog.Logger  // Where failed backups are reported while running, defaults to slog.Default()
+}
+
+// takes backups of a store on a schedule
+type Scheduler struct {
+	store  *keyvalue.Store
+	sink   Sink
+	config Config
+}
+
+// create a scheduler backing up store to sink
+func New(store *keyvalue.Store, sink Sink, config Config) *Scheduler {
+	if config.Interval <= 0 {
+		config.Interval = time.Hour
+	}
+	if config.Prefix == "" {
+		config.Prefix = "backup-"
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Scheduler{store: store, sink: sink, config: config}
+}
+
+// take a backup every Config.Interval until ctx is cancelled, starting with
+// one right away. failed backups are logged and retried at the next interval.
+// always returns ctx.Err().
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		if name, err := s.BackupNow(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.config.Logger.Error("error backing up store", "err", err)
+		} else {
+			s.config.Logger.Info("backed up store", "name", name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// take a backup, then delete all but the last Config.Keep of them. returns
+// the name the backup was stored under.
+func (s *Scheduler) BackupNow(ctx context.Context) (string, error) {
+	// the time sorts the names in the order the backups were taken
+	name := s.config.Prefix + time.Now().UTC().Format("20060102T150405.000000000Z") + ".log"
+	w, err := s.sink.Create(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("error creating backup %s: %w", name, err)
+	}
+	if err := s.store.Snapshot(w); err != nil {
+		return "", errors.Join(fmt.Errorf("error writing backup %s: %w", name, err), w.Abort())
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("error storing backup %s: %w", name, err)
+	}
+	if err := s.prune(ctx); err != nil {
+		return name, err
+	}
+	return name, nil
+}
+
+// the names of the stored backups, oldest first
+func (s *Scheduler) List(ctx context.Context) ([]string, error) {
+	names, err := s.sink.List(ctx, s.config.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing backups: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// delete all but the last Config.Keep backups
+func (s *Scheduler) prune(ctx context.Context) error {
+	if s.config.Keep <= 0 {
+		return nil
+	}
+	names, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for len(names) > s.config.Keep {
+		if err := s.sink.Delete(ctx, names[0]); err != nil {
+			errs = append(errs, fmt.Errorf("error deleting backup %s: %w", names[0], err))
+		}
+		names = names[1:]
+	}
+	return errors.Join(errs...)
+}
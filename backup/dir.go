@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// a Sink keeping backups as files in a local directory
+type DirSink struct {
+	dir string
+}
+
+// create a sink storing backups in dir, which is created if it doesn't exist
+func NewDirSink(dir string) *DirSink {
+	return &DirSink{dir: dir}
+}
+
+// the backup is written to a temporary file in the directory and renamed
+// into place once it is complete and synced to disk
+func (d *DirSink) Create(ctx context.Context, name string) (Writer, error) {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating backup directory: %w", err)
+	}
+	f, err := os.CreateTemp(d.dir, name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	return &dirWriter{File: f, path: filepath.Join(d.dir, name)}, nil
+}
+
+func (d *DirSink) List(ctx context.Context, prefix string) ([]string, error) {
+	files, err := os.ReadDir(d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		// temporary files are backups still being written, or left behind by
+		// ones that never finished
+		if f.Type().IsRegular() && strings.HasPrefix(f.Name(), prefix) && !strings.HasSuffix(f.Name(), ".tmp") {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *DirSink) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+// a backup being written to a temporary file
+type dirWriter struct {
+	*os.File
+	path string // Where the backup goes once it is complete
+}
+
+func (w *dirWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("error syncing backup: %w", err), w.Abort())
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return fmt.Errorf("error closing backup: %w", err)
+	}
+	if err := os.Rename(w.File.Name(), w.path); err != nil {
+		os.Remove(w.File.Name())
+		return fmt.Errorf("error renaming backup into place: %w", err)
+	}
+	return nil
+}
+
+func (w *dirWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
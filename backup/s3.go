@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// options for an S3Sink
+type S3Config struct {
+	Endpoint  string       // Base URL of the service, like https://s3.us-east-1.amazonaws.com
+	Region    string       // Region requests are signed for, defaults to us-east-1
+	Bucket    string       // Bucket backups are stored in
+	Prefix    string       // Put in front of backup names to form object keys, like "backups/"
+	AccessKey string       // Access key ID
+	SecretKey string       // Secret access key
+	Client    *http.Client // Client requests are sent with, defaults to http.DefaultClient
+}
+
+// a Sink keeping backups as objects in an S3-compatible object store.
+// requests are signed with AWS Signature Version 4 and address the bucket in
+// the path, which S3 and the services compatible with it all accept. backups
+// are uploaded in a single request, which S3 limits to 5GB.
+type S3Sink struct {
+	config S3Config
+}
+
+// create a sink storing backups in an S3 bucket
+func NewS3Sink(config S3Config) *S3Sink {
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &S3Sink{config: config}
+}
+
+// the backup is spooled to a temporary file, since the upload has to be
+// signed with its hash and length, and uploaded when the writer is closed
+func (s *S3Sink) Create(ctx context.Context, name string) (Writer, error) {
+	f, err := os.CreateTemp("", "keyvalue-backup-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	return &s3Writer{sink: s, ctx: ctx, name: name, file: f, hash: sha256.New()}, nil
+}
+
+// the response to a ListObjectsV2 request
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Sink) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Sink) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.config.Prefix+name, nil, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// the hex SHA-256 hash of an empty request body
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// send a signed request for the object key in the bucket, or for the bucket
+// itself if key is empty. responses other than 2xx are returned as errors.
+func (s *S3Sink) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	path := "/" + s.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing endpoint: %w", err)
+	}
+	base := u.EscapedPath()
+	u.Path += path
+	u.RawPath = base + escapePath(path)
+	u.RawQuery = escapeQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	s.sign(req, u.RawPath, payloadHash, time.Now().UTC())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// add the AWS Signature Version 4 headers to req, whose escaped path is path
+func (s *S3Sink) sign(req *http.Request, path, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// percent-encode everything but the characters SigV4 leaves as they are,
+// and slashes as well if keepSlash is set
+func escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(path string) string {
+	return escape(path, true)
+}
+
+// the query string in the canonical form SigV4 signs, sorted by name
+func escapeQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, escape(name, false)+"="+escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// a backup being spooled to a temporary file before it is uploaded
+type s3Writer struct {
+	sink *S3Sink
+	ctx  context.Context
+	name string
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	defer w.Abort()
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error rewinding temporary file: %w", err)
+	}
+	payloadHash := hex.EncodeToString(w.hash.Sum(nil))
+	// the body is wrapped so the client can't close the file when it is done
+	var body io.Reader = io.NopCloser(io.LimitReader(w.file, w.size))
+	if w.size == 0 {
+		body = http.NoBody
+	}
+	resp, err := w.sink.do(w.ctx, http.MethodPut, w.sink.config.Prefix+w.name, nil, body, w.size, payloadHash)
+	if err != nil {
+		return fmt.Errorf("error uploading backup: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	return errors.Join(w.file.Close(), os.Remove(w.file.Name()))
+}
@@ -0,0 +1,126 @@
+// Package kvbadger converts between Badger databases and keyvalue stores, for
+// moving data from one embedded store to the other. only the latest version
+// of each Badger key is converted, and expirations are kept both ways,
+// rounded up to whole seconds in Badger.
+package kvbadger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/jere-mie/keyvalue"
+)
+
+// entries set in the store with each write while importing
+const importBatch = 10000
+
+// which keys are converted and how the Badger database is opened
+type Options struct {
+	Prefix        string // Only convert keys starting with this
+	EncryptionKey []byte // Key of an encrypted Badger database, 16, 24 or 32 bytes
+}
+
+func (o Options) badger(dir string) badger.Options {
+	opts := badger.DefaultOptions(dir).WithLogger(nil)
+	if o.EncryptionKey != nil {
+		// encrypted tables can only be read through the index cache
+		opts = opts.WithEncryptionKey(o.EncryptionKey).WithIndexCacheSize(64 << 20)
+	}
+	return opts
+}
+
+// set every live key of the Badger database in dir in store, returning how
+// many were set. the database is opened read-only, so it can't be open in
+// another process. keys are set in batches, so an error partway leaves the
+// batches before it set.
+func Import(store *keyvalue.Store, dir string, opts Options) (int, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+	db, err := badger.Open(opts.badger(dir).WithReadOnly(true))
+	if err != nil {
+		return 0, fmt.Errorf("error opening Badger database: %w", err)
+	}
+	defer db.Close()
+
+	imported := 0
+	batch := make([]keyvalue.Entry, 0, importBatch)
+	flush := func() error {
+		if err := store.SetEntries(batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         []byte(opts.Prefix),
+		})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("error reading %q: %w", item.Key(), err)
+			}
+			entry := keyvalue.Entry{Key: string(item.Key()), Value: string(value)}
+			if expiresAt := item.ExpiresAt(); expiresAt != 0 {
+				entry.ExpiresAt = time.Unix(int64(expiresAt), 0).UnixNano()
+			}
+			batch = append(batch, entry)
+			if len(batch) == importBatch {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+// set every live entry of store in the Badger database in dir, creating it
+// if it doesn't exist, and return how many were set. entries are written with
+// a write batch, which may commit some of them before failing.
+func Export(store *keyvalue.Store, dir string, opts Options) (int, error) {
+	entries, err := store.Entries()
+	if err != nil {
+		return 0, err
+	}
+	db, err := badger.Open(opts.badger(dir))
+	if err != nil {
+		return 0, fmt.Errorf("error opening Badger database: %w", err)
+	}
+	defer db.Close()
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	exported := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Key, opts.Prefix) {
+			continue
+		}
+		e := badger.NewEntry([]byte(entry.Key), []byte(entry.Value))
+		if entry.ExpiresAt != 0 {
+			e.ExpiresAt = uint64((entry.ExpiresAt + int64(time.Second) - 1) / int64(time.Second))
+		}
+		if err := wb.SetEntry(e); err != nil {
+			return 0, fmt.Errorf("error setting %q: %w", entry.Key, err)
+		}
+		exported++
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, fmt.Errorf("error writing Badger database: %w", err)
+	}
+	return exported, nil
+}
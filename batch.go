@@ -0,0 +1,201 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// get many keys at once while holding the lock once. in file-only mode the
+// keys the index can't answer are all found in a single pass over the log.
+// keys that don't exist are left out of the result.
+func (s *Store) GetMany(keys []string) (map[string]string, error) {
+	var values map[string]string
+	err := s.runFunc(Operation{Type: OpGetMany, Ctx: context.Background(), Keys: keys}, func(ctx context.Context) (err error) {
+		values, err = s.getMany(ctx, keys)
+		return err
+	})
+	return values, err
+}
+
+func (s *Store) getMany(ctx context.Context, keys []string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// the result is keyed by the keys as passed, see StoreConfig.NormalizeKey
+	requested := keys
+	if s.normalizeKey != nil {
+		keys = make([]string, len(requested))
+		for i, key := range requested {
+			keys[i] = s.normalize(key)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	values := make(map[string]string, len(keys))
+	scan := make(map[string]bool) // Keys to look for in the log
+	for _, key := range keys {
+		switch {
+		case s.useMemory:
+			if entry, ok := s.memLookup(key, now); ok {
+				values[key] = entry.Value
+			}
+		case s.bloom != nil && !s.bloom.mayContain(key):
+		case s.index != nil && !s.index[key].appended:
+			entry, ok, err := s.lookupIndexed(key, now)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				values[key] = entry.Value
+			}
+		default:
+			scan[key] = true
+		}
+	}
+
+	if len(scan) > 0 {
+		latest := make(map[string]Entry, len(scan))
+		err := s.replayKeys(ctx, func(key string) bool { return scan[key] }, func(entry Entry) bool {
+			latest[entry.Key] = entry
+			return true
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading log file: %w", err)
+		}
+		for key, entry := range latest {
+			if !entry.Deleted && !entry.expired(now) {
+				values[key] = entry.Value
+			}
+		}
+	}
+
+	for _, key := range keys {
+		_, exists := values[key]
+		s.counters.read(exists)
+		if exists {
+			s.touch(key)
+		}
+	}
+	if s.normalizeKey != nil {
+		found := make(map[string]string, len(values))
+		for i, key := range requested {
+			if value, ok := values[keys[i]]; ok {
+				found[key] = value
+			}
+		}
+		values = found
+	}
+	return values, nil
+}
+
+// set many key-value pairs at once, appending them to the log with a single
+// write while holding the lock once. either every entry is validated and
+// written, or none are.
+func (s *Store) SetBatch(entries map[string]string) error {
+	// sort keys so the log order is deterministic
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return s.runFunc(Operation{Type: OpSetBatch, Ctx: context.Background(), Keys: keys}, func(context.Context) error {
+		return s.setBatch(keys, entries)
+	})
+}
+
+// set entries in the order of keys, its sorted keys
+func (s *Store) setBatch(keys []string, entries map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// keys that normalize to the same key take the value of the last one in
+	// sorted order
+	batch := make([]Entry, 0, len(keys))
+	positions := make(map[string]int, len(keys))
+	for _, key := range keys {
+		entry := Entry{Key: s.normalize(key), Value: entries[key]}
+		if i, ok := positions[entry.Key]; ok {
+			batch[i] = entry
+			continue
+		}
+		positions[entry.Key] = len(batch)
+		batch = append(batch, entry)
+	}
+	return s.setEntriesLocked(batch)
+}
+
+// validate and append entries with distinct keys in a single write, then
+// apply them to memory. the caller must hold the write lock.
+func (s *Store) setEntriesLocked(batch []Entry) error {
+	newKeys, newBytes := 0, int64(0)
+	keep := make(map[string]bool, len(batch))
+	for _, entry := range batch {
+		keep[entry.Key] = true
+		if err := s.validate(entry.Key, entry.Value); err != nil {
+			return err
+		}
+		newBytes += memSize(entry.Key, entry.Value)
+		if old, exists := s.memValue(entry.Key); exists {
+			newBytes -= memSize(entry.Key, old)
+		} else {
+			newKeys++
+		}
+	}
+	var evicted []Entry
+	if s.useMemory {
+		if err := s.checkQuota(batch...); err != nil {
+			return err
+		}
+		var err error
+		if evicted, err = s.makeRoomLocked(newKeys, newBytes, keep); err != nil {
+			return err
+		}
+	}
+
+	records := append(evicted, batch...)
+	if err := s.appendEntries(records...); err != nil {
+		return err
+	}
+
+	if s.useMemory {
+		for _, entry := range evicted {
+			s.dropLocked(entry.Key, RemovalEvicted)
+		}
+		for _, entry := range records[len(evicted):] {
+			s.putLocked(entry)
+		}
+	}
+
+	return nil
+}
+
+// delete many keys at once, appending all tombstones with a single write
+func (s *Store) DeleteBatch(keys []string) error {
+	return s.runFunc(Operation{Type: OpDeleteBatch, Ctx: context.Background(), Keys: keys}, func(context.Context) error {
+		return s.deleteBatch(keys)
+	})
+}
+
+func (s *Store) deleteBatch(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		batch = append(batch, Entry{Key: s.normalize(key), Deleted: true})
+	}
+	if err := s.appendEntries(batch...); err != nil {
+		return err
+	}
+
+	if s.useMemory {
+		for _, entry := range batch {
+			s.dropLocked(entry.Key, RemovalDeleted)
+		}
+	}
+
+	return nil
+}
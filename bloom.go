@@ -0,0 +1,190 @@
+package keyvalue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// bloom filter files start with a magic string followed by a version byte
+const (
+	bloomMagic   = "KVBF"
+	bloomVersion = 1
+)
+
+// sizing for a false positive rate of about 1%
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+	bloomMinKeys    = 1024
+)
+
+// a scalable bloom filter of the keys written to the log. once a layer holds
+// as many keys as it was sized for a layer twice as big is added, and a key
+// may be present if any layer has it. deleted keys stay in the filter until
+// the log is rewritten.
+type bloomFilter struct {
+	layers []*bloomLayer
+}
+
+type bloomLayer struct {
+	bits     []uint64
+	capacity int // Keys the layer was sized for
+	count    int // Keys added so far
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	return &bloomFilter{layers: []*bloomLayer{newBloomLayer(max(keys, bloomMinKeys))}}
+}
+
+func newBloomLayer(capacity int) *bloomLayer {
+	words := (capacity*bloomBitsPerKey + 63) / 64
+	return &bloomLayer{bits: make([]uint64, words), capacity: capacity}
+}
+
+// the two halves of a 64 bit FNV-1a hash, combined to derive every probe
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	layer := b.layers[len(b.layers)-1]
+	if layer.count >= layer.capacity {
+		layer = newBloomLayer(layer.capacity * 2)
+		b.layers = append(b.layers, layer)
+	}
+	h1, h2 := bloomHash(key)
+	n := uint32(len(layer.bits) * 64)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		layer.bits[bit/64] |= 1 << (bit % 64)
+	}
+	layer.count++
+}
+
+// report whether a key may have been added. false means it never was.
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	for _, layer := range b.layers {
+		n := uint32(len(layer.bits) * 64)
+		found := true
+		for i := uint32(0); i < bloomHashes && found; i++ {
+			bit := (h1 + i*h2) % n
+			found = layer.bits[bit/64]&(1<<(bit%64)) != 0
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// the bloom filter is saved next to the log when the store is closed
+func bloomPath(filename string) string {
+	return filename + ".bloom"
+}
+
+// load the bloom filter saved by the last clean close, or build it from the
+// log if there isn't a usable one. like the index, the saved filter is removed
+// from disk while the store is open. the caller must hold the write lock.
+func (s *Store) openBloom() error {
+	ok, err := s.loadBloom()
+	if err != nil {
+		s.logger.Warn("error reading bloom filter file, rebuilding it", "err", err)
+	}
+	if !ok {
+		if err := s.buildBloom(); err != nil {
+			return err
+		}
+	}
+	return s.removeSidecar(bloomPath(s.filename))
+}
+
+// build a bloom filter of the keys that are live in the log. the caller must
+// hold the write lock.
+func (s *Store) buildBloom() error {
+	live := make(map[string]bool)
+	err := s.replay(func(entry Entry) bool {
+		if entry.Deleted {
+			delete(live, entry.Key)
+		} else {
+			live[entry.Key] = true
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+
+	s.bloom = newBloomFilter(len(live) * 2)
+	for key := range live {
+		s.bloom.add(key)
+	}
+	return nil
+}
+
+// save the bloom filter next to the log. the caller must hold the write lock
+// and have flushed the write buffer.
+func (s *Store) saveBloom() error {
+	buf := binary.AppendUvarint(nil, uint64(len(s.bloom.layers)))
+	for _, layer := range s.bloom.layers {
+		buf = binary.AppendUvarint(buf, uint64(layer.capacity))
+		buf = binary.AppendUvarint(buf, uint64(layer.count))
+		for _, word := range layer.bits {
+			buf = binary.BigEndian.AppendUint64(buf, word)
+		}
+	}
+	return s.saveSidecar(bloomPath(s.filename), bloomMagic, bloomVersion, buf)
+}
+
+// load the saved bloom filter, reporting false if there is none or the log
+// files don't match the ones it was saved for. the caller must hold the write
+// lock.
+func (s *Store) loadBloom() (bool, error) {
+	buf, ok, err := s.readSidecar(bloomPath(s.filename), bloomMagic, bloomVersion)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	bad := errors.New("malformed bloom filter file")
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return v, true
+	}
+
+	count, ok := readUvarint()
+	if !ok || count == 0 {
+		return false, bad
+	}
+	filter := &bloomFilter{}
+	for ; count > 0; count-- {
+		capacity, ok1 := readUvarint()
+		keys, ok2 := readUvarint()
+		if !ok1 || !ok2 || capacity == 0 || capacity > uint64(len(buf)) {
+			return false, bad
+		}
+		layer := newBloomLayer(int(capacity))
+		if len(buf) < len(layer.bits)*8 {
+			return false, bad
+		}
+		for i := range layer.bits {
+			layer.bits[i] = binary.BigEndian.Uint64(buf)
+			buf = buf[8:]
+		}
+		layer.count = int(keys)
+		filter.layers = append(filter.layers, layer)
+	}
+	if len(buf) != 0 {
+		return false, bad
+	}
+	s.bloom = filter
+	return true, nil
+}
@@ -0,0 +1,148 @@
+// Package kvbolt converts between bbolt (BoltDB) databases and keyvalue
+// stores, for moving data from one embedded store to the other.
+//
+// bolt keeps keys in buckets, which may be nested, while a store has a single
+// flat keyspace. keys read from every bucket are put behind the names of the
+// buckets holding them, so key "k" in bucket "b" nested in bucket "a" becomes
+// "a/b/k". bolt has no expirations, so entries lose theirs when exported.
+package kvbolt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	bolt "go.etcd.io/bbolt"
+)
+
+// entries set in the store with each write while importing
+const importBatch = 10000
+
+// how long to wait for another process to release the database
+const openTimeout = 5 * time.Second
+
+// returned when the bucket named in Options doesn't exist
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// which buckets Import reads and Export writes
+type Options struct {
+	Bucket    string // Bucket holding every key, "" for every bucket with keys behind bucket names
+	Separator string // Joins bucket names and keys, "/" by default
+}
+
+func (o Options) separator() string {
+	if o.Separator == "" {
+		return "/"
+	}
+	return o.Separator
+}
+
+// set every key of the bolt database at path in store, returning how many
+// were set. the database is opened read-only, so it can't be open in another
+// process for writing. keys are set in batches, so an error partway leaves
+// the batches before it set.
+func Import(store *keyvalue.Store, path string, opts Options) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: true, Timeout: openTimeout})
+	if err != nil {
+		return 0, fmt.Errorf("error opening bolt database: %w", err)
+	}
+	defer db.Close()
+
+	imported := 0
+	batch := make([]keyvalue.Entry, 0, importBatch)
+	flush := func() error {
+		if err := store.SetEntries(batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	sep := opts.separator()
+
+	// walk a bucket, putting prefix in front of its keys and nested buckets
+	var walk func(b *bolt.Bucket, prefix string) error
+	walk = func(b *bolt.Bucket, prefix string) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(b.Bucket(k), prefix+string(k)+sep)
+			}
+			batch = append(batch, keyvalue.Entry{Key: prefix + string(k), Value: string(v)})
+			if len(batch) == importBatch {
+				return flush()
+			}
+			return nil
+		})
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if opts.Bucket != "" {
+			b := tx.Bucket([]byte(opts.Bucket))
+			if b == nil {
+				return fmt.Errorf("%q: %w", opts.Bucket, ErrBucketNotFound)
+			}
+			return walk(b, "")
+		}
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walk(b, string(name)+sep)
+		})
+	})
+	if err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+// put every live entry of store in the bolt database at path, creating it
+// and the buckets it needs if they don't exist, and return how many were put.
+// with Options.Bucket unset, each key is split at its first separator into a
+// bucket name and the key in that bucket, and keys without one are an error.
+// either every entry is put or none are.
+func Export(store *keyvalue.Store, path string, opts Options) (int, error) {
+	entries, err := store.Entries()
+	if err != nil {
+		return 0, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return 0, fmt.Errorf("error opening bolt database: %w", err)
+	}
+	defer db.Close()
+
+	sep := opts.separator()
+	err = db.Update(func(tx *bolt.Tx) error {
+		var b *bolt.Bucket
+		var current string
+		for _, entry := range entries {
+			bucket, key := opts.Bucket, entry.Key
+			if bucket == "" {
+				var ok bool
+				if bucket, key, ok = strings.Cut(entry.Key, sep); !ok {
+					return fmt.Errorf("%q: key has no bucket name before %q", entry.Key, sep)
+				}
+			}
+			// entries are sorted, so keys of the same bucket come together
+			if b == nil || bucket != current {
+				var err error
+				if b, err = tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+					return fmt.Errorf("error creating bucket %q: %w", bucket, err)
+				}
+				current = bucket
+			}
+			if err := b.Put([]byte(key), []byte(entry.Value)); err != nil {
+				return fmt.Errorf("error putting %q: %w", entry.Key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
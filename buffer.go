@@ -0,0 +1,62 @@
+package keyvalue
+
+import "fmt"
+
+// write encoded records to the log, through the write buffer if there is one.
+// the caller must hold the write lock.
+func (s *Store) write(buf []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.writer != nil {
+		_, err := s.writer.Write(buf)
+		return err
+	}
+	if s.memoryOnly() {
+		return nil
+	}
+	n, err := s.file.Write(buf)
+	return writeError(n, len(buf), err)
+}
+
+// push buffered records to the log file. safe to call with only the read
+// lock held, which replay relies on so readers always see every write.
+func (s *Store) flushBuffer() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.writer == nil || s.writer.Buffered() == 0 {
+		return nil
+	}
+	buffered := s.writer.Buffered()
+	if err := s.writer.Flush(); err != nil {
+		err = writeError(buffered-s.writer.Buffered(), buffered, err)
+		return s.fail(fmt.Errorf("error flushing log file: %w", err))
+	}
+	return nil
+}
+
+// point the write buffer at the current log file, after it was reopened
+func (s *Store) resetBuffer() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.writer != nil {
+		s.writer.Reset(s.file)
+	}
+}
+
+// write any buffered records to the log file. this doesn't fsync, see
+// Sync and SyncMode for durability.
+func (s *Store) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return s.flushBuffer()
+}
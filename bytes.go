@@ -0,0 +1,17 @@
+package keyvalue
+
+// set a key to an arbitrary binary value. values that aren't valid UTF-8 are
+// base64 encoded in JSON logs and stored raw in binary logs, so they always
+// round-trip unchanged.
+func (s *Store) SetBytes(key string, value []byte) error {
+	return s.Set(key, string(value))
+}
+
+// retrieve a value by key as a byte slice
+func (s *Store) GetBytes(key string) ([]byte, bool) {
+	value, exists := s.Get(key)
+	if !exists {
+		return nil, false
+	}
+	return []byte(value), true
+}
@@ -0,0 +1,86 @@
+package keyvalue
+
+import (
+	"container/list"
+	"sync"
+)
+
+// a cache of entries read from the log in file-only mode, see
+// StoreConfig.CacheBytes. once their size, see memSize, passes the limit the
+// least recently used ones are dropped. readers holding only the read lock
+// share it, so it has its own lock.
+type readCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	order *list.List               // Cached entries, most recently used first
+	items map[string]*list.Element // Element holding each cached key's entry
+}
+
+func newReadCache(limit int64) *readCache {
+	return &readCache{limit: limit, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// the cached entry for a key, unless it isn't cached or has expired
+func (c *readCache) get(key string, now int64) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	entry := el.Value.(Entry)
+	if entry.expired(now) {
+		c.removeLocked(el)
+		return Entry{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+// cache the current entry for a key, dropping the least recently used ones
+// to make room. entries larger than the whole cache aren't kept.
+func (c *readCache) add(entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[entry.Key]; ok {
+		c.removeLocked(el)
+	}
+	size := memSize(entry.Key, entry.Value)
+	if size > c.limit {
+		return
+	}
+	for c.size+size > c.limit {
+		c.removeLocked(c.order.Back())
+	}
+	c.items[entry.Key] = c.order.PushFront(entry)
+	c.size += size
+}
+
+// drop a key, once a record changing it is written
+func (c *readCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// drop every key, once the log is replaced
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.items)
+	c.size = 0
+}
+
+func (c *readCache) removeLocked(el *list.Element) {
+	entry := c.order.Remove(el).(Entry)
+	delete(c.items, entry.Key)
+	c.size -= memSize(entry.Key, entry.Value)
+}
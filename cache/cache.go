@@ -0,0 +1,125 @@
+// Package cache fronts a slower database with a keyvalue.Store. reads of
+// keys the store doesn't have are loaded from the database and kept
+// (read-through), and writes go to the database before the store
+// (write-through):
+//
+//	c := cache.New(store, cache.Config{
+//		Load: func(ctx context.Context, key string) (string, bool, error) {
+//			return db.Get(ctx, key)
+//		},
+//		Sink: db,
+//		TTL:  time.Minute,
+//	})
+//	value, ok, err := c.Get(ctx, "user:1")
+//
+// loads and writes of a key are serialized with Store.LockKey, so concurrent
+// misses load a key once and the store and database see writes to it in the
+// same order. writes made to the store directly bypass the database.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// loads the value of a key the store doesn't have, reporting false if the
+// database doesn't have it either
+type Loader func(ctx context.Context, key string) (string, bool, error)
+
+// the database writes are propagated to
+type Sink interface {
+	Set(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+}
+
+// options for a Cache
+type Config struct {
+	Load Loader        // Called on a miss, nil disables read-through
+	Sink Sink          // Receives every Set and Delete before the store, nil disables write-through
+	TTL  time.Duration // How long loaded and written values are kept (0 keeps them until deleted or evicted)
+}
+
+// a store in front of a database
+type Cache struct {
+	store  *keyvalue.Store
+	config Config
+}
+
+// create a cache keeping values in store
+func New(store *keyvalue.Store, config Config) *Cache {
+	return &Cache{store: store, config: config}
+}
+
+// the store holding the cached values
+func (c *Cache) Store() *keyvalue.Store {
+	return c.store
+}
+
+// the value of a key, from the store or, on a miss, loaded with Config.Load
+// and kept in the store. reports false if neither has it.
+func (c *Cache) Get(ctx context.Context, key string) (string, bool, error) {
+	value, ok, err := c.store.GetCtx(ctx, key)
+	if err != nil || ok || c.config.Load == nil {
+		return value, ok, err
+	}
+
+	unlock := c.store.LockKey(key)
+	defer unlock()
+	// another caller may have loaded it while we waited for the lock
+	if value, ok, err := c.store.GetCtx(ctx, key); err != nil || ok {
+		return value, ok, err
+	}
+	value, ok, err = c.config.Load(ctx, key)
+	if err != nil {
+		return "", false, fmt.Errorf("error loading %q: %w", key, err)
+	}
+	if !ok {
+		return "", false, nil
+	}
+	if err := c.keep(key, value); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// set a key in Config.Sink and then the store. if the sink fails the store
+// is left as it was.
+func (c *Cache) Set(ctx context.Context, key, value string) error {
+	unlock := c.store.LockKey(key)
+	defer unlock()
+
+	if c.config.Sink != nil {
+		if err := c.config.Sink.Set(ctx, key, value); err != nil {
+			return fmt.Errorf("error writing %q through: %w", key, err)
+		}
+	}
+	return c.keep(key, value)
+}
+
+// delete a key from Config.Sink and then the store, see Set
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	unlock := c.store.LockKey(key)
+	defer unlock()
+
+	if c.config.Sink != nil {
+		if err := c.config.Sink.Delete(ctx, key); err != nil {
+			return fmt.Errorf("error deleting %q through: %w", key, err)
+		}
+	}
+	return c.store.Delete(key)
+}
+
+// drop a key from the store only, so the next Get loads it again
+func (c *Cache) Invalidate(key string) error {
+	return c.store.Delete(key)
+}
+
+func (c *Cache) keep(key, value string) error {
+	if c.config.TTL > 0 {
+		return c.store.SetWithTTL(key, value, c.config.TTL)
+	}
+	return c.store.Set(key, value)
+}
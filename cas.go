@@ -0,0 +1,168 @@
+package keyvalue
+
+import "context"
+
+// set key to new only if its current value is old, as a single atomic step.
+// reports whether the swap happened, a missing key never matches.
+func (s *Store) CompareAndSwap(key, old, new string) (bool, error) {
+	var swapped bool
+	err := s.runFunc(Operation{Type: OpCompareAndSwap, Ctx: context.Background(), Key: key, Value: new}, func(context.Context) (err error) {
+		swapped, err = s.compareAndSwap(key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+func (s *Store) compareAndSwap(key, old, new string) (bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists || current.Value != old {
+		return false, nil
+	}
+	if err := s.setLocked(key, new, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete key only if its current value is old, as a single atomic step.
+// reports whether the key was deleted.
+func (s *Store) CompareAndDelete(key, old string) (bool, error) {
+	var deleted bool
+	err := s.runFunc(Operation{Type: OpCompareAndSwap, Ctx: context.Background(), Key: key}, func(context.Context) (err error) {
+		deleted, err = s.compareAndDelete(key, old)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *Store) compareAndDelete(key, old string) (bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists || current.Value != old {
+		return false, nil
+	}
+	if err := s.deleteLocked(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// set key only if it doesn't exist yet, as a single atomic step. reports
+// whether the value was stored.
+func (s *Store) SetIfAbsent(key, value string) (bool, error) {
+	var stored bool
+	err := s.runFunc(Operation{Type: OpSetIfAbsent, Ctx: context.Background(), Key: key, Value: value}, func(context.Context) (err error) {
+		stored, err = s.setIfAbsent(key, value)
+		return err
+	})
+	return stored, err
+}
+
+func (s *Store) setIfAbsent(key, value string) (bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	if err := s.setLocked(key, value, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// return the value of key, or set it to def if the key doesn't exist, as a
+// single atomic step. reports whether the value already existed.
+func (s *Store) GetOrSet(key, def string) (string, bool, error) {
+	return s.runGetOrCompute(Operation{Type: OpGetOrSet, Ctx: context.Background(), Key: key, Value: def}, func() (string, error) {
+		return def, nil
+	})
+}
+
+// like GetOrSet, but the value is only computed by fn when the key doesn't
+// exist. fn runs with the store locked, so it must not use the store. an
+// error from fn is returned without setting anything.
+func (s *Store) GetOrCompute(key string, fn func() (string, error)) (string, bool, error) {
+	return s.runGetOrCompute(Operation{Type: OpGetOrSet, Ctx: context.Background(), Key: key}, fn)
+}
+
+func (s *Store) runGetOrCompute(op Operation, fn func() (string, error)) (string, bool, error) {
+	var value string
+	var existed bool
+	err := s.runFunc(op, func(context.Context) (err error) {
+		value, existed, err = s.getOrCompute(op.Key, fn)
+		return err
+	})
+	return value, existed, err
+}
+
+func (s *Store) getOrCompute(key string, fn func() (string, error)) (string, bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return "", false, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+		return current.Value, true, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return "", false, err
+	}
+	if err := s.setLocked(key, value, 0); err != nil {
+		return "", false, err
+	}
+	return value, false, nil
+}
+
+// read-modify-write key as a single atomic step. fn gets the current value
+// and whether the key exists, and returns the new value and whether to keep
+// the key: if keep is false the key is deleted. an existing expiration time
+// is kept. fn runs with the store locked, so it must not use the store.
+func (s *Store) Update(key string, fn func(old string, exists bool) (new string, keep bool)) error {
+	return s.runFunc(Operation{Type: OpUpdate, Ctx: context.Background(), Key: key}, func(context.Context) error {
+		return s.update(key, fn)
+	})
+}
+
+func (s *Store) update(key string, fn func(old string, exists bool) (new string, keep bool)) error {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return err
+	}
+	value, keep := fn(current.Value, exists)
+	switch {
+	case keep:
+		return s.setLocked(key, value, current.ExpiresAt)
+	case exists:
+		return s.deleteLocked(key)
+	}
+	return nil
+}
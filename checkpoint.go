@@ -0,0 +1,367 @@
+package keyvalue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// checkpoint files start with a magic string followed by a version byte, the
+// length of the fields describing the log they were saved for and a CRC32 of
+// everything before it. the keys in memory follow as a binary log.
+const (
+	checkpointMagic   = "KVCP"
+	checkpointVersion = 1
+)
+
+// bytes before the end of the last log file a checkpoint covers that it keeps
+// a checksum of, to tell if the log was replaced by another one since
+const checkpointTail = 4 << 10
+
+// the checkpoint is saved next to the log
+func checkpointPath(filename string) string {
+	return filename + ".ckpt"
+}
+
+// a point in the log, by index into logFiles and offset in that file. the
+// zero value is the beginning of the log.
+type logPosition struct {
+	file   int
+	offset int64
+}
+
+// the log files a checkpoint covers and their sizes when it was saved. the
+// last one may have grown since, the others must be as they were.
+type checkpointHeader struct {
+	segments []int   // Segment numbers, 0 for a single log file
+	sizes    []int64 // Bytes of each file the checkpoint covers
+	tail     uint32  // CRC32 of the last checkpointTail bytes covered
+	entries  uint64  // Entries in the checkpoint
+	records  int     // Records in the log up to the end of what it covers
+	lastSeq  uint64
+}
+
+// save the keys in memory to a checkpoint next to the log, so opening the
+// store loads them from there and only replays the records written after
+// it, see StoreConfig.CheckpointInterval to save one periodically. writers
+// are only held up while the keys are copied, not while they are written.
+// needs a store kept in memory with a log file.
+func (s *Store) Checkpoint() error {
+	// a compaction would replace the log the checkpoint is for
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if !s.useMemory || s.memoryOnly() {
+		s.mu.Unlock()
+		return errors.New("checkpoints need a store kept in memory with a log file")
+	}
+	if s.readOnly {
+		s.mu.Unlock()
+		return ErrReadOnly
+	}
+	if err := s.Err(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := s.flushBuffer(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	header, err := s.logHeader()
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+	entries := s.memEntries(time.Now().UnixNano())
+	s.mu.Unlock()
+
+	body := LogFormatBinary.header()
+	for _, entry := range entries {
+		data, err := encodeEntry(LogFormatBinary, s.aead, entry)
+		if err != nil {
+			return err
+		}
+		body = append(body, data...)
+	}
+	header.entries = uint64(len(entries))
+	if err := replaceFile(checkpointPath(s.filename), append(header.encode(), body...)); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	s.mu.Lock()
+	s.checkpointed = header.size()
+	s.mu.Unlock()
+	return nil
+}
+
+// describe the log as it is now for a checkpoint. the caller must hold the
+// write lock and have flushed the write buffer.
+func (s *Store) logHeader() (checkpointHeader, error) {
+	header := checkpointHeader{records: s.records, lastSeq: s.lastSeq}
+	paths := s.logFiles()
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return checkpointHeader{}, err
+		}
+		segment := 0
+		if s.segments != nil {
+			segment = s.segments[i]
+		}
+		header.segments = append(header.segments, segment)
+		header.sizes = append(header.sizes, info.Size())
+	}
+	tail, err := tailChecksum(paths[len(paths)-1], header.sizes[len(paths)-1])
+	if err != nil {
+		return checkpointHeader{}, err
+	}
+	header.tail = tail
+	return header, nil
+}
+
+// the CRC32 of the checkpointTail bytes before size in the file at path
+func tailChecksum(path string, size int64) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	start := max(size-checkpointTail, 0)
+	buf := make([]byte, size-start)
+	if _, err := file.ReadAt(buf, start); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// the total size of the log files a checkpoint covers
+func (h checkpointHeader) size() int64 {
+	var total int64
+	for _, size := range h.sizes {
+		total += size
+	}
+	return total
+}
+
+// the start of a checkpoint file, up to where its entries begin
+func (h checkpointHeader) encode() []byte {
+	fields := binary.AppendUvarint(nil, uint64(len(h.segments)))
+	for i, segment := range h.segments {
+		fields = binary.AppendUvarint(fields, uint64(segment))
+		fields = binary.AppendUvarint(fields, uint64(h.sizes[i]))
+	}
+	fields = binary.BigEndian.AppendUint32(fields, h.tail)
+	fields = binary.AppendUvarint(fields, h.entries)
+	fields = binary.AppendUvarint(fields, uint64(h.records))
+	fields = binary.AppendUvarint(fields, h.lastSeq)
+
+	buf := []byte(checkpointMagic)
+	buf = append(buf, checkpointVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(fields)))
+	buf = append(buf, fields...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// read the start of a checkpoint file, returning the offset its entries
+// begin at
+func readCheckpointHeader(r io.ReaderAt, size int64) (checkpointHeader, int64, error) {
+	bad := errors.New("checkpoint is malformed")
+	prefix := len(checkpointMagic) + 5
+	head := make([]byte, prefix)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return checkpointHeader{}, 0, err
+	}
+	if !bytes.Equal(head[:len(checkpointMagic)], []byte(checkpointMagic)) {
+		return checkpointHeader{}, 0, errors.New("checkpoint has an unknown format")
+	}
+	if head[len(checkpointMagic)] != checkpointVersion {
+		return checkpointHeader{}, 0, errors.New("checkpoint has an unsupported version")
+	}
+	n := int64(binary.BigEndian.Uint32(head[len(checkpointMagic)+1:]))
+	if int64(prefix)+n+4 > size {
+		return checkpointHeader{}, 0, bad
+	}
+	buf := make([]byte, prefix+int(n)+4)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return checkpointHeader{}, 0, err
+	}
+	if binary.BigEndian.Uint32(buf[len(buf)-4:]) != crc32.ChecksumIEEE(buf[:len(buf)-4]) {
+		return checkpointHeader{}, 0, errors.New("checkpoint has a checksum mismatch")
+	}
+
+	fields := buf[prefix : len(buf)-4]
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(fields)
+		if n <= 0 {
+			return 0, false
+		}
+		fields = fields[n:]
+		return v, true
+	}
+	var h checkpointHeader
+	count, ok := readUvarint()
+	if !ok || count == 0 || count > uint64(len(fields)) {
+		return checkpointHeader{}, 0, bad
+	}
+	for ; count > 0; count-- {
+		segment, ok1 := readUvarint()
+		size, ok2 := readUvarint()
+		if !ok1 || !ok2 {
+			return checkpointHeader{}, 0, bad
+		}
+		h.segments = append(h.segments, int(segment))
+		h.sizes = append(h.sizes, int64(size))
+	}
+	if len(fields) < 4 {
+		return checkpointHeader{}, 0, bad
+	}
+	h.tail = binary.BigEndian.Uint32(fields)
+	fields = fields[4:]
+	entries, ok1 := readUvarint()
+	records, ok2 := readUvarint()
+	lastSeq, ok3 := readUvarint()
+	if !ok1 || !ok2 || !ok3 || len(fields) != 0 {
+		return checkpointHeader{}, 0, bad
+	}
+	h.entries, h.records, h.lastSeq = entries, int(records), lastSeq
+	return h, int64(len(buf)), nil
+}
+
+// where in the current log the checkpoint with header h leaves off, reporting
+// false if the log isn't the one it was saved for. the caller must hold the
+// write lock.
+func (s *Store) checkpointPosition(h checkpointHeader) (logPosition, bool, error) {
+	paths := s.logFiles()
+	if len(h.segments) > len(paths) {
+		return logPosition{}, false, nil
+	}
+	last := len(h.segments) - 1
+	for i, segment := range h.segments {
+		info, err := os.Stat(paths[i])
+		if err != nil {
+			return logPosition{}, false, err
+		}
+		if s.segments != nil && segment != s.segments[i] {
+			return logPosition{}, false, nil
+		}
+		if info.Size() < h.sizes[i] || (i < last && info.Size() != h.sizes[i]) {
+			return logPosition{}, false, nil
+		}
+	}
+	tail, err := tailChecksum(paths[last], h.sizes[last])
+	if err != nil {
+		return logPosition{}, false, err
+	}
+	if tail != h.tail {
+		return logPosition{}, false, nil
+	}
+	return logPosition{file: last, offset: h.sizes[last]}, true, nil
+}
+
+// pass fn the entries of the checkpoint, if there is one for the current log,
+// returning where replay continues from. fn returning false fails loading it.
+// the caller must hold the write lock.
+func (s *Store) loadCheckpoint(fn func(Entry) bool) (logPosition, error) {
+	path := checkpointPath(s.filename)
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return logPosition{}, nil
+	}
+	if err != nil {
+		return logPosition{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return logPosition{}, err
+	}
+
+	header, start, err := readCheckpointHeader(file, info.Size())
+	if err != nil {
+		return logPosition{}, err
+	}
+	from, ok, err := s.checkpointPosition(header)
+	if err != nil || !ok {
+		return logPosition{}, err
+	}
+
+	// unlike the log, a checkpoint is only used if all of it can be read
+	var entries uint64
+	var bad error
+	stopped := false
+	body := io.NewSectionReader(file, start, info.Size()-start)
+	err = replayFrom(body, path, s.aead, s.maxRecordSize, func(entry Entry, _ int64) bool {
+		entries++
+		stopped = !fn(entry)
+		return !stopped
+	}, func(err error) {
+		if bad == nil {
+			bad = err
+		}
+	})
+	switch {
+	case err != nil:
+		return logPosition{}, err
+	case bad != nil:
+		return logPosition{}, bad
+	case stopped:
+		return logPosition{}, errors.New("store exceeded its limits")
+	case entries != header.entries:
+		return logPosition{}, fmt.Errorf("checkpoint holds %d of %d entries", entries, header.entries)
+	}
+	s.records = header.records
+	s.lastSeq = max(s.lastSeq, header.lastSeq)
+	s.checkpointed = header.size()
+	return from, nil
+}
+
+// remove the checkpoint before the log is replaced or cut short, so a crash
+// can't leave it next to a log it doesn't match. the caller must hold the
+// write lock.
+func (s *Store) dropCheckpoint() error {
+	s.checkpointed = 0
+	if err := os.Remove(checkpointPath(s.filename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing checkpoint: %w", err)
+	}
+	return nil
+}
+
+// save a checkpoint every interval if the log has grown since the last one,
+// until the store is closed
+func (s *Store) checkpointLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.RLock()
+			s.amu.Lock()
+			size, err := s.logSize()
+			s.amu.Unlock()
+			changed := err == nil && size != s.checkpointed
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := s.Checkpoint(); err != nil && !errors.Is(err, ErrStoreClosed) {
+				s.logger.Error("error saving checkpoint", "err", err)
+			}
+		}
+	}
+}
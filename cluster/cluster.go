@@ -0,0 +1,256 @@
+// Package cluster spreads keys over several stores with consistent hashing,
+// for datasets too large for one log file or machine. each store is a node,
+// either a keyvalue.Store opened locally or a kvserver reached over its REST
+// API:
+//
+//	c, err := cluster.New(map[string]cluster.Node{
+//		"a": cluster.Local(storeA),
+//		"b": cluster.Remote("10.0.0.2:8080"),
+//		"c": cluster.Remote("10.0.0.3:8080"),
+//	}, cluster.Config{Replicas: 2})
+//
+// every node owns many points on a hash ring, picked from its name, and a key
+// belongs to the nodes owning the next points after the key's hash. only
+// about 1/N of the keys change nodes when a node is added or removed, but
+// they aren't moved, so they read as missing until they are written again.
+// keep the names of nodes the same across restarts, even when their
+// addresses change.
+package cluster
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// points each node owns on the ring when Config.VirtualNodes is 0
+const defaultVirtualNodes = 128
+
+// returned by New without any nodes
+var ErrNoNodes = errors.New("cluster has no nodes")
+
+// how a Cluster spreads keys over its nodes
+type Config struct {
+	Replicas     int // Nodes each key is written to, reads fall back to the next one when a node fails (1 if 0)
+	VirtualNodes int // Points each node owns on the ring, more spread keys more evenly (128 if 0)
+}
+
+// a point on the ring and the node owning it
+type point struct {
+	hash uint64
+	node int // Index into Cluster.nodes
+}
+
+// a client spreading keys over several nodes, safe for concurrent use. the
+// nodes can't change once it is created, create a new Cluster instead.
+type Cluster struct {
+	names    []string // Node names, sorted
+	nodes    []Node
+	ring     []point // Sorted by hash
+	replicas int
+}
+
+// create a cluster over nodes by name
+func New(nodes map[string]Node, config Config) (*Cluster, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	if config.Replicas < 0 || config.VirtualNodes < 0 {
+		return nil, fmt.Errorf("replicas and virtual nodes can't be negative")
+	}
+	if config.VirtualNodes == 0 {
+		config.VirtualNodes = defaultVirtualNodes
+	}
+
+	c := &Cluster{replicas: min(max(config.Replicas, 1), len(nodes))}
+	for name := range nodes {
+		c.names = append(c.names, name)
+	}
+	slices.Sort(c.names)
+	for i, name := range c.names {
+		c.nodes = append(c.nodes, nodes[name])
+		for v := range config.VirtualNodes {
+			c.ring = append(c.ring, point{hash: hash(name + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+	// ties between nodes go to the one with the lower name
+	slices.SortFunc(c.ring, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.node, b.node))
+	})
+	return c, nil
+}
+
+// FNV-1a, with the bits mixed afterwards so keys differing only in their
+// last bytes spread over the whole ring
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// the indexes of the nodes key belongs to, its primary first
+func (c *Cluster) owners(key string) []int {
+	h := hash(key)
+	i, _ := slices.BinarySearchFunc(c.ring, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	return c.ownersFrom(i)
+}
+
+// the indexes of the nodes owning the keys that hash up to ring[i], walking
+// the ring from there
+func (c *Cluster) ownersFrom(i int) []int {
+	owners := make([]int, 0, c.replicas)
+	for n := 0; n < len(c.ring) && len(owners) < c.replicas; n++ {
+		p := c.ring[(i+n)%len(c.ring)]
+		if !slices.Contains(owners, p.node) {
+			owners = append(owners, p.node)
+		}
+	}
+	return owners
+}
+
+// the names of the nodes key is written to, its primary first
+func (c *Cluster) NodesFor(key string) []string {
+	var names []string
+	for _, i := range c.owners(key) {
+		names = append(names, c.names[i])
+	}
+	return names
+}
+
+// read a key from its primary, or from the next of its nodes when reading
+// fails. the error of every node is returned if none of them could be read.
+func (c *Cluster) Get(key string) (string, bool, error) {
+	var errs []error
+	for _, i := range c.owners(key) {
+		value, exists, err := c.nodes[i].Get(key)
+		if err == nil {
+			return value, exists, nil
+		}
+		errs = append(errs, fmt.Errorf("node %s: %w", c.names[i], err))
+	}
+	return "", false, errors.Join(errs...)
+}
+
+func (c *Cluster) Set(key, value string) error {
+	return c.write(key, func(n Node) error {
+		return n.Set(key, value, 0)
+	})
+}
+
+// like Set, but the key expires after ttl on every node
+func (c *Cluster) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return keyvalue.ErrInvalidTTL
+	}
+	return c.write(key, func(n Node) error {
+		return n.Set(key, value, ttl)
+	})
+}
+
+func (c *Cluster) Delete(key string) error {
+	return c.write(key, func(n Node) error {
+		return n.Delete(key)
+	})
+}
+
+// run fn on every node key belongs to at once. the write fails if it failed
+// on any of them, though the others keep it.
+func (c *Cluster) write(key string, fn func(n Node) error) error {
+	owners := c.owners(key)
+	errs := make([]error, len(owners))
+	var wg sync.WaitGroup
+	for j, i := range owners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(c.nodes[i]); err != nil {
+				errs[j] = fmt.Errorf("node %s: %w", c.names[i], err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// return every entry whose key starts with prefix, sorted by key, asking
+// every node at once. a key on several nodes is taken from the first of its
+// nodes that has it, and keys left on nodes they no longer belong to are
+// skipped, like Get would. nodes that fail are skipped too as long as every
+// key they own has another node that answered, otherwise the errors of the
+// failed nodes are returned.
+func (c *Cluster) Scan(prefix string) ([]keyvalue.Entry, error) {
+	results := make([][]keyvalue.Entry, len(c.nodes))
+	errs := make([]error, len(c.nodes))
+	var wg sync.WaitGroup
+	for i, n := range c.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries, err := n.Scan(prefix)
+			if err != nil {
+				errs[i] = fmt.Errorf("node %s: %w", c.names[i], err)
+			}
+			results[i] = entries
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for i := range c.ring {
+			if !slices.ContainsFunc(c.ownersFrom(i), func(node int) bool { return errs[node] == nil }) {
+				return nil, err
+			}
+		}
+	}
+
+	type found struct {
+		entry keyvalue.Entry
+		rank  int // Position of the node it came from among the key's nodes
+	}
+	byKey := make(map[string]found)
+	for i, entries := range results {
+		for _, e := range entries {
+			rank := slices.Index(c.owners(e.Key), i)
+			if rank < 0 {
+				continue
+			}
+			if f, ok := byKey[e.Key]; !ok || rank < f.rank {
+				byKey[e.Key] = found{entry: e, rank: rank}
+			}
+		}
+	}
+	entries := make([]keyvalue.Entry, 0, len(byKey))
+	for _, f := range byKey {
+		entries = append(entries, f.entry)
+	}
+	slices.SortFunc(entries, func(a, b keyvalue.Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries, nil
+}
+
+// close every node, returning their errors
+func (c *Cluster) Close() error {
+	var errs []error
+	for i, n := range c.nodes {
+		if err := n.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", c.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
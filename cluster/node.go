@@ -0,0 +1,196 @@
+package cluster
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// a store a Cluster spreads keys over. Get reports a missing key with false
+// rather than an error, so the cluster only falls back to another node when
+// a node fails.
+type Node interface {
+	Get(key string) (string, bool, error)
+	Set(key, value string, ttl time.Duration) error // ttl is 0 for keys that never expire
+	Delete(key string) error
+	Scan(prefix string) ([]keyvalue.Entry, error)
+	Close() error
+}
+
+// a node backed by a store opened in this process
+type localNode struct {
+	store *keyvalue.Store
+}
+
+// use a local store as a node. closing the cluster closes the store.
+func Local(store *keyvalue.Store) Node {
+	return &localNode{store: store}
+}
+
+func (n *localNode) Get(key string) (string, bool, error) {
+	return n.store.GetCtx(context.Background(), key)
+}
+
+func (n *localNode) Set(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return n.store.SetWithTTL(key, value, ttl)
+	}
+	return n.store.Set(key, value)
+}
+
+func (n *localNode) Delete(key string) error                      { return n.store.Delete(key) }
+func (n *localNode) Scan(prefix string) ([]keyvalue.Entry, error) { return n.store.Scan(prefix) }
+func (n *localNode) Close() error                                 { return n.store.Close() }
+
+// a node served by kvserver, talking to its REST API, see httpserver
+type RemoteNode struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// use the server at addr as a node, like "10.0.0.2:8080" or
+// "https://kv.example.com"
+func Remote(addr string) *RemoteNode {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &RemoteNode{
+		base: strings.TrimSuffix(addr, "/"),
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// send token as a bearer token with every request, for servers with an ACL.
+// call it before using the node.
+func (n *RemoteNode) UseToken(token string) {
+	n.token = token
+}
+
+// send requests with client rather than one with a 30 second timeout, like
+// one with TLS client certificates. call it before using the node.
+func (n *RemoteNode) UseClient(client *http.Client) {
+	n.http = client
+}
+
+func (n *RemoteNode) Get(key string) (string, bool, error) {
+	req, err := n.request(http.MethodGet, n.keyURL(key), nil)
+	if err != nil {
+		return "", false, err
+	}
+	// fetch the raw value so binary values survive
+	req.Header.Set("Accept", "application/octet-stream")
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, responseError(resp)
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (n *RemoteNode) Set(key, value string, ttl time.Duration) error {
+	u := n.keyURL(key)
+	if ttl > 0 {
+		u += "?ttl=" + url.QueryEscape(ttl.String())
+	}
+	return n.do(http.MethodPut, u, strings.NewReader(value), nil)
+}
+
+func (n *RemoteNode) Delete(key string) error {
+	return n.do(http.MethodDelete, n.keyURL(key), nil, nil)
+}
+
+// the entries come without their expiration times, which the REST API
+// doesn't return. keys and values are fetched in base64 so binary ones
+// survive.
+func (n *RemoteNode) Scan(prefix string) ([]keyvalue.Entry, error) {
+	var entries []keyvalue.Entry
+	if err := n.do(http.MethodGet, n.base+"/keys?encoding=base64&prefix="+url.QueryEscape(prefix), nil, &entries); err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		key, err := base64.StdEncoding.DecodeString(e.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding key: %w", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding value of %q: %w", key, err)
+		}
+		entries[i].Key, entries[i].Value = string(key), string(value)
+	}
+	return entries, nil
+}
+
+func (n *RemoteNode) Close() error {
+	n.http.CloseIdleConnections()
+	return nil
+}
+
+func (n *RemoteNode) keyURL(key string) string {
+	return n.base + "/keys/" + url.PathEscape(key)
+}
+
+func (n *RemoteNode) request(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return req, nil
+}
+
+// send a request, decoding a JSON response into out if it isn't nil
+func (n *RemoteNode) do(method, u string, body io.Reader, out any) error {
+	req, err := n.request(method, u, body)
+	if err != nil {
+		return err
+	}
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// the error reported by the server in a failed response
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return fmt.Errorf("server returned %s: %s", resp.Status, body.Error)
+}
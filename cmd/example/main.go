@@ -9,12 +9,16 @@ import (
 
 func testStore(useMemory bool, fileName string) {
 	// Create a new store with in-memory storage enabled
-	store := keyvalue.NewStore(fileName, keyvalue.StoreConfig{
+	store, err := keyvalue.NewStore(fileName, keyvalue.StoreConfig{
 		UseMemory:    useMemory,
 		MaxKeys:      100,
 		MaxKeySize:   256,
 		MaxValueSize: 1024,
 	})
+	if err != nil {
+		fmt.Printf("❌ Error opening store %s: %v\n", fileName, err)
+		return
+	}
 
 	// Add 5 entries, k1 to k5 with values v1 to v5
 	for i := 1; i <= 5; i++ {
@@ -40,7 +44,7 @@ func testStore(useMemory bool, fileName string) {
 	}
 
 	// Delete k3
-	err := store.Delete("k3")
+	err = store.Delete("k3")
 	if err != nil {
 		fmt.Printf("❌ Error deleting key k3: %v\n", err)
 	} else {
@@ -69,11 +73,17 @@ func testStore(useMemory bool, fileName string) {
 	}
 
 	// Test compaction (optional)
-	store.Compact()
-	fmt.Println("✅ Compaction complete.")
+	if err := store.Compact(); err != nil {
+		fmt.Printf("❌ Error compacting store: %v\n", err)
+	} else {
+		fmt.Println("✅ Compaction complete.")
+	}
 
-	store.Close()
-	fmt.Println("✅ Store closed.")
+	if err := store.Close(); err != nil {
+		fmt.Printf("❌ Error closing store: %v\n", err)
+	} else {
+		fmt.Println("✅ Store closed.")
+	}
 
 	// remove the log file
 	if err := os.Remove(fileName); err != nil {
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// the operations kvctl runs, against a log file or a remote server
+type client interface {
+	Get(key string) (string, bool, error)
+	Set(key, value string, ttl time.Duration) error
+	Delete(key string) error
+	Scan(prefix string) ([]keyvalue.Entry, error)
+	Compact() error
+	Close()
+}
+
+// operates on a log file directly. the store is opened in file-only mode so
+// large logs don't need to fit in memory and there is no key limit.
+type localClient struct {
+	store *keyvalue.Store
+}
+
+func newLocalClient(filename string, config keyvalue.StoreConfig) (*localClient, error) {
+	config.UseMemory = false
+	store, err := keyvalue.NewStore(filename, config)
+	if err != nil {
+		return nil, err
+	}
+	return &localClient{store: store}, nil
+}
+
+func (c *localClient) Get(key string) (string, bool, error) {
+	value, exists := c.store.Get(key)
+	return value, exists, nil
+}
+
+func (c *localClient) Set(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return c.store.SetWithTTL(key, value, ttl)
+	}
+	return c.store.Set(key, value)
+}
+
+func (c *localClient) Delete(key string) error                      { return c.store.Delete(key) }
+func (c *localClient) Scan(prefix string) ([]keyvalue.Entry, error) { return c.store.Scan(prefix) }
+func (c *localClient) Compact() error                               { return c.store.Compact() }
+func (c *localClient) Close()                                       { c.store.Close() }
+
+// talks to the REST API served by kvserver
+type remoteClient struct {
+	base  string
+	token string // Sent as a bearer token if not empty, for servers run with -acl
+	http  *http.Client
+}
+
+func newRemoteClient(addr, token string) *remoteClient {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &remoteClient{
+		base:  strings.TrimSuffix(addr, "/"),
+		token: token,
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *remoteClient) Get(key string) (string, bool, error) {
+	req, err := c.newRequest(http.MethodGet, c.keyURL(key), nil)
+	if err != nil {
+		return "", false, err
+	}
+	// fetch the raw value so binary values survive
+	req.Header.Set("Accept", "application/octet-stream")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, responseError(resp)
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (c *remoteClient) Set(key, value string, ttl time.Duration) error {
+	u := c.keyURL(key)
+	if ttl > 0 {
+		u += "?ttl=" + url.QueryEscape(ttl.String())
+	}
+	return c.do(http.MethodPut, u, strings.NewReader(value), nil)
+}
+
+func (c *remoteClient) Delete(key string) error {
+	return c.do(http.MethodDelete, c.keyURL(key), nil, nil)
+}
+
+func (c *remoteClient) Scan(prefix string) ([]keyvalue.Entry, error) {
+	var records []record
+	if err := c.do(http.MethodGet, c.base+"/keys?prefix="+url.QueryEscape(prefix), nil, &records); err != nil {
+		return nil, err
+	}
+	entries := make([]keyvalue.Entry, 0, len(records))
+	for _, rec := range records {
+		entries = append(entries, keyvalue.Entry{Key: rec.Key, Value: rec.Value})
+	}
+	return entries, nil
+}
+
+func (c *remoteClient) Compact() error {
+	return c.do(http.MethodPost, c.base+"/compact", nil, nil)
+}
+
+func (c *remoteClient) Close() {}
+
+func (c *remoteClient) keyURL(key string) string {
+	return c.base + "/keys/" + url.PathEscape(key)
+}
+
+// a request to the server carrying the token
+func (c *remoteClient) newRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// send a request, decoding a JSON response into out if it isn't nil
+func (c *remoteClient) do(method, u string, body io.Reader, out any) error {
+	req, err := c.newRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// the error reported by the server in a failed response
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return fmt.Errorf("server returned %s: %s", resp.Status, body.Error)
+}
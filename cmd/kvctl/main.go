@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	kvbadger "github.com/jere-mie/keyvalue/badger"
+	kvbolt "github.com/jere-mie/keyvalue/bolt"
+)
+
+const usage = `Usage: kvctl [flags] <command> [args]
+
+Commands:
+  get <key>              print the value of a key
+  set <key> <value>      set a key, a value of - is read from stdin
+  del <key>...           delete keys
+  scan [prefix]          print every key and value, tab separated
+  compact                compact the log file
+  export [file]          write every entry as JSON lines to file or stdout
+  import [file]          set every entry in JSON lines from file or stdin
+  restore <time> <out>   write the log file as it was at an RFC 3339 time to a new log file
+  migrate <out> <format> write a compacted copy of the log file in json or binary format
+                         to a new log file, dropping entries over the size limits
+  verify [file]          check every record of a log file, -file by default, and how much is dead
+  import-redis <source>  set every string key from a Redis server, given as a URL like
+                         redis://[user:password@]host:port[/db], or from an RDB dump file
+  export-redis <target>  set every entry as a string key on a Redis server URL, or write
+                         them to an RDB dump file Redis can load
+  import-bolt <file> [bucket]
+                         set every key of a BoltDB database, behind the names of their
+                         buckets unless only one bucket is given
+  export-bolt <file> [bucket]
+                         put every entry in a BoltDB database, in the given bucket or
+                         the one named before the first / of each key
+  import-badger <dir> [prefix]
+                         set every key of a Badger database, or only those with a prefix
+  export-badger <dir> [prefix]
+                         set every entry, or only those with a prefix, in a Badger database
+  shell                  run commands interactively
+
+Flags:
+`
+
+// a key-value pair in exported JSON lines
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func main() {
+	file := flag.String("file", "store.log", "log file to operate on")
+	addr := flag.String("addr", "", "URL of a kvserver to use instead of a log file, e.g. http://localhost:8080")
+	token := flag.String("token", os.Getenv("KVCTL_TOKEN"), "API token to send to -addr, for servers run with -acl (defaults to $KVCTL_TOKEN)")
+	ttl := flag.Duration("ttl", 0, "expiration for set, 0 means never")
+	maxKeySize := flag.Int("max-key-size", 256, "maximum key size in bytes")
+	maxValueSize := flag.Int("max-value-size", 1<<20, "maximum value size in bytes")
+	readOnly := flag.Bool("read-only", false, "open the log file without writing to it, safe while another process owns it")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// restoring, migrating and verifying read the log file itself rather
+	// than going through a client
+	if args[0] == "restore" || args[0] == "migrate" || args[0] == "verify" {
+		config := keyvalue.StoreConfig{
+			MaxKeySize:   *maxKeySize,
+			MaxValueSize: *maxValueSize,
+		}
+		var err error
+		switch args[0] {
+		case "restore":
+			err = restore(*file, args[1:], config)
+		case "migrate":
+			err = migrate(*file, args[1:], config)
+		default:
+			err = verify(*file, args[1:], config, os.Stdout)
+		}
+		if errors.Is(err, errUsage) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var c client
+	if *addr != "" {
+		c = newRemoteClient(*addr, *token)
+	} else {
+		var err error
+		c, err = newLocalClient(*file, keyvalue.StoreConfig{
+			MaxKeySize:   *maxKeySize,
+			MaxValueSize: *maxValueSize,
+			ReadOnly:     *readOnly,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening store:", err)
+			os.Exit(1)
+		}
+	}
+
+	err := run(c, os.Stdout, args[0], args[1:], *ttl)
+	c.Close()
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// returned for a bad command line
+var errUsage = errors.New("usage")
+
+// run a single command, writing its output to out
+func run(c client, out io.Writer, cmd string, args []string, ttl time.Duration) error {
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+		value, exists, err := c.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%q: %w", args[0], keyvalue.ErrKeyNotFound)
+		}
+		fmt.Fprintln(out, value)
+	case "set":
+		if len(args) != 2 {
+			return errUsage
+		}
+		value := args[1]
+		if value == "-" {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			value = string(data)
+		}
+		return c.Set(args[0], value, ttl)
+	case "del":
+		if len(args) == 0 {
+			return errUsage
+		}
+		for _, key := range args {
+			if err := c.Delete(key); err != nil {
+				return err
+			}
+		}
+	case "scan":
+		if len(args) > 1 {
+			return errUsage
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		entries, err := c.Scan(prefix)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(out)
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\t%s\n", entry.Key, entry.Value)
+		}
+		return w.Flush()
+	case "compact":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return c.Compact()
+	case "export":
+		if len(args) > 1 {
+			return errUsage
+		}
+		if len(args) == 1 {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return export(c, out)
+	case "import":
+		if len(args) > 1 {
+			return errUsage
+		}
+		in := os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		return importEntries(c, in, ttl)
+	case "import-redis":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return importRedis(c, out, args[0])
+	case "export-redis":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return exportRedis(c, out, args[0])
+	case "import-bolt", "export-bolt", "import-badger", "export-badger":
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+		return convert(c, out, cmd, args)
+	case "shell":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return shell(c, ttl)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// write the log file as it was at the time in args[0] to a new log file at
+// args[1]
+func restore(file string, args []string, config keyvalue.StoreConfig) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	t, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return fmt.Errorf("invalid time: %w", err)
+	}
+	return keyvalue.RestoreToTime(file, t, args[1], config)
+}
+
+// write a compacted copy of file to args[0] in the format named by args[1],
+// leaving out entries over the size limits in config
+func migrate(file string, args []string, config keyvalue.StoreConfig) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	var format keyvalue.LogFormat
+	switch args[1] {
+	case "json":
+		format = keyvalue.LogFormatJSON
+	case "binary":
+		format = keyvalue.LogFormatBinary
+	default:
+		return fmt.Errorf("unknown format %q, expected json or binary", args[1])
+	}
+	return keyvalue.Migrate(file, args[0], keyvalue.MigrateOptions{
+		Format:        format,
+		MaxKeySize:    config.MaxKeySize,
+		MaxValueSize:  config.MaxValueSize,
+		DropOversized: true,
+	})
+}
+
+// returned by verify for a log with bad records, which it already reported
+var errBadRecords = errors.New("log has bad records")
+
+// check the log file in args[0], or file if there is none, and print what
+// was found
+func verify(file string, args []string, config keyvalue.StoreConfig, out io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	if len(args) == 1 {
+		file = args[0]
+	}
+	report, err := keyvalue.VerifyLog(file, config)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	for _, bad := range report.Bad {
+		fmt.Fprintln(w, bad)
+	}
+	fmt.Fprintf(w, "format:       %s, %d file(s), %d bytes\n", report.Format, report.Files, report.Size)
+	fmt.Fprintf(w, "records:      %d, %d bad\n", report.Records, len(report.Bad))
+	fmt.Fprintf(w, "live keys:    %d\n", report.Keys)
+	fmt.Fprintf(w, "duplicates:   %d\n", report.Duplicates)
+	fmt.Fprintf(w, "uncommitted:  %d\n", report.Uncommitted)
+	fmt.Fprintf(w, "dead records: %d\n", report.Dead)
+	fmt.Fprintf(w, "reclaimable:  ~%d bytes\n", report.Reclaimable)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errBadRecords
+	}
+	return nil
+}
+
+// write every entry as a JSON line
+func export(c client, w io.Writer) error {
+	entries, err := c.Scan("")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, entry := range entries {
+		if err := enc.Encode(record{Key: entry.Key, Value: entry.Value}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// set every entry read from JSON lines
+func importEntries(c client, r io.Reader, ttl time.Duration) error {
+	dec := json.NewDecoder(r)
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading entries: %w", err)
+		}
+		if err := c.Set(rec.Key, rec.Value, ttl); err != nil {
+			return err
+		}
+	}
+}
+
+// whether a Redis source or target is a server URL rather than an RDB file
+func isRedisURL(s string) bool {
+	return strings.HasPrefix(s, "redis://") || strings.HasPrefix(s, "rediss://")
+}
+
+// set every string key read from a Redis server or RDB file, keeping its
+// expiration. keys that have already expired are left out.
+func importRedis(c client, out io.Writer, source string) error {
+	imported := 0
+	set := func(entry keyvalue.Entry) error {
+		var ttl time.Duration
+		if entry.ExpiresAt != 0 {
+			if ttl = time.Until(time.Unix(0, entry.ExpiresAt)); ttl <= 0 {
+				return nil
+			}
+		}
+		if err := c.Set(entry.Key, entry.Value, ttl); err != nil {
+			return fmt.Errorf("error setting %q: %w", entry.Key, err)
+		}
+		imported++
+		return nil
+	}
+
+	var skipped int
+	if isRedisURL(source) {
+		conn, err := dialRedis(source)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if skipped, err = conn.scan(set); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if skipped, err = readRDB(f, set); err != nil {
+			return fmt.Errorf("error reading %s: %w", source, err)
+		}
+	}
+	fmt.Fprintf(out, "imported %d keys, skipped %d that aren't strings\n", imported, skipped)
+	return nil
+}
+
+// set every entry as a string key on a Redis server, or write them all to a
+// new RDB file
+func exportRedis(c client, out io.Writer, target string) error {
+	entries, err := expiringEntries(c)
+	if err != nil {
+		return err
+	}
+	if isRedisURL(target) {
+		conn, err := dialRedis(target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.set(entries); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		if err := writeRDB(f, entries); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing %s: %w", target, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "exported %d keys\n", len(entries))
+	return nil
+}
+
+// every entry along with its expiration where the client knows it. the REST
+// API doesn't report expirations, so entries from a server never expire.
+func expiringEntries(c client) ([]keyvalue.Entry, error) {
+	entries, err := c.Scan("")
+	if err != nil {
+		return nil, err
+	}
+	if lc, ok := c.(*localClient); ok {
+		for i := range entries {
+			if entry, exists := lc.store.GetEntry(entries[i].Key); exists {
+				entries[i].ExpiresAt = entry.ExpiresAt
+			}
+		}
+	}
+	return entries, nil
+}
+
+// copy entries between the log file and a BoltDB or Badger database. the
+// converters need the store itself, so they can't go through a kvserver.
+func convert(c client, out io.Writer, cmd string, args []string) error {
+	lc, ok := c.(*localClient)
+	if !ok {
+		return fmt.Errorf("%s works on a log file, not with -addr", cmd)
+	}
+	path, arg := args[0], ""
+	if len(args) == 2 {
+		arg = args[1]
+	}
+
+	var n int
+	var err error
+	switch cmd {
+	case "import-bolt":
+		n, err = kvbolt.Import(lc.store, path, kvbolt.Options{Bucket: arg})
+	case "export-bolt":
+		n, err = kvbolt.Export(lc.store, path, kvbolt.Options{Bucket: arg})
+	case "import-badger":
+		n, err = kvbadger.Import(lc.store, path, kvbadger.Options{Prefix: arg})
+	case "export-badger":
+		n, err = kvbadger.Export(lc.store, path, kvbadger.Options{Prefix: arg})
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(cmd, "import") {
+		fmt.Fprintf(out, "imported %d keys\n", n)
+	} else {
+		fmt.Fprintf(out, "exported %d keys\n", n)
+	}
+	return nil
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// the RDB version written by writeRDB, understood by Redis 5.0 and later
+const rdbVersion = 9
+
+// the newest RDB version readRDB understands, written by Redis 7.4
+const maxRDBVersion = 12
+
+// opcodes found in place of a value type
+const (
+	rdbOpSlotInfo     = 0xf4
+	rdbOpFunction2    = 0xf5
+	rdbOpModuleAux    = 0xf7
+	rdbOpIdle         = 0xf8
+	rdbOpFreq         = 0xf9
+	rdbOpAux          = 0xfa
+	rdbOpResizeDB     = 0xfb
+	rdbOpExpireTimeMS = 0xfc
+	rdbOpExpireTime   = 0xfd
+	rdbOpSelectDB     = 0xfe
+	rdbOpEOF          = 0xff
+)
+
+// value types. only strings are imported, the rest are read past.
+const (
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeZipmap         = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeStream         = 15
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeStream2        = 19
+	rdbTypeSetListpack    = 20
+	rdbTypeStream3        = 21
+)
+
+// special encodings of a string, in place of its length
+const (
+	rdbEncInt8 = iota
+	rdbEncInt16
+	rdbEncInt32
+	rdbEncLZF
+)
+
+// the longest string readRDB reads, the most Redis allows
+const rdbMaxStringLen = 512 * 1024 * 1024
+
+// the CRC-64/Jones table Redis checksums RDB files with, in the reflected
+// form hash/crc64 expects
+var rdbCRCTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// the checksum Redis uses, which unlike hash/crc64 doesn't invert the CRC
+// before and after
+type rdbCRC struct{ crc uint64 }
+
+func (c *rdbCRC) Write(p []byte) (int, error) {
+	c.crc = ^crc64.Update(^c.crc, rdbCRCTable, p)
+	return len(p), nil
+}
+
+// reads an RDB file, checksumming everything read
+type rdbReader struct {
+	r       *bufio.Reader
+	crc     rdbCRC
+	version int
+}
+
+// read the string keys of database 0 from an RDB dump, passing each to fn
+// with its expiration in Unix nanoseconds, 0 for none. other types and
+// databases are read past and counted in skipped.
+func readRDB(r io.Reader, fn func(entry keyvalue.Entry) error) (skipped int, err error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	header := make([]byte, 9)
+	if err := rr.full(header); err != nil {
+		return 0, fmt.Errorf("error reading RDB header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return 0, errors.New("not an RDB file")
+	}
+	if rr.version, err = strconv.Atoi(string(header[5:])); err != nil || rr.version < 1 || rr.version > maxRDBVersion {
+		return 0, fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+
+	db := 0
+	var expiresAt int64
+	for {
+		typ, err := rr.byte()
+		if err != nil {
+			return skipped, unexpectedEOF(err)
+		}
+		switch typ {
+		case rdbOpEOF:
+			return skipped, rr.checksum()
+		case rdbOpSelectDB:
+			n, err := rr.length()
+			if err != nil {
+				return skipped, err
+			}
+			db = int(n)
+			continue
+		case rdbOpResizeDB:
+			err = rr.skipLengths(2)
+		case rdbOpAux:
+			err = rr.skipStrings(2)
+		case rdbOpSlotInfo:
+			err = rr.skipLengths(3)
+		case rdbOpFunction2:
+			err = rr.skipStrings(1)
+		case rdbOpIdle:
+			err = rr.skipLengths(1)
+		case rdbOpFreq:
+			_, err = rr.byte()
+		case rdbOpExpireTime:
+			var buf [4]byte
+			err = rr.full(buf[:])
+			expiresAt = int64(binary.LittleEndian.Uint32(buf[:])) * int64(time.Second)
+		case rdbOpExpireTimeMS:
+			var buf [8]byte
+			err = rr.full(buf[:])
+			expiresAt = int64(binary.LittleEndian.Uint64(buf[:])) * int64(time.Millisecond)
+		case rdbOpModuleAux:
+			return skipped, errors.New("RDB files with module data aren't supported")
+		default:
+			key, err := rr.string()
+			if err != nil {
+				return skipped, fmt.Errorf("error reading key: %w", err)
+			}
+			if typ == rdbTypeString && db == 0 {
+				value, err := rr.string()
+				if err != nil {
+					return skipped, fmt.Errorf("%q: error reading value: %w", key, err)
+				}
+				if err := fn(keyvalue.Entry{Key: key, Value: value, ExpiresAt: expiresAt}); err != nil {
+					return skipped, err
+				}
+			} else {
+				if err := rr.skipValue(typ); err != nil {
+					return skipped, fmt.Errorf("%q: error reading value: %w", key, err)
+				}
+				skipped++
+			}
+			expiresAt = 0
+		}
+		if err != nil {
+			return skipped, unexpectedEOF(err)
+		}
+	}
+}
+
+// check the checksum after the EOF opcode, which files before version 5
+// don't have and a checksum of 0 disables
+func (rr *rdbReader) checksum() error {
+	if rr.version < 5 {
+		return nil
+	}
+	want := rr.crc.crc
+	var buf [8]byte
+	if _, err := io.ReadFull(rr.r, buf[:]); err != nil {
+		return fmt.Errorf("error reading checksum: %w", unexpectedEOF(err))
+	}
+	if sum := binary.LittleEndian.Uint64(buf[:]); sum != 0 && sum != want {
+		return errors.New("RDB checksum mismatch")
+	}
+	return nil
+}
+
+func (rr *rdbReader) byte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (rr *rdbReader) full(buf []byte) error {
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return unexpectedEOF(err)
+	}
+	rr.crc.Write(buf)
+	return nil
+}
+
+// read a length, or the encoding of a string stored in a special format
+func (rr *rdbReader) lengthOrEncoding() (n uint64, encoded bool, err error) {
+	b, err := rr.byte()
+	if err != nil {
+		return 0, false, unexpectedEOF(err)
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rr.byte()
+		if err != nil {
+			return 0, false, unexpectedEOF(err)
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		var buf [8]byte
+		switch b {
+		case 0x80:
+			err := rr.full(buf[:4])
+			return uint64(binary.BigEndian.Uint32(buf[:4])), false, err
+		case 0x81:
+			err := rr.full(buf[:])
+			return binary.BigEndian.Uint64(buf[:]), false, err
+		}
+		return 0, false, fmt.Errorf("invalid length encoding %#x", b)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (rr *rdbReader) length() (uint64, error) {
+	n, encoded, err := rr.lengthOrEncoding()
+	if err == nil && encoded {
+		err = errors.New("expected a length, got a string encoding")
+	}
+	return n, err
+}
+
+// read a string, which may be stored as an integer or compressed with LZF
+func (rr *rdbReader) string() (string, error) {
+	n, encoded, err := rr.lengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := rr.bytes(n)
+		return string(buf), err
+	}
+	var buf [4]byte
+	switch n {
+	case rdbEncInt8:
+		err := rr.full(buf[:1])
+		return strconv.Itoa(int(int8(buf[0]))), err
+	case rdbEncInt16:
+		err := rr.full(buf[:2])
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf[:2])))), err
+	case rdbEncInt32:
+		err := rr.full(buf[:4])
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf[:4])))), err
+	case rdbEncLZF:
+		clen, err := rr.length()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := rr.length()
+		if err != nil {
+			return "", err
+		}
+		if ulen > rdbMaxStringLen {
+			return "", errors.New("string too long")
+		}
+		compressed, err := rr.bytes(clen)
+		if err != nil {
+			return "", err
+		}
+		data, err := lzfDecompress(compressed, int(ulen))
+		return string(data), err
+	default:
+		return "", fmt.Errorf("unknown string encoding %d", n)
+	}
+}
+
+func (rr *rdbReader) bytes(n uint64) ([]byte, error) {
+	if n > rdbMaxStringLen {
+		return nil, errors.New("string too long")
+	}
+	buf := make([]byte, n)
+	return buf, rr.full(buf)
+}
+
+func (rr *rdbReader) skipStrings(n uint64) error {
+	for i := uint64(0); i < n; i++ {
+		if _, err := rr.string(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rr *rdbReader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := rr.length(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read past a value that isn't imported
+func (rr *rdbReader) skipValue(typ byte) error {
+	switch typ {
+	case rdbTypeString, rdbTypeZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		return rr.skipStrings(1)
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		n, err := rr.length()
+		if err != nil {
+			return err
+		}
+		return rr.skipStrings(n)
+	case rdbTypeHash:
+		n, err := rr.length()
+		if err != nil {
+			return err
+		}
+		return rr.skipStrings(2 * n)
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := rr.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+			if err := rr.skipScore(typ); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeListQuicklist2:
+		n, err := rr.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := rr.skipLengths(1); err != nil {
+				return err
+			}
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeStream, rdbTypeStream2, rdbTypeStream3:
+		return rr.skipStream(typ)
+	default:
+		return fmt.Errorf("unsupported value type %d", typ)
+	}
+}
+
+// read past a sorted set score, a binary double in ZSet2 and a string with a
+// one byte length before it, or one of three special lengths, in ZSet
+func (rr *rdbReader) skipScore(typ byte) error {
+	if typ == rdbTypeZSet2 {
+		var buf [8]byte
+		return rr.full(buf[:])
+	}
+	n, err := rr.byte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if n >= 253 {
+		return nil // NaN and infinities
+	}
+	_, err = rr.bytes(uint64(n))
+	return err
+}
+
+// read past a stream: its listpacks, metadata and consumer groups
+func (rr *rdbReader) skipStream(typ byte) error {
+	n, err := rr.length()
+	if err != nil {
+		return err
+	}
+	if err := rr.skipStrings(2 * n); err != nil {
+		return err
+	}
+	// length, last ID, and in newer versions the first ID, max deleted ID
+	// and entries added
+	lengths := 3
+	if typ >= rdbTypeStream2 {
+		lengths += 5
+	}
+	if err := rr.skipLengths(lengths); err != nil {
+		return err
+	}
+
+	groups, err := rr.length()
+	if err != nil {
+		return err
+	}
+	var buf [16]byte
+	for i := uint64(0); i < groups; i++ {
+		if err := rr.skipStrings(1); err != nil {
+			return err
+		}
+		// last delivered ID, and entries read in newer versions
+		lengths := 2
+		if typ >= rdbTypeStream2 {
+			lengths++
+		}
+		if err := rr.skipLengths(lengths); err != nil {
+			return err
+		}
+		pending, err := rr.length()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pending; j++ {
+			// entry ID, delivery time and delivery count
+			if err := rr.full(buf[:]); err != nil {
+				return err
+			}
+			if err := rr.full(buf[:8]); err != nil {
+				return err
+			}
+			if err := rr.skipLengths(1); err != nil {
+				return err
+			}
+		}
+		consumers, err := rr.length()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+			// seen time, and active time in the newest version
+			if err := rr.full(buf[:8]); err != nil {
+				return err
+			}
+			if typ >= rdbTypeStream3 {
+				if err := rr.full(buf[:8]); err != nil {
+					return err
+				}
+			}
+			pending, err := rr.length()
+			if err != nil {
+				return err
+			}
+			for k := uint64(0); k < pending; k++ {
+				if err := rr.full(buf[:]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decompress LZF data to exactly n bytes
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// a run of ctrl+1 literal bytes
+			end := i + ctrl + 1
+			if end > len(in) || len(out)+ctrl+1 > n {
+				return nil, errors.New("corrupt LZF data")
+			}
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+		// a back reference
+		size := ctrl >> 5
+		if size == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			size += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF data")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		size += 2
+		if ref < 0 || len(out)+size > n {
+			return nil, errors.New("corrupt LZF data")
+		}
+		// byte by byte, since the reference may overlap what it produces
+		for j := 0; j < size; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errors.New("corrupt LZF data")
+	}
+	return out, nil
+}
+
+// write entries to w as an RDB dump Redis can load, with every key in
+// database 0 as a string
+func writeRDB(w io.Writer, entries []keyvalue.Entry) error {
+	crc := &rdbCRC{}
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	fmt.Fprintf(bw, "REDIS%04d", rdbVersion)
+
+	expires := 0
+	for _, entry := range entries {
+		if entry.ExpiresAt != 0 {
+			expires++
+		}
+	}
+	bw.WriteByte(rdbOpSelectDB)
+	writeRDBLength(bw, 0)
+	bw.WriteByte(rdbOpResizeDB)
+	writeRDBLength(bw, uint64(len(entries)))
+	writeRDBLength(bw, uint64(expires))
+
+	for _, entry := range entries {
+		if entry.ExpiresAt != 0 {
+			bw.WriteByte(rdbOpExpireTimeMS)
+			bw.Write(binary.LittleEndian.AppendUint64(nil, uint64(entry.ExpiresAt/int64(time.Millisecond))))
+		}
+		bw.WriteByte(rdbTypeString)
+		writeRDBString(bw, entry.Key)
+		writeRDBString(bw, entry.Value)
+	}
+	bw.WriteByte(rdbOpEOF)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, crc.crc))
+	return err
+}
+
+func writeRDBLength(w *bufio.Writer, n uint64) {
+	switch {
+	case n < 1<<6:
+		w.WriteByte(byte(n))
+	case n < 1<<14:
+		w.Write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		w.WriteByte(0x80)
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		w.WriteByte(0x81)
+		w.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func writeRDBString(w *bufio.Writer, s string) {
+	writeRDBLength(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+// an EOF partway through a file means it was cut short
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
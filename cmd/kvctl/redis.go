@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// keys fetched or set per round trip to Redis
+const redisBatch = 1000
+
+// how long a round trip to Redis may take
+const redisTimeout = 30 * time.Second
+
+// an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// a connection to a Redis server speaking RESP2, just enough to scan, read
+// and write string keys
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// connect to the server in a URL like redis://[user:password@]host:port[/db],
+// or rediss:// for TLS, authenticating and selecting the database it names
+func dialRedis(rawURL string) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", host)
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("invalid Redis URL: unknown scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error authenticating: %w", err)
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err := c.do("SELECT", db); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error selecting database %s: %w", db, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() { c.conn.Close() }
+
+// send a command without waiting for its reply
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// send the commands written so far, giving the server redisTimeout to
+// reply to all of them
+func (c *redisConn) flush() error {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	return c.w.Flush()
+}
+
+// send a command and read its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	c.send(args...)
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// read a reply: a string, an int64, nil, a slice of replies or a redisError
+// returned as the error
+func (c *redisConn) reply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > rdbMaxStringLen {
+			return nil, errors.New("invalid bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("invalid array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]any, 0, min(n, redisBatch))
+		for i := 0; i < n; i++ {
+			r, err := c.reply()
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, r)
+		}
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+// pass every string key of the selected database to fn with its
+// expiration, returning how many keys of other types were skipped. the keys
+// are scanned with SCAN, so the server keeps serving while they are read.
+func (c *redisConn) scan(fn func(entry keyvalue.Entry) error) (skipped int, err error) {
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "COUNT", strconv.Itoa(redisBatch))
+		if err != nil {
+			return skipped, fmt.Errorf("error scanning keys: %w", err)
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 2 {
+			return skipped, errors.New("unexpected reply to SCAN")
+		}
+		cursor, _ = parts[0].(string)
+		keys, _ := parts[1].([]any)
+
+		for _, key := range keys {
+			key, _ := key.(string)
+			c.send("GET", key)
+			c.send("PTTL", key)
+		}
+		if err := c.flush(); err != nil {
+			return skipped, err
+		}
+		now := time.Now()
+		for _, key := range keys {
+			key, _ := key.(string)
+			value, getErr := c.reply()
+			ttl, err := c.reply()
+			if err != nil {
+				return skipped, fmt.Errorf("%q: %w", key, err)
+			}
+			var rerr redisError
+			if errors.As(getErr, &rerr) && strings.HasPrefix(string(rerr), "WRONGTYPE") {
+				skipped++
+				continue
+			}
+			if getErr != nil {
+				return skipped, fmt.Errorf("%q: %w", key, getErr)
+			}
+			if value == nil {
+				continue // deleted or expired since it was scanned
+			}
+			entry := keyvalue.Entry{Key: key, Value: value.(string)}
+			if ms, _ := ttl.(int64); ms > 0 {
+				entry.ExpiresAt = now.Add(time.Duration(ms) * time.Millisecond).UnixNano()
+			}
+			if err := fn(entry); err != nil {
+				return skipped, err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return skipped, nil
+		}
+	}
+}
+
+// set every entry as a string key, pipelined in batches
+func (c *redisConn) set(entries []keyvalue.Entry) error {
+	now := time.Now().UnixNano()
+	for start := 0; start < len(entries); start += redisBatch {
+		batch := entries[start:min(start+redisBatch, len(entries))]
+		for _, entry := range batch {
+			if entry.ExpiresAt != 0 {
+				ms := max((entry.ExpiresAt-now)/int64(time.Millisecond), 1)
+				c.send("SET", entry.Key, entry.Value, "PX", strconv.FormatInt(ms, 10))
+			} else {
+				c.send("SET", entry.Key, entry.Value)
+			}
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			if _, err := c.reply(); err != nil {
+				return fmt.Errorf("error setting %q: %w", entry.Key, err)
+			}
+		}
+	}
+	return nil
+}
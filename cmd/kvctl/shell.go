@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// commands offered by the shell, for completion
+var shellCommands = []string{"compact", "del", "exit", "export", "get", "help", "import", "scan", "set"}
+
+// commands whose arguments are keys, the others complete nothing
+var keyCommands = map[string]bool{"get": true, "set": true, "del": true, "scan": true}
+
+const shellHelp = `Commands:
+  get <key>              print the value of a key
+  set <key> <value>      set a key, quote values containing spaces
+  del <key>...           delete keys
+  scan [prefix]          print every key and value, tab separated
+  compact                compact the log file
+  export [file]          write every entry as JSON lines to file or the terminal
+  import <file>          set every entry in JSON lines from file
+  exit                   leave the shell
+
+Tab completes commands and keys, up and down walk the history.
+`
+
+// read commands until exit or EOF. a terminal gets line editing, history and
+// tab completion, anything else is read line by line so scripts can be piped
+// in.
+func shell(c client, ttl time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !shellExec(c, os.Stdout, scanner.Text(), ttl) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "kv> ")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return complete(c, t, line, pos)
+	}
+	if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+		t.SetSize(width, height)
+	}
+
+	fmt.Fprintln(t, `Type "help" for a list of commands.`)
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !shellExec(c, t, line, ttl) {
+			return nil
+		}
+	}
+}
+
+// run one line typed into the shell, reporting whether to keep going
+func shellExec(c client, out io.Writer, line string, ttl time.Duration) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintln(out, "Error:", err)
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+
+	switch args[0] {
+	case "exit", "quit":
+		return false
+	case "help":
+		fmt.Fprint(out, shellHelp)
+		return true
+	case "shell":
+		fmt.Fprintln(out, "Error: already in a shell")
+		return true
+	case "import":
+		// stdin is the terminal
+		if len(args) != 2 {
+			fmt.Fprintln(out, "Usage: import <file>")
+			return true
+		}
+	}
+
+	err = run(c, out, args[0], args[1:], ttl)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(out, `Error: bad command, type "help" for usage`)
+	} else if err != nil {
+		fmt.Fprintln(out, "Error:", err)
+	}
+	return true
+}
+
+// complete the word before the cursor, a command for the first word and a
+// key for the arguments of commands that take keys. an ambiguous completion
+// is extended as far as the candidates agree, and lists them if it can't be.
+func complete(c client, t *term.Terminal, line string, pos int) (string, int, bool) {
+	head := line[:pos]
+	start := strings.LastIndexFunc(head, unicode.IsSpace) + 1
+	word := head[start:]
+	if strings.ContainsAny(word, `"'`) {
+		return "", 0, false
+	}
+
+	var candidates []string
+	if args := strings.Fields(head[:start]); len(args) == 0 {
+		for _, cmd := range shellCommands {
+			if strings.HasPrefix(cmd, word) {
+				candidates = append(candidates, cmd)
+			}
+		}
+	} else if keyCommands[args[0]] && (args[0] != "set" || len(args) == 1) {
+		entries, err := c.Scan(word)
+		if err != nil {
+			return "", 0, false
+		}
+		for _, entry := range entries {
+			candidates = append(candidates, entry.Key)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	completion := candidates[0]
+	for _, candidate := range candidates[1:] {
+		completion = commonPrefix(completion, candidate)
+	}
+	if len(candidates) == 1 {
+		completion = quoteArg(completion) + " "
+	} else if completion == word {
+		sort.Strings(candidates)
+		fmt.Fprintln(t, strings.Join(candidates, "  "))
+		return "", 0, false
+	}
+
+	newLine := head[:start] + completion + line[pos:]
+	return newLine, start + len(completion), true
+}
+
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
+// quote an argument if splitArgs wouldn't read it back as a single word
+func quoteArg(s string) string {
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '\'' || r == '\\'
+	}) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// split a line into words separated by spaces. double quoted words use Go
+// escapes and single quoted words are taken literally.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return args, nil
+		}
+
+		switch line[0] {
+		case '"':
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, errors.New("unterminated or invalid double quoted string")
+			}
+			arg, _ := strconv.Unquote(quoted)
+			args = append(args, arg)
+			line = line[len(quoted):]
+		case '\'':
+			end := strings.IndexByte(line[1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quoted string")
+			}
+			args = append(args, line[1:end+1])
+			line = line[end+2:]
+		default:
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+		}
+	}
+}
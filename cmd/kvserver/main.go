@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+	"github.com/jere-mie/keyvalue/backup"
+	kvgrpc "github.com/jere-mie/keyvalue/grpc"
+	"github.com/jere-mie/keyvalue/httpserver"
+	"github.com/jere-mie/keyvalue/lineserver"
+	kvprom "github.com/jere-mie/keyvalue/prometheus"
+	kvraft "github.com/jere-mie/keyvalue/raft"
+	"github.com/jere-mie/keyvalue/ratelimit"
+	"github.com/jere-mie/keyvalue/replication"
+	"github.com/jere-mie/keyvalue/resp"
+)
+
+func main() {
+	file := flag.String("file", "store.log", "log file backing the store")
+	addr := flag.String("addr", "localhost:8080", "address to serve the HTTP API on")
+	respAddr := flag.String("resp-addr", "", "address to serve the Redis protocol on (disabled if empty)")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve gRPC on (disabled if empty)")
+	socketPath := flag.String("socket", "", "Unix socket to serve the line protocol on, which has no authentication and can't be used with -acl (disabled if empty)")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on /metrics (disabled if empty)")
+	replicationAddr := flag.String("replication-addr", "", "address to serve replicas on (disabled if empty)")
+	replicaOf := flag.String("replica-of", "", "address of a primary to replicate, which makes the store read-only (disabled if empty)")
+	raftID := flag.String("raft-id", "", "this server's ID among -raft-peers, which replicates the store over a Raft cluster (disabled if empty)")
+	raftAddr := flag.String("raft-addr", "", "address to serve the other Raft nodes on (defaults to this server's address in -raft-peers)")
+	raftPeers := flag.String("raft-peers", "", "comma-separated id=host:port of every Raft node, this one included")
+	raftLog := flag.String("raft-log", "", "file to keep the Raft log in (defaults to -file with .raft appended)")
+	raftTokenFile := flag.String("raft-token-file", "", "file holding the secret shared by every Raft node, which they require of each other's requests (defaults to $KVSERVER_RAFT_TOKEN, none if both are empty)")
+	backupDir := flag.String("backup-dir", "", "directory to back the store up to (disabled if empty)")
+	backupInterval := flag.Duration("backup-interval", time.Hour, "time between backups")
+	backupKeep := flag.Int("backup-keep", 24, "number of backups to keep (0 keeps them all)")
+	useMemory := flag.Bool("memory", true, "keep the store in memory")
+	searchIndex := flag.Bool("search", false, "keep a search index of the words in values for /search")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "how often to checkpoint the keys in memory so a restart only replays the log written since (disabled if 0)")
+	maxKeys := flag.Int("max-keys", 10000, "maximum number of keys")
+	maxKeySize := flag.Int("max-key-size", 256, "maximum key size in bytes")
+	maxValueSize := flag.Int("max-value-size", 1<<20, "maximum value size in bytes")
+	aclFile := flag.String("acl", "", "JSON file of API tokens and the key prefixes they may use, required by the HTTP, Redis and gRPC servers, and an admin token by replicas (disabled if empty)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file to serve HTTP, Redis, gRPC, metrics, replicas and Raft nodes over TLS with (disabled if empty)")
+	tlsKey := flag.String("tls-key", "", "PEM key file for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM file of CAs client certificates must be signed by (not required if empty)")
+	peerTokenFile := flag.String("peer-token-file", "", "file holding the admin API token to present to the primary of -replica-of, for primaries run with -acl (defaults to $KVSERVER_PEER_TOKEN)")
+	peerTLS := flag.Bool("peer-tls", false, "dial the primary of -replica-of or the other Raft nodes over TLS, presenting -tls-cert as a client certificate if set")
+	peerCA := flag.String("peer-ca", "", "PEM file of CAs the certificates of the primary or the other Raft nodes must be signed by, implies -peer-tls (the system's CAs if empty)")
+	rateLimit := flag.Float64("rate-limit", 0, "requests a second each client may make to the HTTP, Redis and gRPC servers on average (no limit if 0)")
+	rateBurst := flag.Int("rate-burst", 100, "requests each client may make at once before -rate-limit applies")
+	maxBodySize := flag.Int("max-body-size", 0, "largest HTTP or gRPC request body, or string in a Redis command, in bytes (defaults to -max-value-size plus room for the key)")
+	maxCommandSize := flag.Int("max-command-size", 0, "largest total size of the strings in a Redis command in bytes (defaults to 4 times -max-body-size)")
+	flag.Parse()
+
+	// secrets are never taken as flags, which anyone on the machine can read
+	// from the process's command line
+	raftToken, err := readSecret(*raftTokenFile, "KVSERVER_RAFT_TOKEN")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading -raft-token-file:", err)
+		os.Exit(1)
+	}
+	peerToken, err := readSecret(*peerTokenFile, "KVSERVER_PEER_TOKEN")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading -peer-token-file:", err)
+		os.Exit(1)
+	}
+
+	var limiter *ratelimit.Limiter
+	if *rateLimit > 0 {
+		limiter = ratelimit.New(*rateLimit, *rateBurst)
+	}
+	if *maxBodySize <= 0 {
+		*maxBodySize = *maxValueSize + *maxKeySize + 1024
+	}
+	if *maxCommandSize <= 0 {
+		*maxCommandSize = 4 * *maxBodySize
+	}
+
+	scheme := "http"
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		if tlsConfig, err = auth.TLSConfig(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading TLS config:", err)
+			os.Exit(1)
+		}
+		scheme = "https"
+	} else if *tlsClientCA != "" {
+		fmt.Fprintln(os.Stderr, "-tls-client-ca needs -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
+	var peerTLSConfig *tls.Config
+	if *peerTLS || *peerCA != "" {
+		var err error
+		if peerTLSConfig, err = auth.ClientTLSConfig(*peerCA, *tlsCert, *tlsKey); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading peer TLS config:", err)
+			os.Exit(1)
+		}
+	}
+
+	// the line protocol has no tokens, it would get around the ACL
+	if *socketPath != "" && *aclFile != "" {
+		fmt.Fprintln(os.Stderr, "-socket can't be used with -acl")
+		os.Exit(1)
+	}
+
+	var peers map[string]string
+	if *raftID != "" {
+		if *replicaOf != "" {
+			fmt.Fprintln(os.Stderr, "-raft-id can't be used with -replica-of")
+			os.Exit(1)
+		}
+		var err error
+		if peers, err = parsePeers(*raftPeers); err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing -raft-peers:", err)
+			os.Exit(1)
+		}
+		if *raftAddr == "" {
+			*raftAddr = peers[*raftID]
+		}
+		if *raftLog == "" {
+			*raftLog = *file + ".raft"
+		}
+		if tlsConfig != nil && peerTLSConfig == nil {
+			fmt.Fprintln(os.Stderr, "-raft-id with -tls-cert needs -peer-tls or -peer-ca to reach the other nodes")
+			os.Exit(1)
+		}
+	}
+
+	var acl *auth.ACL
+	if *aclFile != "" {
+		var err error
+		if acl, err = auth.LoadFile(*aclFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading ACL:", err)
+			os.Exit(1)
+		}
+	}
+
+	store, err := keyvalue.NewStore(*file, keyvalue.StoreConfig{
+		UseMemory:          *useMemory,
+		SearchIndex:        *searchIndex,
+		MaxKeys:            *maxKeys,
+		MaxKeySize:         *maxKeySize,
+		MaxValueSize:       *maxValueSize,
+		Replica:            *replicaOf != "" || *raftID != "",
+		CheckpointInterval: *checkpointInterval,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening store:", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *raftID != "" {
+		node, err := kvraft.Open(store, *raftLog, kvraft.Config{
+			ID:        *raftID,
+			Peers:     peers,
+			Token:     raftToken,
+			TLS:       tlsConfig,
+			ClientTLS: peerTLSConfig,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error joining Raft cluster:", err)
+			store.Close()
+			os.Exit(1)
+		}
+		defer node.Close()
+		go func() {
+			if err := node.ListenAndServe(*raftAddr); err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving Raft:", err)
+			}
+		}()
+		fmt.Printf("Replicating %s over Raft as %s on %s\n", *file, *raftID, *raftAddr)
+	}
+
+	if *respAddr != "" {
+		respServer := resp.New(store)
+		respServer.UseACL(acl)
+		respServer.UseTLS(tlsConfig)
+		respServer.UseRateLimit(limiter)
+		respServer.LimitRequestSize(*maxBodySize)
+		respServer.LimitCommandSize(*maxCommandSize)
+		defer respServer.Close()
+		go func() {
+			if err := respServer.ListenAndServe(*respAddr); err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving Redis protocol:", err)
+			}
+		}()
+		fmt.Printf("Serving %s over the Redis protocol on %s\n", *file, *respAddr)
+	}
+
+	if *socketPath != "" {
+		lineServer := lineserver.New(store)
+		defer lineServer.Close()
+		go func() {
+			if err := lineServer.ListenAndServe(*socketPath); err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving line protocol:", err)
+			}
+		}()
+		fmt.Printf("Serving %s over the line protocol on %s\n", *file, *socketPath)
+	}
+
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error serving gRPC:", err)
+			store.Close()
+			os.Exit(1)
+		}
+		service := kvgrpc.New(store)
+		service.UseACL(acl)
+		service.UseRateLimit(limiter)
+		opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(*maxBodySize)}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer := grpc.NewServer(opts...)
+		kvgrpc.RegisterKeyValueServer(grpcServer, service)
+		defer grpcServer.GracefulStop()
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving gRPC:", err)
+			}
+		}()
+		fmt.Printf("Serving %s over gRPC on %s\n", *file, *grpcAddr)
+	}
+
+	if *metricsAddr != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(kvprom.NewCollector(store, "keyvalue"))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		go func() {
+			srv := &http.Server{Addr: *metricsAddr, Handler: mux, TLSConfig: tlsConfig}
+			var err error
+			if tlsConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving metrics:", err)
+			}
+		}()
+		fmt.Printf("Serving metrics for %s on %s://%s/metrics\n", *file, scheme, *metricsAddr)
+	}
+
+	if *replicationAddr != "" {
+		primary := replication.NewPrimary(store)
+		primary.UseACL(acl)
+		primary.UseTLS(tlsConfig)
+		defer primary.Close()
+		go func() {
+			if err := primary.ListenAndServe(*replicationAddr); err != nil {
+				fmt.Fprintln(os.Stderr, "Error serving replicas:", err)
+			}
+		}()
+		fmt.Printf("Serving replicas of %s on %s\n", *file, *replicationAddr)
+	}
+
+	if *replicaOf != "" {
+		replica := replication.NewReplica(store, *replicaOf)
+		replica.UseToken(peerToken)
+		replica.UseTLS(peerTLSConfig)
+		go replica.Run(ctx)
+		fmt.Printf("Replicating %s into %s\n", *replicaOf, *file)
+	}
+
+	if *backupDir != "" {
+		scheduler := backup.New(store, backup.NewDirSink(*backupDir), backup.Config{
+			Interval: *backupInterval,
+			Keep:     *backupKeep,
+		})
+		go scheduler.Run(ctx)
+		fmt.Printf("Backing up %s to %s every %s\n", *file, *backupDir, *backupInterval)
+	}
+
+	fmt.Printf("Serving %s on %s://%s, dashboard on %s://%s/ui/\n", *file, scheme, *addr, scheme, *addr)
+	httpServer := httpserver.New(store)
+	httpServer.UseACL(acl)
+	httpServer.UseTLS(tlsConfig)
+	httpServer.UseRateLimit(limiter)
+	httpServer.LimitBodySize(int64(*maxBodySize))
+	if err := httpServer.Run(ctx, *addr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving:", err)
+		store.Close()
+		os.Exit(1)
+	}
+}
+
+// the secret in filename, without surrounding whitespace, or in the
+// environment variable env if filename is empty
+func readSecret(filename, env string) (string, error) {
+	if filename == "" {
+		return os.Getenv(env), nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parse -raft-peers, like "a=10.0.0.1:7100,b=10.0.0.2:7100"
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, want id=host:port", peer)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
@@ -0,0 +1,251 @@
+package keyvalue
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// periodically compact the log once it has too many stale records or has
+// grown too large, until the store is closed
+func (s *Store) compactLoop(interval time.Duration, threshold int, maxBytes int64) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// closing the store cancels a compaction in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.needsCompaction(threshold, maxBytes) {
+				err := s.CompactCtx(ctx)
+				if err != nil && ctx.Err() == nil && !errors.Is(err, ErrStoreClosed) {
+					s.logger.Error("automatic compaction failed", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// compact a single log file in three steps. under the write lock, note where
+// the log ends. without the lock, collect what compaction keeps of the
+// records up to there and write it to a temp file. then, under the write lock
+// again, append the records written since to the temp file and rename it
+// over the log. the caller must hold cmu.
+func (s *Store) compactFile(ctx context.Context) error {
+	s.mu.Lock()
+	if err := s.flushBuffer(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	end, records, limit := s.activeSize, s.records, s.maxRecordSize
+	s.mu.Unlock()
+
+	t := s.newThrottle()
+	versions, err := collectVersions(s.keepVersions, func(fn func(Entry) bool) error {
+		return replayPrefix(ctx, t, s.filename, end, s.aead, limit, fn)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+	s.mu.RLock()
+	entries := s.keptEntries(versions)
+	s.mu.RUnlock()
+
+	buf := s.newFormat.header()
+	for _, entry := range entries {
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+	tempFile := s.filename + tempSuffix
+	if err := t.writeFile(ctx, tempFile, buf); err != nil {
+		os.Remove(tempFile)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error writing temp log file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		os.Remove(tempFile)
+		return ErrStoreClosed
+	}
+	if s.maps != nil {
+		s.maps.dropAll()
+	}
+	if err := s.flushBuffer(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	tail, err := s.logTail(end)
+	if err == nil {
+		err = appendSynced(tempFile, tail)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("error compacting log file: %w", err)
+	}
+	if err := s.replaceLog(tempFile, int64(len(buf)+len(tail))); err != nil {
+		return fmt.Errorf("error compacting log file: %w", err)
+	}
+	s.records = len(entries) + s.records - records
+	if err := s.reindex(); err != nil {
+		return fmt.Errorf("error compacting log file: %w", err)
+	}
+	return nil
+}
+
+// replay the records of the log file at path up to offset end at the pace
+// of t, see replayKeys, without the store's lock. the records up to end
+// mustn't change meanwhile, which holding cmu ensures.
+func replayPrefix(ctx context.Context, t *throttle, path string, end int64, aead cipher.AEAD, limit int, fn func(Entry) bool) error {
+	appends := newAppendResolver(aead, limit)
+	var stopErr error
+	err := t.replayPrefix(ctx, path, end, aead, limit, func(entry Entry, offset int64) bool {
+		if entry, stopErr = appends.resolve(entry, path, offset); stopErr != nil {
+			return false
+		}
+		return fn(entry)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return stopErr
+}
+
+// the records appended to the log file after offset, encoded in the
+// configured format. bad records, which replay would skip, are dropped when
+// they have to be converted. the caller must hold the write lock and have
+// flushed the write buffer.
+func (s *Store) logTail(offset int64) ([]byte, error) {
+	section := io.NewSectionReader(s.file, offset, s.activeSize-offset)
+	if s.format == s.newFormat {
+		buf := make([]byte, s.activeSize-offset)
+		if _, err := io.ReadFull(section, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	var buf []byte
+	reader := newFormatReader(section, s.format, s.aead, s.maxRecordSize, offset)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return buf, nil
+		}
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+}
+
+// report whether either compaction threshold has been crossed
+func (s *Store) needsCompaction(threshold int, maxBytes int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return false
+	}
+
+	records, live, err := s.recordCounts()
+	if err != nil {
+		s.logger.Error("error counting log records", "err", err)
+		return false
+	}
+
+	kept := s.keptRecords(live)
+	if threshold > 0 && records-kept >= threshold {
+		return true
+	}
+	if maxBytes > 0 {
+		s.amu.Lock()
+		size, err := s.logSize()
+		s.amu.Unlock()
+		if err != nil {
+			s.logger.Error("error reading log file size", "err", err)
+			return false
+		}
+		// compacting can't shrink a log that holds only what it keeps
+		if size >= maxBytes && records > kept {
+			return true
+		}
+	}
+	return false
+}
+
+// the records in the log and how many keys they leave live, counted from
+// the log in file-only mode where neither is kept in memory. the caller must
+// hold at least the read lock.
+func (s *Store) recordCounts() (records, live int, err error) {
+	if s.memoryOnly() {
+		// there is no log
+		return 0, int(s.keys.Load()), nil
+	}
+	if !s.useMemory {
+		return s.countRecords()
+	}
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	return s.records, int(s.keys.Load()), nil
+}
+
+// how many records compaction keeps for live keys, past versions that it
+// keeps aren't stale
+func (s *Store) keptRecords(live int) int {
+	return live * (s.keepVersions + 1)
+}
+
+// count the records in the log and how many keys they leave live, for
+// file-only mode where neither is kept in memory
+func (s *Store) countRecords() (records, live int, err error) {
+	now := time.Now().UnixNano()
+	keys := make(map[string]struct{})
+	err = s.replay(func(entry Entry) bool {
+		records++
+		if entry.Deleted || entry.expired(now) {
+			delete(keys, entry.Key)
+		} else {
+			keys[entry.Key] = struct{}{}
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading log file: %w", err)
+	}
+	return records, len(keys), nil
+}
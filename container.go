@@ -0,0 +1,592 @@
+package keyvalue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// the value of a key holding a list, a set or a hash, stored as a JSON object
+// with one of the fields set. set members are kept sorted.
+type container struct {
+	List []string          `json:"list,omitempty"`
+	Set  []string          `json:"set,omitempty"`
+	Hash map[string]string `json:"hash,omitempty"`
+}
+
+// list, set and hash operations logged in Entry.Op. the record's value holds
+// the JSON array of elements pushed, members added or removed, the field and
+// value set or the fields deleted. pops have none.
+const (
+	opLPush = "lpush"
+	opRPush = "rpush"
+	opLPop  = "lpop"
+	opRPop  = "rpop"
+	opSAdd  = "sadd"
+	opSRem  = "srem"
+	opHSet  = "hset"
+	opHDel  = "hdel"
+)
+
+func decodeContainer(value string) (container, bool) {
+	var c container
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil || decoder.More() {
+		return container{}, false
+	}
+	return c, true
+}
+
+func decodeList(value string) ([]string, error) {
+	c, ok := decodeContainer(value)
+	if !ok || c.List == nil || c.Set != nil || c.Hash != nil {
+		return nil, ErrNotList
+	}
+	return c.List, nil
+}
+
+func decodeSet(value string) ([]string, error) {
+	c, ok := decodeContainer(value)
+	if !ok || c.Set == nil || c.List != nil || c.Hash != nil || !slices.IsSorted(c.Set) {
+		return nil, ErrNotSet
+	}
+	return c.Set, nil
+}
+
+func decodeHash(value string) (map[string]string, error) {
+	c, ok := decodeContainer(value)
+	if !ok || c.Hash == nil || c.List != nil || c.Set != nil {
+		return nil, ErrNotHash
+	}
+	return c.Hash, nil
+}
+
+func encodeContainer(c container) string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// the value an Op record leaves its key with, given base, the value before it
+func applyContainerOp(op, base, args string) (string, error) {
+	var elems []string
+	if args != "" {
+		if err := json.Unmarshal([]byte(args), &elems); err != nil {
+			return "", fmt.Errorf("error decoding arguments: %w", err)
+		}
+	}
+	switch op {
+	case opLPush, opRPush, opLPop, opRPop:
+		list, err := decodeList(base)
+		if err != nil {
+			return "", err
+		}
+		if (op == opLPop || op == opRPop) && len(list) == 0 {
+			return "", fmt.Errorf("%s from an empty list", op)
+		}
+		return encodeContainer(container{List: updateList(list, op, elems)}), nil
+	case opSAdd, opSRem:
+		set, err := decodeSet(base)
+		if err != nil {
+			return "", err
+		}
+		return encodeContainer(container{Set: updateSet(set, op, elems)}), nil
+	case opHSet, opHDel:
+		hash, err := decodeHash(base)
+		if err != nil {
+			return "", err
+		}
+		if op == opHSet && len(elems) != 2 {
+			return "", fmt.Errorf("%s needs a field and a value", op)
+		}
+		return encodeContainer(container{Hash: updateHash(hash, op, elems)}), nil
+	}
+	return "", fmt.Errorf("unknown operation %q", op)
+}
+
+// list after a push or pop. pops must only be applied to a list that isn't
+// empty.
+func updateList(list []string, op string, elems []string) []string {
+	switch op {
+	case opLPush:
+		// like repeated pushes, the last element ends up first
+		pushed := slices.Clone(elems)
+		slices.Reverse(pushed)
+		return append(pushed, list...)
+	case opRPush:
+		return append(slices.Clip(list), elems...)
+	case opLPop:
+		return list[1:]
+	case opRPop:
+		return list[:len(list)-1]
+	}
+	return list
+}
+
+// set after members are added or removed
+func updateSet(set []string, op string, members []string) []string {
+	set = slices.Clone(set)
+	for _, member := range members {
+		i, found := slices.BinarySearch(set, member)
+		switch {
+		case op == opSAdd && !found:
+			set = slices.Insert(set, i, member)
+		case op == opSRem && found:
+			set = slices.Delete(set, i, i+1)
+		}
+	}
+	return set
+}
+
+// hash after a field is set, elems holding the field and its value, or fields
+// are deleted
+func updateHash(hash map[string]string, op string, elems []string) map[string]string {
+	if hash == nil {
+		hash = make(map[string]string)
+	}
+	switch op {
+	case opHSet:
+		hash[elems[0]] = elems[1]
+	case opHDel:
+		for _, field := range elems {
+			delete(hash, field)
+		}
+	}
+	return hash
+}
+
+// write an Op record for the list, set or hash at current.Key, or the whole value
+// if the key doesn't exist yet, leaving it with c. a key left empty is
+// deleted. the caller must hold the write lock.
+func (s *Store) writeContainerLocked(current Entry, exists bool, op string, elems []string, c container) error {
+	if len(c.List) == 0 && len(c.Set) == 0 && len(c.Hash) == 0 {
+		return s.deleteLocked(current.Key)
+	}
+	value := encodeContainer(c)
+	if !exists {
+		return s.setLocked(current.Key, value, 0)
+	}
+	var args string
+	if len(elems) > 0 {
+		data, _ := json.Marshal(elems)
+		args = string(data)
+	}
+	return s.patchLocked(current, Entry{Key: current.Key, Op: op, Value: args}, value)
+}
+
+// the list stored at key, nil if the key doesn't exist. the caller must hold
+// at least the read lock.
+func (s *Store) listLocked(key string) (Entry, []string, bool, error) {
+	current, exists, err := s.lookupLocked(key)
+	if err != nil || !exists {
+		return Entry{Key: key}, nil, false, err
+	}
+	list, err := decodeList(current.Value)
+	if err != nil {
+		return current, nil, true, fmt.Errorf("%q: %w", key, err)
+	}
+	return current, list, true, nil
+}
+
+// the set stored at key, see listLocked
+func (s *Store) setMembersLocked(key string) (Entry, []string, bool, error) {
+	current, exists, err := s.lookupLocked(key)
+	if err != nil || !exists {
+		return Entry{Key: key}, nil, false, err
+	}
+	set, err := decodeSet(current.Value)
+	if err != nil {
+		return current, nil, true, fmt.Errorf("%q: %w", key, err)
+	}
+	return current, set, true, nil
+}
+
+// pass a list, set or hash command on key through the interceptors as an
+// OpContainer, carrying it out with do
+func (s *Store) runContainer(key string, do func() error) error {
+	return s.runFunc(Operation{Type: OpContainer, Ctx: context.Background(), Key: key}, func(context.Context) error {
+		return do()
+	})
+}
+
+// insert values at the head of the list stored at key as a single atomic
+// step, one after the other, so the last ends up first. a missing key starts
+// as an empty list, and an existing expiration time is kept. returns the new
+// length of the list, or fails with ErrNotList if key holds something else.
+func (s *Store) LPush(key string, values ...string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.push(key, opLPush, values)
+		return err
+	})
+	return n, err
+}
+
+// insert values at the tail of the list stored at key, see LPush
+func (s *Store) RPush(key string, values ...string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.push(key, opRPush, values)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) push(key, op string, values []string) (int, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, list, exists, err := s.listLocked(key)
+	if err != nil || len(values) == 0 {
+		return len(list), err
+	}
+	list = updateList(list, op, values)
+	if err := s.writeContainerLocked(current, exists, op, values, container{List: list}); err != nil {
+		return 0, err
+	}
+	return len(list), nil
+}
+
+// remove and return the first element of the list stored at key as a single
+// atomic step, reporting false if the key doesn't exist. the key is deleted
+// once the list is empty.
+func (s *Store) LPop(key string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := s.runContainer(key, func() (err error) {
+		value, ok, err = s.pop(key, opLPop)
+		return err
+	})
+	return value, ok, err
+}
+
+// remove and return the last element of the list stored at key, see LPop
+func (s *Store) RPop(key string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := s.runContainer(key, func() (err error) {
+		value, ok, err = s.pop(key, opRPop)
+		return err
+	})
+	return value, ok, err
+}
+
+func (s *Store) pop(key, op string) (string, bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, list, exists, err := s.listLocked(key)
+	if err != nil || len(list) == 0 {
+		return "", false, err
+	}
+	value := list[0]
+	if op == opRPop {
+		value = list[len(list)-1]
+	}
+	if err := s.writeContainerLocked(current, exists, op, nil, container{List: updateList(list, op, nil)}); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// the elements of the list stored at key from index start to stop, both
+// included. negative indexes count back from the end, so LRange(key, 0, -1)
+// returns the whole list.
+func (s *Store) LRange(key string, start, stop int) ([]string, error) {
+	var elems []string
+	err := s.runContainer(key, func() (err error) {
+		elems, err = s.listRange(key, start, stop)
+		return err
+	})
+	return elems, err
+}
+
+func (s *Store) listRange(key string, start, stop int) ([]string, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, list, exists, err := s.listLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+
+	if start < 0 {
+		start = max(len(list)+start, 0)
+	}
+	if stop < 0 {
+		stop += len(list)
+	}
+	stop = min(stop, len(list)-1)
+	if start > stop {
+		return nil, nil
+	}
+	return list[start : stop+1], nil
+}
+
+// the length of the list stored at key, 0 if the key doesn't exist
+func (s *Store) LLen(key string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.listLen(key)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) listLen(key string) (int, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, list, exists, err := s.listLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	s.counters.read(exists)
+	return len(list), nil
+}
+
+// add members to the set stored at key as a single atomic step. a missing key
+// starts as an empty set, and an existing expiration time is kept. returns
+// how many members weren't in the set already, or fails with ErrNotSet if key
+// holds something else.
+func (s *Store) SAdd(key string, members ...string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.updateMembers(key, opSAdd, members)
+		return err
+	})
+	return n, err
+}
+
+// remove members from the set stored at key, see SAdd. returns how many of
+// them were in the set. the key is deleted once the set is empty.
+func (s *Store) SRem(key string, members ...string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.updateMembers(key, opSRem, members)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) updateMembers(key, op string, members []string) (int, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, set, exists, err := s.setMembersLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	// only the members that change the set are logged
+	var changed []string
+	for _, member := range members {
+		_, found := slices.BinarySearch(set, member)
+		if found == (op == opSRem) && !slices.Contains(changed, member) {
+			changed = append(changed, member)
+		}
+	}
+	if len(changed) == 0 {
+		return 0, nil
+	}
+	c := container{Set: updateSet(set, op, changed)}
+	if err := s.writeContainerLocked(current, exists, op, changed, c); err != nil {
+		return 0, err
+	}
+	return len(changed), nil
+}
+
+// the members of the set stored at key, sorted. nil if the key doesn't exist.
+func (s *Store) SMembers(key string) ([]string, error) {
+	var elems []string
+	err := s.runContainer(key, func() (err error) {
+		elems, err = s.members(key)
+		return err
+	})
+	return elems, err
+}
+
+func (s *Store) members(key string) ([]string, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, set, exists, err := s.setMembersLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+	return set, nil
+}
+
+// whether member is in the set stored at key
+func (s *Store) SIsMember(key, member string) (bool, error) {
+	var ok bool
+	err := s.runContainer(key, func() (err error) {
+		ok, err = s.isMember(key, member)
+		return err
+	})
+	return ok, err
+}
+
+func (s *Store) isMember(key, member string) (bool, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, set, exists, err := s.setMembersLocked(key)
+	if err != nil {
+		return false, err
+	}
+	s.counters.read(exists)
+	_, found := slices.BinarySearch(set, member)
+	return found, nil
+}
+
+// the hash stored at key, see listLocked
+func (s *Store) hashLocked(key string) (Entry, map[string]string, bool, error) {
+	current, exists, err := s.lookupLocked(key)
+	if err != nil || !exists {
+		return Entry{Key: key}, nil, false, err
+	}
+	hash, err := decodeHash(current.Value)
+	if err != nil {
+		return current, nil, true, fmt.Errorf("%q: %w", key, err)
+	}
+	return current, hash, true, nil
+}
+
+// set a field of the hash stored at key as a single atomic step, logging only
+// the field rather than the whole hash. a missing key starts as an empty
+// hash, and an existing expiration time is kept. reports whether the field
+// is new, or fails with ErrNotHash if key holds something else.
+func (s *Store) HSet(key, field, value string) (bool, error) {
+	var ok bool
+	err := s.runContainer(key, func() (err error) {
+		ok, err = s.hashSet(key, field, value)
+		return err
+	})
+	return ok, err
+}
+
+func (s *Store) hashSet(key, field, value string) (bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, hash, exists, err := s.hashLocked(key)
+	if err != nil {
+		return false, err
+	}
+	_, found := hash[field]
+	elems := []string{field, value}
+	if err := s.writeContainerLocked(current, exists, opHSet, elems, container{Hash: updateHash(hash, opHSet, elems)}); err != nil {
+		return false, err
+	}
+	return !found, nil
+}
+
+// the value of a field of the hash stored at key, reporting false if the key
+// or the field doesn't exist
+func (s *Store) HGet(key, field string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := s.runContainer(key, func() (err error) {
+		value, ok, err = s.hashGet(key, field)
+		return err
+	})
+	return value, ok, err
+}
+
+func (s *Store) hashGet(key, field string) (string, bool, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, hash, exists, err := s.hashLocked(key)
+	if err != nil {
+		return "", false, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+	value, ok := hash[field]
+	return value, ok, nil
+}
+
+// every field of the hash stored at key, nil if the key doesn't exist
+func (s *Store) HGetAll(key string) (map[string]string, error) {
+	var hash map[string]string
+	err := s.runContainer(key, func() (err error) {
+		hash, err = s.hashGetAll(key)
+		return err
+	})
+	return hash, err
+}
+
+func (s *Store) hashGetAll(key string) (map[string]string, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, hash, exists, err := s.hashLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+	return hash, nil
+}
+
+// delete fields from the hash stored at key as a single atomic step, see
+// HSet. returns how many of them existed. the key is deleted once the hash is
+// empty.
+func (s *Store) HDel(key string, fields ...string) (int, error) {
+	var n int
+	err := s.runContainer(key, func() (err error) {
+		n, err = s.hashDel(key, fields)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) hashDel(key string, fields []string) (int, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, hash, exists, err := s.hashLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	var deleted []string
+	for _, field := range fields {
+		if _, ok := hash[field]; ok && !slices.Contains(deleted, field) {
+			deleted = append(deleted, field)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	c := container{Hash: updateHash(hash, opHDel, deleted)}
+	if err := s.writeContainerLocked(current, exists, opHDel, deleted, c); err != nil {
+		return 0, err
+	}
+	return len(deleted), nil
+}
@@ -0,0 +1,60 @@
+package keyvalue
+
+import (
+	"context"
+	"time"
+)
+
+// like Set, but fails with ctx's error if it is already done. a write that
+// has started isn't interrupted, so it is either applied in full or not at
+// all.
+func (s *Store) SetCtx(ctx context.Context, key, value string) error {
+	return s.run(Operation{Type: OpSet, Ctx: ctx, Key: key, Value: value})
+}
+
+// like Get, but gives up with ctx's error once it is done, which matters for
+// the log scan of file-only mode. unlike Get, errors reading the log are
+// returned rather than reported as a missing key.
+func (s *Store) GetCtx(ctx context.Context, key string) (string, bool, error) {
+	var result OpResult
+	if err := s.run(Operation{Type: OpGet, Ctx: ctx, Key: key, Result: &result}); err != nil {
+		return "", false, err
+	}
+	return result.Value, result.Found, nil
+}
+
+// read a key once it made it through the interceptors, see GetCtx
+func (s *Store) get(ctx context.Context, key string) (string, bool, error) {
+	key = s.normalize(key)
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+	return entry.Value, exists, nil
+}
+
+// like SetWithTTL, but fails with ctx's error if it is already done, see
+// SetCtx
+func (s *Store) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	return s.run(Operation{Type: OpSet, Ctx: ctx, Key: key, Value: value, ExpiresAt: expiresAt})
+}
+
+// like Delete, but fails with ctx's error if it is already done, see SetCtx
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	return s.run(Operation{Type: OpDelete, Ctx: ctx, Key: key})
+}
@@ -0,0 +1,63 @@
+package keyvalue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// the version byte at the start of every encrypted value, so the scheme can
+// change without breaking existing logs
+const encryptionVersion = 1
+
+// create the AES-GCM cipher for StoreConfig.EncryptionKey, nil if no key is
+// configured
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt an entry's value. every value gets a fresh random nonce, and the
+// key and expiration are authenticated along with it so records can't be
+// swapped between keys or have their expiration changed on disk.
+func sealValue(aead cipher.AEAD, entry Entry) (string, error) {
+	buf := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(entry.Value)+aead.Overhead())
+	buf[0] = encryptionVersion
+	nonce := buf[1:]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	return string(aead.Seal(buf, nonce, []byte(entry.Value), sealedData(entry))), nil
+}
+
+// decrypt a value sealed by sealValue. a missing or wrong key isn't a bad
+// record, so it is reported as ErrEncryptionKey.
+func openValue(aead cipher.AEAD, entry Entry) (string, error) {
+	if aead == nil {
+		return "", fmt.Errorf("%w: log is encrypted", ErrEncryptionKey)
+	}
+	data := []byte(entry.Value)
+	if len(data) < 1+aead.NonceSize() || data[0] != encryptionVersion {
+		return "", fmt.Errorf("%w: unsupported encrypted value", ErrEncryptionKey)
+	}
+	nonce, ciphertext := data[1:1+aead.NonceSize()], data[1+aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, sealedData(entry))
+	if err != nil {
+		return "", fmt.Errorf("%w: can't decrypt value of %q", ErrEncryptionKey, entry.Key)
+	}
+	return string(value), nil
+}
+
+// the parts of a record authenticated along with its encrypted value
+func sealedData(entry Entry) []byte {
+	data := binary.AppendVarint([]byte{encryptionVersion}, entry.ExpiresAt)
+	return append(data, entry.Key...)
+}
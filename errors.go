@@ -0,0 +1,33 @@
+package keyvalue
+
+import "errors"
+
+// errors returned by the store, check for them with errors.Is
+var (
+	ErrKeyTooLarge        = errors.New("key exceeds max size")
+	ErrInvalidKey         = errors.New("invalid key")
+	ErrInvalidValue       = errors.New("invalid value")
+	ErrValueTooLarge      = errors.New("value exceeds max size")
+	ErrMaxKeysReached     = errors.New("store has reached max number of keys")
+	ErrMemoryLimitReached = errors.New("store has reached max memory")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrStoreClosed        = errors.New("store is closed")
+	ErrInvalidTTL         = errors.New("ttl must be positive")
+	ErrReadOnly           = errors.New("store is read-only")
+	ErrLocked             = errors.New("log file is locked by another process")
+	ErrNotInteger         = errors.New("value is not an integer")
+	ErrNotList            = errors.New("value is not a list")
+	ErrNotSet             = errors.New("value is not a set")
+	ErrNotHash            = errors.New("value is not a hash")
+	ErrEncryptionKey      = errors.New("missing or wrong encryption key")
+	ErrNoSearchIndex      = errors.New("store has no search index")
+	ErrInvalidCursor      = errors.New("invalid list cursor")
+	ErrRecordTooLarge     = errors.New("log record exceeds max record size")
+	ErrQuotaExceeded      = errors.New("prefix has reached its quota")
+	ErrInvalidStoreName   = errors.New("invalid store name")
+	ErrManagerClosed      = errors.New("manager is closed")
+	ErrIO                 = errors.New("store failed writing its log file")
+	ErrStoreCorrupt       = errors.New("log file may end in a partial record")
+	ErrOperationChanged   = errors.New("interceptor changed an operation that can't be changed")
+	ErrStalePlan          = errors.New("keys read by a planned write have changed")
+)
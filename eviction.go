@@ -0,0 +1,240 @@
+package keyvalue
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// what a store in memory mode does when a write would go over MaxKeys or
+// MaxMemoryBytes
+type EvictionPolicy int
+
+const (
+	EvictNone EvictionPolicy = iota // Refuse the write with ErrMaxKeysReached (default)
+	EvictLRU                        // Evict the least recently read or written key
+	EvictLFU                        // Evict the least frequently read or written key, oldest first on ties
+	EvictFIFO                       // Evict the oldest key
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictNone:
+		return "none"
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictFIFO:
+		return "fifo"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// keeps keys in eviction order for a policy
+type evictionTracker interface {
+	add(key string)    // A new key was stored
+	access(key string) // An existing key was read or overwritten
+	remove(key string)
+	// keys to evict next, skipping keys in keep, until enough reports that
+	// the keys so far are enough. the keys stay tracked until they are
+	// removed.
+	victims(keep map[string]bool, enough func(key string) bool) []string
+}
+
+func newEvictionTracker(policy EvictionPolicy) evictionTracker {
+	switch policy {
+	case EvictLRU:
+		return newListTracker(true)
+	case EvictFIFO:
+		return newListTracker(false)
+	case EvictLFU:
+		return &lfuTracker{items: make(map[string]*lfuItem)}
+	default:
+		return nil
+	}
+}
+
+// make room in memory for a write that adds newKeys keys and newBytes bytes,
+// see memSize, by picking keys to evict and returning their tombstones. they
+// are only removed from memory once the tombstones are written. keys in keep
+// are never evicted. the caller must hold the write lock.
+func (s *Store) makeRoomLocked(newKeys int, newBytes int64, keep map[string]bool) ([]Entry, error) {
+	keys := int(s.keys.Load()) + newKeys - s.maxKeys
+	bytes := int64(0)
+	if s.maxMemory > 0 {
+		bytes = s.memBytes.Load() + newBytes - s.maxMemory
+	}
+	if keys <= 0 && bytes <= 0 {
+		return nil, nil
+	}
+	limitErr := func() error {
+		if keys > 0 {
+			return fmt.Errorf("%w (%d)", ErrMaxKeysReached, s.maxKeys)
+		}
+		return fmt.Errorf("%w (%d bytes)", ErrMemoryLimitReached, s.maxMemory)
+	}
+	if s.evictor == nil {
+		return nil, limitErr()
+	}
+
+	s.emu.Lock()
+	victims := s.evictor.victims(keep, func(key string) bool {
+		keys--
+		value, _ := s.memValue(key)
+		bytes -= memSize(key, value)
+		return keys <= 0 && bytes <= 0
+	})
+	s.emu.Unlock()
+	if keys > 0 || bytes > 0 {
+		return nil, limitErr()
+	}
+
+	tombstones := make([]Entry, 0, len(victims))
+	for _, key := range victims {
+		tombstones = append(tombstones, Entry{Key: key, Deleted: true})
+	}
+	return tombstones, nil
+}
+
+// record a read of a key held in memory. safe to call with only the read
+// lock held.
+func (s *Store) touch(key string) {
+	if s.evictor == nil {
+		return
+	}
+	s.emu.Lock()
+	s.evictor.access(key)
+	s.emu.Unlock()
+}
+
+// LRU and FIFO order, least recently used or oldest at the back
+type listTracker struct {
+	order   *list.List
+	elems   map[string]*list.Element
+	recency bool // Whether accesses move a key to the front
+}
+
+func newListTracker(recency bool) *listTracker {
+	return &listTracker{order: list.New(), elems: make(map[string]*list.Element), recency: recency}
+}
+
+func (t *listTracker) add(key string) {
+	if _, ok := t.elems[key]; ok {
+		t.access(key)
+		return
+	}
+	t.elems[key] = t.order.PushFront(key)
+}
+
+func (t *listTracker) access(key string) {
+	if elem, ok := t.elems[key]; ok && t.recency {
+		t.order.MoveToFront(elem)
+	}
+}
+
+func (t *listTracker) remove(key string) {
+	if elem, ok := t.elems[key]; ok {
+		t.order.Remove(elem)
+		delete(t.elems, key)
+	}
+}
+
+func (t *listTracker) victims(keep map[string]bool, enough func(string) bool) []string {
+	var keys []string
+	for elem := t.order.Back(); elem != nil; elem = elem.Prev() {
+		if key := elem.Value.(string); !keep[key] {
+			keys = append(keys, key)
+			if enough(key) {
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// LFU order, a min-heap on access count then insertion order
+type lfuTracker struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	seq   uint64
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	seq   uint64 // Insertion order, the oldest key goes first on ties
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (t *lfuTracker) add(key string) {
+	if _, ok := t.items[key]; ok {
+		t.access(key)
+		return
+	}
+	t.seq++
+	item := &lfuItem{key: key, count: 1, seq: t.seq}
+	t.items[key] = item
+	heap.Push(&t.heap, item)
+}
+
+func (t *lfuTracker) access(key string) {
+	if item, ok := t.items[key]; ok {
+		item.count++
+		heap.Fix(&t.heap, item.index)
+	}
+}
+
+func (t *lfuTracker) remove(key string) {
+	if item, ok := t.items[key]; ok {
+		heap.Remove(&t.heap, item.index)
+		delete(t.items, key)
+	}
+}
+
+// pop until enough victims are found, then push everything back
+func (t *lfuTracker) victims(keep map[string]bool, enough func(string) bool) []string {
+	var keys []string
+	var popped []*lfuItem
+	for t.heap.Len() > 0 {
+		item := heap.Pop(&t.heap).(*lfuItem)
+		popped = append(popped, item)
+		if !keep[item.key] {
+			keys = append(keys, item.key)
+			if enough(item.key) {
+				break
+			}
+		}
+	}
+	for _, item := range popped {
+		heap.Push(&t.heap, item)
+	}
+	return keys
+}
@@ -0,0 +1,241 @@
+package keyvalue
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jere-mie/keyvalue/internal/logcodec"
+)
+
+// the encoding used by Export and Import
+type ExportFormat int
+
+const (
+	ExportJSON   ExportFormat = iota // A single JSON array of entries
+	ExportNDJSON                     // One JSON object per line
+	ExportCSV                        // A key,value,expires_at header followed by one row per entry
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportJSON:
+		return "json"
+	case ExportNDJSON:
+		return "ndjson"
+	case ExportCSV:
+		return "csv"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", int(f))
+	}
+}
+
+var csvHeader = []string{"key", "value", "expires_at"}
+
+// an entry in JSON and NDJSON exports. keys and values that aren't valid
+// UTF-8 are base64 encoded, like in JSON logs.
+type exportRecord struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Enc       string `json:"enc,omitempty"`        // "base64" for binary values
+	KeyEnc    string `json:"key_enc,omitempty"`    // "base64" for binary keys
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix nanoseconds, 0 means never
+}
+
+// write every live entry to w in the given format, sorted by key. unlike
+// Snapshot the output is meant to be read by other tools.
+func (s *Store) Export(w io.Writer, format ExportFormat) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	switch format {
+	case ExportJSON:
+		records := make([]exportRecord, 0, len(entries))
+		for _, entry := range entries {
+			records = append(records, newExportRecord(entry))
+		}
+		if err := json.NewEncoder(bw).Encode(records); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+	case ExportNDJSON:
+		enc := json.NewEncoder(bw)
+		for _, entry := range entries {
+			if err := enc.Encode(newExportRecord(entry)); err != nil {
+				return fmt.Errorf("error writing export: %w", err)
+			}
+		}
+	case ExportCSV:
+		cw := csv.NewWriter(bw)
+		cw.Write(csvHeader)
+		for _, entry := range entries {
+			expiresAt := ""
+			if entry.ExpiresAt != 0 {
+				expiresAt = strconv.FormatInt(entry.ExpiresAt, 10)
+			}
+			cw.Write([]string{entry.Key, entry.Value, expiresAt})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown export format %v", format)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	return nil
+}
+
+// set every entry read from r in the given format, with a single write. when
+// a key appears more than once the last one wins, and entries that have
+// already expired are skipped. either every entry is imported or none are.
+func (s *Store) Import(r io.Reader, format ExportFormat) error {
+	var records []exportRecord
+	switch format {
+	case ExportJSON:
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return fmt.Errorf("error reading import: %w", err)
+		}
+	case ExportNDJSON:
+		dec := json.NewDecoder(r)
+		for {
+			var record exportRecord
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading import: %w", err)
+			}
+			records = append(records, record)
+		}
+	case ExportCSV:
+		var err error
+		if records, err = readCSV(r); err != nil {
+			return fmt.Errorf("error reading import: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown export format %v", format)
+	}
+
+	entries := make([]Entry, 0, len(records))
+	for _, record := range records {
+		entry, err := record.entry()
+		if err != nil {
+			return fmt.Errorf("error reading import: %q: %w", record.Key, err)
+		}
+		entries = append(entries, entry)
+	}
+	return s.runFunc(Operation{Type: OpLoad, Ctx: context.Background()}, func(context.Context) error {
+		return s.setEntries(entries)
+	})
+}
+
+// every live entry with its expiration, sorted by key. for copying a store
+// into another database, see Export for writing it out as text.
+func (s *Store) Entries() ([]Entry, error) {
+	var entries []Entry
+	err := s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(ctx context.Context) (err error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		entries, err = s.liveEntries(ctx)
+		return err
+	})
+	return entries, err
+}
+
+// set the keys of entries to their values and expirations with a single
+// write, ignoring their other fields. when a key appears more than once the
+// last one wins, and entries that have already expired are skipped. either
+// every entry is set or none are.
+func (s *Store) SetEntries(entries []Entry) error {
+	return s.runFunc(Operation{Type: OpLoad, Ctx: context.Background()}, func(context.Context) error {
+		return s.setEntries(entries)
+	})
+}
+
+func (s *Store) setEntries(entries []Entry) error {
+	now := time.Now().UnixNano()
+	latest := make(map[string]Entry, len(entries))
+	for _, entry := range entries {
+		entry = Entry{Key: s.normalize(entry.Key), Value: entry.Value, ExpiresAt: entry.ExpiresAt}
+		if entry.expired(now) {
+			delete(latest, entry.Key)
+			continue
+		}
+		latest[entry.Key] = entry
+	}
+
+	batch := make([]Entry, 0, len(latest))
+	for _, entry := range latest {
+		batch = append(batch, entry)
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Key < batch[j].Key })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setEntriesLocked(batch)
+}
+
+func newExportRecord(entry Entry) exportRecord {
+	record := exportRecord{ExpiresAt: entry.ExpiresAt}
+	record.Key, record.KeyEnc = logcodec.EncodeString(entry.Key)
+	record.Value, record.Enc = logcodec.EncodeString(entry.Value)
+	return record
+}
+
+func (r exportRecord) entry() (Entry, error) {
+	entry := Entry{ExpiresAt: r.ExpiresAt}
+	var err error
+	if entry.Key, err = logcodec.DecodeString(r.Key, r.KeyEnc); err != nil {
+		return Entry{}, fmt.Errorf("error decoding key: %w", err)
+	}
+	if entry.Value, err = logcodec.DecodeString(r.Value, r.Enc); err != nil {
+		return Entry{}, fmt.Errorf("error decoding value: %w", err)
+	}
+	return entry, nil
+}
+
+// read CSV rows of key, value and an optional expiration. the header row is
+// optional, so a plain two-column file of seed data can be imported.
+func readCSV(r io.Reader) ([]exportRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	var records []exportRecord
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && len(row) >= 2 && row[0] == csvHeader[0] && row[1] == csvHeader[1] {
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+		if len(row) < 2 || len(row) > 3 {
+			return nil, fmt.Errorf("line %d: expected 2 or 3 fields, got %d", line, len(row))
+		}
+		record := exportRecord{Key: row[0], Value: row[1]}
+		if len(row) == 3 && row[2] != "" {
+			if record.ExpiresAt, err = strconv.ParseInt(row[2], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid expires_at: %w", line, err)
+			}
+		}
+		records = append(records, record)
+	}
+}
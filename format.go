@@ -0,0 +1,369 @@
+package keyvalue
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jere-mie/keyvalue/internal/logcodec"
+)
+
+// the encoding used for records in the log file
+type LogFormat int
+
+const (
+	LogFormatJSON   LogFormat = iota // One JSON object per line (default)
+	LogFormatBinary                  // Length-prefixed binary records after a version header
+)
+
+// binary logs start with a magic string followed by a version byte
+const (
+	binaryMagic   = "KVLB"
+	binaryVersion = 1
+)
+
+var binaryHeader = []byte{binaryMagic[0], binaryMagic[1], binaryMagic[2], binaryMagic[3], binaryVersion}
+
+// the smallest default for StoreConfig.MaxRecordSize. records bigger than
+// the limit are treated as corruption rather than allocated.
+const defaultMaxRecordSize = 64 << 20
+
+// the largest record a key and value within the given sizes can encode to.
+// JSON escapes a byte in up to 6, more than encryption and base64 add.
+func recordSizeFor(maxKeySize, maxValueSize int) int {
+	return 6*(maxKeySize+maxValueSize) + 1024
+}
+
+func (f LogFormat) String() string {
+	switch f {
+	case LogFormatJSON:
+		return "json"
+	case LogFormatBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("LogFormat(%d)", int(f))
+	}
+}
+
+// the bytes written at the start of a new log in this format
+func (f LogFormat) header() []byte {
+	if f == LogFormatBinary {
+		return append([]byte(nil), binaryHeader...)
+	}
+	return nil
+}
+
+// encode a single record in the given format, including its framing and
+// checksum. if aead isn't nil the value is encrypted with it.
+func encodeEntry(format LogFormat, aead cipher.AEAD, entry Entry) ([]byte, error) {
+	record := logcodec.Record{
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Deleted:   entry.Deleted,
+		Append:    entry.Append,
+		Op:        entry.Op,
+		ExpiresAt: entry.ExpiresAt,
+		Txn:       entry.Txn,
+		Commit:    entry.Commit,
+		Seq:       entry.Seq,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: entry.UpdatedAt,
+	}
+	if aead != nil && !entry.Deleted && !entry.Commit {
+		sealed, err := sealValue(aead, entry)
+		if err != nil {
+			return nil, err
+		}
+		record.Value = sealed
+		record.Encrypted = true
+	}
+	if format == LogFormatJSON {
+		return logcodec.AppendJSON(nil, record)
+	}
+	return logcodec.AppendBinary(nil, record)
+}
+
+// decode a JSON log line and verify its checksum, decrypting the value with
+// aead if it is encrypted
+func decodeJSONEntry(line []byte, aead cipher.AEAD) (Entry, error) {
+	record, err := logcodec.DecodeJSON(line)
+	if err != nil {
+		return Entry{}, err
+	}
+	return openRecord(record, aead)
+}
+
+// decode a binary record in format from the bytes after its length, its
+// payload and checksum, decrypting the value with aead if it is encrypted
+func decodeBinaryEntry(format LogFormat, framed []byte, aead cipher.AEAD) (Entry, error) {
+	record, err := logcodec.DecodeBinary(framed)
+	if err != nil {
+		return Entry{}, err
+	}
+	return openRecord(record, aead)
+}
+
+// the entry a decoded record holds, opening its value with aead if it is
+// encrypted
+func openRecord(record logcodec.Record, aead cipher.AEAD) (Entry, error) {
+	entry := Entry{
+		Key:       record.Key,
+		Value:     record.Value,
+		Deleted:   record.Deleted,
+		Append:    record.Append,
+		Op:        record.Op,
+		ExpiresAt: record.ExpiresAt,
+		Txn:       record.Txn,
+		Commit:    record.Commit,
+		Seq:       record.Seq,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+	}
+	if record.Encrypted {
+		value, err := openValue(aead, entry)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.Value = value
+	}
+	return entry, nil
+}
+
+// a record that couldn't be decoded. reading continues with the next record
+// when the framing allows it. see StoreConfig.StrictReplay and
+// Store.RecoveryReport.
+type RecordError struct {
+	File   string // Log file the record is in, if known
+	Offset int64  // Byte offset of the start of the record
+	Line   int    // Line number in JSON logs, 0 for binary logs
+	Err    error  // Why the record couldn't be decoded
+}
+
+func (e *RecordError) Error() string {
+	where := ""
+	if e.File != "" {
+		where = " of " + e.File
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("bad record on line %d%s (offset %d): %v", e.Line, where, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("bad record at offset %d%s: %v", e.Offset, where, e.Err)
+}
+
+func (e *RecordError) Unwrap() error { return e.Err }
+
+// reads records from a log in either format, detecting which one from the
+// header
+type recordReader struct {
+	format LogFormat
+	aead   cipher.AEAD // Decrypts encrypted values, nil if no key is configured
+	r      *bufio.Reader
+	limit  int   // Largest record accepted, see StoreConfig.MaxRecordSize
+	offset int64 // Offset of the next unread byte
+	start  int64 // Offset of the record last returned by Next
+	line   int
+	done   bool
+}
+
+func newRecordReader(r io.Reader, aead cipher.AEAD, limit int) (*recordReader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(binaryHeader))
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	if len(head) >= len(binaryMagic) && bytes.Equal(head[:len(binaryMagic)], []byte(binaryMagic)) {
+		if len(head) < len(binaryHeader) || head[len(binaryMagic)] != binaryVersion {
+			return nil, fmt.Errorf("unsupported binary log version")
+		}
+		br.Discard(len(binaryHeader))
+		return newFormatReader(br, LogFormatBinary, aead, limit, int64(len(binaryHeader))), nil
+	}
+	return newFormatReader(br, LogFormatJSON, aead, limit, 0), nil
+}
+
+// read records of a known format from r, which starts at offset in the log
+func newFormatReader(r io.Reader, format LogFormat, aead cipher.AEAD, limit int, offset int64) *recordReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &recordReader{r: br, aead: aead, format: format, limit: limit, offset: offset}
+}
+
+// read the single record at offset in a log of the given format
+func readRecordAt(r io.ReaderAt, format LogFormat, aead cipher.AEAD, limit int, offset int64) (Entry, error) {
+	rr := newFormatReader(io.NewSectionReader(r, offset, math.MaxInt64-offset), format, aead, limit, offset)
+	entry, err := rr.Next()
+	if err == io.EOF {
+		return Entry{}, io.ErrUnexpectedEOF
+	}
+	return entry, err
+}
+
+// read the next record, returning io.EOF once the log is exhausted. a
+// *RecordError means only this record was bad, unless the framing is lost in
+// which case the following call returns io.EOF. a value that can't be
+// decrypted is reported as ErrEncryptionKey rather than a bad record, since
+// the whole log is unreadable without the right key.
+func (rr *recordReader) Next() (Entry, error) {
+	raw, err := rr.frame()
+	if err != nil {
+		return Entry{}, err
+	}
+	entry, err := raw.decode(rr.format, rr.aead)
+	if err != nil {
+		return Entry{}, err
+	}
+	rr.start = raw.start
+	return entry, nil
+}
+
+// the offset of the record last returned by Next
+func (rr *recordReader) Start() int64 {
+	return rr.start
+}
+
+// a record read from the log but not decoded yet, so that decoding, which
+// takes most of the time, can be done apart from reading, see decodePipeline
+type rawRecord struct {
+	data  []byte // The JSON line, or the binary payload followed by its checksum
+	start int64  // Offset of the start of the record
+	line  int    // Line number in JSON logs, 0 for binary logs
+}
+
+// read the next record without decoding it, see Next
+func (rr *recordReader) frame() (rawRecord, error) {
+	if rr.done {
+		return rawRecord{}, io.EOF
+	}
+
+	if rr.format == LogFormatJSON {
+		for {
+			start := rr.offset
+			line, size, err := rr.readLine()
+			if err != nil {
+				return rawRecord{}, err
+			}
+			rr.offset += int64(size)
+			rr.line++
+			if line == nil {
+				// the line was skipped, the next one can still be read
+				err := fmt.Errorf("%w: %d bytes of at most %d", ErrRecordTooLarge, size, rr.limit)
+				return rawRecord{}, &RecordError{Offset: start, Line: rr.line, Err: err}
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			return rawRecord{data: line, start: start, line: rr.line}, nil
+		}
+	}
+
+	start := rr.offset
+	size, err := binary.ReadUvarint(rr)
+	if err == io.EOF && rr.offset == start {
+		return rawRecord{}, io.EOF
+	}
+	if err != nil {
+		return rawRecord{}, rr.lost(start, fmt.Errorf("error reading record length: %w", err))
+	}
+	if size > uint64(rr.limit) {
+		return rawRecord{}, rr.lost(start, fmt.Errorf("%w: %d bytes of at most %d", ErrRecordTooLarge, size, rr.limit))
+	}
+
+	// the payload is followed by its CRC32
+	record := make([]byte, size+4)
+	n, err := io.ReadFull(rr.r, record)
+	rr.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return rawRecord{}, rr.lost(start, errors.New("incomplete record"))
+	}
+	if err != nil {
+		return rawRecord{}, err
+	}
+	return rawRecord{data: record, start: start}, nil
+}
+
+// decode a record of a log in format, decrypting its value with aead
+func (raw rawRecord) decode(format LogFormat, aead cipher.AEAD) (Entry, error) {
+	var entry Entry
+	var err error
+	if format == LogFormatJSON {
+		entry, err = decodeJSONEntry(raw.data, aead)
+	} else {
+		entry, err = decodeBinaryEntry(format, raw.data, aead)
+	}
+	if errors.Is(err, ErrEncryptionKey) {
+		return Entry{}, err
+	}
+	if err != nil {
+		return Entry{}, &RecordError{Offset: raw.start, Line: raw.line, Err: err}
+	}
+	return entry, nil
+}
+
+// read the next line of a JSON log without its line ending, along with the
+// bytes it took up. lines longer than the limit are skipped and returned as
+// nil. a last line without a newline is still returned, io.EOF follows it.
+func (rr *recordReader) readLine() ([]byte, int, error) {
+	var line []byte
+	size := 0
+	for {
+		chunk, err := rr.r.ReadSlice('\n')
+		size += len(chunk)
+		if size <= rr.limit+1 {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && size == 0:
+			return nil, 0, io.EOF
+		case err != nil && err != io.EOF:
+			return nil, 0, err
+		}
+		break
+	}
+	if size > rr.limit+1 || (size > rr.limit && line[len(line)-1] != '\n') {
+		return nil, size, nil
+	}
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	return line, size, nil
+}
+
+// read a byte for decoding record lengths, keeping track of the offset
+func (rr *recordReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.offset++
+	}
+	return b, err
+}
+
+// report a bad record after which the rest of the log can't be framed
+func (rr *recordReader) lost(offset int64, err error) error {
+	rr.done = true
+	return &RecordError{Offset: offset, Err: err}
+}
+
+// detect the format of an existing log file from its first bytes. an empty
+// log reports ok as false.
+func detectFormat(r io.Reader) (format LogFormat, ok bool, err error) {
+	head := make([]byte, len(binaryHeader))
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	if n >= len(binaryMagic) && bytes.Equal(head[:len(binaryMagic)], []byte(binaryMagic)) {
+		return LogFormatBinary, true, nil
+	}
+	return LogFormatJSON, true, nil
+}
@@ -0,0 +1,250 @@
+// Package kvgrpc serves a keyvalue.Store over gRPC. the service is defined in
+// keyvalue.proto, regenerate the .pb.go files after changing it with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative keyvalue.proto
+//
+// clients are created with NewKeyValueClient.
+//
+// with an ACL from UseACL every call needs an authorization: Bearer <token>
+// metadata entry, and fails with PermissionDenied for keys the token can't
+// use. Scan and Watch leave out the keys it can't read. to serve over TLS pass
+// grpc.Creds(credentials.NewTLS(config)) to NewGRPCServer or grpc.NewServer,
+// and to cap the size of requests pass grpc.MaxRecvMsgSize(n). with a limiter
+// from UseRateLimit calls from clients making too many, by IP address and by
+// token, fail with ResourceExhausted.
+package kvgrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+	"github.com/jere-mie/keyvalue/ratelimit"
+)
+
+// a KeyValueServer backed by a store
+type Server struct {
+	UnimplementedKeyValueServer
+	store   *keyvalue.Store
+	acl     *auth.ACL
+	limiter *ratelimit.Limiter
+}
+
+// create a service implementation for the given store
+func New(store *keyvalue.Store) *Server {
+	return &Server{store: store}
+}
+
+// create a gRPC server with the service for store registered on it
+func NewGRPCServer(store *keyvalue.Store, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	RegisterKeyValueServer(srv, New(store))
+	return srv
+}
+
+// require API tokens checked against acl, see the package docs. call it
+// before serving, registering the Server on a grpc.Server with
+// RegisterKeyValueServer rather than using NewGRPCServer.
+func (s *Server) UseACL(acl *auth.ACL) {
+	s.acl = acl
+}
+
+// limit how often each client may make calls, see the ratelimit package.
+// call it before serving.
+func (s *Server) UseRateLimit(limiter *ratelimit.Limiter) {
+	s.limiter = limiter
+}
+
+// authenticate and rate limit a call, returning who it is authenticated as,
+// nil without an ACL
+func (s *Server) admit(ctx context.Context) (*auth.Principal, error) {
+	// limit by address first so failed tokens count too
+	if err := s.allow(remoteIP(ctx)); err != nil {
+		return nil, err
+	}
+	var p *auth.Principal
+	if s.acl != nil {
+		var token string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				token, _ = auth.BearerToken(values[0])
+			}
+		}
+		var err error
+		if p, err = s.acl.Authenticate(token); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	if p != nil {
+		if err := s.allow("token:" + p.Name); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// count a call against client's rate limit
+func (s *Server) allow(client string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if ok, _ := s.limiter.Allow(client); !ok {
+		return status.Error(codes.ResourceExhausted, ratelimit.ErrLimited.Error())
+	}
+	return nil
+}
+
+// the IP address a call came from
+func remoteIP(ctx context.Context) string {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	addr := pr.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit a call, failing unless its token has the given access to key
+func (s *Server) authorize(ctx context.Context, key string, access auth.Access) error {
+	p, err := s.admit(ctx)
+	if err != nil || p == nil {
+		return err
+	}
+	if err := p.Check(key, access); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func (s *Server) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	key := string(req.Key)
+	if err := s.authorize(ctx, key, auth.Write); err != nil {
+		return nil, err
+	}
+	var err error
+	if req.Ttl != nil {
+		err = s.store.SetWithTTLCtx(ctx, key, string(req.Value), req.Ttl.AsDuration())
+	} else {
+		err = s.store.SetCtx(ctx, key, string(req.Value))
+	}
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return &SetResponse{}, nil
+}
+
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	key := string(req.Key)
+	if err := s.authorize(ctx, key, auth.Read); err != nil {
+		return nil, err
+	}
+	value, exists, err := s.store.GetCtx(ctx, key)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	if !exists {
+		return nil, statusFor(keyvalue.ErrKeyNotFound)
+	}
+	return &GetResponse{Value: []byte(value)}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	key := string(req.Key)
+	if err := s.authorize(ctx, key, auth.Write); err != nil {
+		return nil, err
+	}
+	if err := s.store.DeleteCtx(ctx, key); err != nil {
+		return nil, statusFor(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// the entries are collected before sending, so a slow client doesn't hold
+// the store's read lock
+func (s *Server) Scan(req *ScanRequest, stream grpc.ServerStreamingServer[Entry]) error {
+	p, err := s.admit(stream.Context())
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.Scan(string(req.Prefix))
+	if err != nil {
+		return statusFor(err)
+	}
+	for _, e := range entries {
+		if p != nil && !p.Allowed(e.Key, auth.Read) {
+			continue
+		}
+		if err := stream.Send(&Entry{Key: []byte(e.Key), Value: []byte(e.Value)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[Event]) error {
+	ctx := stream.Context()
+	p, err := s.admit(ctx)
+	if err != nil {
+		return err
+	}
+	events, cancel := s.store.Watch(string(req.Prefix))
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, keyvalue.ErrStoreClosed.Error())
+			}
+			if p != nil && !p.Allowed(event.Key, auth.Read) {
+				continue
+			}
+			msg := &Event{Type: Event_SET, Key: []byte(event.Key), Value: []byte(event.Value)}
+			if event.Type == keyvalue.EventDelete {
+				msg.Type = Event_DELETE
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// map store errors to gRPC status codes
+func statusFor(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, keyvalue.ErrKeyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, keyvalue.ErrKeyTooLarge), errors.Is(err, keyvalue.ErrValueTooLarge),
+		errors.Is(err, keyvalue.ErrInvalidKey), errors.Is(err, keyvalue.ErrInvalidValue), errors.Is(err, keyvalue.ErrInvalidTTL):
+		code = codes.InvalidArgument
+	case errors.Is(err, keyvalue.ErrMaxKeysReached), errors.Is(err, keyvalue.ErrMemoryLimitReached), errors.Is(err, keyvalue.ErrQuotaExceeded):
+		code = codes.ResourceExhausted
+	case errors.Is(err, keyvalue.ErrReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, keyvalue.ErrStoreClosed), errors.Is(err, keyvalue.ErrIO):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
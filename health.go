@@ -0,0 +1,46 @@
+package keyvalue
+
+import "fmt"
+
+// the error the store failed with, nil while it is healthy. a write or fsync
+// of the log that fails may leave it holding part of a record, or records
+// that were never reported as written, so from then on writes, and reads
+// that go to the log, fail with an error wrapping ErrIO, and ErrStoreCorrupt
+// if a record was cut short. reads served from memory keep working. reopening
+// the store recovers it, replaying the log like after a crash.
+func (s *Store) Err() error {
+	if err := s.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// fail the store after an error writing or syncing the log, see Err. returns
+// the error the store failed with, the first one if it already had.
+func (s *Store) fail(err error) error {
+	failure := fmt.Errorf("%w: %w", ErrIO, err)
+	if s.failure.CompareAndSwap(nil, &failure) {
+		s.logger.Error("store failed, reopen it to recover", "err", err)
+		if s.queue != nil {
+			s.queue.release(failure)
+		}
+	}
+	return s.Err()
+}
+
+// the error for a write to the log that failed after n of size bytes, which
+// may have left part of a record behind
+func writeError(n, size int, err error) error {
+	if n > 0 && n < size {
+		return fmt.Errorf("%w after %d of %d bytes: %w", ErrStoreCorrupt, n, size, err)
+	}
+	return err
+}
+
+// fsync the active log file, failing the store if that fails
+func (s *Store) syncLog() error {
+	if err := s.file.Sync(); err != nil {
+		return s.fail(fmt.Errorf("error syncing log file: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// a version of a key as recorded in the log
+type VersionedEntry struct {
+	Value     string
+	Seq       uint64    // Sequence number of the record, 0 for records written before they were kept
+	Deleted   bool      // Whether this version deleted the key
+	ExpiresAt int64     // Unix nanoseconds, 0 means never
+	Time      time.Time // When the version was written, zero for records written before timestamps were kept
+}
+
+// the versions of a key still in the log, newest first, up to limit of them
+// (0 or less returns them all). the newest is the key's current state unless
+// it has expired. compaction drops all but StoreConfig.KeepVersions past
+// versions of live keys, and every version of deleted ones.
+func (s *Store) GetHistory(key string, limit int) ([]VersionedEntry, error) {
+	var history []VersionedEntry
+	err := s.runFunc(Operation{Type: OpGetEntry, Ctx: context.Background(), Key: key}, func(context.Context) (err error) {
+		history, err = s.getHistory(key, limit)
+		return err
+	})
+	return history, err
+}
+
+func (s *Store) getHistory(key string, limit int) ([]VersionedEntry, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var history []VersionedEntry
+	err := s.replay(func(entry Entry) bool {
+		if entry.Key != key {
+			return true
+		}
+		version := VersionedEntry{Value: entry.Value, Seq: entry.Seq, Deleted: entry.Deleted, ExpiresAt: entry.ExpiresAt}
+		if entry.UpdatedAt != 0 {
+			version.Time = time.Unix(0, entry.UpdatedAt)
+		}
+		history = append(history, version)
+		if limit > 0 && len(history) > limit {
+			history = history[1:]
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
+
+// the value a key had at time t, worked out from the versions of it still in
+// the log, see GetHistory. records written before timestamps were kept count
+// as older than t.
+func (s *Store) GetAt(key string, t time.Time) (string, bool, error) {
+	var entry Entry
+	var ok bool
+	err := s.runFunc(Operation{Type: OpGetEntry, Ctx: context.Background(), Key: key}, func(context.Context) error {
+		key := s.normalize(key)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		entries, err := s.entriesAt(t, func(k string) bool { return k == key })
+		entry, ok = entries[key]
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return entry.Value, ok, nil
+}
+
+// every key-value pair the store held at time t, see GetAt
+func (s *Store) SnapshotAt(t time.Time) (map[string]string, error) {
+	var data map[string]string
+	err := s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(context.Context) (err error) {
+		data, err = s.snapshotAt(t)
+		return err
+	})
+	return data, err
+}
+
+func (s *Store) snapshotAt(t time.Time) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := s.entriesAt(t, func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string, len(entries))
+	for key, entry := range entries {
+		data[key] = entry.Value
+	}
+	return data, nil
+}
+
+// write a compacted log to out holding what the store in logPath held at
+// time t, see SnapshotAt, to recover from bad writes made after it. the log is
+// opened read-only with config, so this can run while another process owns
+// it, and out is written in config.Format. entries keep their expirations, so
+// ones that have passed since t are gone once out is opened. out must not
+// already exist.
+func RestoreToTime(logPath string, t time.Time, out string, config StoreConfig) error {
+	if _, err := os.Lstat(out); err == nil {
+		return fmt.Errorf("%s: %w", out, os.ErrExist)
+	}
+	config.ReadOnly, config.UseMemory = true, false
+	s, err := NewStore(logPath, config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.mu.RLock()
+	latest, err := s.entriesAt(t, func(string) bool { return true })
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	entries := make([]Entry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry.standalone())
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	buf := s.newFormat.header()
+	for _, entry := range entries {
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+	if err := replaceFile(out, buf); err != nil {
+		return fmt.Errorf("error writing restored log file: %w", err)
+	}
+	return nil
+}
+
+// replay the records written up to time t for the keys match accepts,
+// returning the entry each of them held at t if it was live, with its
+// creation time filled in. the caller must hold at least the read lock.
+func (s *Store) entriesAt(t time.Time, match func(key string) bool) (map[string]Entry, error) {
+	at := t.UnixNano()
+	latest := make(map[string]Entry)
+	err := s.replay(func(entry Entry) bool {
+		if entry.UpdatedAt > at || !match(entry.Key) {
+			return true
+		}
+		if entry.Deleted || entry.expired(at) {
+			delete(latest, entry.Key)
+		} else {
+			prev, ok := latest[entry.Key]
+			entry.CreatedAt = creationTime(entry, prev, ok)
+			latest[entry.Key] = entry
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+	return latest, nil
+}
+
+// the entry as a record of its own, outside of any transaction
+func (e Entry) standalone() Entry {
+	e.Txn, e.Commit = 0, false
+	return e
+}
+
+// collect the records a compacted log keeps, sorted by key: the latest record
+// of every live key, preceded by up to keepVersions of its earlier ones, with
+// the creation times that the dropped records held filled in. in
+// memory mode keys that aren't in memory, like ones evicted while loading,
+// are dropped. gives up once ctx is done. the caller must hold at least the
+// read lock.
+func (s *Store) compactEntries(ctx context.Context) ([]Entry, error) {
+	versions, err := collectVersions(s.keepVersions, func(fn func(Entry) bool) error {
+		return s.replayContext(ctx, fn, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+	return s.keptEntries(versions), nil
+}
+
+// the latest record of every key replay passes, preceded by up to
+// keepVersions of its earlier ones, with the creation times that the dropped
+// records held filled in
+func collectVersions(keepVersions int, replay func(fn func(Entry) bool) error) (map[string][]Entry, error) {
+	versions := make(map[string][]Entry)
+	err := replay(func(entry Entry) bool {
+		history := versions[entry.Key]
+		var prev Entry
+		if len(history) > 0 {
+			prev = history[len(history)-1]
+		}
+		entry.CreatedAt = creationTime(entry, prev, len(history) > 0)
+		if len(history) > keepVersions {
+			copy(history, history[1:])
+			history = history[:keepVersions]
+		}
+		versions[entry.Key] = append(history, entry.standalone())
+		return true
+	})
+	return versions, err
+}
+
+// the versions of live keys, sorted by key, see compactEntries. the caller
+// must hold at least the read lock.
+func (s *Store) keptEntries(versions map[string][]Entry) []Entry {
+	now := time.Now().UnixNano()
+	var entries []Entry
+	for key, history := range versions {
+		last := history[len(history)-1]
+		live := !last.Deleted && !last.expired(now)
+		if s.useMemory && live {
+			_, live = s.memLookup(key, now)
+		}
+		if live {
+			entries = append(entries, history...)
+		}
+	}
+	// versions of a key stay in the order they were written
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
@@ -0,0 +1,454 @@
+// Package httpserver exposes a keyvalue.Store over a small JSON REST API.
+//
+//	GET    /keys/{key}       fetch a value
+//	PUT    /keys/{key}       set a value from the request body, ?ttl=10s sets an expiration
+//	DELETE /keys/{key}       delete a key
+//	GET    /keys?prefix=p    list entries, optionally filtered by prefix
+//	                         ?limit=n pages through them, the X-Next-Cursor response
+//	                         header is passed back as ?cursor= for the next page,
+//	                         ?reverse=true lists in descending order, ?encoding=base64
+//	                         encodes keys and values so binary ones survive
+//	GET    /search?q=words   list entries whose values hold every word, see Store.Search
+//	GET    /stats            counters and sizes, see Store.Stats
+//	POST   /compact          compact the log file
+//	GET    /ui/              a dashboard for browsing, searching and editing keys
+//
+// with an ACL from UseACL every request but the dashboard's files needs an
+// Authorization: Bearer <token> header. keys the token can't read are left out
+// of lists and search results, so a page can be shorter than its limit, and
+// /stats and /compact need an admin token. with a limiter from UseRateLimit
+// clients making too many requests, by IP address and by token, get 429
+// responses with a Retry-After header, and LimitBodySize caps the size of PUT
+// bodies. UseMiddleware wraps the requests Run serves, to trace them for
+// example.
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+	"github.com/jere-mie/keyvalue/ratelimit"
+)
+
+//go:embed ui
+var ui embed.FS
+
+// an http.Handler serving the REST API for a store
+type Server struct {
+	store   *keyvalue.Store
+	mux     *http.ServeMux
+	acl     *auth.ACL
+	tls     *tls.Config
+	limiter *ratelimit.Limiter
+	maxBody int64 // Largest PUT body accepted, 0 for no limit
+	wrap    func(http.Handler) http.Handler
+}
+
+// a key-value pair in responses
+type entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// create a handler for the given store
+func New(store *keyvalue.Store) *Server {
+	s := &Server{store: store, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /keys/{key...}", s.handleGet)
+	s.mux.HandleFunc("PUT /keys/{key...}", s.handlePut)
+	s.mux.HandleFunc("DELETE /keys/{key...}", s.handleDelete)
+	s.mux.HandleFunc("GET /keys", s.handleList)
+	s.mux.HandleFunc("GET /search", s.handleSearch)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+	s.mux.HandleFunc("POST /compact", s.handleCompact)
+	s.mux.Handle("GET /ui/", http.FileServerFS(ui))
+	s.mux.Handle("GET /{$}", http.RedirectHandler("ui/", http.StatusFound))
+	return s
+}
+
+// require API tokens checked against acl, see the package docs. call it
+// before serving.
+func (s *Server) UseACL(acl *auth.ACL) {
+	s.acl = acl
+}
+
+// serve HTTPS with config from Run. config needs a certificate, see
+// auth.TLSConfig.
+func (s *Server) UseTLS(config *tls.Config) {
+	s.tls = config
+}
+
+// limit how often each client may make requests, see the package docs. call
+// it before serving.
+func (s *Server) UseRateLimit(limiter *ratelimit.Limiter) {
+	s.limiter = limiter
+}
+
+// reject PUT bodies larger than n bytes with 413 responses before reading
+// all of them, 0 for no limit. call it before serving.
+func (s *Server) LimitBodySize(n int64) {
+	s.maxBody = n
+}
+
+// serve every request from Run through mw, like the tracing of
+// kvotel.Middleware. call it before serving.
+func (s *Server) UseMiddleware(mw func(http.Handler) http.Handler) {
+	s.wrap = mw
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	orig := r
+	static := r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/ui/")
+	// limit by address first so failed tokens count too
+	if !static && !s.allow(w, remoteIP(r)) {
+		return
+	}
+	var p *auth.Principal
+	if s.acl != nil && !static {
+		token, _ := auth.BearerToken(r.Header.Get("Authorization"))
+		var err error
+		if p, err = s.acl.Authenticate(token); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		r = r.WithContext(auth.NewContext(r.Context(), p))
+	}
+	if p != nil && !s.allow(w, "token:"+p.Name) {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+	// like a ServeMux, leave the route that matched on the caller's request
+	// for middleware to see
+	orig.Pattern = r.Pattern
+}
+
+// count a request against client's rate limit, answering it with 429 if it
+// is over
+func (s *Server) allow(w http.ResponseWriter, client string) bool {
+	if s.limiter == nil {
+		return true
+	}
+	ok, retryAfter := s.limiter.Allow(client)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		writeError(w, http.StatusTooManyRequests, ratelimit.ErrLimited)
+	}
+	return ok
+}
+
+// the IP address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// listen on addr and serve until ctx is cancelled, then shut down gracefully,
+// giving in-flight requests up to 10 seconds to finish
+func (s *Server) Run(ctx context.Context, addr string) error {
+	var handler http.Handler = s
+	if s.wrap != nil {
+		handler = s.wrap(s)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: s.tls}
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.tls != nil {
+			// the certificate comes from the config rather than files
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.allowed(w, r, key, auth.Read) {
+		return
+	}
+	value, exists, err := s.store.GetCtx(r.Context(), key)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, keyvalue.ErrKeyNotFound)
+		return
+	}
+
+	// binary values can be fetched as-is instead of inside a JSON string
+	if r.Header.Get("Accept") == "application/octet-stream" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, value)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry{Key: key, Value: value})
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.allowed(w, r, key, auth.Write) {
+		return
+	}
+	if s.maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBody)
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, keyvalue.ErrValueTooLarge)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = s.store.SetWithTTLCtx(r.Context(), key, string(body), d)
+	} else {
+		err = s.store.SetCtx(r.Context(), key, string(body))
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry{Key: key, Value: string(body)})
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.allowed(w, r, key, auth.Write) {
+		return
+	}
+	if err := s.store.DeleteCtx(r.Context(), key); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := keyvalue.ListOptions{Prefix: query.Get("prefix"), Cursor: query.Get("cursor")}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", limit))
+			return
+		}
+		opts.Limit = n
+	}
+	if reverse := query.Get("reverse"); reverse != "" {
+		b, err := strconv.ParseBool(reverse)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid reverse %q", reverse))
+			return
+		}
+		opts.Reverse = b
+	}
+	encoding := query.Get("encoding")
+	if encoding != "" && encoding != "base64" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid encoding %q", encoding))
+		return
+	}
+	entries, next, err := s.store.List(opts)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
+	results := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if !s.readable(r, e.Key) {
+			continue
+		}
+		if encoding == "base64" {
+			e.Key = base64.StdEncoding.EncodeToString([]byte(e.Key))
+			e.Value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+		}
+		results = append(results, entry{Key: e.Key, Value: e.Value})
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.store.Search(r.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	results := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if s.readable(r, e.Key) {
+			results = append(results, entry{Key: e.Key, Value: e.Value})
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// the store's stats in responses
+type stats struct {
+	Keys         int        `json:"keys"`
+	LogSize      int64      `json:"log_size"`
+	Records      int        `json:"records"`
+	StaleRecords int        `json:"stale_records"`
+	LiveRatio    float64    `json:"live_ratio"`
+	Compacted    *time.Time `json:"compacted,omitempty"`
+	Sets         uint64     `json:"sets"`
+	Gets         uint64     `json:"gets"`
+	Hits         uint64     `json:"hits"`
+	Misses       uint64     `json:"misses"`
+	Deletes      uint64     `json:"deletes"`
+	Compactions  uint64     `json:"compactions"`
+	BytesWritten uint64     `json:"bytes_written"`
+	LoadSeconds  float64    `json:"load_seconds"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedAdmin(w, r) {
+		return
+	}
+	st := s.store.Stats()
+	resp := stats{
+		Keys:         st.Keys,
+		LogSize:      st.LogSize,
+		Records:      st.Records,
+		StaleRecords: st.StaleRecords,
+		LiveRatio:    st.LiveRatio,
+		Sets:         st.Sets,
+		Gets:         st.Gets,
+		Hits:         st.Hits,
+		Misses:       st.Misses,
+		Deletes:      st.Deletes,
+		Compactions:  st.Compactions,
+		BytesWritten: st.BytesWritten,
+		LoadSeconds:  st.LoadTime.Seconds(),
+	}
+	if !st.Compacted.IsZero() {
+		resp.Compacted = &st.Compacted
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedAdmin(w, r) {
+		return
+	}
+	if err := s.store.CompactCtx(r.Context()); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// whether the request's token has the given access to key, writing a 403
+// response if it doesn't
+func (s *Server) allowed(w http.ResponseWriter, r *http.Request, key string, access auth.Access) bool {
+	if s.acl == nil {
+		return true
+	}
+	p, _ := auth.FromContext(r.Context())
+	if err := p.Check(key, access); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// whether the request's token is an admin's, writing a 403 response if it
+// isn't
+func (s *Server) allowedAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.acl == nil {
+		return true
+	}
+	p, _ := auth.FromContext(r.Context())
+	if err := p.CheckAdmin(); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// whether key belongs in the request's list and search results
+func (s *Server) readable(r *http.Request, key string) bool {
+	if s.acl == nil {
+		return true
+	}
+	p, _ := auth.FromContext(r.Context())
+	return p.Allowed(key, auth.Read)
+}
+
+// map store errors to HTTP status codes
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, keyvalue.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, keyvalue.ErrInvalidCursor), errors.Is(err, keyvalue.ErrInvalidKey), errors.Is(err, keyvalue.ErrInvalidValue),
+		errors.Is(err, keyvalue.ErrInvalidTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, keyvalue.ErrNoSearchIndex):
+		return http.StatusNotImplemented
+	case errors.Is(err, keyvalue.ErrKeyTooLarge), errors.Is(err, keyvalue.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, keyvalue.ErrMaxKeysReached), errors.Is(err, keyvalue.ErrMemoryLimitReached), errors.Is(err, keyvalue.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, keyvalue.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, keyvalue.ErrStoreClosed), errors.Is(err, keyvalue.ErrIO):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,61 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// add delta to the integer stored at key as a single atomic step and return
+// the new value. a missing key counts as 0, and an existing expiration time is
+// kept.
+func (s *Store) Incr(key string, delta int64) (int64, error) {
+	var n int64
+	err := s.runFunc(Operation{Type: OpIncr, Ctx: context.Background(), Key: key}, func(context.Context) (err error) {
+		n, err = s.incr(key, delta)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) incr(key string, delta int64) (int64, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := s.lookupLocked(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if exists {
+		n, err = strconv.ParseInt(current.Value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q: %w", key, ErrNotInteger)
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%q: increment would overflow", key)
+	}
+	n += delta
+
+	if err := s.setLocked(key, strconv.FormatInt(n, 10), current.ExpiresAt); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// subtract delta from the integer stored at key, see Incr
+func (s *Store) Decr(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, fmt.Errorf("%q: decrement would overflow", key)
+	}
+	var n int64
+	err := s.runFunc(Operation{Type: OpIncr, Ctx: context.Background(), Key: key}, func(context.Context) (err error) {
+		n, err = s.incr(key, -delta)
+		return err
+	})
+	return n, err
+}
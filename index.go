@@ -0,0 +1,245 @@
+package keyvalue
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// where the latest record of a key is in the log, for file-only stores with
+// an index
+type indexEntry struct {
+	segment   int   // Segment number, 0 for a single log file
+	offset    int64 // Offset of the record in its file
+	expiresAt int64
+	createdAt int64 // When the key was created, which older records don't say
+	appended  bool  // Whether the record is partial, like an append, so it doesn't hold the whole value
+}
+
+// index files start with a magic string followed by a version byte
+const (
+	indexMagic   = "KVIX"
+	indexVersion = 3
+)
+
+// the index is saved next to the log when the store is closed
+func indexPath(filename string) string {
+	return filename + ".idx"
+}
+
+// load the index saved by the last clean close, or build it from the log if
+// there isn't a usable one. the saved index is removed from disk while the
+// store is open, so a crash can't leave one behind that doesn't match the
+// log. the caller must hold the write lock.
+func (s *Store) openIndex() error {
+	ok, err := s.loadIndex()
+	if err != nil {
+		s.logger.Warn("error reading index file, rebuilding it", "err", err)
+	}
+	if !ok {
+		if err := s.buildIndex(); err != nil {
+			return err
+		}
+	}
+	return s.removeSidecar(indexPath(s.filename))
+}
+
+// index every record in the log from scratch. the caller must hold the write
+// lock.
+func (s *Store) buildIndex() error {
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+
+	s.index = make(map[string]indexEntry)
+	for i, path := range s.logFiles() {
+		segment := 0
+		if s.segments != nil {
+			segment = s.segments[i]
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error reading log file: %w", err)
+		}
+		reader, err := newRecordReader(file, s.aead, s.maxRecordSize)
+		if err == nil {
+			err = replayRecords(reader, func(entry Entry, offset int64) bool {
+				s.indexEntry(entry, segment, offset)
+				return true
+			}, nil)
+		}
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error reading log file: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebuild the index, bloom filter and search index after the log was
+// rewritten, if the store keeps them. the caller must hold the write lock.
+func (s *Store) reindex() error {
+	if s.index != nil {
+		if err := s.buildIndex(); err != nil {
+			return fmt.Errorf("error rebuilding index: %w", err)
+		}
+	}
+	if s.bloom != nil {
+		if err := s.buildBloom(); err != nil {
+			return fmt.Errorf("error rebuilding bloom filter: %w", err)
+		}
+	}
+	if s.search != nil {
+		if err := s.buildSearch(); err != nil {
+			return fmt.Errorf("error rebuilding search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// point the index at a record, or drop the key for a tombstone. the caller
+// must hold the write lock.
+func (s *Store) indexEntry(entry Entry, segment int, offset int64) {
+	switch {
+	case entry.Commit:
+	case entry.Deleted:
+		delete(s.index, entry.Key)
+	default:
+		prev, ok := s.index[entry.Key]
+		created := creationTime(entry, Entry{ExpiresAt: prev.expiresAt, CreatedAt: prev.createdAt}, ok)
+		s.index[entry.Key] = indexEntry{segment: segment, offset: offset, expiresAt: entry.ExpiresAt, createdAt: created, appended: entry.partial()}
+	}
+}
+
+// find the current entry for a key by reading the record the index points
+// at. keys last changed by a partial record, like an append, are looked for
+// in the log instead, as the record doesn't hold the whole value. the caller
+// must hold at least the read lock.
+func (s *Store) lookupIndexed(key string, now int64) (Entry, bool, error) {
+	pos, ok := s.index[key]
+	if !ok || (pos.expiresAt != 0 && pos.expiresAt <= now) {
+		return Entry{}, false, nil
+	}
+	if pos.appended {
+		return s.lookupScan(context.Background(), key, now)
+	}
+
+	path := s.filename
+	if s.segments != nil {
+		path = segmentPath(s.filename, pos.segment)
+	}
+	if path == s.activePath() {
+		if err := s.flushBuffer(); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	entry, err := s.readLogRecord(path, pos.offset)
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("error reading indexed record: %w", err)
+	}
+	if entry.Key != key {
+		return Entry{}, false, fmt.Errorf("index points at a record for %q instead of %q", entry.Key, key)
+	}
+	entry.CreatedAt = pos.createdAt
+	return entry.standalone(), true, nil
+}
+
+// read the record at offset in a sealed segment
+func readSegmentRecord(path string, aead cipher.AEAD, limit int, offset int64) (Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer file.Close()
+
+	format, _, err := detectFormat(file)
+	if err != nil {
+		return Entry{}, err
+	}
+	return readRecordAt(file, format, aead, limit, offset)
+}
+
+// save the index next to the log. the caller must hold the write lock and
+// have flushed the write buffer.
+func (s *Store) saveIndex() error {
+	// expired keys are left out
+	now := time.Now().UnixNano()
+	live := make(map[string]indexEntry, len(s.index))
+	for key, pos := range s.index {
+		if pos.expiresAt == 0 || pos.expiresAt > now {
+			live[key] = pos
+		}
+	}
+
+	buf := binary.AppendUvarint(nil, uint64(len(live)))
+	for key, pos := range live {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(pos.segment))
+		buf = binary.AppendUvarint(buf, uint64(pos.offset))
+		buf = binary.AppendVarint(buf, pos.expiresAt)
+		buf = binary.AppendVarint(buf, pos.createdAt)
+		var appended byte
+		if pos.appended {
+			appended = 1
+		}
+		buf = append(buf, appended)
+	}
+	return s.saveSidecar(indexPath(s.filename), indexMagic, indexVersion, buf)
+}
+
+// load the saved index, reporting false if there is none or the log files
+// don't match the ones it was saved for. the caller must hold the write lock.
+func (s *Store) loadIndex() (bool, error) {
+	buf, ok, err := s.readSidecar(indexPath(s.filename), indexMagic, indexVersion)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	bad := errors.New("malformed index file")
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return v, true
+	}
+
+	count, ok := readUvarint()
+	if !ok {
+		return false, bad
+	}
+	index := make(map[string]indexEntry)
+	for ; count > 0; count-- {
+		n, ok := readUvarint()
+		if !ok || n > uint64(len(buf)) {
+			return false, bad
+		}
+		key := string(buf[:n])
+		buf = buf[n:]
+		segment, ok1 := readUvarint()
+		offset, ok2 := readUvarint()
+		expiresAt, size := binary.Varint(buf)
+		if !ok1 || !ok2 || size <= 0 {
+			return false, bad
+		}
+		buf = buf[size:]
+		createdAt, size := binary.Varint(buf)
+		if size <= 0 || size >= len(buf) || buf[size] > 1 {
+			return false, bad
+		}
+		appended := buf[size] == 1
+		buf = buf[size+1:]
+		index[key] = indexEntry{segment: int(segment), offset: int64(offset), expiresAt: expiresAt, createdAt: createdAt, appended: appended}
+	}
+	if len(buf) != 0 {
+		return false, bad
+	}
+	s.index = index
+	return true, nil
+}
@@ -0,0 +1,209 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// the kind of operation an Interceptor sees
+type OpType int
+
+const (
+	OpGet     OpType = iota // A key is read, see Store.Get
+	OpSet                   // A key is set, see Store.Set and Store.SetWithTTL
+	OpDelete                // A key is deleted, see Store.Delete
+	OpCompact               // The log is compacted, by Store.Compact or in the background
+
+	OpGetMany        // Several keys are read, see Store.GetMany
+	OpScan           // Entries are read in bulk, see Store.Scan, List, Range, Search, Iterate, Export and Snapshot
+	OpGetEntry       // A key's metadata or past versions are read, see Store.GetEntry, GetHistory and GetAt
+	OpSetBatch       // Several keys are set at once, see Store.SetBatch
+	OpDeleteBatch    // Several keys are deleted at once, see Store.DeleteBatch
+	OpCompareAndSwap // A key is changed only if it holds a value, see Store.CompareAndSwap and CompareAndDelete
+	OpSetIfAbsent    // A key is set only if it doesn't exist, see Store.SetIfAbsent
+	OpGetOrSet       // A key is read or set if it doesn't exist, see Store.GetOrSet and GetOrCompute
+	OpUpdate         // A key is read and changed in one step, see Store.Update
+	OpIncr           // A number is added to a key, see Store.Incr and Decr
+	OpExpire         // An expiration is set on a key, see Store.Expire
+	OpRename         // A key is renamed, see Store.Rename and RenameIfAbsent
+	OpAppend         // A key's value is added to, see Store.Append
+	OpContainer      // A list, set or hash is read or changed, see Store.LPush, SAdd, HSet and the rest
+	OpCommit         // A transaction is committed, see Txn.Commit
+	OpLoad           // Entries are loaded into the store, see Store.SetEntries, Import, Merge and RestoreSnapshot
+)
+
+func (t OpType) String() string {
+	switch t {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	case OpCompact:
+		return "compact"
+	case OpGetMany:
+		return "get_many"
+	case OpScan:
+		return "scan"
+	case OpGetEntry:
+		return "get_entry"
+	case OpSetBatch:
+		return "set_batch"
+	case OpDeleteBatch:
+		return "delete_batch"
+	case OpCompareAndSwap:
+		return "compare_and_swap"
+	case OpSetIfAbsent:
+		return "set_if_absent"
+	case OpGetOrSet:
+		return "get_or_set"
+	case OpUpdate:
+		return "update"
+	case OpIncr:
+		return "incr"
+	case OpExpire:
+		return "expire"
+	case OpRename:
+		return "rename"
+	case OpAppend:
+		return "append"
+	case OpContainer:
+		return "container"
+	case OpCommit:
+		return "commit"
+	case OpLoad:
+		return "load"
+	default:
+		return fmt.Sprintf("OpType(%d)", int(t))
+	}
+}
+
+// an operation on the way through the interceptors to the store
+type Operation struct {
+	Type      OpType
+	Ctx       context.Context
+	Key       string    // Key as it was passed, before StoreConfig.NormalizeKey, or the prefix an OpScan reads
+	Keys      []string  // Keys of the operations on several keys, like OpGetMany, OpSetBatch, OpRename and OpCommit
+	Value     string    // Value written by OpSet, and by OpCompareAndSwap, OpSetIfAbsent, OpGetOrSet and OpAppend
+	ExpiresAt int64     // When the value written by OpSet or OpExpire expires in Unix nanoseconds, 0 if never
+	Result    *OpResult // What OpGet read, filled in by the store on the way back
+
+	do func(op Operation) error // Carries out operations other than OpGet, OpSet, OpDelete and OpCompact, see runFunc
+}
+
+// the value an OpGet read
+type OpResult struct {
+	Value string
+	Found bool
+}
+
+// carries out an operation, by calling the rest of the interceptors and then
+// the store
+type Handler func(op Operation) error
+
+// wraps the operations passed to the store, see Store.Use
+type Interceptor func(op Operation, next Handler) error
+
+// the interceptors added with Use
+type interceptorChain struct {
+	mu   sync.Mutex
+	list []Interceptor
+	head atomic.Pointer[Handler] // The interceptors wrapped around handle, nil without any
+}
+
+// add an interceptor around every method that reads or writes values, to
+// layer logging, metrics, tracing or changes to values over the store.
+// interceptors run in the order they were added, each deciding whether to
+// call next and with what operation. only OpGet, OpSet and OpDelete can be
+// changed on the way: changes to their Key or Value carry on to the store,
+// and a Get's Result can be changed once next returns. any other operation
+// that reaches the store changed, other than its Ctx, fails with
+// ErrOperationChanged, so an interceptor changing values, like one
+// encrypting them, should fail the operations it doesn't handle itself.
+// Keys, Exists and Len, which read no values, and ApplyRecords and
+// ApplyCatchUp, which bring in writes made elsewhere, don't go through
+// interceptors.
+func (s *Store) Use(fn Interceptor) {
+	c := &s.interceptors
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.list = append(c.list, fn)
+	h := Handler(s.handle)
+	for i := len(c.list) - 1; i >= 0; i-- {
+		fn, next := c.list[i], h
+		h = func(op Operation) error {
+			return fn(op, next)
+		}
+	}
+	c.head.Store(&h)
+}
+
+// pass op through the interceptors to the store
+func (s *Store) run(op Operation) error {
+	if h := s.interceptors.head.Load(); h != nil {
+		return (*h)(op)
+	}
+	return s.handle(op)
+}
+
+// pass op through the interceptors to the store, which carries it out with
+// do. do gets the operation's Ctx as the interceptors left it.
+func (s *Store) runFunc(op Operation, do func(ctx context.Context) error) error {
+	want := op
+	want.Keys = slices.Clone(op.Keys)
+	op.do = func(got Operation) error {
+		if got.Type != want.Type || got.Key != want.Key || got.Value != want.Value ||
+			got.ExpiresAt != want.ExpiresAt || !slices.Equal(got.Keys, want.Keys) {
+			return fmt.Errorf("%v: %w", want.Type, ErrOperationChanged)
+		}
+		ctx := got.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return do(ctx)
+	}
+	return s.run(op)
+}
+
+// carry out an operation that made it through the interceptors. a write
+// fails with ctx's error if it is already done, but isn't interrupted once
+// it has started, so it is either applied in full or not at all.
+func (s *Store) handle(op Operation) error {
+	if op.do != nil {
+		return op.do(op)
+	}
+	ctx := op.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	switch op.Type {
+	case OpGet:
+		value, exists, err := s.get(ctx, op.Key)
+		if op.Result != nil {
+			*op.Result = OpResult{Value: value, Found: exists}
+		}
+		return err
+	case OpSet:
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.set(op.Key, op.Value, op.ExpiresAt)
+	case OpDelete:
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.deleteKey(op.Key)
+	case OpCompact:
+		return s.compact(ctx)
+	default:
+		return fmt.Errorf("unknown operation %v", op.Type)
+	}
+}
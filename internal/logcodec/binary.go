@@ -0,0 +1,192 @@
+package logcodec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// flags stored as a varint at the start of a binary record
+const (
+	flagDeleted uint64 = 1 << iota
+	flagCommit
+	flagExpires
+	flagTxn
+	flagEncrypted
+	flagUpdated
+	flagCreated
+	flagSeq
+	flagAppend
+	flagOp
+
+	knownFlags = flagOp<<1 - 1
+)
+
+// the size of the checksum following each payload
+const checksumSize = 4
+
+// append a record to dst in the binary format: the length of its payload as
+// a uvarint, the payload and its CRC32
+func AppendBinary(dst []byte, r Record) ([]byte, error) {
+	var flags uint64
+	if r.Deleted {
+		flags |= flagDeleted
+	}
+	if r.Commit {
+		flags |= flagCommit
+	}
+	if r.ExpiresAt != 0 {
+		flags |= flagExpires
+	}
+	if r.Txn != 0 {
+		flags |= flagTxn
+	}
+	if r.Encrypted {
+		flags |= flagEncrypted
+	}
+	if r.UpdatedAt != 0 {
+		flags |= flagUpdated
+	}
+	if r.CreatedAt != 0 {
+		flags |= flagCreated
+	}
+	if r.Seq != 0 {
+		flags |= flagSeq
+	}
+	if r.Append {
+		flags |= flagAppend
+	}
+	if r.Op != "" {
+		flags |= flagOp
+	}
+
+	payload := binary.AppendUvarint(nil, flags)
+	payload = binary.AppendUvarint(payload, uint64(len(r.Key)))
+	payload = append(payload, r.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(r.Value)))
+	payload = append(payload, r.Value...)
+	if r.ExpiresAt != 0 {
+		payload = binary.AppendVarint(payload, r.ExpiresAt)
+	}
+	if r.Txn != 0 {
+		payload = binary.AppendUvarint(payload, r.Txn)
+	}
+	if r.UpdatedAt != 0 {
+		payload = binary.AppendVarint(payload, r.UpdatedAt)
+	}
+	if r.CreatedAt != 0 {
+		payload = binary.AppendVarint(payload, r.CreatedAt)
+	}
+	if r.Seq != 0 {
+		payload = binary.AppendUvarint(payload, r.Seq)
+	}
+	if r.Op != "" {
+		payload = binary.AppendUvarint(payload, uint64(len(r.Op)))
+		payload = append(payload, r.Op...)
+	}
+
+	dst = binary.AppendUvarint(dst, uint64(len(payload)))
+	dst = append(dst, payload...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(payload)), nil
+}
+
+// decode a binary record from the bytes after its length prefix, its payload
+// followed by its checksum
+func DecodeBinary(framed []byte) (Record, error) {
+	if len(framed) < checksumSize {
+		return Record{}, errors.New("record shorter than its checksum")
+	}
+	payload, sum := framed[:len(framed)-checksumSize], framed[len(framed)-checksumSize:]
+	if binary.BigEndian.Uint32(sum) != crc32.ChecksumIEEE(payload) {
+		return Record{}, ErrChecksum
+	}
+	return decodePayload(payload)
+}
+
+func decodePayload(payload []byte) (Record, error) {
+	var r Record
+	if len(payload) == 0 {
+		return r, errors.New("empty record")
+	}
+	flags, size := binary.Uvarint(payload)
+	if size <= 0 {
+		return r, errors.New("error decoding flags")
+	}
+	if flags&^knownFlags != 0 {
+		return r, fmt.Errorf("unknown flags %#x", flags)
+	}
+	buf := payload[size:]
+
+	readBytes := func() (string, error) {
+		n, size := binary.Uvarint(buf)
+		if size <= 0 || n > uint64(len(buf)-size) {
+			return "", errors.New("invalid length")
+		}
+		str := string(buf[size : size+int(n)])
+		buf = buf[size+int(n):]
+		return str, nil
+	}
+	readVarint := func(what string) (int64, error) {
+		v, size := binary.Varint(buf)
+		if size <= 0 {
+			return 0, fmt.Errorf("error decoding %s", what)
+		}
+		buf = buf[size:]
+		return v, nil
+	}
+	readUvarint := func(what string) (uint64, error) {
+		v, size := binary.Uvarint(buf)
+		if size <= 0 {
+			return 0, fmt.Errorf("error decoding %s", what)
+		}
+		buf = buf[size:]
+		return v, nil
+	}
+
+	var err error
+	if r.Key, err = readBytes(); err != nil {
+		return r, fmt.Errorf("error decoding key: %w", err)
+	}
+	if r.Value, err = readBytes(); err != nil {
+		return r, fmt.Errorf("error decoding value: %w", err)
+	}
+	if flags&flagExpires != 0 {
+		if r.ExpiresAt, err = readVarint("expiration"); err != nil {
+			return r, err
+		}
+	}
+	if flags&flagTxn != 0 {
+		if r.Txn, err = readUvarint("transaction ID"); err != nil {
+			return r, err
+		}
+	}
+	if flags&flagUpdated != 0 {
+		if r.UpdatedAt, err = readVarint("update time"); err != nil {
+			return r, err
+		}
+	}
+	if flags&flagCreated != 0 {
+		if r.CreatedAt, err = readVarint("creation time"); err != nil {
+			return r, err
+		}
+	}
+	if flags&flagSeq != 0 {
+		if r.Seq, err = readUvarint("sequence number"); err != nil {
+			return r, err
+		}
+	}
+	if flags&flagOp != 0 {
+		if r.Op, err = readBytes(); err != nil {
+			return r, fmt.Errorf("error decoding operation: %w", err)
+		}
+	}
+	if len(buf) != 0 {
+		return r, errors.New("trailing bytes in record")
+	}
+	r.Deleted = flags&flagDeleted != 0
+	r.Commit = flags&flagCommit != 0
+	r.Append = flags&flagAppend != 0
+	r.Encrypted = flags&flagEncrypted != 0
+	return r, nil
+}
@@ -0,0 +1,69 @@
+// Package logcodec encodes and decodes the records of a store's log file, in
+// the JSON and binary formats. decoding never trusts its input: lengths are
+// checked before they are used, checksums cover the bytes as written, and
+// anything the decoder doesn't understand, like a field written by a newer
+// version, fails the record instead of being dropped from it.
+//
+// it knows nothing about encryption. an encrypted record carries its sealed
+// value, which the store opens itself.
+package logcodec
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// returned for records whose checksum doesn't match their contents
+var ErrChecksum = errors.New("checksum mismatch")
+
+// a single record of the log, the fields of keyvalue.Entry plus whether the
+// value is encrypted
+type Record struct {
+	Key       string
+	Value     string // Sealed value if Encrypted is set
+	Deleted   bool
+	Append    bool
+	Op        string
+	ExpiresAt int64
+	Txn       uint64
+	Commit    bool
+	Seq       uint64
+	CreatedAt int64
+	UpdatedAt int64
+	Encrypted bool
+}
+
+// value encodings, stored alongside strings that aren't plain text
+const (
+	encBase64    = "base64"
+	encEncrypted = "aes-gcm" // Base64 of a sealed value, only for values
+)
+
+// a string as JSON can hold it and how it is encoded. JSON strings replace
+// bytes that aren't valid UTF-8, so such strings are base64 encoded instead.
+// newlines and other control characters are escaped by encoding/json, so a
+// record stays on a single line.
+func EncodeString(s string) (string, string) {
+	if utf8.ValidString(s) {
+		return s, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(s)), encBase64
+}
+
+// undo EncodeString
+func DecodeString(s, enc string) (string, error) {
+	switch enc {
+	case "":
+		return s, nil
+	case encBase64:
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", enc)
+	}
+}
@@ -0,0 +1,125 @@
+package logcodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// a JSON log line. the checksum and encodings are optional, so logs written
+// before they were added still load and are appended to as they are.
+type jsonRecord struct {
+	Key       *string `json:"key"` // A pointer to tell lines without a key apart
+	Value     string  `json:"value,omitempty"`
+	Deleted   bool    `json:"deleted,omitempty"`
+	Append    bool    `json:"append,omitempty"`
+	Op        string  `json:"op,omitempty"`
+	ExpiresAt int64   `json:"expires_at,omitempty"`
+	Txn       uint64  `json:"txn,omitempty"`
+	Commit    bool    `json:"commit,omitempty"`
+	Seq       uint64  `json:"seq,omitempty"`
+	CreatedAt int64   `json:"created_at,omitempty"`
+	UpdatedAt int64   `json:"updated_at,omitempty"`
+	Enc       string  `json:"enc,omitempty"`     // How Value is encoded, "base64" for binary values or "aes-gcm" for encrypted ones
+	KeyEnc    string  `json:"key_enc,omitempty"` // How Key is encoded, "base64" for binary keys
+}
+
+// the last field of a checksummed line
+var crcField = []byte(`,"crc":`)
+
+// append a record to dst as a JSON line, ending in a newline. the checksum
+// covers the line as encoded without it, and is spliced in as a last field
+// so each line stays plain JSON.
+func AppendJSON(dst []byte, r Record) ([]byte, error) {
+	key, keyEnc := EncodeString(r.Key)
+	record := jsonRecord{
+		Key:       &key,
+		KeyEnc:    keyEnc,
+		Deleted:   r.Deleted,
+		Append:    r.Append,
+		Op:        r.Op,
+		ExpiresAt: r.ExpiresAt,
+		Txn:       r.Txn,
+		Commit:    r.Commit,
+		Seq:       r.Seq,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+	}
+	if r.Encrypted {
+		record.Value = base64.StdEncoding.EncodeToString([]byte(r.Value))
+		record.Enc = encEncrypted
+	} else {
+		record.Value, record.Enc = EncodeString(r.Value)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return dst, fmt.Errorf("error encoding JSON: %w", err)
+	}
+	sum := crc32.ChecksumIEEE(data)
+	dst = append(dst, data[:len(data)-1]...)
+	dst = append(dst, crcField...)
+	dst = strconv.AppendUint(dst, uint64(sum), 10)
+	return append(dst, '}', '\n'), nil
+}
+
+// decode a JSON log line without its line ending. a line with a checksum
+// must match it byte for byte, and fields the record doesn't have, trailing
+// data and lines that aren't objects with a key are errors.
+func DecodeJSON(line []byte) (Record, error) {
+	body := line
+	if i := bytes.LastIndex(line, crcField); i >= 0 {
+		digits, ok := bytes.CutSuffix(line[i+len(crcField):], []byte("}"))
+		sum, err := strconv.ParseUint(string(digits), 10, 32)
+		if !ok || err != nil {
+			return Record{}, errors.New("malformed checksum")
+		}
+		// the checksummed bytes are the line with the field cut out, which
+		// can't be done in place since line may be reused by the caller
+		body = make([]byte, 0, i+1)
+		body = append(append(body, line[:i]...), '}')
+		if crc32.ChecksumIEEE(body) != uint32(sum) {
+			return Record{}, ErrChecksum
+		}
+	}
+
+	var record jsonRecord
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&record); err != nil {
+		return Record{}, err
+	}
+	if dec.More() {
+		return Record{}, errors.New("trailing data after record")
+	}
+	if record.Key == nil {
+		return Record{}, errors.New("record has no key")
+	}
+
+	r := Record{
+		Deleted:   record.Deleted,
+		Append:    record.Append,
+		Op:        record.Op,
+		ExpiresAt: record.ExpiresAt,
+		Txn:       record.Txn,
+		Commit:    record.Commit,
+		Seq:       record.Seq,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+	}
+	var err error
+	if r.Key, err = DecodeString(*record.Key, record.KeyEnc); err != nil {
+		return Record{}, fmt.Errorf("error decoding key: %w", err)
+	}
+	if record.Enc == encEncrypted {
+		record.Enc = encBase64
+		r.Encrypted = true
+	}
+	if r.Value, err = DecodeString(record.Value, record.Enc); err != nil {
+		return Record{}, fmt.Errorf("error decoding value: %w", err)
+	}
+	return r, nil
+}
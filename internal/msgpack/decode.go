@@ -0,0 +1,641 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// returned by the read methods for a value of another type than they read,
+// which decode turns into an error naming both
+var errWrongType = errors.New("msgpack: wrong type")
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// decode the MessagePack value in data into v, which must be a non-nil
+// pointer. values decoded into an empty interface are nil, bool, int64,
+// uint64 above math.MaxInt64, float64, string, []byte, []any, map[string]any,
+// map[any]any if not every key is a string, or time.Time.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal needs a non-nil pointer, not %T", v)
+	}
+	d := &decoder{data: data}
+	if err := d.decode(rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d bytes after the value", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+// decode the next value into v
+func (d *decoder) decode(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errDepth
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == codeNil {
+		d.pos++
+		v.SetZero()
+		return nil
+	}
+	err = d.decodeValue(v, c, depth)
+	if errors.Is(err, errWrongType) {
+		return fmt.Errorf("msgpack: cannot decode %s into %s", describe(c), v.Type())
+	}
+	return err
+}
+
+// decode the next value, which starts with code c and isn't nil, into v
+func (d *decoder) decodeValue(v reflect.Value, c byte, depth int) error {
+	t := v.Type()
+	if t == timeType {
+		tm, err := d.readTime()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.decode(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return errWrongType
+		}
+		x, err := d.decodeAny(depth + 1)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+	case reflect.Bool:
+		b, err := d.readBool()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, t)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := d.readUint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, t)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := d.readFloat()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(bytes.Clone(b))
+			return nil
+		}
+		n, err := d.readArrayLen()
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		for i := range n {
+			if err := d.decode(s.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		return d.decodeArray(v, c, depth)
+	case reflect.Map:
+		return d.decodeMap(v, depth)
+	case reflect.Struct:
+		return d.decodeStruct(v, depth)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+// decode an array, or binary data into a byte array. elements beyond the
+// length of v are dropped, and those missing are zeroed.
+func (d *decoder) decodeArray(v reflect.Value, c byte, depth int) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 && isBytes(c) {
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		for i := range v.Len() {
+			if i < len(b) {
+				v.Index(i).SetUint(uint64(b[i]))
+			} else {
+				v.Index(i).SetZero()
+			}
+		}
+		return nil
+	}
+
+	n, err := d.readArrayLen()
+	if err != nil {
+		return err
+	}
+	for i := range n {
+		if i >= v.Len() {
+			if _, err := d.decodeAny(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	for i := n; i < v.Len(); i++ {
+		v.Index(i).SetZero()
+	}
+	return nil
+}
+
+// decode a map into v, adding to it if it isn't nil
+func (d *decoder) decodeMap(v reflect.Value, depth int) error {
+	n, err := d.readMapLen()
+	if err != nil {
+		return err
+	}
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+	for range n {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decode(key, depth+1); err != nil {
+			return err
+		}
+		if !key.Comparable() {
+			return fmt.Errorf("msgpack: map key of type %s isn't comparable", key.Elem().Type())
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decode(elem, depth+1); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+// decode a map into the fields of a struct by name, skipping keys that
+// aren't the name of a field
+func (d *decoder) decodeStruct(v reflect.Value, depth int) error {
+	n, err := d.readMapLen()
+	if err != nil {
+		return err
+	}
+	info := structFields(v.Type())
+	for range n {
+		if _, err := d.peek(); err != nil {
+			return err
+		}
+		name, err := d.readBytes()
+		if errors.Is(err, errWrongType) {
+			return fmt.Errorf("msgpack: struct %s needs string keys", v.Type())
+		}
+		if err != nil {
+			return err
+		}
+		i, ok := info.byName[string(name)]
+		if !ok {
+			if _, err := d.decodeAny(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.FieldByIndex(info.fields[i].index), depth+1); err != nil {
+			return fmt.Errorf("%w in field %s", err, name)
+		}
+	}
+	return nil
+}
+
+// decode the next value into the types listed for Unmarshal
+func (d *decoder) decodeAny(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errDepth
+	}
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == codeNil:
+		d.pos++
+		return nil, nil
+	case c == codeTrue || c == codeFalse:
+		d.pos++
+		return c == codeTrue, nil
+	case c == codeFloat32 || c == codeFloat64:
+		f, err := d.readFloat()
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case c >= codeUint8 && c <= codeUint64:
+		n, err := d.readUint()
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case c <= 0x7f || c >= negFix || (c >= codeInt8 && c <= codeInt64):
+		n, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case isBytes(c):
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if c >= codeBin8 && c <= codeBin32 {
+			return bytes.Clone(b), nil
+		}
+		return string(b), nil
+	case c&0xf0 == fixArray || c == codeArray16 || c == codeArray32:
+		n, err := d.readArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		s := make([]any, n)
+		for i := range s {
+			if s[i], err = d.decodeAny(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case c&0xf0 == fixMap || c == codeMap16 || c == codeMap32:
+		return d.decodeAnyMap(depth)
+	case (c >= codeFixExt1 && c <= codeFixExt16) || (c >= codeExt8 && c <= codeExt32):
+		return d.readTime()
+	}
+	return nil, fmt.Errorf("msgpack: unknown type code 0x%02x", c)
+}
+
+// decode a map into a map[string]any, or a map[any]any if not every key is
+// a string
+func (d *decoder) decodeAnyMap(depth int) (any, error) {
+	n, err := d.readMapLen()
+	if err != nil {
+		return nil, err
+	}
+	keys, values := make([]any, n), make([]any, n)
+	allStrings := true
+	for i := range n {
+		if keys[i], err = d.decodeAny(depth + 1); err != nil {
+			return nil, err
+		}
+		if values[i], err = d.decodeAny(depth + 1); err != nil {
+			return nil, err
+		}
+		if _, ok := keys[i].(string); !ok {
+			allStrings = false
+		}
+	}
+
+	if allStrings {
+		m := make(map[string]any, n)
+		for i, key := range keys {
+			m[key.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[any]any, n)
+	for i, key := range keys {
+		if key != nil && !reflect.ValueOf(key).Comparable() {
+			return nil, fmt.Errorf("msgpack: map key of type %T isn't comparable", key)
+		}
+		m[key] = values[i]
+	}
+	return m, nil
+}
+
+// the next byte without consuming it
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, ErrTruncated
+	}
+	return d.data[d.pos], nil
+}
+
+// consume the next n bytes
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// consume a big-endian unsigned integer of size bytes
+func (d *decoder) readUintN(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// the read methods below expect a byte to be left, see peek
+
+func (d *decoder) readBool() (bool, error) {
+	switch d.data[d.pos] {
+	case codeTrue:
+		d.pos++
+		return true, nil
+	case codeFalse:
+		d.pos++
+		return false, nil
+	}
+	return false, errWrongType
+}
+
+func (d *decoder) readInt() (int64, error) {
+	c := d.data[d.pos]
+	switch {
+	case c <= 0x7f:
+		d.pos++
+		return int64(c), nil
+	case c >= negFix:
+		d.pos++
+		return int64(int8(c)), nil
+	case c >= codeInt8 && c <= codeInt64:
+		d.pos++
+		size := 1 << (c - codeInt8)
+		n, err := d.readUintN(size)
+		if err != nil {
+			return 0, err
+		}
+		// sign extend
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case c >= codeUint8 && c <= codeUint64:
+		n, err := d.readUint()
+		if err != nil {
+			return 0, err
+		}
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("msgpack: %d overflows int64", n)
+		}
+		return int64(n), nil
+	}
+	return 0, errWrongType
+}
+
+func (d *decoder) readUint() (uint64, error) {
+	c := d.data[d.pos]
+	if c >= codeUint8 && c <= codeUint64 {
+		d.pos++
+		return d.readUintN(1 << (c - codeUint8))
+	}
+	n, err := d.readInt()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("msgpack: %d overflows an unsigned integer", n)
+	}
+	return uint64(n), nil
+}
+
+// consume a float, or an integer as a float
+func (d *decoder) readFloat() (float64, error) {
+	switch c := d.data[d.pos]; c {
+	case codeFloat32:
+		d.pos++
+		n, err := d.readUintN(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case codeFloat64:
+		d.pos++
+		n, err := d.readUintN(8)
+		return math.Float64frombits(n), err
+	case codeUint8, codeUint16, codeUint32, codeUint64:
+		n, err := d.readUint()
+		return float64(n), err
+	}
+	n, err := d.readInt()
+	return float64(n), err
+}
+
+// consume a string or binary data, returning its bytes in data
+func (d *decoder) readBytes() ([]byte, error) {
+	c := d.data[d.pos]
+	var n uint64
+	var err error
+	switch {
+	case c&0xe0 == fixStr:
+		d.pos++
+		n = uint64(c & 0x1f)
+	case c == codeStr8 || c == codeBin8:
+		d.pos++
+		n, err = d.readUintN(1)
+	case c == codeStr16 || c == codeBin16:
+		d.pos++
+		n, err = d.readUintN(2)
+	case c == codeStr32 || c == codeBin32:
+		d.pos++
+		n, err = d.readUintN(4)
+	default:
+		return nil, errWrongType
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, ErrTruncated
+	}
+	return d.read(int(n))
+}
+
+// consume an array header, returning its length. every element takes at
+// least a byte, so a length longer than the data left fails.
+func (d *decoder) readArrayLen() (int, error) {
+	c := d.data[d.pos]
+	var n uint64
+	var err error
+	switch {
+	case c&0xf0 == fixArray:
+		d.pos++
+		n = uint64(c & 0x0f)
+	case c == codeArray16:
+		d.pos++
+		n, err = d.readUintN(2)
+	case c == codeArray32:
+		d.pos++
+		n, err = d.readUintN(4)
+	default:
+		return 0, errWrongType
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, ErrTruncated
+	}
+	return int(n), nil
+}
+
+// consume a map header, returning its number of pairs, see readArrayLen
+func (d *decoder) readMapLen() (int, error) {
+	c := d.data[d.pos]
+	var n uint64
+	var err error
+	switch {
+	case c&0xf0 == fixMap:
+		d.pos++
+		n = uint64(c & 0x0f)
+	case c == codeMap16:
+		d.pos++
+		n, err = d.readUintN(2)
+	case c == codeMap32:
+		d.pos++
+		n, err = d.readUintN(4)
+	default:
+		return 0, errWrongType
+	}
+	if err != nil {
+		return 0, err
+	}
+	if 2*n > uint64(len(d.data)-d.pos) {
+		return 0, ErrTruncated
+	}
+	return int(n), nil
+}
+
+// consume a timestamp extension
+func (d *decoder) readTime() (time.Time, error) {
+	c := d.data[d.pos]
+	var n uint64
+	var err error
+	switch {
+	case c >= codeFixExt1 && c <= codeFixExt16:
+		d.pos++
+		n = 1 << (c - codeFixExt1)
+	case c == codeExt8:
+		d.pos++
+		n, err = d.readUintN(1)
+	case c == codeExt16:
+		d.pos++
+		n, err = d.readUintN(2)
+	case c == codeExt32:
+		d.pos++
+		n, err = d.readUintN(4)
+	default:
+		return time.Time{}, errWrongType
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	typ, err := d.read(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return time.Time{}, ErrTruncated
+	}
+	data, _ := d.read(int(n))
+	if typ[0] != extTime {
+		return time.Time{}, fmt.Errorf("msgpack: unsupported extension type %d", int8(typ[0]))
+	}
+
+	var sec, nsec int64
+	switch len(data) {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(data))
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		sec, nsec = int64(v&(1<<34-1)), int64(v>>34)
+	case 12:
+		nsec = int64(binary.BigEndian.Uint32(data))
+		sec = int64(binary.BigEndian.Uint64(data[4:]))
+	default:
+		return time.Time{}, fmt.Errorf("msgpack: timestamp of %d bytes", len(data))
+	}
+	if nsec > 999999999 {
+		return time.Time{}, errors.New("msgpack: timestamp nanoseconds out of range")
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// whether c starts a string or binary data
+func isBytes(c byte) bool {
+	return c&0xe0 == fixStr || (c >= codeStr8 && c <= codeStr32) || (c >= codeBin8 && c <= codeBin32)
+}
+
+// the kind of value code c starts, for errors
+func describe(c byte) string {
+	switch {
+	case c == codeNil:
+		return "nil"
+	case c == codeTrue || c == codeFalse:
+		return "a bool"
+	case c == codeFloat32 || c == codeFloat64:
+		return "a float"
+	case c <= 0x7f || c >= negFix || (c >= codeUint8 && c <= codeInt64):
+		return "an integer"
+	case c >= codeBin8 && c <= codeBin32:
+		return "binary data"
+	case isBytes(c):
+		return "a string"
+	case c&0xf0 == fixArray || c == codeArray16 || c == codeArray32:
+		return "an array"
+	case c&0xf0 == fixMap || c == codeMap16 || c == codeMap32:
+		return "a map"
+	case (c >= codeFixExt1 && c <= codeFixExt16) || (c >= codeExt8 && c <= codeExt32):
+		return "an extension"
+	}
+	return fmt.Sprintf("type code 0x%02x", c)
+}
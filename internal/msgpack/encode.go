@@ -0,0 +1,264 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+type encoder struct {
+	buf []byte
+}
+
+// encode v as MessagePack
+func Marshal(v any) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (e *encoder) encode(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errDepth
+	}
+	if !v.IsValid() {
+		e.buf = append(e.buf, codeNil)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, codeTrue)
+		} else {
+			e.buf = append(e.buf, codeFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, codeFloat32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, codeFloat64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		return e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, codeNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(v.Bytes())
+		}
+		return e.encodeArray(v, depth)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			for i := range b {
+				b[i] = byte(v.Index(i).Uint())
+			}
+			return e.encodeBytes(b)
+		}
+		return e.encodeArray(v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, codeNil)
+			return nil
+		}
+		return e.encodeMap(v, depth)
+	case reflect.Struct:
+		return e.encodeStruct(v, depth)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, codeNil)
+			return nil
+		}
+		return e.encode(v.Elem(), depth+1)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// append the header of a string, binary, array or map of length n: a fixed
+// size code holding the length up to fixMax, or the smallest of the codes
+// followed by an 8, 16 or 32 bit length. code8 is 0 for types without one.
+func (e *encoder) header(n int, fix byte, fixMax int, code8, code16, code32 byte) error {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case uint64(n) <= math.MaxUint32:
+		e.buf = append(e.buf, code32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		return errLength
+	}
+	return nil
+}
+
+// append n in the smallest encoding that holds it
+func (e *encoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, codeInt8, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, codeInt16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, codeInt32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, codeInt64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(n))
+	}
+}
+
+func (e *encoder) encodeUint(n uint64) {
+	switch {
+	case n <= math.MaxInt8:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, codeUint8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, codeUint16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, codeUint32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, codeUint64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+	}
+}
+
+func (e *encoder) encodeString(s string) error {
+	if err := e.header(len(s), fixStr, 31, codeStr8, codeStr16, codeStr32); err != nil {
+		return err
+	}
+	e.buf = append(e.buf, s...)
+	return nil
+}
+
+func (e *encoder) encodeBytes(b []byte) error {
+	if err := e.header(len(b), 0, -1, codeBin8, codeBin16, codeBin32); err != nil {
+		return err
+	}
+	e.buf = append(e.buf, b...)
+	return nil
+}
+
+func (e *encoder) encodeArray(v reflect.Value, depth int) error {
+	if err := e.header(v.Len(), fixArray, 15, 0, codeArray16, codeArray32); err != nil {
+		return err
+	}
+	for i := range v.Len() {
+		if err := e.encode(v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append a map with its pairs sorted by key if the keys are strings, by
+// encoded key otherwise
+func (e *encoder) encodeMap(v reflect.Value, depth int) error {
+	type pair struct {
+		key   []byte
+		value reflect.Value
+		str   string
+	}
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var key encoder
+		if err := key.encode(iter.Key(), depth+1); err != nil {
+			return err
+		}
+		p := pair{key: key.buf, value: iter.Value()}
+		if iter.Key().Kind() == reflect.String {
+			p.str = iter.Key().String()
+		}
+		pairs = append(pairs, p)
+	}
+	byString := v.Type().Key().Kind() == reflect.String
+	sort.Slice(pairs, func(i, j int) bool {
+		if byString {
+			return pairs[i].str < pairs[j].str
+		}
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+
+	if err := e.header(len(pairs), fixMap, 15, 0, codeMap16, codeMap32); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		e.buf = append(e.buf, p.key...)
+		if err := e.encode(p.value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append a struct as a map of its fields by name
+func (e *encoder) encodeStruct(v reflect.Value, depth int) error {
+	info := structFields(v.Type())
+	fields := make([]field, 0, len(info.fields))
+	for _, f := range info.fields {
+		if !f.omitEmpty || !v.FieldByIndex(f.index).IsZero() {
+			fields = append(fields, f)
+		}
+	}
+
+	if err := e.header(len(fields), fixMap, 15, 0, codeMap16, codeMap32); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := e.encodeString(f.name); err != nil {
+			return err
+		}
+		if err := e.encode(v.FieldByIndex(f.index), depth+1); err != nil {
+			return fmt.Errorf("%w in field %s", err, f.name)
+		}
+	}
+	return nil
+}
+
+// append t as a timestamp extension, in the smallest of its three sizes
+func (e *encoder) encodeTime(t time.Time) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec>>32 == 0 && nsec == 0:
+		e.buf = append(e.buf, codeFixExt4, extTime)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(sec))
+	case sec>>34 == 0:
+		e.buf = append(e.buf, codeFixExt8, extTime)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, nsec<<34|uint64(sec))
+	default:
+		e.buf = append(e.buf, codeExt8, 12, extTime)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(nsec))
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(sec))
+	}
+}
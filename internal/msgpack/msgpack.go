@@ -0,0 +1,144 @@
+// Package msgpack encodes Go values as MessagePack and decodes them back,
+// for keyvalue.MsgpackCodec. it covers what a stored value needs: nil,
+// booleans, numbers, strings, byte slices, slices, arrays, maps, structs,
+// pointers and time.Time, which uses the timestamp extension.
+//
+// structs are encoded as maps keyed by field name, or by the name in a
+// `msgpack:"name"` tag. "-" leaves a field out, and ",omitempty" leaves it out
+// when it holds its zero value. the fields of embedded structs are encoded as
+// if they were the outer struct's. maps are encoded with their keys sorted,
+// so equal values always encode to the same bytes.
+//
+// like the log codecs, decoding never trusts its input: lengths are checked
+// against the data left before anything is allocated for them, and data
+// after the value fails it.
+package msgpack
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// type codes, see the MessagePack specification
+const (
+	codeNil      = 0xc0
+	codeFalse    = 0xc2
+	codeTrue     = 0xc3
+	codeBin8     = 0xc4
+	codeBin16    = 0xc5
+	codeBin32    = 0xc6
+	codeExt8     = 0xc7
+	codeExt16    = 0xc8
+	codeExt32    = 0xc9
+	codeFloat32  = 0xca
+	codeFloat64  = 0xcb
+	codeUint8    = 0xcc
+	codeUint16   = 0xcd
+	codeUint32   = 0xce
+	codeUint64   = 0xcf
+	codeInt8     = 0xd0
+	codeInt16    = 0xd1
+	codeInt32    = 0xd2
+	codeInt64    = 0xd3
+	codeFixExt1  = 0xd4
+	codeFixExt4  = 0xd6
+	codeFixExt8  = 0xd7
+	codeFixExt16 = 0xd8
+	codeStr8     = 0xd9
+	codeStr16    = 0xda
+	codeStr32    = 0xdb
+	codeArray16  = 0xdc
+	codeArray32  = 0xdd
+	codeMap16    = 0xde
+	codeMap32    = 0xdf
+
+	fixMap   = 0x80 // Up to 15 pairs, the count in the low bits
+	fixArray = 0x90 // Up to 15 elements
+	fixStr   = 0xa0 // Up to 31 bytes
+	negFix   = 0xe0 // -32 to -1
+)
+
+// extension type of timestamps, -1 as a byte
+const extTime = 0xff
+
+// values nested deeper than this fail, so hostile input can't exhaust the
+// stack
+const maxDepth = 1000
+
+// returned when the data ends in the middle of a value
+var ErrTruncated = errors.New("msgpack: data ends in the middle of a value")
+
+var (
+	timeType  = reflect.TypeFor[time.Time]()
+	errDepth  = errors.New("msgpack: value nested too deeply")
+	errLength = errors.New("msgpack: length too large")
+)
+
+// a struct field as it is encoded
+type field struct {
+	name      string
+	index     []int // Path to the field through embedded structs
+	omitEmpty bool
+}
+
+// the encoded fields of a struct type
+type structInfo struct {
+	fields []field
+	byName map[string]int // Index into fields
+}
+
+var structCache sync.Map // reflect.Type to *structInfo
+
+// the fields of struct type t, in the order they are declared. a field of an
+// outer struct hides one of the same name in a struct it embeds.
+func structFields(t reflect.Type) *structInfo {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{byName: make(map[string]int)}
+	for _, f := range collectFields(t, nil) {
+		if i, ok := info.byName[f.name]; ok {
+			if len(f.index) < len(info.fields[i].index) {
+				info.fields[i] = f
+			}
+			continue
+		}
+		info.byName[f.name] = len(info.fields)
+		info.fields = append(info.fields, f)
+	}
+	structCache.Store(t, info)
+	return info
+}
+
+// the fields of t and of the exported structs it embeds without a tag
+func collectFields(t reflect.Type, index []int) []field {
+	var fields []field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("msgpack")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		path := append(slices.Clone(index), i)
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct && sf.Type != timeType {
+			if sf.IsExported() {
+				fields = append(fields, collectFields(sf.Type, path)...)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		omitEmpty := slices.Contains(strings.Split(opts, ","), "omitempty")
+		fields = append(fields, field{name: name, index: path, omitEmpty: omitEmpty})
+	}
+	return fields
+}
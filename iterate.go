@@ -0,0 +1,104 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"time"
+)
+
+// call fn for every key-value pair in the store until it returns false,
+// without collecting them first. keys are visited in sorted order in memory
+// mode and in log order in file-only mode. the store is read locked while
+// iterating, so fn must not modify it.
+func (s *Store) Iterate(fn func(key, value string) bool) error {
+	return s.IterateCtx(context.Background(), fn)
+}
+
+// like Iterate, but stops with ctx's error once it is done
+func (s *Store) IterateCtx(ctx context.Context, fn func(key, value string) bool) error {
+	return s.runFunc(Operation{Type: OpScan, Ctx: ctx}, func(ctx context.Context) error {
+		return s.iterate(ctx, fn)
+	})
+}
+
+func (s *Store) iterate(ctx context.Context, fn func(key, value string) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	if s.useMemory {
+		for _, key := range s.prefixRange("") {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry, ok := s.memLookup(key, now)
+			if ok && !fn(key, entry.Value) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	return s.scanFile(ctx, fn)
+}
+
+// call fn with the current value of every live key in the log until it
+// returns false, reading the log even in memory mode. keys are visited in
+// the order their latest records were written, and values are streamed
+// rather than collected. the store is read locked while scanning, so fn must
+// not modify it.
+func (s *Store) ScanFile(fn func(key, value string) bool) error {
+	return s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(ctx context.Context) error {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		return s.scanFile(ctx, fn)
+	})
+}
+
+// stream the live keys in the log, see ScanFile, stopping with ctx's error
+// once it is done. the caller must hold at least the read lock.
+func (s *Store) scanFile(ctx context.Context, fn func(key, value string) bool) error {
+	// the first pass finds the record that holds the final state of each key
+	// so only keys, not values, are kept in memory. the second pass streams
+	// those records.
+	now := time.Now().UnixNano()
+	last := make(map[string]int)
+	n := 0
+	err := s.replayContext(ctx, func(entry Entry) bool {
+		if entry.Deleted || entry.expired(now) {
+			delete(last, entry.Key)
+		} else {
+			last[entry.Key] = n
+		}
+		n++
+		return true
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+
+	n = 0
+	err = s.replayContext(ctx, func(entry Entry) bool {
+		i, ok := last[entry.Key]
+		n++
+		if !ok || i != n-1 {
+			return true
+		}
+		return fn(entry.Key, entry.Value)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+	return nil
+}
+
+// an iterator over every key-value pair in the store, see Iterate
+func (s *Store) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if err := s.Iterate(yield); err != nil {
+			s.logger.Error("error iterating store", "err", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package keyvalue
+
+import "sync"
+
+// locks on single keys handed out by LockKey. a key's lock only exists while
+// it is held or waited for.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu      sync.Mutex
+	waiters int // Holders and waiters, the lock is dropped once none are left
+}
+
+// lock a key against other LockKey callers, so a multi-step operation on it,
+// like reading a value and writing one computed from it, isn't interleaved
+// with another one. the lock is advisory: it doesn't block the store's own
+// methods, and other keys and the rest of the store stay available while it
+// is held. call the returned function to unlock, which is safe to call more
+// than once.
+func (s *Store) LockKey(key string) func() {
+	return s.keyLocks.lock(s.normalize(key))
+}
+
+// run fn while holding the lock on key, see LockKey, and return its error
+func (s *Store) WithKeyLock(key string, fn func() error) error {
+	unlock := s.LockKey(key)
+	defer unlock()
+	return fn()
+}
+
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.waiters++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Unlock()
+			k.mu.Lock()
+			if l.waiters--; l.waiters == 0 {
+				delete(k.locks, key)
+			}
+			k.mu.Unlock()
+		})
+	}
+}
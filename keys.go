@@ -0,0 +1,151 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// checks a key before it is written, see StoreConfig.ValidateKey. the error
+// is returned from the write, so it should wrap ErrInvalidKey.
+type KeyValidator func(key string) error
+
+// rewrites a key before the store uses it, see StoreConfig.NormalizeKey.
+// keys already in the log aren't rewritten, so the store should be normalized
+// from the start or keys written before can't be reached. prefixes, like the
+// one passed to Keys, are used as they are.
+type KeyNormalizer func(key string) string
+
+// a KeyValidator rejecting empty keys and keys with control characters like
+// newlines, which tools reading the log line by line trip over
+func RejectControlChars(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	for i, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: control character %U at byte %d", ErrInvalidKey, r, i)
+		}
+	}
+	return nil
+}
+
+// check a key against the configured validator, see StoreConfig.ValidateKey
+func (s *Store) checkKey(key string) error {
+	if s.validateKey == nil {
+		return nil
+	}
+	if err := s.validateKey(key); err != nil {
+		return fmt.Errorf("%q: %w", key, err)
+	}
+	return nil
+}
+
+// apply the configured normalization to a key passed to the store, see
+// StoreConfig.NormalizeKey
+func (s *Store) normalize(key string) string {
+	if s.normalizeKey == nil {
+		return key
+	}
+	return s.normalizeKey(key)
+}
+
+// the key the store uses for key, with StoreConfig.NormalizeKey applied.
+// records passed to ApplyRecords are used as they are, so their keys should
+// go through it first.
+func (s *Store) NormalizeKey(key string) string {
+	return s.normalize(key)
+}
+
+// list the keys in the store in sorted order. if prefix isn't empty only keys
+// starting with it are returned.
+func (s *Store) Keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	if s.useMemory {
+		now := time.Now().UnixNano()
+		for _, key := range s.prefixRange(prefix) {
+			if _, ok := s.memLookup(key, now); ok {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	entries, err := s.liveEntries(context.Background())
+	if err != nil {
+		s.logger.Error("error listing keys", "err", err)
+		return nil
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Key, prefix) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	return keys
+}
+
+// count the keys in the store
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.useMemory {
+		return len(s.memEntries(time.Now().UnixNano()))
+	}
+
+	entries, err := s.liveEntries(context.Background())
+	if err != nil {
+		s.logger.Error("error counting keys", "err", err)
+		return 0
+	}
+	return len(entries)
+}
+
+// report whether a key exists. in file-only mode the index and bloom filter
+// answer without reading the log when the store keeps them.
+func (s *Store) Exists(key string) bool {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var exists bool
+	switch {
+	case s.useMemory:
+		_, exists = s.memLookup(key, now)
+	case s.bloom != nil && !s.bloom.mayContain(key):
+	case s.index != nil:
+		pos, ok := s.index[key]
+		exists = ok && (pos.expiresAt == 0 || pos.expiresAt > now)
+	default:
+		var err error
+		if _, exists, err = s.lookupScan(context.Background(), key, now); err != nil {
+			s.logger.Error("error reading log file", "key", key, "err", err)
+			return false
+		}
+	}
+	s.counters.read(exists)
+	return exists
+}
+
+// count the key-value pairs fn returns true for, without collecting them.
+// see Iterate for the order they are visited in.
+func (s *Store) Count(fn func(k, v string) bool) int {
+	n := 0
+	err := s.Iterate(func(key, value string) bool {
+		if fn(key, value) {
+			n++
+		}
+		return true
+	})
+	if err != nil {
+		s.logger.Error("error counting keys", "err", err)
+		return 0
+	}
+	return n
+}
@@ -2,261 +2,1232 @@ package keyvalue
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// a key-value pair, with optional delete flag.
+// a key-value pair, with optional delete flag and expiration time. entries
+// written by a transaction carry its ID and are followed by a commit record.
 type Entry struct {
-	Key     string `json:"key"`
-	Value   string `json:"value,omitempty"`
-	Deleted bool   `json:"deleted,omitempty"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Append    bool   `json:"append,omitempty"`     // Value is appended to the key's value rather than replacing it
+	Op        string `json:"op,omitempty"`         // List, set or hash operation applied to the key's value with the arguments in Value, see Store.LPush, Store.SAdd and Store.HSet
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix nanoseconds, 0 means never
+	Txn       uint64 `json:"txn,omitempty"`        // Transaction the entry belongs to
+	Commit    bool   `json:"commit,omitempty"`     // Marks the commit record of Txn
+	Seq       uint64 `json:"seq,omitempty"`        // Sequence number of the record, increasing through the log, 0 if unknown
+	CreatedAt int64  `json:"created_at,omitempty"` // When the key was last created in Unix nanoseconds, 0 if unknown
+	UpdatedAt int64  `json:"updated_at,omitempty"` // When the record was written in Unix nanoseconds, 0 if unknown
+}
+
+// report whether the entry has an expiration time that has passed
+func (e Entry) expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
 }
 
 type Store struct {
-	mu           sync.RWMutex
-	data         map[string]string // Optional in-memory storage
-	useMemory    bool              // Whether to store in memory
-	filename     string
-	file         *os.File
-	maxKeys      int // Maximum number of entries
-	maxKeySize   int // Max key size
-	maxValueSize int // Max value size
+	mu            sync.RWMutex
+	shards        [shardCount]shard // Optional in-memory storage, split up by key hash
+	keys          atomic.Int64      // Number of keys in memory
+	memBytes      atomic.Int64      // Approximate memory used by keys and values, see memSize
+	sorted        []string          // Keys in memory in sorted order, for prefix scans
+	smu           sync.Mutex        // Guards sorted, which writers holding only the read lock update
+	loading       bool              // Set while replaying, sorted is rebuilt afterwards
+	useMemory     bool              // Whether to store in memory
+	filename      string
+	file          *os.File                  // The log file, or the active segment of a segmented log
+	segments      []int                     // Segment numbers oldest first, the last is active. nil for a single log file
+	segmentSize   int64                     // Size at which a new segment is started, 0 never starts one
+	activeSize    int64                     // Size of the active segment
+	lock          *os.File                  // Held lock file, nil for read-only stores
+	writer        *bufio.Writer             // Optional buffer in front of file
+	queue         *writeQueue               // Records in writer left for writeLoop to write, nil without StoreConfig.AsyncWrites
+	amu           sync.Mutex                // Serializes appends, which writers holding only the read lock make
+	pmu           sync.Mutex                // Serializes Plan and ApplyPlan
+	planning      atomic.Pointer[planState] // The running Plan or ApplyPlan, which takes over appends, nil if there is none
+	wmu           sync.Mutex                // Guards writer, which readers flush
+	cmu           sync.Mutex                // Held by compactions, which run without mu, and by anything else replacing the log
+	format        LogFormat                 // Format of the records currently in the log file
+	newFormat     LogFormat                 // Format used for new and compacted logs
+	aead          cipher.AEAD               // Encrypts values written to the log, nil if not encrypted
+	maxKeys       int                       // Maximum number of entries
+	maxKeySize    int                       // Max key size
+	maxValueSize  int                       // Max value size
+	validateKey   KeyValidator              // Checks every key written, see StoreConfig.ValidateKey
+	normalizeKey  KeyNormalizer             // Applied to every key passed in, see StoreConfig.NormalizeKey
+	interceptors  interceptorChain          // Wrap Get, Set, Delete and Compact, see Use
+	validators    validatorTable            // Checks values written under a prefix, see ValidatePrefix
+	maxRecordSize int                       // Largest encoded log record read or written
+	maxMemory     int64                     // Max approximate memory used by keys and values, 0 means no limit
+	quotas        quotaTable                // Limits set with QuotaFor
+	lastTxn       uint64                    // Most recently issued transaction ID
+	lastSeq       uint64                    // Most recently issued record sequence number
+	truncate      bool                      // Whether to truncate the log at the first bad record
+	strict        bool                      // Whether to fail to open on the first bad record
+	recovery      RecoveryReport            // Bad records found while opening
+	closed        bool                      // Set once Close has been called
+	readOnly      bool                      // Whether the log was opened read-only
+	replica       bool                      // Whether only records applied from a primary are written, see StoreConfig.Replica
+	syncMode      SyncMode                  // When writes are fsynced
+	syncStop      chan struct{}             // Stops the running syncLoop, nil if there is none
+	dirty         bool                      // Whether there are writes that haven't been fsynced
+	failure       atomic.Pointer[error]     // Why writing the log failed, see Err
+	records       int                       // Records in the log file, only tracked in memory mode
+	keepVersions  int                       // Past versions of each live key compaction keeps
+	compactRate   atomic.Int64              // Bytes per second compaction reads and writes, see StoreConfig.CompactionRate
+	index         map[string]indexEntry     // Where the latest record of each key is in file-only mode, nil without an index
+	bloom         *bloomFilter              // Keys that may be in the log in file-only mode, nil without a bloom filter
+	search        *searchIndex              // Words in values for Search, nil without a search index
+	cache         *readCache                // Recently read entries in file-only mode, nil without a cache
+	maps          *logMaps                  // Log files mapped for reading in file-only mode, nil unless StoreConfig.MmapReads is set
+	watchers      map[*watcher]struct{}     // Subscribers registered with Watch
+	evictHooks    map[*hook]struct{}        // Callbacks registered with OnEvict
+	feeds         map[*feed]struct{}        // Replicas registered with Subscribe
+	counters      storeCounters             // Totals reported by Stats
+	loadTime      time.Duration             // How long NewStore took to replay the log, see StoreStats.LoadTime
+	checkpointed  int64                     // Log size the last checkpoint was saved or loaded at, 0 if there is none
+	keyLocks      keyLocks                  // Locks taken with LockKey
+	logger        *slog.Logger              // Receives diagnostics, discards them unless configured
+	policy        EvictionPolicy            // What happens when maxKeys or maxMemory is reached
+	evictor       evictionTracker           // Eviction order of keys in memory, nil with EvictNone
+	emu           sync.Mutex                // Guards evictor, which readers update
+	stop          chan struct{}
+	wg            sync.WaitGroup
 }
 
 type StoreConfig struct {
-	UseMemory    bool // Whether to store in memory
-	MaxKeys      int  // Maximum number of entries
-	MaxKeySize   int  // Max key size
-	MaxValueSize int  // Max value size
+	UseMemory           bool           // Whether to store in memory
+	MaxKeys             int            // Maximum number of entries
+	MaxKeySize          int            // Max key size
+	MaxValueSize        int            // Max value size
+	ExpirationInterval  time.Duration  // How often expired keys are purged from memory (default 1s)
+	Format              LogFormat      // Encoding for new logs, existing logs are converted on Compact
+	TruncateCorrupt     bool           // Cut the log at the first corrupt or torn record when opening
+	StrictReplay        bool           // Fail to open with a *RecordError at the first corrupt or torn record instead of skipping it
+	CompactionThreshold int            // Compact automatically once this many records are stale (0 disables)
+	CompactionMaxBytes  int64          // Compact automatically once the log grows past this size (0 disables)
+	CompactionInterval  time.Duration  // How often the compaction thresholds are checked (default 1m)
+	CompactionRate      int64          // Pace compaction's reads and writes to about this many bytes per second, a chunk at a time (0 means no limit)
+	CheckpointInterval  time.Duration  // Save a checkpoint of the keys in memory this often once the log has grown, so opening only replays the log after it (0 disables, see Store.Checkpoint)
+	SyncMode            SyncMode       // When writes are fsynced to disk (default SyncNever)
+	SyncInterval        time.Duration  // How often to fsync with SyncInterval (default 1s)
+	WriteBufferSize     int            // Buffer writes in memory up to this many bytes until Flush (0 writes directly)
+	AsyncWrites         bool           // Return from writes once they are applied and queued, leaving a background goroutine to write them to the log in batches, see Store.Written
+	EncryptionKey       []byte         // AES key of 16, 24 or 32 bytes to encrypt values with AES-GCM (nil disables)
+	EvictionPolicy      EvictionPolicy // Evict keys instead of refusing writes once a limit is reached (memory mode only)
+	MaxMemoryBytes      int64          // Max approximate memory used by keys and values in memory mode (0 disables)
+	ReadOnly            bool           // Open an existing log without writing to it, writes fail with ErrReadOnly
+	WaitForLock         time.Duration  // How long to wait for another process to release the log (0 fails with ErrLocked at once)
+	SegmentSize         int64          // Split the log into segment files of about this size (0 keeps a single file)
+	Index               bool           // Keep an index of record offsets in file-only mode so reads seek instead of scanning the log
+	BloomFilter         bool           // Keep a bloom filter of keys in file-only mode so reads of missing keys skip the log
+	Logger              *slog.Logger   // Receives diagnostics like skipped log records and background errors (nil discards them)
+	KeepVersions        int            // Past versions of each live key that compaction keeps for GetHistory (0 keeps only the current value)
+	SearchIndex         bool           // Keep an inverted index of the words in values for Search
+	MaxRecordSize       int            // Largest log record read or written in bytes (default fits any key and value within the size limits, and at least 64MB)
+	MmapReads           bool           // Read the log through a memory mapping in file-only mode instead of opening it for every read
+	CacheBytes          int64          // Keep recently read entries in memory up to about this many bytes in file-only mode, so repeated reads skip the log (0 disables)
+	Replica             bool           // Fail writes with ErrReadOnly except records applied from a primary with ApplyRecords, which skip the key and memory limits, and writes made with ApplyPlan
+	ValidateKey         KeyValidator   // Checked against every key written on top of MaxKeySize, see RejectControlChars (nil accepts any key)
+	NormalizeKey        KeyNormalizer  // Applied to every key passed to the store before it is used, like strings.ToLower (nil leaves keys as they are)
 }
 
-func NewStore(filename string, config StoreConfig) *Store {
+// open the store backed by the given log file, creating the file if it
+// doesn't exist. with an empty filename the store only lives in memory and
+// never touches the filesystem, whatever config.UseMemory says. it then
+// keeps no records, so there is nothing to compact and GetHistory and the
+// other functions reading past versions find none.
+func NewStore(filename string, config StoreConfig) (*Store, error) {
+	if filename == "" {
+		if config.ReadOnly {
+			return nil, fmt.Errorf("a store without a log file can't be read-only")
+		}
+		config.UseMemory = true
+		config.SyncMode = SyncNever
+		config.CompactionThreshold, config.CompactionMaxBytes = 0, 0
+	}
 	s := &Store{
-		filename:     filename,
-		useMemory:    config.UseMemory,
-		data:         make(map[string]string),
-		maxKeys:      config.MaxKeys,
-		maxKeySize:   config.MaxKeySize,
-		maxValueSize: config.MaxValueSize,
+		filename:      filename,
+		useMemory:     config.UseMemory,
+		maxKeys:       config.MaxKeys,
+		maxKeySize:    config.MaxKeySize,
+		maxValueSize:  config.MaxValueSize,
+		validateKey:   config.ValidateKey,
+		normalizeKey:  config.NormalizeKey,
+		maxRecordSize: config.MaxRecordSize,
+		maxMemory:     config.MaxMemoryBytes,
+		newFormat:     config.Format,
+		truncate:      config.TruncateCorrupt,
+		strict:        config.StrictReplay,
+		syncMode:      config.SyncMode,
+		policy:        config.EvictionPolicy,
+		readOnly:      config.ReadOnly,
+		replica:       config.Replica,
+		segmentSize:   config.SegmentSize,
+		keepVersions:  max(config.KeepVersions, 0),
+		logger:        config.Logger,
+		stop:          make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = slog.New(discardHandler{})
+	}
+	s.compactRate.Store(config.CompactionRate)
+	if s.maxRecordSize <= 0 {
+		s.maxRecordSize = max(recordSizeFor(config.MaxKeySize, config.MaxValueSize), defaultMaxRecordSize)
+	}
+	// a read-only store can't truncate or compact the log it reads
+	if config.ReadOnly {
+		s.truncate = false
+		config.CompactionThreshold, config.CompactionMaxBytes = 0, 0
+	}
+	if config.UseMemory {
+		s.resetMemory()
+		s.evictor = newEvictionTracker(config.EvictionPolicy)
 	}
 
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	aead, err := newAEAD(config.EncryptionKey)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	s.aead = aead
+
+	if filename == "" {
+		s.format = config.Format
+		if config.SearchIndex {
+			s.search = newSearchIndex()
+		}
+		s.startExpiry(config.ExpirationInterval)
+		return s, nil
+	}
+
+	// only one process may write to a log, readers don't need the lock
+	if !config.ReadOnly {
+		if s.lock, err = lockFile(filename, config.WaitForLock); err != nil {
+			return nil, err
+		}
+	}
+	opened := false
+	defer func() {
+		if !opened && s.lock != nil {
+			s.lock.Close()
+		}
+	}()
+
+	// a crash while compacting or saving a sidecar leaves a temp file behind
+	if !config.ReadOnly {
+		if err := s.removeTempFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	// a segmented log appends to its newest segment
+	if s.segments, err = findSegments(filename, config.SegmentSize > 0, config.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	var file *os.File
+	if config.ReadOnly {
+		file, err = os.Open(s.activePath())
+	} else {
+		file, err = os.OpenFile(s.activePath(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file: %w", err)
 	}
 	s.file = file
 
+	// keep appending in the format already on disk, a fresh log starts with
+	// the configured format's header
+	format, ok, err := detectFormat(io.NewSectionReader(file, 0, int64(len(binaryHeader))))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+	if !ok {
+		format = config.Format
+	}
+	if !ok && !config.ReadOnly {
+		if _, err := file.Write(format.header()); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error writing to log file: %w", err)
+		}
+	}
+	s.format = format
+	bufferSize := config.WriteBufferSize
+	if config.AsyncWrites && !config.ReadOnly {
+		bufferSize = max(bufferSize, defaultQueueSize)
+		s.queue = newWriteQueue()
+	}
+	if bufferSize > 0 {
+		s.writer = bufio.NewWriterSize(file, bufferSize)
+	}
+
+	// a torn JSON line must not run into the next record we append
+	if info, err := file.Stat(); err == nil && !config.ReadOnly && format == LogFormatJSON && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte{'\n'})
+		}
+	}
+	if info, err := file.Stat(); err == nil {
+		s.activeSize = info.Size()
+	}
+
+	start := time.Now()
 	if config.UseMemory {
-		s.load()
+		if err := s.load(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if config.SearchIndex {
+			s.mu.Lock()
+			err := s.buildSearch()
+			s.mu.Unlock()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		s.startExpiry(config.ExpirationInterval)
+	} else {
+		// there's nothing to load, but a log that can't be read at all, like
+		// one encrypted with another key, should still fail to open. reading
+		// up to the first value is enough to tell unless truncating.
+		s.mu.Lock()
+		err := s.checkLog(logPosition{}, func(entry Entry) bool {
+			return config.TruncateCorrupt || config.StrictReplay || entry.Deleted || entry.Commit
+		})
+		if err == nil && config.Index {
+			err = s.openIndex()
+		}
+		if err == nil && config.BloomFilter {
+			err = s.openBloom()
+		}
+		if err == nil && config.SearchIndex {
+			err = s.buildSearch()
+		}
+		s.mu.Unlock()
+		if config.CacheBytes > 0 {
+			s.cache = newReadCache(config.CacheBytes)
+		}
+		if config.MmapReads {
+			s.maps = newLogMaps()
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
 	}
+	s.loadTime = time.Since(start)
 
+	if config.CompactionThreshold > 0 || config.CompactionMaxBytes > 0 {
+		interval := config.CompactionInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		s.wg.Add(1)
+		go s.compactLoop(interval, config.CompactionThreshold, config.CompactionMaxBytes)
+	}
+
+	if config.CheckpointInterval > 0 && config.UseMemory && !config.ReadOnly {
+		s.wg.Add(1)
+		go s.checkpointLoop(config.CheckpointInterval)
+	}
+
+	if config.SyncMode == SyncInterval && !config.ReadOnly {
+		s.startSync(config.SyncInterval)
+	}
+
+	if s.queue != nil {
+		s.wg.Add(1)
+		go s.writeLoop()
+	}
+
+	opened = true
+	return s, nil
+}
+
+// like NewStore, but panics if the store can't be opened
+func MustNewStore(filename string, config StoreConfig) *Store {
+	s, err := NewStore(filename, config)
+	if err != nil {
+		panic(err)
+	}
 	return s
 }
 
-// build the in-memory map
-func (s *Store) load() {
+// build the in-memory map, from the checkpoint and the log after it if there
+// is one that matches the log, see Store.Checkpoint
+func (s *Store) load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	file, err := os.Open(s.filename)
+	now := time.Now().UnixNano()
+	s.loading = true
+	defer func() {
+		s.loading = false
+		s.rebuildSorted()
+	}()
+
+	from, err := s.loadCheckpoint(s.loadEntry(now))
+	if err != nil {
+		s.logger.Warn("error loading checkpoint, replaying the whole log", "err", err)
+		s.resetMemory()
+		s.evictor = newEvictionTracker(s.policy)
+		s.records, s.lastSeq, s.checkpointed = 0, 0, 0
+		from = logPosition{}
+	}
+	return s.checkLog(from, s.loadEntry(now))
+}
+
+// apply an entry read while loading to memory. the caller must hold the
+// write lock.
+func (s *Store) loadEntry(now int64) func(Entry) bool {
+	return func(entry Entry) bool {
+		s.records++
+		s.lastSeq = max(s.lastSeq, entry.Seq)
+		if entry.Deleted || entry.expired(now) {
+			s.removeLocked(entry.Key)
+		} else {
+			s.putLocked(entry)
+		}
+
+		// keys evicted while loading are only dropped from memory, the next
+		// compaction removes them from the log
+		evicted, err := s.makeRoomLocked(0, 0, nil)
+		if err != nil {
+			s.logger.Warn("store exceeded its limits while loading, consider compaction", "err", err)
+			return false
+		}
+		for _, entry := range evicted {
+			s.removeLocked(entry.Key)
+		}
+		return true
+	}
+}
+
+// replay the log from from, recording corrupt or torn records in the
+// recovery report. if configured to, replay stops at the first one and either
+// fails or truncates the log there so nothing after it is applied. errors
+// that stop the whole log from being read are returned. replay from a
+// checkpoint applies partial records to the values in memory. the caller
+// must hold the write lock.
+func (s *Store) checkLog(from logPosition, fn func(Entry) bool) error {
+	var before func(key string) (string, bool)
+	if from != (logPosition{}) {
+		before = s.memValue
+	}
+	var corrupt *RecordError
+	err := s.replayAfter(context.Background(), from, before, nil, func(entry Entry) bool {
+		if (s.truncate || s.strict) && corrupt != nil {
+			return false
+		}
+		return fn(entry)
+	}, func(err error) {
+		s.logger.Warn("skipping bad log record", "err", err)
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			if corrupt == nil {
+				corrupt = recErr
+			}
+			s.recovery.Skipped = append(s.recovery.Skipped, recErr)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+	if s.strict && corrupt != nil {
+		return fmt.Errorf("error reading log file: %w", corrupt)
+	}
+
+	if s.truncate && corrupt != nil {
+		if err := s.truncateLog(corrupt.File, corrupt.Offset); err != nil {
+			s.logger.Error("error truncating log file", "err", err)
+			return nil
+		}
+		s.logger.Warn("truncated log file at bad record", "file", corrupt.File, "offset", corrupt.Offset)
+		s.recovery.Truncated = true
+	}
+	return nil
+}
+
+// the bad records found while opening the store
+type RecoveryReport struct {
+	Skipped   []*RecordError // Corrupt or torn records that were skipped, in the order they were read
+	Truncated bool           // Whether the log was cut at the first of them, see StoreConfig.TruncateCorrupt
+}
+
+// the bad records found while opening the store, see StoreConfig.StrictReplay
+// to fail instead. in file-only mode opening only reads the whole log with
+// StoreConfig.TruncateCorrupt, otherwise it stops at the first value.
+func (s *Store) RecoveryReport() RecoveryReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recovery
+}
+
+// read the log from the start, calling fn for every entry in the order it
+// should be applied until fn returns false. entries that belong to a
+// transaction are held back until its commit record is read, so an
+// uncommitted transaction is never applied. malformed records are skipped and
+// passed to onError if it isn't nil.
+func (s *Store) replay(fn func(Entry) bool, onError func(error)) error {
+	return s.replayContext(context.Background(), fn, onError)
+}
+
+// like replay, but stops with ctx's error once it is done
+func (s *Store) replayContext(ctx context.Context, fn func(Entry) bool, onError func(error)) error {
+	return s.replayKeys(ctx, nil, fn, onError)
+}
+
+// like replayContext, but only passes fn the entries of keys that match
+// accepts, or every key if match is nil. appends to other keys then don't
+// need to be resolved. appends are passed to fn as the whole value they
+// leave their key with.
+func (s *Store) replayKeys(ctx context.Context, match func(key string) bool, fn func(Entry) bool, onError func(error)) error {
+	return s.replayAfter(ctx, logPosition{}, nil, match, fn, onError)
+}
+
+// like replayKeys, but starts at from, like where a checkpoint leaves off.
+// partial records to keys last set before from are applied to the value
+// before returns for them.
+func (s *Store) replayAfter(ctx context.Context, from logPosition, before func(key string) (string, bool), match func(key string) bool, fn func(Entry) bool, onError func(error)) error {
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+
+	appends := newAppendResolver(s.aead, s.maxRecordSize)
+	appends.before = before
+	var stopErr error
+	n := 0
+	for i, path := range s.logFiles() {
+		if i < from.file {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var offset int64
+		if i == from.file {
+			offset = from.offset
+		}
+		stopped := false
+		err := s.replayLogFile(path, offset, func(entry Entry, offset int64) bool {
+			// checking every record would slow down long replays
+			if n++; n%256 == 0 {
+				if stopErr = ctx.Err(); stopErr != nil {
+					stopped = true
+					return false
+				}
+			}
+			if match != nil && !match(entry.Key) {
+				return true
+			}
+			if entry, stopErr = appends.resolve(entry, path, offset); stopErr != nil {
+				stopped = true
+				return false
+			}
+			stopped = !fn(entry)
+			return !stopped
+		}, onError)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return stopErr
+		}
+	}
+	return nil
+}
+
+// replay a single log file, see replayRecords. appends aren't resolved. bad
+// records are reported with the file they are in.
+func replayFile(path string, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return replayFrom(file, path, aead, limit, fn, onError)
+}
+
+// replay the contents of the log file at path read from r, see replayFile.
+// large files are decoded on several goroutines, see decodePipeline.
+func replayFrom(r io.Reader, path string, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	reader, err := newRecordReader(r, aead, limit)
 	if err != nil {
-		fmt.Println("Error opening log file:", err)
-		return
+		return err
+	}
+	return replayRead(r, reader, path, fn, onError)
+}
+
+// replay the log file at path from offset, which must be where a record
+// starts, see replayTail
+func replayFileTail(path string, offset int64, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return replayTail(file, info.Size(), path, offset, aead, limit, fn, onError)
+}
+
+// replay the records after offset of the log file at path, size bytes read
+// from r, see replayFrom. the line numbers of bad records in JSON logs
+// aren't known without reading from the start, so they are left out.
+func replayTail(r io.ReaderAt, size int64, path string, offset int64, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	format, ok, err := detectFormat(io.NewSectionReader(r, 0, int64(len(binaryHeader))))
+	if err != nil || !ok {
+		return err
+	}
+	tail := io.NewSectionReader(r, offset, max(size-offset, 0))
+	reader := newFormatReader(tail, format, aead, limit, offset)
+	return replayRead(tail, reader, path, fn, func(err error) {
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			recErr.Line = 0
+		}
+		if onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// replay what reader reads from r, the contents of the log file at path
+func replayRead(r io.Reader, reader *recordReader, path string, fn func(Entry, int64) bool, onError func(error)) error {
+	var records recordSource = reader
+	if pipelined(r) {
+		pipeline := newDecodePipeline(reader)
+		defer pipeline.Close()
+		records = pipeline
+	}
+	return replayRecords(records, fn, func(err error) {
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			recErr.File = path
+		}
+		if onError != nil {
+			onError(err)
+		}
+	})
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var entry Entry
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
-			fmt.Println("Error parsing log entry:", err)
+// replay log records of up to limit bytes read from r, decrypting values
+// with aead, see replayRecords
+func replayReader(r io.Reader, aead cipher.AEAD, limit int, fn func(Entry) bool, onError func(error)) error {
+	reader, err := newRecordReader(r, aead, limit)
+	if err != nil {
+		return err
+	}
+	return replayRecords(reader, func(entry Entry, _ int64) bool {
+		return fn(entry)
+	}, onError)
+}
+
+// replay the records of reader, see replay, passing fn the offset each entry
+// was read from
+func replayRecords(reader recordSource, fn func(Entry, int64) bool, onError func(error)) error {
+	type staged struct {
+		entry  Entry
+		offset int64
+	}
+	pending := make(map[uint64][]staged)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			if onError != nil {
+				onError(err)
+			}
 			continue
 		}
+		if err != nil {
+			return err
+		}
 
-		if entry.Deleted {
-			delete(s.data, entry.Key)
-		} else {
-			s.data[entry.Key] = entry.Value
+		if entry.Txn == 0 {
+			if !fn(entry, reader.Start()) {
+				return nil
+			}
+			continue
+		}
+		if !entry.Commit {
+			pending[entry.Txn] = append(pending[entry.Txn], staged{entry, reader.Start()})
+			continue
+		}
+		for _, op := range pending[entry.Txn] {
+			if !fn(op.entry, op.offset) {
+				return nil
+			}
+		}
+		delete(pending, entry.Txn)
+	}
+}
+
+// purge expired keys from memory every interval, 1s by default, until the
+// store is closed. expired entries don't need tombstones, replay skips them
+// on its own.
+func (s *Store) startExpiry(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	s.wg.Add(1)
+	go s.expireLoop(interval)
+}
+
+func (s *Store) expireLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.removeExpired()
 		}
+	}
+}
 
-		if len(s.data) > s.maxKeys {
-			fmt.Println("Store exceeded max keys limit, consider compaction.")
-			break
+func (s *Store) removeExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	var expired []string
+	s.rangeMemory(func(entry Entry) {
+		if entry.expired(now) {
+			expired = append(expired, entry.Key)
 		}
+	})
+	for _, key := range expired {
+		s.dropLocked(key, RemovalExpired)
+		if s.search != nil {
+			s.search.remove(key)
+		}
+		s.notify(Event{Type: EventDelete, Key: key})
 	}
 }
 
+// the approximate memory a key-value pair takes up in the store, counting
+// the map entries and sorted index as well as the strings themselves
+func memSize(key, value string) int64 {
+	const overhead = 64
+	return int64(len(key)+len(value)) + overhead
+}
+
+// store an entry in memory. the caller must hold the write lock.
+func (s *Store) putLocked(entry Entry) {
+	sh := s.shardFor(entry.Key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if s.putShard(sh, entry) {
+		s.keys.Add(1)
+	}
+}
+
+// remove a key from memory, returning its entry if it was there. the caller
+// must hold the write lock.
+func (s *Store) removeLocked(key string) (Entry, bool) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry, removed := s.removeShard(sh, key)
+	if removed {
+		s.keys.Add(-1)
+	}
+	return entry, removed
+}
+
 // safely set a key-value pair and append to the log file
 func (s *Store) Set(key, value string) error {
+	return s.run(Operation{Type: OpSet, Ctx: context.Background(), Key: key, Value: value})
+}
+
+// set a key-value pair that expires after the given duration
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	return s.run(Operation{Type: OpSet, Ctx: context.Background(), Key: key, Value: value, ExpiresAt: expiresAt})
+}
+
+// set an expiration on an existing key, keeping its value. reports whether
+// the key existed.
+func (s *Store) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, ErrInvalidTTL
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	var exists bool
+	err := s.runFunc(Operation{Type: OpExpire, Ctx: context.Background(), Key: key, ExpiresAt: expiresAt}, func(context.Context) (err error) {
+		exists, err = s.expire(key, expiresAt)
+		return err
+	})
+	return exists, err
+}
+
+func (s *Store) expire(key string, expiresAt int64) (bool, error) {
+	key = s.normalize(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists, err := s.lookupLocked(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := s.setLocked(key, entry.Value, expiresAt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) set(key, value string, expiresAt int64) error {
+	key = s.normalize(key)
+	if s.sharedWrites() {
+		return s.setShared(key, value, expiresAt)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.setLocked(key, value, expiresAt)
+}
+
+// validate, log and apply a single Set. the caller must hold the write lock.
+func (s *Store) setLocked(key, value string, expiresAt int64) error {
+	if err := s.validate(key, value); err != nil {
+		return err
+	}
+	// Check the memory limits, overwriting an existing key doesn't add one
+	var evicted []Entry
+	if s.useMemory {
+		if err := s.checkQuota(Entry{Key: key, Value: value}); err != nil {
+			return err
+		}
+		newKeys, newBytes := 1, memSize(key, value)
+		if old, exists := s.memValue(key); exists {
+			newKeys, newBytes = 0, newBytes-memSize(key, old)
+		}
+		var err error
+		if evicted, err = s.makeRoomLocked(newKeys, newBytes, map[string]bool{key: true}); err != nil {
+			return err
+		}
+	}
 
+	records := append(evicted, Entry{Key: key, Value: value, ExpiresAt: expiresAt})
+	if err := s.appendEntries(records...); err != nil {
+		return err
+	}
+
+	if s.useMemory {
+		for _, e := range evicted {
+			s.dropLocked(e.Key, RemovalEvicted)
+		}
+		s.putLocked(records[len(evicted)])
+	}
+
+	return nil
+}
+
+// check a key-value pair against the configured size limits and validators
+func (s *Store) validate(key, value string) error {
 	// Validate key size
 	if len(key) > s.maxKeySize {
-		return fmt.Errorf("key exceeds max size of %d bytes", s.maxKeySize)
+		return fmt.Errorf("%w of %d bytes", ErrKeyTooLarge, s.maxKeySize)
+	}
+	if err := s.checkKey(key); err != nil {
+		return err
 	}
 	// Validate value size
 	if len(value) > s.maxValueSize {
-		return fmt.Errorf("value exceeds max size of %d bytes", s.maxValueSize)
+		return fmt.Errorf("%w of %d bytes", ErrValueTooLarge, s.maxValueSize)
 	}
-	// Check max keys limit
-	if s.useMemory && len(s.data) >= s.maxKeys {
-		return fmt.Errorf("store has reached max number of keys (%d)", s.maxKeys)
+	return s.checkValue(key, value)
+}
+
+// encode entries and append them to the log file with a single write,
+// stamping them with a sequence number and time first, see stamp. the caller
+// must hold the write lock, or the read lock for writes that qualify for
+// sharedWrites.
+func (s *Store) appendEntries(entries ...Entry) error {
+	return s.appendRecords(entries, true)
+}
+
+// append entries to the log file, see appendEntries. records replicated from
+// a primary aren't stamped, they keep the primary's sequence numbers.
+func (s *Store) appendRecords(entries []Entry, stamp bool) error {
+	if p := s.planning.Load(); p != nil && stamp {
+		return s.appendPlanned(p, entries)
 	}
+	s.amu.Lock()
+	defer s.amu.Unlock()
 
-	entry := Entry{Key: key, Value: value}
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("error encoding JSON: %v", err)
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.readOnly || (s.replica && stamp) {
+		return ErrReadOnly
+	}
+	if err := s.Err(); err != nil {
+		return err
 	}
 
-	_, err = s.file.WriteString(string(data) + "\n")
-	if err != nil {
-		return fmt.Errorf("error writing to log file: %v", err)
+	var buf []byte
+	now := time.Now().UnixNano()
+	offsets := make([]int64, len(entries))
+	for i := range entries {
+		if stamp {
+			s.stamp(&entries[i], now)
+		} else {
+			s.lastSeq = max(s.lastSeq, entries[i].Seq)
+		}
+		if s.memoryOnly() {
+			continue
+		}
+		data, err := encodeEntry(s.format, s.aead, entries[i])
+		if err != nil {
+			return err
+		}
+		// a record too large to read back would cut off the rest of the log
+		if len(data) > s.maxRecordSize {
+			return fmt.Errorf("%q: %w of %d bytes", entries[i].Key, ErrRecordTooLarge, s.maxRecordSize)
+		}
+		offsets[i] = s.activeSize + int64(len(buf))
+		buf = append(buf, data...)
 	}
 
-	if s.useMemory {
-		s.data[key] = value
+	if err := s.write(buf); err != nil {
+		return s.fail(fmt.Errorf("error writing to log file: %w", err))
+	}
+	s.records += len(entries)
+	if s.queue != nil {
+		s.queue.add(len(entries))
+	}
+	s.counters.written(entries, len(buf))
+	if s.index != nil {
+		segment := 0
+		if s.segments != nil {
+			segment = s.segments[len(s.segments)-1]
+		}
+		for i, entry := range entries {
+			s.indexEntry(entry, segment, offsets[i])
+		}
+	}
+	if s.bloom != nil {
+		for _, entry := range entries {
+			if !entry.Deleted && !entry.Commit {
+				s.bloom.add(entry.Key)
+			}
+		}
+	}
+	if s.cache != nil {
+		for _, entry := range entries {
+			s.cache.remove(entry.Key)
+		}
+	}
+	if s.maps != nil {
+		s.maps.drop(s.activePath())
+	}
+	if s.search != nil {
+		for _, entry := range entries {
+			s.search.apply(entry)
+		}
 	}
+	s.activeSize += int64(len(buf))
+	s.notifyEntries(entries)
+	s.feedEntries(entries)
 
+	// queued records are synced by writeLoop
+	if s.syncMode == SyncEveryWrite && s.queue == nil {
+		if err := s.flushBuffer(); err != nil {
+			return err
+		}
+		if err := s.syncLog(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	if s.segments != nil && s.segmentSize > 0 && s.activeSize >= s.segmentSize {
+		// the records are in the log even though the write fails
+		if err := s.rollSegment(); err != nil {
+			return s.fail(err)
+		}
+	}
 	return nil
 }
 
 // retrieve a value by key
 func (s *Store) Get(key string) (string, bool) {
-	if s.useMemory {
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-		val, exists := s.data[key]
-		return val, exists
-	}
-
-	// File-only mode: Scan the log file for the most recent entry
-	file, err := os.Open(s.filename)
+	value, exists, err := s.GetCtx(context.Background(), key)
 	if err != nil {
-		fmt.Println("Error opening log file:", err)
+		s.logger.Error("error reading log file", "key", key, "err", err)
 		return "", false
 	}
-	defer file.Close()
+	return value, exists
+}
 
-	scanner := bufio.NewScanner(file)
-	var lastValue string
-	var exists bool
+// find the current entry for a key, see lookupContext. the caller must hold
+// at least the read lock.
+func (s *Store) lookupLocked(key string) (Entry, bool, error) {
+	return s.lookupContext(context.Background(), key)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		var entry Entry
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
-			continue
-		}
-		if entry.Key == key {
-			if entry.Deleted {
-				lastValue = ""
-				exists = false
-			} else {
-				lastValue = entry.Value
-				exists = true
-			}
+// find the current entry for a key, from memory or, in file-only mode, from
+// the record the index points at or by scanning the log file for the most
+// recent entry until ctx is done. keys the bloom filter rules out aren't
+// looked for at all. the caller must hold at least the read lock.
+func (s *Store) lookupContext(ctx context.Context, key string) (Entry, bool, error) {
+	if s.closed {
+		return Entry{}, false, ErrStoreClosed
+	}
+	now := time.Now().UnixNano()
+	if s.useMemory {
+		entry, exists := s.memLookup(key, now)
+		return entry, exists, nil
+	}
+
+	if s.bloom != nil && !s.bloom.mayContain(key) {
+		return Entry{}, false, nil
+	}
+	if s.cache != nil {
+		if entry, ok := s.cache.get(key, now); ok {
+			return entry, true, nil
 		}
 	}
 
-	return lastValue, exists
+	var entry Entry
+	var exists bool
+	var err error
+	if s.index != nil {
+		entry, exists, err = s.lookupIndexed(key, now)
+	} else {
+		entry, exists, err = s.lookupScan(ctx, key, now)
+	}
+	if exists && s.cache != nil {
+		s.cache.add(entry)
+	}
+	return entry, exists, err
+}
+
+// find the current entry for a key by scanning the log for its most recent
+// record until ctx is done. the caller must hold at least the read lock.
+func (s *Store) lookupScan(ctx context.Context, key string, now int64) (Entry, bool, error) {
+	var last Entry
+	var seen bool
+	err := s.replayKeys(ctx, func(k string) bool { return k == key }, func(entry Entry) bool {
+		entry.CreatedAt = creationTime(entry, last, seen)
+		last, seen = entry.standalone(), true
+		return true
+	}, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if !seen || last.Deleted || last.expired(now) {
+		return Entry{}, false, nil
+	}
+	return last, true, nil
 }
 
 // mark a key as deleted in the log and remove it from memory.
 func (s *Store) Delete(key string) error {
+	return s.run(Operation{Type: OpDelete, Ctx: context.Background(), Key: key})
+}
+
+// delete a key once it made it through the interceptors, see Delete
+func (s *Store) deleteKey(key string) error {
+	key = s.normalize(key)
+	if s.sharedWrites() {
+		return s.deleteShared(key)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.deleteLocked(key)
+}
 
+// delete a key, see Delete. the caller must hold the write lock.
+func (s *Store) deleteLocked(key string) error {
 	entry := Entry{Key: key, Deleted: true}
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("error encoding JSON: %v", err)
-	}
-
-	_, err = s.file.WriteString(string(data) + "\n")
-	if err != nil {
-		return fmt.Errorf("error writing to log file: %v", err)
+	if err := s.appendEntries(entry); err != nil {
+		return err
 	}
 
 	if s.useMemory {
-		delete(s.data, key)
+		s.dropLocked(key, RemovalDeleted)
 	}
 
 	return nil
 }
 
-// rewrite the log file, removing deleted and outdated entries
-func (s *Store) Compact() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// rewrite the log file, removing deleted, expired and outdated entries apart
+// from the past versions kept for GetHistory, see StoreConfig.KeepVersions.
+// the new log uses the configured format, so this also migrates existing
+// logs. a segmented log is compacted one segment at a time instead, see
+// compactSegments.
+func (s *Store) Compact() error {
+	return s.CompactCtx(context.Background())
+}
 
-	tempFile := s.filename + ".tmp"
-	file, err := os.Create(tempFile)
-	if err != nil {
-		fmt.Println("Error creating temp log file:", err)
-		return
-	}
-	defer file.Close()
+// like Compact, but gives up once ctx is done. the compacted copy is written
+// without holding the store's lock, so reads and writes carry on meanwhile,
+// and only takes the log's place once it is complete, with the writes made
+// since appended to it. a compaction that fails or is cancelled leaves the
+// log as it was. only one compaction runs at a time.
+func (s *Store) CompactCtx(ctx context.Context) error {
+	return s.run(Operation{Type: OpCompact, Ctx: ctx})
+}
+
+// compact the log once the interceptors let it, see CompactCtx
+func (s *Store) compact(ctx context.Context) error {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
 
-	// Use the latest data to write a clean log
-	for key, value := range s.data {
-		entry := Entry{Key: key, Value: value}
-		data, _ := json.Marshal(entry)
-		file.WriteString(string(data) + "\n")
+	s.mu.RLock()
+	closed, readOnly, segmented := s.closed, s.readOnly, s.segments != nil
+	s.mu.RUnlock()
+	switch {
+	case closed:
+		return ErrStoreClosed
+	case s.memoryOnly():
+		return nil
+	case readOnly:
+		return ErrReadOnly
+	}
+	if err := s.Err(); err != nil {
+		return err
 	}
 
-	// replace old log with compacted version
-	os.Rename(tempFile, s.filename)
-	s.file.Close()
-	s.file, _ = os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	var err error
+	if segmented {
+		err = s.compactSegments(ctx)
+	} else {
+		err = s.compactFile(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	s.counters.compacted()
+	return nil
 }
 
-func (s *Store) Close() {
+// close the store: stop the background goroutines, flush and fsync buffered
+// writes, save the index and bloom filter and release the log and its lock.
+// everything is attempted even if a step fails, and the errors are returned
+// together. operations on a closed store fail with ErrStoreClosed, and
+// closing it again does nothing.
+func (s *Store) Close() error {
+	// once closed is set writers fail, so nothing new is written while the
+	// background goroutines, which need the lock, finish up
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	s.wg.Wait()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.file.Close()
+	s.stopWatchers()
+	s.stopHooks()
+	s.stopFeeds()
+	if s.maps != nil {
+		s.maps.dropAll()
+	}
+	var errs []error
+	if err := s.flushBuffer(); err != nil {
+		errs = append(errs, err)
+	}
+	if !s.readOnly && !s.memoryOnly() {
+		if err := s.file.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("error syncing log file: %w", err))
+		}
+	}
+	// a failed store's index and bloom filter may describe records that
+	// never made it to the log, they are rebuilt when it is reopened
+	failed := s.Err() != nil
+	if s.index != nil && !s.readOnly && !failed {
+		if err := s.saveIndex(); err != nil {
+			errs = append(errs, fmt.Errorf("error saving index: %w", err))
+		}
+	}
+	if s.bloom != nil && !s.readOnly && !failed {
+		if err := s.saveBloom(); err != nil {
+			errs = append(errs, fmt.Errorf("error saving bloom filter: %w", err))
+		}
+	}
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing log file: %w", err))
+		}
+	}
+	if s.lock != nil {
+		if err := s.lock.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error releasing lock: %w", err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// find the entries whose key and current value fn returns true for
 func (s *Store) FindByFunction(fn func(string, string) bool) ([]Entry, error) {
+	var entries []Entry
+	err := s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(ctx context.Context) (err error) {
+		entries, err = s.findByFunction(ctx, fn)
+		return err
+	})
+	return entries, err
+}
+
+func (s *Store) findByFunction(ctx context.Context, fn func(string, string) bool) ([]Entry, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	now := time.Now().UnixNano()
 	var results = make(map[string]string)
-	for key, value := range s.data {
-		if fn(key, value) {
-			results[key] = value
+	if s.useMemory {
+		for _, entry := range s.memEntries(now) {
+			if fn(entry.Key, entry.Value) {
+				results[entry.Key] = entry.Value
+			}
 		}
 	}
 
 	// file-only mode
 	if !s.useMemory {
-		file, err := os.Open(s.filename)
-		if err != nil {
-			fmt.Println("Error opening log file:", err)
-			return nil, err
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			var entry Entry
-			if err := json.Unmarshal([]byte(line), &entry); err != nil {
-				continue
-			}
-			if entry.Deleted {
-				continue
+		err := s.scanFile(ctx, func(key, value string) bool {
+			if fn(key, value) {
+				results[key] = value
 			}
-			if fn(entry.Key, entry.Value) {
-				results[entry.Key] = entry.Value
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading log file:", err)
+			return true
+		})
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -266,7 +1237,7 @@ func (s *Store) FindByFunction(fn func(string, string) bool) ([]Entry, error) {
 		result = append(result, Entry{Key: key, Value: value})
 	}
 	if len(result) == 0 {
-		return nil, fmt.Errorf("no entries found matching the criteria")
+		return nil, fmt.Errorf("no entries found matching the criteria: %w", ErrKeyNotFound)
 	}
 
 	return result, nil
@@ -0,0 +1,222 @@
+// Package lineserver serves a keyvalue.Store over a line-based text protocol,
+// usually on a Unix socket, so shell scripts and other local processes can
+// use it with nc or socat:
+//
+//	$ echo 'SET greeting hello world' | nc -U /tmp/kv.sock
+//	OK
+//	$ echo 'GET greeting' | nc -U /tmp/kv.sock
+//	OK hello world
+//
+// every request is a line holding a command and its arguments separated by
+// spaces, and every reply is a single line starting with OK, NOTFOUND or
+// ERR followed by a message:
+//
+//	GET key          OK value, or NOTFOUND
+//	SET key value    OK, the value is the rest of the line
+//	DEL key          OK
+//	QUIT             OK, then the connection is closed
+//
+// keys can't hold spaces and values can't hold newlines, a line feed ends
+// the request and a carriage return before it is dropped.
+//
+// there is no authentication, so ListenAndServe makes the socket accessible
+// only to the user the server runs as.
+package lineserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// the longest request line read, longer ones close the connection
+const maxLineSize = 64 << 20
+
+// a line protocol server backed by a store
+type Server struct {
+	store *keyvalue.Store
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// create a server for the given store
+func New(store *keyvalue.Store) *Server {
+	return &Server{store: store, conns: make(map[net.Conn]struct{})}
+}
+
+// listen on a Unix socket at path, readable and writable only by the user
+// the server runs as, and serve until Close is called, which removes the
+// socket. a socket left behind by a server that didn't shut down cleanly is
+// replaced, but not one another server is still listening on.
+func (s *Server) ListenAndServe(path string) error {
+	l, err := net.Listen("unix", path)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+			conn.Close()
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing stale socket: %w", err)
+		}
+		l, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("error restricting socket permissions: %w", err)
+	}
+	return s.Serve(l)
+}
+
+// accept connections from l until Close is called. a clean shutdown returns
+// nil.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errors.New("lineserver: server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// stop accepting connections, close open ones and wait for their handlers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, maxLineSize)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		quit := s.exec(w, line)
+		if err := w.Flush(); err != nil || quit {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(w, "ERR %v\n", err)
+		w.Flush()
+	}
+}
+
+// run a request line and write its reply, reporting whether the client
+// asked to quit
+func (s *Server) exec(w *bufio.Writer, line string) bool {
+	command, rest, _ := strings.Cut(strings.TrimLeft(line, " "), " ")
+	switch strings.ToUpper(command) {
+	case "GET":
+		key, ok := singleArg(w, command, rest)
+		if !ok {
+			return false
+		}
+		value, exists := s.store.Get(key)
+		if !exists {
+			w.WriteString("NOTFOUND\n")
+			return false
+		}
+		fmt.Fprintf(w, "OK %s\n", value)
+	case "SET":
+		key, value, ok := strings.Cut(rest, " ")
+		if !ok || key == "" {
+			w.WriteString("ERR usage: SET key value\n")
+			return false
+		}
+		if err := s.store.Set(key, value); err != nil {
+			writeError(w, err)
+			return false
+		}
+		w.WriteString("OK\n")
+	case "DEL":
+		key, ok := singleArg(w, command, rest)
+		if !ok {
+			return false
+		}
+		if err := s.store.Delete(key); err != nil {
+			writeError(w, err)
+			return false
+		}
+		w.WriteString("OK\n")
+	case "QUIT":
+		w.WriteString("OK\n")
+		return true
+	default:
+		fmt.Fprintf(w, "ERR unknown command %q\n", command)
+	}
+	return false
+}
+
+// the key of a command that takes only a key, writing an error if there
+// isn't exactly one
+func singleArg(w *bufio.Writer, command, rest string) (string, bool) {
+	if rest == "" || strings.Contains(rest, " ") {
+		fmt.Fprintf(w, "ERR usage: %s key\n", strings.ToUpper(command))
+		return "", false
+	}
+	return rest, true
+}
+
+// write an error reply, keeping it on one line
+func writeError(w *bufio.Writer, err error) {
+	msg := strings.ReplaceAll(err.Error(), "\n", " ")
+	fmt.Fprintf(w, "ERR %s\n", msg)
+}
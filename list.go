@@ -0,0 +1,69 @@
+package keyvalue
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+// options for List
+type ListOptions struct {
+	Prefix  string // Only list keys starting with this
+	Cursor  string // Continue after the page that returned this cursor, empty for the first page
+	Limit   int    // Entries per page (0 or less lists everything in one page)
+	Reverse bool   // List keys in descending order
+}
+
+// list entries sorted by key a page at a time, in descending order with
+// ListOptions.Reverse. the returned cursor is passed back in
+// ListOptions.Cursor to get the next page, and is empty once there are no
+// more entries.
+func (s *Store) List(opts ListOptions) (entries []Entry, nextCursor string, err error) {
+	start, end := opts.Prefix, prefixEnd(opts.Prefix)
+	if opts.Cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+		}
+		switch {
+		case !opts.Reverse:
+			// the smallest key that sorts after the last one listed
+			start = max(start, string(last)+"\x00")
+		case end == "":
+			end = string(last)
+		default:
+			end = min(end, string(last))
+		}
+	}
+
+	// one entry more than a page tells whether there is another one
+	limit := 0
+	if opts.Limit > 0 {
+		limit = opts.Limit + 1
+	}
+	err = s.runFunc(Operation{Type: OpScan, Ctx: context.Background(), Key: opts.Prefix}, func(context.Context) (err error) {
+		entries, err = s.readRange(start, end, limit, opts.Reverse)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		nextCursor = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Key))
+	}
+	return entries, nextCursor, nil
+}
+
+// the smallest key that sorts after every key starting with prefix, or ""
+// if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
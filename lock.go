@@ -0,0 +1,42 @@
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// how often a held lock is retried while waiting for it
+const lockRetryInterval = 50 * time.Millisecond
+
+// returned by tryLock when another process holds the lock
+var errLockHeld = errors.New("lock held")
+
+// take an exclusive lock on a file next to the log so only one process
+// appends to it at a time, waiting up to wait for another process to release
+// it. the lock file, rather than the log, is locked because Compact replaces
+// the log file. the lock is released by closing the returned file.
+func lockFile(filename string, wait time.Duration) (*os.File, error) {
+	file, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := tryLock(file)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, errLockHeld) {
+			file.Close()
+			return nil, fmt.Errorf("error locking log file: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLocked, filename)
+		}
+		time.Sleep(min(lockRetryInterval, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,14 @@
+package keyvalue
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discards every record, the logger used when StoreConfig.Logger is nil
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
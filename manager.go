@@ -0,0 +1,406 @@
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// longest store name a Manager accepts
+const maxStoreName = 200
+
+// how a Manager opens and closes its stores
+type ManagerConfig struct {
+	Store       StoreConfig                           // Config every store is opened with
+	IdleTimeout time.Duration                         // Close stores unused for this long (0 keeps them open until Close)
+	MaxOpen     int                                   // Close the least recently used idle stores once more than this many are open (0 means no limit)
+	Setup       func(name string, store *Store) error // Called on every store once it is opened, like to set quotas. an error closes it again and fails the call opening it
+}
+
+// a store opened by a Manager, or being opened
+type managedStore struct {
+	name     string
+	store    *Store
+	err      error         // Why the store failed to open
+	ready    chan struct{} // Closed once the store is open or failed to open
+	users    int           // Calls using the store, it isn't closed while there are any
+	lastUsed time.Time
+	closing  bool          // Close the store once the last user is done, see CloseStore
+	done     chan struct{} // Closed once the store is closed after being detached
+}
+
+// opens and closes many named stores kept under a directory, each with its
+// own log file, so a server can host a store per tenant without keeping
+// every one of them open. stores are opened when first used and, with an
+// IdleTimeout or MaxOpen, closed again once unused.
+type Manager struct {
+	dir     string
+	config  ManagerConfig
+	logger  *slog.Logger
+	mu      sync.Mutex
+	stores  map[string]*managedStore // Open stores and stores being opened by name
+	closing map[string]*managedStore // Stores being closed by name, which mustn't be opened again until they are
+	closed  bool
+	opened  uint64     // Stores opened since the manager was created
+	totals  StoreStats // Counters of the stores closed so far
+	inUse   sync.WaitGroup
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// totals over the stores of a Manager, see Manager.Stats
+type ManagerStats struct {
+	Open   int        // Stores open now
+	Opened uint64     // Times a store was opened since the manager was created
+	Totals StoreStats // Counters summed over every store since the manager was created, sizes and Compacted over the open ones
+}
+
+// create a manager for the stores in dir, creating it if it doesn't exist.
+// no store is opened until it is used.
+func NewManager(dir string, config ManagerConfig) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating store directory: %w", err)
+	}
+	m := &Manager{
+		dir:     dir,
+		config:  config,
+		logger:  config.Store.Logger,
+		stores:  make(map[string]*managedStore),
+		closing: make(map[string]*managedStore),
+		stop:    make(chan struct{}),
+	}
+	if m.logger == nil {
+		m.logger = slog.New(discardHandler{})
+	}
+	if config.IdleTimeout > 0 {
+		m.wg.Add(1)
+		go m.idleLoop(config.IdleTimeout)
+	}
+	return m, nil
+}
+
+// check a store name can be used as a file name: letters, digits, '-', '_'
+// and '.', not starting with a '.'
+func checkStoreName(name string) error {
+	if name == "" || len(name) > maxStoreName || name[0] == '.' {
+		return fmt.Errorf("%q: %w", name, ErrInvalidStoreName)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("%q: %w", name, ErrInvalidStoreName)
+		}
+	}
+	return nil
+}
+
+// the log file of the named store
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.dir, name+".log")
+}
+
+// call fn with the named store, opening it first if it isn't open. the store
+// stays open until fn returns, so fn mustn't keep it, and it mustn't close it.
+// stores that don't exist yet are created.
+func (m *Manager) Use(name string, fn func(store *Store) error) error {
+	e, err := m.acquire(name)
+	if err != nil {
+		return err
+	}
+	defer m.release(e)
+	return fn(e.store)
+}
+
+// take a reference to the named store, opening it if needed
+func (m *Manager) acquire(name string) (*managedStore, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrManagerClosed
+	}
+	m.inUse.Add(1)
+	if e, ok := m.stores[name]; ok {
+		e.users++
+		m.mu.Unlock()
+		<-e.ready
+		if e.err != nil {
+			m.release(e)
+			return nil, e.err
+		}
+		return e, nil
+	}
+
+	e := &managedStore{name: name, ready: make(chan struct{}), users: 1}
+	m.stores[name] = e
+	prev := m.closing[name]
+	evicted := m.evictLocked()
+	m.mu.Unlock()
+	m.closeStores(evicted)
+
+	// the log is still locked by the store being closed
+	if prev != nil {
+		<-prev.done
+	}
+	store, err := m.open(name)
+	m.mu.Lock()
+	e.store, e.err = store, err
+	if e.err == nil {
+		m.opened++
+	} else if m.stores[name] == e {
+		// let the next call try again
+		delete(m.stores, name)
+	}
+	m.mu.Unlock()
+	close(e.ready)
+	if e.err != nil {
+		m.release(e)
+		return nil, e.err
+	}
+	return e, nil
+}
+
+// open the named store and run config.Setup on it
+func (m *Manager) open(name string) (*Store, error) {
+	store, err := NewStore(m.path(name), m.config.Store)
+	if err != nil {
+		return nil, fmt.Errorf("error opening store %q: %w", name, err)
+	}
+	if m.config.Setup != nil {
+		if err := m.config.Setup(name, store); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("error setting up store %q: %w", name, err)
+		}
+	}
+	return store, nil
+}
+
+// drop a reference taken by acquire, closing the store if CloseStore asked
+// for it while it was in use, or if it failed so the next call reopens it,
+// see Store.Err
+func (m *Manager) release(e *managedStore) {
+	m.mu.Lock()
+	e.users--
+	e.lastUsed = time.Now()
+	var detached []*managedStore
+	if e.users == 0 && e.err == nil && (e.closing || e.store.Err() != nil) {
+		detached = append(detached, m.detachLocked(e))
+	}
+	m.mu.Unlock()
+	m.closeStores(detached)
+	m.inUse.Done()
+}
+
+// take an idle store out of stores so it can be closed without the lock.
+// the caller must hold mu.
+func (m *Manager) detachLocked(e *managedStore) *managedStore {
+	delete(m.stores, e.name)
+	e.done = make(chan struct{})
+	m.closing[e.name] = e
+	return e
+}
+
+// detach the least recently used idle stores while more than MaxOpen are
+// open, counting the one being opened. the caller must hold mu.
+func (m *Manager) evictLocked() []*managedStore {
+	if m.config.MaxOpen <= 0 {
+		return nil
+	}
+	var evicted []*managedStore
+	for len(m.stores) > m.config.MaxOpen {
+		var victim *managedStore
+		for _, e := range m.stores {
+			if e.users == 0 && (victim == nil || e.lastUsed.Before(victim.lastUsed)) {
+				victim = e
+			}
+		}
+		if victim == nil {
+			break
+		}
+		evicted = append(evicted, m.detachLocked(victim))
+	}
+	return evicted
+}
+
+// close detached stores, keeping their counters for Stats. errors are
+// logged, and the first one is returned.
+func (m *Manager) closeStores(detached []*managedStore) error {
+	var first error
+	for _, e := range detached {
+		counters := e.store.counterStats()
+		err := e.store.Close()
+		if err != nil {
+			m.logger.Error("error closing store", "store", e.name, "err", err)
+			if first == nil {
+				first = fmt.Errorf("error closing store %q: %w", e.name, err)
+			}
+		}
+		m.mu.Lock()
+		addStats(&m.totals, counters)
+		delete(m.closing, e.name)
+		close(e.done)
+		m.mu.Unlock()
+	}
+	return first
+}
+
+// add the counters of o to t
+func addStats(t *StoreStats, o StoreStats) {
+	t.Sets += o.Sets
+	t.Gets += o.Gets
+	t.Hits += o.Hits
+	t.Misses += o.Misses
+	t.Deletes += o.Deletes
+	t.Compactions += o.Compactions
+	t.BytesWritten += o.BytesWritten
+}
+
+// close the named store if it is open. a store in use is closed once the
+// calls using it return, and calls made meanwhile still get it.
+func (m *Manager) CloseStore(name string) error {
+	m.mu.Lock()
+	e, ok := m.stores[name]
+	if !ok {
+		m.mu.Unlock()
+		return nil
+	}
+	if e.users > 0 {
+		e.closing = true
+		m.mu.Unlock()
+		return nil
+	}
+	detached := m.detachLocked(e)
+	m.mu.Unlock()
+	return m.closeStores([]*managedStore{detached})
+}
+
+// close stores that haven't been used for timeout, checking every half of it
+func (m *Manager) idleLoop(timeout time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(max(timeout/2, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			var idle []*managedStore
+			for _, e := range m.stores {
+				if e.users == 0 && time.Since(e.lastUsed) >= timeout {
+					idle = append(idle, m.detachLocked(e))
+				}
+			}
+			m.mu.Unlock()
+			m.closeStores(idle)
+		}
+	}
+}
+
+// the names of the stores open now
+func (m *Manager) Open() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.stores))
+	for name, e := range m.stores {
+		if e.store != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the names of every store in the directory, open or not, sorted
+func (m *Manager) Names() ([]string, error) {
+	files, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading store directory: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".log")
+		if ok && file.Type().IsRegular() && checkStoreName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// report totals over the manager's stores. the sizes come from Stats of
+// every open store, which reads the whole log of those in file-only mode.
+func (m *Manager) Stats() ManagerStats {
+	m.mu.Lock()
+	stats := ManagerStats{Opened: m.opened, Totals: m.totals}
+	var open []*managedStore
+	for _, e := range m.stores {
+		if e.store != nil {
+			// keep it from being closed while it is read
+			e.users++
+			m.inUse.Add(1)
+			open = append(open, e)
+		}
+	}
+	m.mu.Unlock()
+
+	stats.Open = len(open)
+	var live int
+	for _, e := range open {
+		s := e.store.Stats()
+		addStats(&stats.Totals, s)
+		stats.Totals.Keys += s.Keys
+		stats.Totals.LogSize += s.LogSize
+		stats.Totals.Records += s.Records
+		stats.Totals.StaleRecords += s.StaleRecords
+		live += s.Records - s.StaleRecords
+		if s.Compacted.After(stats.Totals.Compacted) {
+			stats.Totals.Compacted = s.Compacted
+		}
+		m.release(e)
+	}
+	stats.Totals.LiveRatio = 1
+	if stats.Totals.Records > 0 {
+		stats.Totals.LiveRatio = float64(live) / float64(stats.Totals.Records)
+	}
+	return stats
+}
+
+// close every store, waiting for the calls using them to return first.
+// calls made after Close fail with ErrManagerClosed.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+	close(m.stop)
+	m.wg.Wait()
+	m.inUse.Wait()
+
+	m.mu.Lock()
+	var open []*managedStore
+	for _, e := range m.stores {
+		open = append(open, m.detachLocked(e))
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, e := range open {
+		if err := m.closeStores([]*managedStore{e}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,121 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// picks the entry a key ends up with when both stores being merged have it,
+// see Merge. remote is Deleted if the other store deleted the key, and
+// returning an entry with Deleted set deletes it.
+type ConflictFunc func(local, remote Entry) Entry
+
+// the newer of two entries by update time, then sequence number, keeping
+// local on a tie. the default ConflictFunc for Merge.
+func LastWriteWins(local, remote Entry) Entry {
+	if remote.UpdatedAt != local.UpdatedAt {
+		if remote.UpdatedAt > local.UpdatedAt {
+			return remote
+		}
+		return local
+	}
+	if remote.Seq > local.Seq {
+		return remote
+	}
+	return local
+}
+
+// bring in the contents of other in a single transaction. keys only other
+// has are copied, and keys both stores have with different values or
+// expirations are settled by resolve, LastWriteWins if it is nil. deletions
+// are merged while other's log still holds their records, which compaction
+// drops, and keys other evicted count as deleted. entries that have expired
+// in other are skipped.
+func (s *Store) Merge(other *Store, resolve ConflictFunc) error {
+	if other == s {
+		return nil
+	}
+	if resolve == nil {
+		resolve = LastWriteWins
+	}
+	return s.runFunc(Operation{Type: OpLoad, Ctx: context.Background()}, func(ctx context.Context) error {
+		return s.merge(ctx, other, resolve)
+	})
+}
+
+func (s *Store) merge(ctx context.Context, other *Store, resolve ConflictFunc) error {
+
+	// the stores are never locked together, so merging two stores into each
+	// other at the same time can't deadlock
+	remote, err := other.latestEntries()
+	if err != nil {
+		return fmt.Errorf("error reading store to merge: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live, err := s.liveEntries(ctx)
+	if err != nil {
+		return err
+	}
+	local := make(map[string]Entry, len(live))
+	for _, entry := range live {
+		local[entry.Key] = entry
+	}
+
+	var ops []Entry
+	for _, theirs := range remote {
+		ours, exists := local[theirs.Key]
+		switch {
+		case !exists && theirs.Deleted:
+			continue
+		case !exists:
+		case !theirs.Deleted && ours.Value == theirs.Value && ours.ExpiresAt == theirs.ExpiresAt:
+			continue
+		default:
+			winner := resolve(ours, theirs)
+			if winner.Deleted == ours.Deleted && winner.Value == ours.Value && winner.ExpiresAt == ours.ExpiresAt {
+				continue
+			}
+			theirs = winner
+		}
+		if theirs.Deleted {
+			ops = append(ops, Entry{Key: theirs.Key, Deleted: true})
+		} else {
+			ops = append(ops, Entry{Key: theirs.Key, Value: theirs.Value, ExpiresAt: theirs.ExpiresAt})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return s.commitLocked(ops)
+}
+
+// the last record of every key in the log, deleted or not, leaving out ones
+// that have expired. a store without a log file only has its live entries.
+func (s *Store) latestEntries() ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	if s.memoryOnly() {
+		return s.memEntries(now), nil
+	}
+	latest := make(map[string]Entry)
+	err := s.replay(func(entry Entry) bool {
+		latest[entry.Key] = entry.standalone()
+		return true
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+	entries := make([]Entry, 0, len(latest))
+	for _, entry := range latest {
+		if !entry.expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,78 @@
+package keyvalue
+
+import "context"
+
+// the metadata kept in memory for a key, see Entry
+type entryMeta struct {
+	seq       uint64
+	createdAt int64
+	updatedAt int64
+}
+
+// retrieve the entry for a key along with its metadata: the sequence number
+// of the record that set it and when the key was created and last updated.
+// metadata that logs written by older versions don't have is 0.
+func (s *Store) GetEntry(key string) (Entry, bool) {
+	var entry Entry
+	var exists bool
+	err := s.runFunc(Operation{Type: OpGetEntry, Ctx: context.Background(), Key: key}, func(ctx context.Context) (err error) {
+		entry, exists, err = s.getEntry(ctx, key)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("error reading log file", "key", key, "err", err)
+		return Entry{}, false
+	}
+	return entry, exists
+}
+
+func (s *Store) getEntry(ctx context.Context, key string) (Entry, bool, error) {
+	key = s.normalize(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	s.counters.read(exists)
+	if exists {
+		s.touch(key)
+	}
+	return entry, exists, nil
+}
+
+// give an entry about to be appended its sequence number and update time.
+// commit records get neither. the caller must hold amu.
+func (s *Store) stamp(entry *Entry, now int64) {
+	if entry.Commit {
+		return
+	}
+	entry.UpdatedAt = now
+	entry.Seq = s.nextSeq(now)
+}
+
+// issue a record sequence number. like transaction IDs they start from the
+// clock, so they keep increasing across restarts without the whole log being
+// read to find the last one. the caller must hold amu.
+func (s *Store) nextSeq(now int64) uint64 {
+	seq := uint64(now)
+	if seq <= s.lastSeq {
+		seq = s.lastSeq + 1
+	}
+	s.lastSeq = seq
+	return seq
+}
+
+// when the key set by entry was created, given prev, the record the key had
+// before it if ok is set. a key is created again once it was deleted or had
+// expired.
+func creationTime(entry, prev Entry, ok bool) int64 {
+	if entry.CreatedAt != 0 {
+		return entry.CreatedAt
+	}
+	if ok && !prev.Deleted && !prev.expired(entry.UpdatedAt) && prev.CreatedAt != 0 {
+		return prev.CreatedAt
+	}
+	return entry.UpdatedAt
+}
@@ -0,0 +1,79 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// how Migrate reads the old log and writes the new one
+type MigrateOptions struct {
+	Source        StoreConfig // Opens the old log, which needs its EncryptionKey if it is encrypted
+	Format        LogFormat   // Format of the new log
+	EncryptionKey []byte      // Key to encrypt the new log's values with, nil leaves them unencrypted
+	MaxKeySize    int         // Largest key the new log may hold, 0 for no limit
+	MaxValueSize  int         // Largest value the new log may hold, 0 for no limit
+	KeepVersions  int         // Past versions of each key to carry over for GetHistory, see StoreConfig.KeepVersions
+	DropOversized bool        // Leave out entries over the new limits instead of failing
+}
+
+// write a compacted copy of the log at src to dst, converting it to
+// another format or encryption key and checking its entries against new size
+// limits, for upgrading a store whose config changed. src is opened read-only,
+// so this can run while another process owns it, and logs in every format
+// and version the store reads are migrated. dst must not already exist.
+func Migrate(src, dst string, opts MigrateOptions) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s: %w", dst, os.ErrExist)
+	}
+	aead, err := newAEAD(opts.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	recordLimit := max(recordSizeFor(opts.MaxKeySize, opts.MaxValueSize), defaultMaxRecordSize)
+
+	config := opts.Source
+	config.ReadOnly, config.UseMemory = true, false
+	config.KeepVersions = opts.KeepVersions
+	s, err := NewStore(src, config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.mu.RLock()
+	entries, err := s.compactEntries(context.Background())
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	buf := opts.Format.header()
+	for _, entry := range entries {
+		var err error
+		switch {
+		case opts.MaxKeySize > 0 && len(entry.Key) > opts.MaxKeySize:
+			err = ErrKeyTooLarge
+		case opts.MaxValueSize > 0 && len(entry.Value) > opts.MaxValueSize:
+			err = ErrValueTooLarge
+		}
+		if err != nil && opts.DropOversized {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %w", entry.Key, err)
+		}
+		data, err := encodeEntry(opts.Format, aead, entry)
+		if err != nil {
+			return err
+		}
+		if len(data) > recordLimit {
+			return fmt.Errorf("%q: %w of %d bytes", entry.Key, ErrRecordTooLarge, recordLimit)
+		}
+		buf = append(buf, data...)
+	}
+	if err := replaceFile(dst, buf); err != nil {
+		return fmt.Errorf("error writing migrated log file: %w", err)
+	}
+	return nil
+}
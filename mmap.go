@@ -0,0 +1,99 @@
+package keyvalue
+
+import (
+	"bytes"
+	"sync"
+)
+
+// the log files mapped into memory for reads in file-only mode, see
+// StoreConfig.MmapReads. readers share the mappings while holding the read
+// lock, and writers, which hold the write lock, drop the ones for the files
+// they change, so a mapping is never unmapped while it is being read.
+type logMaps struct {
+	mu   sync.Mutex
+	maps map[string][]byte // Contents of each mapped file
+}
+
+func newLogMaps() *logMaps {
+	return &logMaps{maps: make(map[string][]byte)}
+}
+
+// the contents of the log file at path, mapping it if it isn't already
+func (m *logMaps) get(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if data, ok := m.maps[path]; ok {
+		return data, nil
+	}
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m.maps[path] = data
+	return data, nil
+}
+
+// unmap a file once it is written to, it is mapped again when next read
+func (m *logMaps) drop(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if data, ok := m.maps[path]; ok {
+		unmapFile(data)
+		delete(m.maps, path)
+	}
+}
+
+// unmap every file, before the log is replaced or truncated and when the
+// store is closed
+func (m *logMaps) dropAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path, data := range m.maps {
+		unmapFile(data)
+		delete(m.maps, path)
+	}
+}
+
+// replay one file of the log from offset, see replayFile and replayTail, from
+// its mapping if reads go through one. the caller must hold at least the read
+// lock.
+func (s *Store) replayLogFile(path string, offset int64, fn func(Entry, int64) bool, onError func(error)) error {
+	if s.maps == nil {
+		if offset > 0 {
+			return replayFileTail(path, offset, s.aead, s.maxRecordSize, fn, onError)
+		}
+		return replayFile(path, s.aead, s.maxRecordSize, fn, onError)
+	}
+	data, err := s.maps.get(path)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		return replayTail(bytes.NewReader(data), int64(len(data)), path, offset, s.aead, s.maxRecordSize, fn, onError)
+	}
+	return replayFrom(bytes.NewReader(data), path, s.aead, s.maxRecordSize, fn, onError)
+}
+
+// read the record at offset in one file of the log, from its mapping if
+// reads go through one. the caller must hold at least the read lock and have
+// flushed the write buffer.
+func (s *Store) readLogRecord(path string, offset int64) (Entry, error) {
+	if s.maps == nil {
+		if path == s.activePath() {
+			return readRecordAt(s.file, s.format, s.aead, s.maxRecordSize, offset)
+		}
+		return readSegmentRecord(path, s.aead, s.maxRecordSize, offset)
+	}
+	data, err := s.maps.get(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	format, _, err := detectFormat(bytes.NewReader(data))
+	if err != nil {
+		return Entry{}, err
+	}
+	return readRecordAt(bytes.NewReader(data), format, s.aead, s.maxRecordSize, offset)
+}
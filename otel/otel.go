@@ -0,0 +1,220 @@
+// Package kvotel traces a keyvalue.Store and its servers with OpenTelemetry.
+// nothing is traced unless the store and servers are set up for it:
+//
+//	tracer := otel.Tracer("keyvalue")
+//	kvotel.Instrument(store, tracer)
+//	httpServer.UseMiddleware(kvotel.Middleware(tracer))
+//	grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(kvotel.UnaryServerInterceptor(tracer)),
+//		grpc.ChainStreamInterceptor(kvotel.StreamServerInterceptor(tracer)),
+//	)
+//
+// the store's spans nest under the spans of the requests that caused them.
+package kvotel
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// attributes of the store's spans
+const (
+	KeyLength = attribute.Key("keyvalue.key.length") // Bytes in the key, or the prefix of a scan
+	KeyCount  = attribute.Key("keyvalue.key.count")  // Keys of an operation on several keys, like get_many or commit
+	ValueSize = attribute.Key("keyvalue.value.size") // Bytes in the value written or read
+	Hit       = attribute.Key("keyvalue.hit")        // Whether a get found the key
+	ExpiresAt = attribute.Key("keyvalue.expires_at") // When a set's value or an expire expires in Unix nanoseconds
+)
+
+// trace every operation on the store with a span each named after the
+// operation, like "keyvalue.get" or "keyvalue.set_batch". spans never carry
+// keys or values, only their sizes. see keyvalue.Store.Use for the methods
+// that aren't traced.
+func Instrument(store *keyvalue.Store, tracer trace.Tracer) {
+	store.Use(func(op keyvalue.Operation, next keyvalue.Handler) error {
+		ctx := op.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, span := tracer.Start(ctx, "keyvalue."+op.Type.String(), trace.WithSpanKind(trace.SpanKindInternal))
+		defer span.End()
+		op.Ctx = ctx
+
+		switch op.Type {
+		case keyvalue.OpGet, keyvalue.OpDelete:
+			span.SetAttributes(KeyLength.Int(len(op.Key)))
+		case keyvalue.OpSet, keyvalue.OpCompareAndSwap, keyvalue.OpSetIfAbsent, keyvalue.OpGetOrSet, keyvalue.OpAppend:
+			span.SetAttributes(KeyLength.Int(len(op.Key)), ValueSize.Int(len(op.Value)))
+		default:
+			if op.Key != "" {
+				span.SetAttributes(KeyLength.Int(len(op.Key)))
+			}
+		}
+		if op.Keys != nil {
+			span.SetAttributes(KeyCount.Int(len(op.Keys)))
+		}
+		if op.ExpiresAt != 0 {
+			span.SetAttributes(ExpiresAt.Int64(op.ExpiresAt))
+		}
+
+		err := next(op)
+		if op.Type == keyvalue.OpGet && op.Result != nil && err == nil {
+			span.SetAttributes(Hit.Bool(op.Result.Found))
+			if op.Result.Found {
+				span.SetAttributes(ValueSize.Int(len(op.Result.Value)))
+			}
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
+}
+
+// a ResponseWriter remembering the status written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// lets http.ResponseController reach the wrapped writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trace every request to a handler, like an httpserver.Server, with a server
+// span named after the route that matched, continuing the trace passed in the
+// request's headers with the global propagator. see
+// httpserver.Server.UseMiddleware.
+func Middleware(tracer trace.Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			r = r.WithContext(ctx)
+			next.ServeHTTP(rec, r)
+
+			// the pattern is only known once the mux routed the request
+			if r.Pattern != "" {
+				span.SetName(r.Pattern)
+				span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+			if rec.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+		})
+	}
+}
+
+// carries the trace context in gRPC metadata for the propagator
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// start a server span for a gRPC call, continuing the trace in its metadata
+func startCall(ctx context.Context, tracer trace.Tracer, method string) (context.Context, trace.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	return tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.RPCSystemGRPC,
+		semconv.RPCMethod(method),
+	))
+}
+
+// record how a gRPC call ended on its span
+func endCall(span trace.Span, err error) {
+	s, _ := status.FromError(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(s.Code())))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, s.Message())
+	}
+	span.End()
+}
+
+// trace unary calls to a gRPC server, like kvgrpc.Server's Get, Set and
+// Delete, with a server span named after the method
+func UnaryServerInterceptor(tracer trace.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, span := startCall(ctx, tracer, info.FullMethod)
+		resp, err := handler(ctx, req)
+		endCall(span, err)
+		return resp, err
+	}
+}
+
+// a ServerStream whose context carries the call's span
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// trace streaming calls to a gRPC server, like kvgrpc.Server's Scan and
+// Watch, with a server span named after the method lasting the whole stream
+func StreamServerInterceptor(tracer trace.Tracer) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startCall(stream.Context(), tracer, info.FullMethod)
+		err := handler(srv, &tracedStream{ServerStream: stream, ctx: ctx})
+		endCall(span, err)
+		return err
+	}
+}
@@ -0,0 +1,176 @@
+package keyvalue
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// records read before a batch is handed to a decoding goroutine
+const pipelineBatch = 256
+
+// log files smaller than this are decoded on the goroutine replaying them
+const pipelineMinSize = 4 << 20
+
+// the records a replay reads one at a time, see recordReader and
+// decodePipeline
+type recordSource interface {
+	Next() (Entry, error)
+	Start() int64
+}
+
+// records read by a single goroutine in batches, decoded by several at once
+// and returned by Next in the order they are in the log, for replaying large
+// logs faster on multiple cores. reading and decoding stay a few batches
+// ahead of the records returned.
+type decodePipeline struct {
+	results chan *decodeBatch // Batches in the order they were read
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	batch   *decodeBatch // Batch Next is returning records from
+	next    int          // Index of the next record in batch
+	start   int64
+}
+
+// records read together, decoded by one goroutine
+type decodeBatch struct {
+	raw     []rawRecord
+	entries []Entry
+	errs    []error       // Why each record couldn't be read or decoded
+	err     error         // Error that ended reading after the records, io.EOF at the end of the log
+	decoded chan struct{} // Closed once entries and errs are filled in
+}
+
+// whether replaying what r reads is worth a decodePipeline: on multiple
+// cores, for a file or mapping of at least pipelineMinSize
+func pipelined(r io.Reader) bool {
+	if runtime.GOMAXPROCS(0) < 2 {
+		return false
+	}
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size() >= pipelineMinSize
+	case *os.File:
+		info, err := r.Stat()
+		return err == nil && info.Size() >= pipelineMinSize
+	}
+	return false
+}
+
+// start reading rr on a goroutine of its own and decoding what it reads on
+// others. the pipeline must be closed once it is done with, after which rr
+// isn't read anymore.
+func newDecodePipeline(rr *recordReader) *decodePipeline {
+	workers := max(runtime.GOMAXPROCS(0)-1, 1)
+	p := &decodePipeline{
+		results: make(chan *decodeBatch, 2*workers),
+		stop:    make(chan struct{}),
+	}
+	jobs := make(chan *decodeBatch, 2*workers)
+
+	p.wg.Add(1 + workers)
+	go func() {
+		defer p.wg.Done()
+		defer close(jobs)
+		defer close(p.results)
+		for {
+			batch := readBatch(rr)
+			select {
+			case jobs <- batch:
+			case <-p.stop:
+				return
+			}
+			select {
+			case p.results <- batch:
+			case <-p.stop:
+				return
+			}
+			if batch.err != nil {
+				return
+			}
+		}
+	}()
+	for range workers {
+		go func() {
+			defer p.wg.Done()
+			for batch := range jobs {
+				batch.decode(rr.format, rr.aead)
+			}
+		}()
+	}
+	return p
+}
+
+// read up to pipelineBatch records without decoding them
+func readBatch(rr *recordReader) *decodeBatch {
+	batch := &decodeBatch{decoded: make(chan struct{})}
+	for len(batch.raw) < pipelineBatch {
+		raw, err := rr.frame()
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			// only this record is bad, it is reported in its place
+			batch.raw = append(batch.raw, rawRecord{start: recErr.Offset})
+			batch.errs = append(batch.errs, err)
+			continue
+		}
+		if err != nil {
+			batch.err = err
+			break
+		}
+		batch.raw = append(batch.raw, raw)
+		batch.errs = append(batch.errs, nil)
+	}
+	return batch
+}
+
+// decode the records of the batch that were read without an error
+func (b *decodeBatch) decode(format LogFormat, aead cipher.AEAD) {
+	b.entries = make([]Entry, len(b.raw))
+	for i, raw := range b.raw {
+		if b.errs[i] == nil {
+			b.entries[i], b.errs[i] = raw.decode(format, aead)
+		}
+	}
+	close(b.decoded)
+}
+
+// the next record in the log, see recordReader.Next
+func (p *decodePipeline) Next() (Entry, error) {
+	for {
+		if b := p.batch; b != nil {
+			if p.next < len(b.raw) {
+				i := p.next
+				p.next++
+				if b.errs[i] != nil {
+					return Entry{}, b.errs[i]
+				}
+				p.start = b.raw[i].start
+				return b.entries[i], nil
+			}
+			if b.err != nil {
+				return Entry{}, b.err
+			}
+		}
+		batch, ok := <-p.results
+		if !ok {
+			return Entry{}, io.EOF
+		}
+		<-batch.decoded
+		p.batch, p.next = batch, 0
+	}
+}
+
+// the offset of the record last returned by Next
+func (p *decodePipeline) Start() int64 {
+	return p.start
+}
+
+// stop reading and decoding, waiting for the goroutines to finish so the
+// reader can be closed
+func (p *decodePipeline) Close() {
+	close(p.stop)
+	p.wg.Wait()
+}
@@ -0,0 +1,224 @@
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// returned to the operation Plan runs once its records are captured
+var errPlanned = errors.New("write planned")
+
+// returned to the operation ApplyPlan runs if it doesn't append the planned
+// records
+var errPlanChanged = errors.New("write no longer comes out as planned")
+
+// a write worked out by Plan without being made, for stores whose writes are
+// put in order elsewhere, like a replica kept by a consensus log
+type Plan struct {
+	Records []Entry           // What the write appends, without sequence numbers
+	Reads   map[string]uint64 // Sequence number of each key the write touches as it saw it, 0 if the key didn't exist
+}
+
+// a Plan or ApplyPlan in progress, which takes over the append of the
+// operation it runs, see appendPlanned
+type planState struct {
+	apply bool     // Whether ApplyPlan is running rather than Plan
+	keys  []string // Keys named by the operation, which go in Reads along with the keys it writes
+	reads bool     // Whether to fill in Reads, Set and Delete read nothing
+	plan  Plan     // What Plan captured, or what ApplyPlan writes
+	seq   uint64   // Sequence number ApplyPlan gives the records
+	done  bool     // Whether the records were captured or written
+}
+
+// work out the records op would append without writing them, so an
+// interceptor can put them in order with other nodes' writes before the
+// store writes them with ApplyPlan. op is carried out up to its append, so
+// an operation that appends nothing, like a CompareAndSwap that doesn't
+// match, returns its results and error as usual with an empty Plan. op
+// must be one passed to an Interceptor. meant for replicas, see
+// StoreConfig.Replica, whose writes all go through that interceptor: any
+// other write made while Plan runs is taken for op's.
+func (s *Store) Plan(op Operation) (Plan, error) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+
+	p := &planState{reads: op.Type != OpSet && op.Type != OpDelete}
+	if p.reads {
+		if op.Key != "" {
+			p.keys = append(p.keys, s.normalize(op.Key))
+		}
+		for _, key := range op.Keys {
+			p.keys = append(p.keys, s.normalize(key))
+		}
+	}
+	s.planning.Store(p)
+	defer s.planning.Store(nil)
+
+	err := s.handle(op)
+	if p.done {
+		return p.plan, nil
+	}
+	return Plan{}, err
+}
+
+// write the records of plan, made by Plan for op, with sequence number seq,
+// carrying op out again so its results come out as they would have. op has
+// to come out as planned: reports false without writing anything if it
+// doesn't, like when a key it reads has expired since it was planned, and
+// the records can still be written with ApplyRecords. CheckPlan checks that
+// it will.
+func (s *Store) ApplyPlan(op Operation, plan Plan, seq uint64) (bool, error) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+
+	p := &planState{apply: true, plan: plan, seq: seq}
+	s.planning.Store(p)
+	defer s.planning.Store(nil)
+
+	err := s.handle(op)
+	return p.done, err
+}
+
+// take over the append of the operation run by Plan or ApplyPlan: capture
+// its records, or write the planned ones in their place. the caller holds
+// the locks appendEntries needs.
+func (s *Store) appendPlanned(p *planState, entries []Entry) error {
+	if p.done {
+		return errPlanChanged
+	}
+	if p.apply {
+		if !samePlan(entries, p.plan.Records) {
+			return errPlanChanged
+		}
+		// the operation goes on with entries, so they become the planned
+		// records
+		for i := range entries {
+			entries[i] = p.plan.Records[i]
+			entries[i].Seq = p.seq
+		}
+		p.done = true
+		return s.appendRecords(entries, false)
+	}
+
+	records := slices.Clone(entries)
+	now := time.Now().UnixNano()
+	for i := range records {
+		if !records[i].Commit {
+			records[i].UpdatedAt = now
+		}
+	}
+	var reads map[string]uint64
+	if p.reads {
+		reads = make(map[string]uint64)
+		for _, key := range p.keys {
+			reads[key] = 0
+		}
+		for _, record := range records {
+			if !record.Commit {
+				reads[record.Key] = 0
+			}
+		}
+		for key := range reads {
+			entry, exists, err := s.lookupLocked(key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				reads[key] = entry.Seq
+			}
+		}
+	}
+	p.plan = Plan{Records: records, Reads: reads}
+	p.done = true
+	return errPlanned
+}
+
+// whether an operation carried out again appends the records it was planned
+// with, apart from the times and transaction IDs they are stamped with
+func samePlan(entries, planned []Entry) bool {
+	return slices.EqualFunc(entries, planned, func(a, b Entry) bool {
+		return a.Key == b.Key && a.Value == b.Value && a.ExpiresAt == b.ExpiresAt && a.Deleted == b.Deleted &&
+			a.Append == b.Append && a.Op == b.Op && a.Commit == b.Commit && (a.Txn == 0) == (b.Txn == 0)
+	})
+}
+
+// check that plan can be written next with ApplyPlan or ApplyRecords: the
+// keys it read still have the sequence numbers it saw, or it fails with
+// ErrStalePlan, and the keys it writes are valid and fit within the key and
+// memory limits and the quotas, which ApplyRecords doesn't check.
+func (s *Store) CheckPlan(plan Plan) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, seq := range plan.Reads {
+		entry, exists, err := s.lookupLocked(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			entry.Seq = 0
+		}
+		if entry.Seq != seq {
+			return fmt.Errorf("%q: %w", key, ErrStalePlan)
+		}
+	}
+
+	// the entry each key is left with, tombstones included
+	final := make(map[string]Entry)
+	for _, record := range plan.Records {
+		switch {
+		case record.Commit:
+			continue
+		case record.partial():
+			base, ok := final[record.Key]
+			if !ok {
+				current, _, err := s.lookupLocked(record.Key)
+				if err != nil {
+					return err
+				}
+				base = current
+			}
+			value, err := record.applyTo(base.Value)
+			if err != nil {
+				return fmt.Errorf("error applying %q record for %q: %w", record.Op, record.Key, err)
+			}
+			record = record.whole(value)
+		}
+		final[record.Key] = record.standalone()
+	}
+
+	entries := make([]Entry, 0, len(final))
+	newKeys, newBytes := 0, int64(0)
+	for key, entry := range final {
+		if !entry.Deleted {
+			if err := s.validate(key, entry.Value); err != nil {
+				return err
+			}
+		}
+		if !s.useMemory {
+			continue
+		}
+		entries = append(entries, entry)
+		if old, exists := s.memValue(key); exists {
+			newKeys, newBytes = newKeys-1, newBytes-memSize(key, old)
+		}
+		if !entry.Deleted {
+			newKeys, newBytes = newKeys+1, newBytes+memSize(key, entry.Value)
+		}
+	}
+	if !s.useMemory {
+		return nil
+	}
+	if err := s.checkQuota(entries...); err != nil {
+		return err
+	}
+	if newKeys > 0 && int(s.keys.Load())+newKeys > s.maxKeys {
+		return fmt.Errorf("%w (%d)", ErrMaxKeysReached, s.maxKeys)
+	}
+	if s.maxMemory > 0 && newBytes > 0 && s.memBytes.Load()+newBytes > s.maxMemory {
+		return fmt.Errorf("%w (%d bytes)", ErrMemoryLimitReached, s.maxMemory)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package kvprom exports the statistics of a keyvalue.Store as Prometheus
+// metrics. register a collector for each store:
+//
+//	prometheus.MustRegister(kvprom.NewCollector(store, "keyvalue"))
+package kvprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// a prometheus.Collector reading Store.Stats on every scrape
+type Collector struct {
+	store        *keyvalue.Store
+	sets         *prometheus.Desc
+	gets         *prometheus.Desc
+	hits         *prometheus.Desc
+	misses       *prometheus.Desc
+	deletes      *prometheus.Desc
+	compactions  *prometheus.Desc
+	bytesWritten *prometheus.Desc
+	keys         *prometheus.Desc
+	logSize      *prometheus.Desc
+	records      *prometheus.Desc
+	staleRecords *prometheus.Desc
+	liveRatio    *prometheus.Desc
+	compacted    *prometheus.Desc
+	loadTime     *prometheus.Desc
+}
+
+// create a collector for store with metric names starting with namespace
+func NewCollector(store *keyvalue.Store, namespace string) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, nil)
+	}
+	return &Collector{
+		store:        store,
+		sets:         desc("sets_total", "Key-value records written to the log."),
+		gets:         desc("gets_total", "Reads of a single key."),
+		hits:         desc("hits_total", "Reads that found the key."),
+		misses:       desc("misses_total", "Reads that didn't find the key."),
+		deletes:      desc("deletes_total", "Tombstones written to the log, including for evicted keys."),
+		compactions:  desc("compactions_total", "Compactions that completed."),
+		bytesWritten: desc("written_bytes_total", "Bytes appended to the log."),
+		keys:         desc("keys", "Keys in the store."),
+		logSize:      desc("log_size_bytes", "Total size of the log files."),
+		records:      desc("log_records", "Records in the log, including stale ones."),
+		staleRecords: desc("log_stale_records", "Records in the log that compaction would drop."),
+		liveRatio:    desc("log_live_ratio", "Fraction of the records in the log that aren't stale."),
+		compacted:    desc("last_compaction_timestamp_seconds", "When the last compaction finished, 0 if there was none since the store was opened."),
+		loadTime:     desc("load_duration_seconds", "How long opening the store took to replay the log."),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sets
+	ch <- c.gets
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.deletes
+	ch <- c.compactions
+	ch <- c.bytesWritten
+	ch <- c.keys
+	ch <- c.logSize
+	ch <- c.records
+	ch <- c.staleRecords
+	ch <- c.liveRatio
+	ch <- c.compacted
+	ch <- c.loadTime
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.store.Stats()
+	counter := func(desc *prometheus.Desc, v uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v))
+	}
+	counter(c.sets, stats.Sets)
+	counter(c.gets, stats.Gets)
+	counter(c.hits, stats.Hits)
+	counter(c.misses, stats.Misses)
+	counter(c.deletes, stats.Deletes)
+	counter(c.compactions, stats.Compactions)
+	counter(c.bytesWritten, stats.BytesWritten)
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	gauge(c.keys, float64(stats.Keys))
+	gauge(c.logSize, float64(stats.LogSize))
+	gauge(c.records, float64(stats.Records))
+	gauge(c.staleRecords, float64(stats.StaleRecords))
+	gauge(c.liveRatio, stats.LiveRatio)
+	var compacted float64
+	if !stats.Compacted.IsZero() {
+		compacted = float64(stats.Compacted.UnixNano()) / 1e9
+	}
+	gauge(c.compacted, compacted)
+	gauge(c.loadTime, stats.LoadTime.Seconds())
+}
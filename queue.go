@@ -0,0 +1,169 @@
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// size of the write buffer records are queued in with StoreConfig.AsyncWrites
+// unless WriteBufferSize is larger. writers that fill it write to the log
+// themselves.
+const defaultQueueSize = 1 << 20
+
+// records queued in the write buffer for writeLoop to write to the log, see
+// StoreConfig.AsyncWrites. they are counted rather than tracked one by one:
+// once the buffer has been flushed, every record queued before is in the log.
+type writeQueue struct {
+	queued  atomic.Int64 // Records queued since the store was opened
+	written atomic.Int64 // Records of them in the log, and fsynced with SyncEveryWrite
+	wake    chan struct{}
+	mu      sync.Mutex
+	waiters []queueWaiter // Calls to Written waiting for their records
+}
+
+// a call to Written waiting for the records queued before it
+type queueWaiter struct {
+	records int64
+	done    chan error
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{wake: make(chan struct{}, 1)}
+}
+
+// count records just added to the write buffer and have writeLoop write them
+func (q *writeQueue) add(n int) {
+	q.queued.Add(int64(n))
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// mark the first n records queued as written, answering the calls to
+// Written waiting for them
+func (q *writeQueue) done(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > q.written.Load() {
+		q.written.Store(n)
+	}
+	waiting := q.waiters[:0]
+	for _, w := range q.waiters {
+		if w.records <= n {
+			w.done <- nil
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	q.waiters = waiting
+}
+
+// answer every call to Written still waiting with err
+func (q *writeQueue) release(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, w := range q.waiters {
+		w.done <- err
+	}
+	q.waiters = nil
+}
+
+// the number of writes queued for the log that aren't written yet, always 0
+// without StoreConfig.AsyncWrites. a write of several records, like a batch,
+// counts each of them.
+func (s *Store) Pending() int {
+	if s.queue == nil {
+		return 0
+	}
+	return int(s.queue.queued.Load() - s.queue.written.Load())
+}
+
+// a channel that receives nil once every write made before the call is in
+// the log, and fsynced with SyncEveryWrite, or the error writing them if
+// that fails. this is how to wait for writes made with
+// StoreConfig.AsyncWrites, which return as soon as they are queued. without
+// it writes are in the log when they return, so this only flushes the write
+// buffer.
+func (s *Store) Written() <-chan error {
+	done := make(chan error, 1)
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	switch {
+	case closed:
+		done <- ErrStoreClosed
+		return done
+	case s.queue == nil:
+		done <- s.Flush()
+		return done
+	}
+
+	q := s.queue
+	records := q.queued.Load()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// checked under mu so a failure either shows here or releases the waiter
+	if err := s.Err(); err != nil {
+		done <- err
+		return done
+	}
+	if records <= q.written.Load() {
+		done <- nil
+		return done
+	}
+	q.waiters = append(q.waiters, queueWaiter{records: records, done: done})
+	return done
+}
+
+// write queued records to the log as they come in, until the store is closed.
+// records queued while the last ones are written are written together, so
+// with SyncEveryWrite one fsync covers all of them.
+func (s *Store) writeLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			// Close stops writes before stopping the loop, so this is the last
+			s.writeQueued()
+			s.queue.release(ErrStoreClosed)
+			return
+		case <-s.queue.wake:
+			s.writeQueued()
+		}
+	}
+}
+
+// flush the write buffer, fsync it with SyncEveryWrite and acknowledge the
+// records that were queued. a failure fails the store, which answers the
+// calls to Written waiting with its error.
+func (s *Store) writeQueued() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.Err() != nil {
+		return
+	}
+
+	// everything counted by now is in the buffer
+	records := s.queue.queued.Load()
+	if err := s.flushBuffer(); err != nil {
+		return
+	}
+	if s.syncMode == SyncEveryWrite {
+		// a segment rolled meanwhile closes the file it sealed, after
+		// syncing it along with the records flushed to it
+		s.wmu.Lock()
+		file := s.file
+		s.wmu.Unlock()
+		if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			s.fail(fmt.Errorf("error syncing log file: %w", err))
+			return
+		}
+	}
+	s.queue.done(records)
+}
@@ -0,0 +1,151 @@
+package keyvalue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync/atomic"
+)
+
+// a limit on the bytes of keys and values under a prefix, see QuotaFor
+type quota struct {
+	limit int64
+	used  atomic.Int64 // Bytes of the keys and values in memory under the prefix
+}
+
+// quotas by prefix. a set is never changed once stored in a quotaTable, so
+// it can be read without the store's locks, but the counters in it are
+// shared with the sets replacing it.
+type quotaSet map[string]*quota
+
+// the current quotaSet, nil without any quotas
+type quotaTable struct {
+	set atomic.Pointer[quotaSet]
+}
+
+func (t *quotaTable) Load() quotaSet {
+	if set := t.set.Load(); set != nil {
+		return *set
+	}
+	return nil
+}
+
+func (t *quotaTable) Store(set quotaSet) {
+	if len(set) == 0 {
+		t.set.Store(nil)
+	} else {
+		t.set.Store(&set)
+	}
+}
+
+// the bytes a key and its value count towards a quota
+func quotaSize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// limit the keys starting with prefix and their values to bytes in total,
+// or remove the limit if bytes isn't positive. writes that would take the
+// prefix over its quota fail with ErrQuotaExceeded, writes that shrink it are
+// let through even while it is over, like after lowering the quota. a key
+// under more than one prefix with a quota counts towards all of them.
+// quotas aren't saved in the log and are only kept in memory mode.
+func (s *Store) QuotaFor(prefix string, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if !s.useMemory {
+		return errors.New("quotas need a store kept in memory")
+	}
+
+	quotas := maps.Clone(s.quotas.Load())
+	if quotas == nil {
+		quotas = make(quotaSet)
+	}
+	if bytes <= 0 {
+		delete(quotas, prefix)
+	} else if q, ok := quotas[prefix]; ok {
+		// the prefix is already counted, keep the counter
+		q.limit = bytes
+	} else {
+		q := &quota{limit: bytes}
+		for _, key := range s.prefixRange(prefix) {
+			if value, ok := s.memValue(key); ok {
+				q.used.Add(quotaSize(key, value))
+			}
+		}
+		quotas[prefix] = q
+	}
+	s.quotas.Store(quotas)
+	return nil
+}
+
+// the bytes of the keys starting with prefix and their values. prefixes with
+// a quota are counted as they are written, others are added up from the keys
+// held, which in file-only mode means reading the log.
+func (s *Store) Usage(prefix string) (int64, error) {
+	if q, ok := s.quotas.Load()[prefix]; ok {
+		return q.used.Load(), nil
+	}
+	entries, err := s.scan(context.Background(), prefix)
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, entry := range entries {
+		used += quotaSize(entry.Key, entry.Value)
+	}
+	return used, nil
+}
+
+// call fn for every quota covering key
+func (q quotaSet) each(key string, fn func(prefix string, q *quota)) {
+	if len(q) == 0 {
+		return
+	}
+	for i := 0; i <= len(key); i++ {
+		if quota, ok := q[key[:i]]; ok {
+			fn(key[:i], quota)
+		}
+	}
+}
+
+// count a change in the size of a key held in memory towards the quotas
+// covering it
+func (s *Store) addUsage(key string, delta int64) {
+	s.quotas.Load().each(key, func(_ string, q *quota) { q.used.Add(delta) })
+}
+
+// fail with ErrQuotaExceeded if writing entries, sets and tombstones, would
+// take a prefix over its quota. when a key appears more than once the last
+// one wins. the caller must hold at least the read lock.
+func (s *Store) checkQuota(entries ...Entry) error {
+	quotas := s.quotas.Load()
+	if quotas == nil {
+		return nil
+	}
+	final := make(map[string]Entry, len(entries))
+	for _, entry := range entries {
+		final[entry.Key] = entry
+	}
+	growth := make(map[string]int64)
+	for key, entry := range final {
+		var delta int64
+		if !entry.Deleted {
+			delta = quotaSize(key, entry.Value)
+		}
+		if old, exists := s.memValue(key); exists {
+			delta -= quotaSize(key, old)
+		}
+		quotas.each(key, func(prefix string, _ *quota) { growth[prefix] += delta })
+	}
+	for prefix, delta := range growth {
+		q := quotas[prefix]
+		if delta > 0 && q.used.Load()+delta > q.limit {
+			return fmt.Errorf("%q: %w of %d bytes", prefix, ErrQuotaExceeded, q.limit)
+		}
+	}
+	return nil
+}
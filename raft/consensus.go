@@ -0,0 +1,704 @@
+package kvraft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/internal/msgpack"
+)
+
+// most entries written to the store at once
+const maxApplyEntries = 1024
+
+// how long sending a node the leader's store may take
+const snapshotTimeout = time.Minute
+
+// returned by propose on a node that isn't the leader
+var errNotLeader = errors.New("raft: not the leader")
+
+// index of the last entry in the log. the caller must hold mu, like for the
+// rest of the functions here unless they say otherwise.
+func (n *Node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.entries))
+}
+
+// term of the entry at index, which is between snapIndex and lastIndex
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapIndex {
+		return n.snapTerm
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+func (n *Node) saveMeta() error {
+	return n.log.saveMeta(meta{Term: n.term, Vote: n.vote, SnapIndex: n.snapIndex, SnapTerm: n.snapTerm})
+}
+
+// votes or copies of an entry that make a majority, counting this node
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// pick when to call an election if the leader stays silent, at random so
+// nodes rarely call one at once
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(n.config.ElectionTimeout + rand.N(n.config.ElectionTimeout))
+}
+
+// stop taking part in the cluster once the log or store can't be written,
+// since the node can no longer keep its promises
+func (n *Node) fail(err error) {
+	if n.err == nil {
+		slog.Error("raft node stopped", "id", n.config.ID, "err", err)
+		n.err = err
+	}
+	n.role, n.leader = follower, ""
+	n.failWaiters(err)
+	n.notifyApplied()
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.done <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) notifyApplied() {
+	close(n.applied)
+	n.applied = make(chan struct{})
+}
+
+func (n *Node) signalCommit() {
+	select {
+	case n.commits <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) signalReplicators() {
+	for _, wake := range n.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// follow in term, or step down to following in the current term. moving to
+// a later term forgets the vote and leader of the earlier one.
+func (n *Node) becomeFollower(term uint64) {
+	if n.role == leader {
+		n.failWaiters(ErrLeadershipLost)
+	}
+	n.role = follower
+	if term > n.term {
+		n.term, n.vote, n.leader = term, "", ""
+		if err := n.saveMeta(); err != nil {
+			n.fail(err)
+		}
+	}
+}
+
+// append entries to the log, on disk first
+func (n *Node) appendEntries(entries ...logEntry) error {
+	if err := n.log.append(n.lastIndex()+1, entries); err != nil {
+		return err
+	}
+	n.entries = append(n.entries, entries...)
+	return nil
+}
+
+// drop the entries from index on, which mustn't be committed
+func (n *Node) truncate(index uint64) error {
+	if err := n.log.remove(index, n.lastIndex()); err != nil {
+		return err
+	}
+	n.entries = n.entries[:index-n.snapIndex-1]
+	return nil
+}
+
+// call elections whenever the leader stays silent past the deadline
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.role != leader && n.err == nil && time.Now().After(n.deadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// stand for leader in the next term, asking every other node for its vote
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.vote, n.leader = n.config.ID, ""
+	n.resetDeadline()
+	if err := n.saveMeta(); err != nil {
+		n.fail(err)
+		return
+	}
+
+	req := voteRequest{Term: n.term, Candidate: n.config.ID, LastIndex: n.lastIndex(), LastTerm: n.termAt(n.lastIndex())}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+			defer cancel()
+			var resp voteResponse
+			if err := n.call(ctx, peer, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// take over as leader of the current term, starting a replicator for every
+// other node
+func (n *Node) becomeLeader() {
+	n.role, n.leader = leader, n.config.ID
+	// committing an entry of its own term commits the entries the earlier
+	// leaders left behind too
+	if err := n.appendEntries(logEntry{Term: n.term}); err != nil {
+		n.fail(err)
+		return
+	}
+	slog.Info("raft node became leader", "id", n.config.ID, "term", n.term)
+
+	n.nextIndex = make(map[string]uint64, len(n.peers))
+	n.matchIndex = make(map[string]uint64, len(n.peers))
+	n.wake = make(map[string]chan struct{}, len(n.peers))
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex()
+		n.wake[peer] = make(chan struct{}, 1)
+		n.wg.Add(1)
+		go n.replicate(peer, n.term, n.wake[peer])
+	}
+	n.advanceCommit()
+}
+
+// move the commit index up to the last entry of the current term a
+// majority of the nodes have
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.signalCommit()
+			return
+		}
+	}
+}
+
+// append the entry of a write to the leader's log and wait until it is
+// committed and written to the store, returning its index. a write with
+// records waits for the store to have every entry before it, so the plan can
+// be checked against the store as the entry will find it.
+func (n *Node) propose(ctx context.Context, req proposeRequest) (uint64, error) {
+	entry := logEntry{Records: req.Plan.Records, ID: req.ID}
+	if len(entry.Records) > 0 {
+		data, err := msgpack.Marshal(entry)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) > maxEntrySize {
+			return 0, fmt.Errorf("raft: write of %d bytes exceeds max of %d", len(data), maxEntrySize)
+		}
+	}
+
+	n.mu.Lock()
+	for {
+		if n.err != nil {
+			n.mu.Unlock()
+			return 0, n.err
+		}
+		if n.closed {
+			n.mu.Unlock()
+			return 0, ErrNodeClosed
+		}
+		if n.role != leader {
+			n.mu.Unlock()
+			return 0, errNotLeader
+		}
+		if len(entry.Records) == 0 || n.lastApplied == n.lastIndex() {
+			break
+		}
+		applied := n.applied
+		n.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-applied:
+		}
+		n.mu.Lock()
+	}
+	if len(entry.Records) > 0 {
+		if err := n.store.CheckPlan(req.Plan); err != nil {
+			n.mu.Unlock()
+			return 0, err
+		}
+	}
+	entry.Term = n.term
+	if err := n.appendEntries(entry); err != nil {
+		n.fail(err)
+		n.mu.Unlock()
+		return 0, err
+	}
+	index := n.lastIndex()
+	w := waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[index] = w
+	n.signalReplicators()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	select {
+	case err := <-w.done:
+		return index, err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.waiters[index] == w {
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// keep a node up to date while this node leads term, sending it heartbeats
+// when idle. runs without mu.
+func (n *Node) replicate(peer string, term uint64, wake <-chan struct{}) {
+	defer n.wg.Done()
+	heartbeat := time.NewTimer(0)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-heartbeat.C:
+		case <-wake:
+		}
+		heartbeat.Reset(n.config.HeartbeatInterval)
+		for {
+			more, leading := n.sendEntries(peer, term)
+			if !leading {
+				return
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// send a node the entries it is missing, or just the commit index if it has
+// them all. reports whether it is missing more, and whether this node still
+// leads term. runs without mu.
+func (n *Node) sendEntries(peer string, term uint64) (more, leading bool) {
+	n.mu.Lock()
+	if n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false, false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	prev := next - 1
+	last := min(n.lastIndex(), prev+maxAppendEntries)
+	size := 0
+	for index := prev + 1; index <= last; index++ {
+		size += n.entries[index-n.snapIndex-1].size()
+		if size > maxAppendBytes && index > prev+1 {
+			last = index - 1
+			break
+		}
+	}
+	req := appendRequest{
+		Term:      term,
+		Leader:    n.config.ID,
+		PrevIndex: prev,
+		PrevTerm:  n.termAt(prev),
+		Entries:   slices.Clone(n.entries[prev-n.snapIndex : last-n.snapIndex]),
+		Commit:    n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	defer cancel()
+	var resp appendResponse
+	if err := n.call(ctx, peer, "/raft/append", req, &resp); err != nil {
+		// try again with the next heartbeat
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return false, false
+	}
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	if resp.Success {
+		match := prev + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		n.advanceCommit()
+	} else {
+		n.nextIndex[peer] = max(min(resp.Next, prev), 1)
+	}
+	return n.nextIndex[peer] <= n.lastIndex(), true
+}
+
+// send a node that needs entries cut from the log the store instead, as of
+// the last entry written to it. runs without mu.
+func (n *Node) sendSnapshot(peer string, term uint64) (more, leading bool) {
+	// the store isn't written while it is read
+	n.amu.Lock()
+	n.mu.Lock()
+	index, lastTerm := n.lastApplied, n.termAt(n.lastApplied)
+	n.mu.Unlock()
+	state, _, unsubscribe, err := n.store.Subscribe(0)
+	n.amu.Unlock()
+	if err != nil {
+		return false, true
+	}
+	unsubscribe()
+
+	ctx, cancel := context.WithTimeout(n.ctx, snapshotTimeout)
+	defer cancel()
+	req := snapshotRequest{Term: term, Leader: n.config.ID, Index: index, LastTerm: lastTerm, State: state}
+	var resp snapshotResponse
+	if err := n.call(ctx, peer, "/raft/snapshot", req, &resp); err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return false, false
+	}
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = max(n.nextIndex[peer], index+1)
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex(), true
+}
+
+func (n *Node) handleVote(_ context.Context, req voteRequest) voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	if n.err != nil || n.closed || req.Term < n.term {
+		return voteResponse{Term: n.term}
+	}
+
+	// only a candidate with every entry this node has can hold every
+	// committed one
+	lastIndex := n.lastIndex()
+	lastTerm := n.termAt(lastIndex)
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= lastIndex)
+	if (n.vote != "" && n.vote != req.Candidate) || !upToDate {
+		return voteResponse{Term: n.term}
+	}
+	n.vote = req.Candidate
+	if err := n.saveMeta(); err != nil {
+		n.fail(err)
+		return voteResponse{Term: n.term}
+	}
+	n.resetDeadline()
+	return voteResponse{Term: n.term, Granted: true}
+}
+
+func (n *Node) handleAppend(_ context.Context, req appendRequest) appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term >= n.term && (req.Term > n.term || n.role != follower) {
+		n.becomeFollower(req.Term)
+	}
+	if n.err != nil || n.closed || req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	n.leader = req.Leader
+	n.resetDeadline()
+
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < n.snapIndex {
+		// the entries up to the snapshot are committed, so they match
+		skip := min(n.snapIndex-prev, uint64(len(entries)))
+		prev, entries = n.snapIndex, entries[skip:]
+	} else if prev > n.lastIndex() {
+		return appendResponse{Term: n.term, Next: n.lastIndex() + 1}
+	} else if term := n.termAt(prev); term != req.PrevTerm {
+		// skip back past the conflicting term in one go
+		next := prev
+		for next > n.snapIndex+1 && n.termAt(next-1) == term {
+			next--
+		}
+		return appendResponse{Term: n.term, Next: next}
+	}
+
+	for i, entry := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= n.lastIndex() && n.termAt(index) == entry.Term {
+			continue
+		}
+		if index <= n.lastIndex() {
+			if index <= n.commitIndex {
+				n.fail(fmt.Errorf("raft: leader %s conflicts with committed entry %d", req.Leader, index))
+				return appendResponse{Term: n.term}
+			}
+			if err := n.truncate(index); err != nil {
+				n.fail(err)
+				return appendResponse{Term: n.term}
+			}
+		}
+		if err := n.appendEntries(entries[i:]...); err != nil {
+			n.fail(err)
+			return appendResponse{Term: n.term}
+		}
+		break
+	}
+
+	if commit := min(req.Commit, prev+uint64(len(entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalCommit()
+	}
+	return appendResponse{Term: n.term, Success: true}
+}
+
+// replace the store with the leader's, and the log up to it
+func (n *Node) handleSnapshot(_ context.Context, req snapshotRequest) snapshotResponse {
+	n.amu.Lock()
+	defer n.amu.Unlock()
+
+	n.mu.Lock()
+	if req.Term >= n.term && (req.Term > n.term || n.role != follower) {
+		n.becomeFollower(req.Term)
+	}
+	if n.err != nil || n.closed || req.Term < n.term || req.Index <= n.lastApplied {
+		defer n.mu.Unlock()
+		return snapshotResponse{Term: n.term}
+	}
+	n.leader = req.Leader
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	// the store is written without mu, so heartbeats keep the node from
+	// calling an election meanwhile. it is synced before the log is cut.
+	err := n.store.ApplyCatchUp(req.State)
+	if err == nil {
+		err = n.store.Sync()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.fail(fmt.Errorf("error applying snapshot: %w", err))
+		return snapshotResponse{Term: n.term}
+	}
+	oldSnap, oldLast := n.snapIndex, n.lastIndex()
+	removeTo := oldLast
+	if req.Index < oldLast && n.termAt(req.Index) == req.LastTerm {
+		// the entries after the snapshot still agree with the leader
+		n.entries = slices.Clone(n.entries[req.Index-oldSnap:])
+		removeTo = req.Index
+	} else {
+		n.entries = nil
+	}
+	n.snapIndex, n.snapTerm = req.Index, req.LastTerm
+	n.commitIndex = max(n.commitIndex, req.Index)
+	n.lastApplied = req.Index
+	n.notifyApplied()
+	if err := n.saveMeta(); err != nil {
+		n.fail(err)
+		return snapshotResponse{Term: n.term}
+	}
+	if err := n.log.remove(oldSnap+1, removeTo); err != nil {
+		n.fail(err)
+	}
+	return snapshotResponse{Term: n.term}
+}
+
+// write committed entries to the store in order
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.commits:
+		}
+		for n.applyCommitted() {
+		}
+	}
+}
+
+// write the next committed entries to the store in a single write, with
+// their index as sequence number, apart from the writes planned on this node,
+// which are carried out again. reports whether more are committed.
+func (n *Node) applyCommitted() bool {
+	n.amu.Lock()
+	defer n.amu.Unlock()
+
+	n.mu.Lock()
+	if n.err != nil || n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	first := n.lastApplied + 1
+	last := min(n.commitIndex, first+maxApplyEntries-1)
+	entries := slices.Clone(n.entries[first-n.snapIndex-1 : last-n.snapIndex])
+	writes := make(map[uint64]*pendingWrite)
+	for i, entry := range entries {
+		if w, ok := n.pending[entry.ID]; ok && len(entry.Records) > 0 {
+			delete(n.pending, entry.ID)
+			writes[first+uint64(i)] = w
+		}
+	}
+	n.mu.Unlock()
+
+	err := n.applyEntries(first, entries, writes)
+	for _, w := range writes {
+		w.err = err
+		close(w.done)
+	}
+
+	n.mu.Lock()
+	if err != nil {
+		n.fail(fmt.Errorf("error applying raft log: %w", err))
+		n.mu.Unlock()
+		return false
+	}
+	n.lastApplied = last
+	n.notifyApplied()
+	for i, entry := range entries {
+		index := first + uint64(i)
+		w, ok := n.waiters[index]
+		if !ok {
+			continue
+		}
+		delete(n.waiters, index)
+		if w.term == entry.Term {
+			w.done <- nil
+		} else {
+			// another leader's entry took its place
+			w.done <- ErrLeadershipLost
+		}
+	}
+	cut := n.lastApplied-n.snapIndex >= uint64(n.config.SnapshotThreshold)
+	more := n.lastApplied < n.commitIndex
+	n.mu.Unlock()
+
+	if cut {
+		n.cutLog()
+	}
+	return more
+}
+
+// write entries to the store, the first at index first, carrying out the
+// writes planned on this node among them again and taking them out of
+// writes. the caller must hold amu but not mu.
+func (n *Node) applyEntries(first uint64, entries []logEntry, writes map[uint64]*pendingWrite) error {
+	var records []keyvalue.Entry
+	for i, entry := range entries {
+		index := first + uint64(i)
+		w, ok := writes[index]
+		if ok {
+			if err := n.store.ApplyRecords(records); err != nil {
+				return err
+			}
+			records = nil
+			applied, err := n.store.ApplyPlan(w.op, w.plan, index)
+			if err := n.store.Err(); err != nil {
+				return err
+			}
+			if applied {
+				w.err = err
+				close(w.done)
+				delete(writes, index)
+				continue
+			}
+			// the other nodes write the planned records all the same
+			w.err = ErrUnknownResult
+			close(w.done)
+			delete(writes, index)
+		}
+		for _, record := range entry.Records {
+			record.Seq = index
+			records = append(records, record)
+		}
+	}
+	return n.store.ApplyRecords(records)
+}
+
+// cut the entries written to the store from the log, once the store has
+// them on disk. the caller must hold amu but not mu.
+func (n *Node) cutLog() {
+	err := n.store.Sync()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.fail(fmt.Errorf("error syncing store: %w", err))
+		return
+	}
+	oldSnap, index := n.snapIndex, n.lastApplied
+	n.snapTerm = n.termAt(index)
+	n.entries = slices.Clone(n.entries[index-oldSnap:])
+	n.snapIndex = index
+	if err := n.saveMeta(); err != nil {
+		n.fail(err)
+		return
+	}
+	if err := n.log.remove(oldSnap+1, index); err != nil {
+		n.fail(err)
+	}
+}
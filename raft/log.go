@@ -0,0 +1,159 @@
+package kvraft
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/internal/msgpack"
+)
+
+// largest entry the log holds, which has to fit the biggest write the
+// replicated store accepts
+const maxEntrySize = 256 << 20
+
+// compact the log's own file once this many of its records are stale, left
+// behind by entries cut from either end of the log
+const logCompactionThreshold = 10000
+
+// the key of the node's term, vote and snapshot position
+const metaKey = "meta"
+
+// an entry of the replicated log. entries appended by a new leader and by
+// Sync carry no records.
+type logEntry struct {
+	Term    uint64
+	Records []keyvalue.Entry
+	ID      uint64 // Picked by the node that planned the records, which carries out their write again instead of writing them, see Node.commit
+}
+
+// roughly how many bytes the entry takes up encoded
+func (e logEntry) size() int {
+	const overhead = 64
+	size := overhead
+	for _, record := range e.Records {
+		size += len(record.Key) + len(record.Value) + overhead
+	}
+	return size
+}
+
+// what a node has to remember across restarts besides its log
+type meta struct {
+	Term      uint64
+	Vote      string // Node voted for in Term, empty if none
+	SnapIndex uint64 // Last entry cut from the log, which the store holds
+	SnapTerm  uint64 // Term of the entry at SnapIndex
+}
+
+// the log and meta of a node, kept in a store of their own in file-only mode
+// and synced on every write. entries are keyed by index, zero-padded so they
+// sort in order.
+type logStore struct {
+	store *keyvalue.Store
+}
+
+func openLog(filename string) (*logStore, error) {
+	store, err := keyvalue.NewStore(filename, keyvalue.StoreConfig{
+		MaxKeys:             math.MaxInt,
+		MaxKeySize:          64,
+		MaxValueSize:        maxEntrySize,
+		Format:              keyvalue.LogFormatBinary,
+		SyncMode:            keyvalue.SyncEveryWrite,
+		CompactionThreshold: logCompactionThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{store: store}, nil
+}
+
+func entryKey(index uint64) string {
+	return fmt.Sprintf("log/%020d", index)
+}
+
+// read the meta and the entries after the snapshot. entries that aren't
+// contiguous with the snapshot, like ones left over from a cut that didn't
+// finish, are dropped.
+func (l *logStore) load() (meta, []logEntry, error) {
+	var m meta
+	if value, exists, err := l.store.GetCtx(context.Background(), metaKey); err != nil {
+		return m, nil, fmt.Errorf("error reading raft meta: %w", err)
+	} else if exists {
+		if err := msgpack.Unmarshal([]byte(value), &m); err != nil {
+			return m, nil, fmt.Errorf("error decoding raft meta: %w", err)
+		}
+	}
+
+	records, err := l.store.Scan("log/")
+	if err != nil {
+		return m, nil, fmt.Errorf("error reading raft log: %w", err)
+	}
+	var entries []logEntry
+	for _, record := range records {
+		index, err := strconv.ParseUint(strings.TrimPrefix(record.Key, "log/"), 10, 64)
+		if err != nil {
+			return m, nil, fmt.Errorf("invalid raft log key %q", record.Key)
+		}
+		if index <= m.SnapIndex {
+			continue
+		}
+		if index != m.SnapIndex+uint64(len(entries))+1 {
+			break
+		}
+		var entry logEntry
+		if err := msgpack.Unmarshal([]byte(record.Value), &entry); err != nil {
+			return m, nil, fmt.Errorf("error decoding raft log entry %d: %w", index, err)
+		}
+		entries = append(entries, entry)
+	}
+	return m, entries, nil
+}
+
+func (l *logStore) saveMeta(m meta) error {
+	data, err := msgpack.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := l.store.Set(metaKey, string(data)); err != nil {
+		return fmt.Errorf("error saving raft meta: %w", err)
+	}
+	return nil
+}
+
+// write entries at index first onwards in a single write
+func (l *logStore) append(first uint64, entries []logEntry) error {
+	batch := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		data, err := msgpack.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		batch[entryKey(first+uint64(i))] = string(data)
+	}
+	if err := l.store.SetBatch(batch); err != nil {
+		return fmt.Errorf("error appending to raft log: %w", err)
+	}
+	return nil
+}
+
+// delete the entries from index from to index to in a single write
+func (l *logStore) remove(from, to uint64) error {
+	if from > to {
+		return nil
+	}
+	keys := make([]string, 0, to-from+1)
+	for index := from; index <= to; index++ {
+		keys = append(keys, entryKey(index))
+	}
+	if err := l.store.DeleteBatch(keys); err != nil {
+		return fmt.Errorf("error removing from raft log: %w", err)
+	}
+	return nil
+}
+
+func (l *logStore) close() error {
+	return l.store.Close()
+}
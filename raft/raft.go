@@ -0,0 +1,492 @@
+// Package kvraft replicates a keyvalue.Store over a fixed cluster of nodes,
+// usually three or five, with the Raft consensus algorithm, so writes
+// survive losing any minority of them. every node opens its store with
+// StoreConfig.Replica and puts a Node on top of it:
+//
+//	node, err := kvraft.Open(store, "store.raft", kvraft.Config{
+//		ID: "a",
+//		Peers: map[string]string{
+//			"a": "10.0.0.1:7100",
+//			"b": "10.0.0.2:7100",
+//			"c": "10.0.0.3:7100",
+//		},
+//	})
+//	go node.ListenAndServe(":7100")
+//
+// the nodes elect a leader, which appends every write to a log that each
+// node keeps in its own file. a write returns once a majority of the nodes
+// have it, and so does an election, so an acknowledged write is never lost
+// while a majority of the nodes survive. every write to any node's store,
+// and the servers built on it, is worked out by that store with
+// keyvalue.Store.Plan and passed on to the leader, failing with ErrNoLeader
+// while there is none. the leader only takes it while the keys it read are
+// as the node saw them, or the node catches up and plans it again, and while
+// it fits the store's key and memory limits. once it is committed the node
+// carries it out again to get its results. writes that come out changing
+// nothing, like a CompareAndSwap that doesn't match, are settled by the
+// node's own store, so they can lag behind like reads. RestoreSnapshot fails
+// with keyvalue.ErrReadOnly.
+//
+// reads are served by each node's own store, so a node can lag behind the
+// leader. call Sync before a read that has to see every write acknowledged
+// before it.
+//
+// once the log holds Config.SnapshotThreshold entries the ones already
+// written to the store are cut from it, the store itself serving as the
+// snapshot, and a node that falls behind the cut is sent the leader's whole
+// store in one message. nodes talk gob over HTTP. unless they are on a
+// trusted network give every node the same Config.Token, which they send with
+// each request and refuse requests without, and serve them over TLS with
+// Config.TLS and Config.ClientTLS, which can require client certificates too.
+package kvraft
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// defaults of the Config fields
+const (
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 8192
+	defaultWriteTimeout      = 10 * time.Second
+	defaultMaxSnapshotSize   = 4 << 30
+)
+
+// most entries sent to a node in one request, and roughly the most bytes
+// of them past the first, see logEntry.size
+const (
+	maxAppendEntries = 256
+	maxAppendBytes   = 16 << 20
+)
+
+var (
+	// returned by writes when no leader is known, like during an election or
+	// on a node cut off from the majority
+	ErrNoLeader = errors.New("raft: no leader")
+
+	// returned by writes whose leader stepped down before they were
+	// committed. the write may still have been committed by the next leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost before the write was committed")
+
+	// returned once the node is closed
+	ErrNodeClosed = errors.New("raft: node closed")
+
+	// returned by writes that were committed but whose results aren't known,
+	// because they came out differently on this node than planned, like when
+	// a key they read expired in between, or reached its store in the
+	// leader's snapshot instead. the planned records were written.
+	ErrUnknownResult = errors.New("raft: write committed but its results are unknown")
+)
+
+// how a Node joins its cluster
+type Config struct {
+	ID                string            // This node's ID, a key of Peers
+	Peers             map[string]string // Address other nodes reach each node's Serve on by ID, this node included
+	HeartbeatInterval time.Duration     // How often the leader contacts idle followers (default 100ms)
+	ElectionTimeout   time.Duration     // How long a follower waits for the leader before calling an election, randomized up to twice this (default 1s)
+	SnapshotThreshold int               // Cut the log once it holds this many entries written to the store (default 8192)
+	WriteTimeout      time.Duration     // How long a write waits for a leader and to be committed (default 10s)
+	MaxSnapshotSize   int64             // Largest copy of the leader's store a node takes in bytes, see SnapshotThreshold (default 4GiB)
+	Token             string            // Secret shared by the nodes, sent with every request and required of the other nodes' requests (none if empty)
+	TLS               *tls.Config       // Serve the other nodes over TLS with this config in ListenAndServe, see auth.TLSConfig
+	ClientTLS         *tls.Config       // Reach the other nodes over TLS with this config, see auth.ClientTLSConfig
+}
+
+// a node's role in its term
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case follower:
+		return "follower"
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	default:
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+}
+
+// a write waiting for its entry to be applied on the leader
+type waiter struct {
+	term uint64 // Term the entry was appended in
+	done chan error
+}
+
+// a write planned on this node, carried out again once its entry is applied
+// so its results reach the caller, see Node.commit
+type pendingWrite struct {
+	op   keyvalue.Operation
+	plan keyvalue.Plan
+	err  error         // What carrying it out returned
+	done chan struct{} // Closed once it has been carried out
+}
+
+// a member of a Raft cluster, replicating the writes to its store
+type Node struct {
+	store  *keyvalue.Store
+	log    *logStore
+	config Config
+	peers  []string // IDs of the other nodes
+	client *http.Client
+
+	mu          sync.Mutex
+	role        role
+	term        uint64
+	vote        string // Node voted for in term
+	leader      string // ID of the leader of term, empty while unknown
+	entries     []logEntry
+	snapIndex   uint64 // Index of the entry before entries[0]
+	snapTerm    uint64
+	commitIndex uint64
+	lastApplied uint64
+	applied     chan struct{} // Closed and replaced whenever lastApplied moves
+	deadline    time.Time     // When a follower calls an election
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	wake        map[string]chan struct{} // Signals the leader's replicators of new entries
+	waiters     map[uint64]waiter        // Writes waiting on the leader by index
+	pending     map[uint64]*pendingWrite // Writes planned on this node by entry ID
+	err         error                    // Why applying to the store failed, which stops the node
+	closed      bool
+	servers     []*http.Server
+
+	commits chan struct{} // Signals the applier of a new commit index
+	amu     sync.Mutex    // Held while the store is written, lock it before mu
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// state of a node, see Node.Status
+type Status struct {
+	ID      string
+	Role    string // leader, follower or candidate
+	Term    uint64
+	Leader  string // ID of the leader, empty while unknown
+	Index   uint64 // Index of the last entry in the log
+	Commit  uint64 // Index of the last entry known to be committed
+	Applied uint64 // Index of the last entry written to the store
+}
+
+// join the cluster in config with store, which should be opened with
+// StoreConfig.Replica, keeping the node's log and vote in filename. a node
+// starting without its log needs an empty store, it is filled in from the
+// leader. writes to store go through the cluster from now on, see the
+// package docs.
+func Open(store *keyvalue.Store, filename string, config Config) (*Node, error) {
+	if _, ok := config.Peers[config.ID]; !ok {
+		return nil, fmt.Errorf("raft: node %q isn't among the peers", config.ID)
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = defaultElectionTimeout
+	}
+	if config.SnapshotThreshold <= 0 {
+		config.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaultWriteTimeout
+	}
+	if config.MaxSnapshotSize <= 0 {
+		config.MaxSnapshotSize = defaultMaxSnapshotSize
+	}
+
+	log, err := openLog(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft log: %w", err)
+	}
+	m, entries, err := log.load()
+	if err != nil {
+		log.close()
+		return nil, err
+	}
+	// the store holds every entry up to the last one written to it, whose
+	// index is its sequence number, and at least the snapshot. entries
+	// after that are written again, which leaves the same keys behind.
+	applied, err := store.LastSeq()
+	if err != nil {
+		log.close()
+		return nil, fmt.Errorf("error finding last applied entry: %w", err)
+	}
+	if m.Term == 0 && len(entries) == 0 && store.Len() > 0 {
+		log.close()
+		return nil, fmt.Errorf("raft: a node without a log needs an empty store")
+	}
+	applied = min(max(applied, m.SnapIndex), m.SnapIndex+uint64(len(entries)))
+
+	n := &Node{
+		store:       store,
+		log:         log,
+		config:      config,
+		client:      &http.Client{Transport: &http.Transport{TLSClientConfig: config.ClientTLS}},
+		term:        m.Term,
+		vote:        m.Vote,
+		entries:     entries,
+		snapIndex:   m.SnapIndex,
+		snapTerm:    m.SnapTerm,
+		commitIndex: applied,
+		lastApplied: applied,
+		applied:     make(chan struct{}),
+		waiters:     make(map[uint64]waiter),
+		pending:     make(map[uint64]*pendingWrite),
+		commits:     make(chan struct{}, 1),
+	}
+	for id := range config.Peers {
+		if id != config.ID {
+			n.peers = append(n.peers, id)
+		}
+	}
+	slices.Sort(n.peers)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetDeadline()
+
+	store.Use(n.intercept)
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+	return n, nil
+}
+
+// leave the cluster: stop serving, fail the writes waiting on this node and
+// close its log. the store stays open but can't be written to.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.failWaiters(ErrNodeClosed)
+	n.notifyApplied()
+	servers := n.servers
+	n.mu.Unlock()
+
+	n.cancel()
+	for _, srv := range servers {
+		srv.Close()
+	}
+	n.wg.Wait()
+	return n.log.close()
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:      n.config.ID,
+		Role:    n.role.String(),
+		Term:    n.term,
+		Leader:  n.leader,
+		Index:   n.lastIndex(),
+		Commit:  n.commitIndex,
+		Applied: n.lastApplied,
+	}
+}
+
+// wait until every write acknowledged before the call is in this node's
+// store, so reads after it see them. fails with ErrNoLeader without a
+// leader.
+func (n *Node) Sync(ctx context.Context) error {
+	return n.write(ctx, proposeRequest{})
+}
+
+// route the writes of the store through the cluster, see the package docs
+func (n *Node) intercept(op keyvalue.Operation, next keyvalue.Handler) error {
+	switch op.Type {
+	case keyvalue.OpGet, keyvalue.OpGetMany, keyvalue.OpScan, keyvalue.OpGetEntry, keyvalue.OpCompact:
+		return next(op)
+	}
+	ctx := op.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.config.WriteTimeout)
+	defer cancel()
+
+	for {
+		plan, err := n.store.Plan(op)
+		if err != nil || len(plan.Records) == 0 {
+			return err
+		}
+		err = n.commit(ctx, op, plan)
+		if !errors.Is(err, keyvalue.ErrStalePlan) {
+			return err
+		}
+		// this node is behind the leader, catch up before planning again
+		if err := n.Sync(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// commit plan through the leader, then wait for applyCommitted to carry out
+// op again when it writes the entry to the store
+func (n *Node) commit(ctx context.Context, op keyvalue.Operation, plan keyvalue.Plan) error {
+	w := &pendingWrite{op: op, plan: plan, done: make(chan struct{})}
+	req := proposeRequest{ID: rand.Uint64(), Plan: plan}
+	n.mu.Lock()
+	n.pending[req.ID] = w
+	n.mu.Unlock()
+
+	err := n.write(ctx, req)
+
+	n.mu.Lock()
+	_, waiting := n.pending[req.ID]
+	delete(n.pending, req.ID)
+	n.mu.Unlock()
+	switch {
+	case !waiting:
+		// the entry is being written, whatever write returned
+		<-w.done
+		return w.err
+	case err == nil:
+		return ErrUnknownResult
+	default:
+		return err
+	}
+}
+
+// commit a write through the leader and wait until this node's store has it.
+// a node that isn't the leader passes it on to it.
+func (n *Node) write(ctx context.Context, req proposeRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.config.WriteTimeout)
+	defer cancel()
+
+	// the last failure to reach the leader, returned if no other leader
+	// turns up in time
+	var lastErr error
+	for {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return ErrNodeClosed
+		}
+		if n.err != nil {
+			n.mu.Unlock()
+			return n.err
+		}
+		leading, leaderID := n.role == leader, n.leader
+		n.mu.Unlock()
+
+		if leading {
+			_, err := n.propose(ctx, req)
+			if !errors.Is(err, errNotLeader) {
+				return err
+			}
+		} else if leaderID != "" {
+			// a leader that can't be reached is likely gone, keep asking
+			// until a new one is elected
+			var resp proposeResponse
+			if err := n.call(ctx, leaderID, "/raft/propose", req, &resp); err != nil {
+				lastErr = fmt.Errorf("error passing write to leader %s: %w", leaderID, err)
+			} else if resp.Error != "" {
+				return resp.err()
+			} else if !resp.NotLeader {
+				return n.waitApplied(ctx, resp.Index)
+			}
+		}
+
+		// wait for the election to settle
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ctx.Err()
+			}
+			if lastErr != nil {
+				return lastErr
+			}
+			return ErrNoLeader
+		case <-time.After(n.config.HeartbeatInterval):
+		}
+	}
+}
+
+// wait until the store holds the entry at index
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		lastApplied, applied, err := n.lastApplied, n.applied, n.err
+		closed := n.closed
+		n.mu.Unlock()
+		switch {
+		case err != nil:
+			return err
+		case closed:
+			return ErrNodeClosed
+		case lastApplied >= index:
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-applied:
+		}
+	}
+}
+
+// handle a write passed on by another node
+func (n *Node) handlePropose(ctx context.Context, req proposeRequest) proposeResponse {
+	if err := n.checkRecords(req.Plan.Records); err != nil {
+		return errorResponse(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.config.WriteTimeout)
+	defer cancel()
+	index, err := n.propose(ctx, req)
+	switch {
+	case errors.Is(err, errNotLeader):
+		return proposeResponse{NotLeader: true}
+	case err != nil:
+		return errorResponse(err)
+	default:
+		return proposeResponse{Index: index}
+	}
+}
+
+// check that records passed on by another node are ones a store plans.
+// whether the values that records change fit the store is left to
+// keyvalue.Store.CheckPlan.
+func (n *Node) checkRecords(records []keyvalue.Entry) error {
+	for _, record := range records {
+		if record.Key != n.store.NormalizeKey(record.Key) {
+			return fmt.Errorf("raft: key %q isn't normalized", record.Key)
+		}
+		partial := record.Append || record.Op != ""
+		if record.Seq != 0 || record.CreatedAt != 0 || record.ExpiresAt < 0 ||
+			(record.Commit && (record.Key != "" || record.Txn == 0 || record.Value != "" || partial)) ||
+			(record.Deleted && (record.Value != "" || record.ExpiresAt != 0 || partial)) {
+			return fmt.Errorf("raft: invalid record for %q", record.Key)
+		}
+		if record.Deleted || record.Commit || partial {
+			continue
+		}
+		if err := n.store.Validate(record.Key, record.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
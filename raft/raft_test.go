@@ -0,0 +1,874 @@
+package kvraft
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// nodes of a cluster on loopback, each with its store and log in dir
+type testCluster struct {
+	t      *testing.T
+	dir    string
+	config Config // Shared by the nodes, with ID set for each
+	nodes  map[string]*Node
+	stores map[string]*keyvalue.Store
+}
+
+// a cluster of nodes with the given IDs, none of them started yet
+func newCluster(t *testing.T, config Config, ids ...string) *testCluster {
+	t.Helper()
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = 20 * time.Millisecond
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 150 * time.Millisecond
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+	config.Peers = make(map[string]string)
+	for _, id := range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Peers[id] = l.Addr().String()
+		l.Close()
+	}
+	c := &testCluster{t: t, dir: t.TempDir(), config: config, nodes: make(map[string]*Node), stores: make(map[string]*keyvalue.Store)}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start every node
+func (c *testCluster) startAll() {
+	for id := range c.config.Peers {
+		c.start(id)
+	}
+}
+
+// open a node's store and log and serve it on its address
+func (c *testCluster) start(id string) {
+	c.t.Helper()
+	store, err := keyvalue.NewStore(filepath.Join(c.dir, id+".log"), keyvalue.StoreConfig{
+		UseMemory:    true,
+		MaxKeys:      1000,
+		MaxKeySize:   64,
+		MaxValueSize: 1024,
+		Replica:      true,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	config := c.config
+	config.ID = id
+	node, err := Open(store, filepath.Join(c.dir, id+".raft"), config)
+	if err != nil {
+		store.Close()
+		c.t.Fatal(err)
+	}
+
+	// the port was free when the cluster was made, and again once the node
+	// serving it closed, but may take a moment to be released
+	var l net.Listener
+	for i := 0; ; i++ {
+		if l, err = net.Listen("tcp", config.Peers[id]); err == nil {
+			break
+		}
+		if i == 50 {
+			c.t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if config.TLS != nil {
+		l = tls.NewListener(l, config.TLS)
+	}
+	go node.Serve(l)
+	c.nodes[id], c.stores[id] = node, store
+}
+
+// close a node and its store
+func (c *testCluster) stop(id string) {
+	c.t.Helper()
+	if err := c.nodes[id].Close(); err != nil {
+		c.t.Error(err)
+	}
+	if err := c.stores[id].Close(); err != nil {
+		c.t.Error(err)
+	}
+	delete(c.nodes, id)
+	delete(c.stores, id)
+}
+
+// wait until the running nodes agree on a leader among them, returning its
+// ID
+func (c *testCluster) waitLeader() string {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := make(map[string]bool)
+		for _, node := range c.nodes {
+			leaders[node.Status().Leader] = true
+		}
+		for id := range leaders {
+			if _, running := c.nodes[id]; running && len(leaders) == 1 && c.nodes[id].Status().Role == "leader" {
+				return id
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+// some running node other than id
+func (c *testCluster) other(id string) string {
+	for other := range c.nodes {
+		if other != id {
+			return other
+		}
+	}
+	c.t.Fatal("no other node running")
+	return ""
+}
+
+// wait until the store of every running node has the value of key, missing
+// if want is empty
+func (c *testCluster) checkValue(key, want string) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for id, node := range c.nodes {
+		if err := node.Sync(ctx); err != nil {
+			c.t.Fatalf("syncing %s: %v", id, err)
+		}
+		value, ok := c.stores[id].Get(key)
+		if value != want || ok != (want != "") {
+			c.t.Errorf("%s has %q=%q (%v), want %q", id, key, value, ok, want)
+		}
+	}
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+
+	term := c.nodes[leader].Status().Term
+	for id, node := range c.nodes {
+		status := node.Status()
+		if status.Term != term {
+			t.Errorf("%s is in term %d, the leader in %d", id, status.Term, term)
+		}
+		if id != leader && status.Role != "follower" {
+			t.Errorf("%s is a %s, want a follower", id, status.Role)
+		}
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newCluster(t, Config{}, "a")
+	c.startAll()
+	c.waitLeader()
+	if err := c.stores["a"].Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k", "v")
+}
+
+func TestWritesReachEveryNode(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	follower := c.stores[c.other(leader)]
+
+	if err := c.stores[leader].Set("on-leader", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Set("on-follower", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.SetWithTTL("expiring", "3", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Set("deleted", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("on-leader", "1")
+	c.checkValue("on-follower", "2")
+	c.checkValue("expiring", "3")
+	c.checkValue("deleted", "")
+
+	// so do the writes that read the keys they change, with their results
+	if n, err := follower.Incr("n", 5); err != nil || n != 5 {
+		t.Errorf("got %d, %v from Incr, want 5", n, err)
+	}
+	if n, err := c.stores[leader].Incr("n", 2); err != nil || n != 7 {
+		t.Errorf("got %d, %v from Incr on the leader, want 7", n, err)
+	}
+	if swapped, err := follower.CompareAndSwap("on-leader", "1", "one"); err != nil || !swapped {
+		t.Errorf("got %v, %v from CompareAndSwap, want a swap", swapped, err)
+	}
+	if swapped, err := follower.CompareAndSwap("on-leader", "1", "uno"); err != nil || swapped {
+		t.Errorf("got %v, %v from a CompareAndSwap that doesn't match, want none", swapped, err)
+	}
+	if n, err := follower.RPush("list", "x", "y"); err != nil || n != 2 {
+		t.Errorf("got %d, %v from RPush, want 2", n, err)
+	}
+	if err := follower.Append("on-follower", "2"); err != nil {
+		t.Error(err)
+	}
+	if err := follower.Rename("expiring", "renamed"); err != nil {
+		t.Error(err)
+	}
+	if err := follower.SetBatch(map[string]string{"b1": "x", "b2": "y"}); err != nil {
+		t.Error(err)
+	}
+	c.checkValue("n", "7")
+	c.checkValue("on-leader", "one")
+	c.checkValue("list", `{"list":["x","y"]}`)
+	c.checkValue("on-follower", "22")
+	c.checkValue("expiring", "")
+	c.checkValue("renamed", "3")
+	c.checkValue("b2", "y")
+
+	// invalid writes are refused before they reach the log
+	if err := follower.Set("k", strings.Repeat("x", 2000)); !errors.Is(err, keyvalue.ErrValueTooLarge) {
+		t.Errorf("got %v for a value past the limit, want ErrValueTooLarge", err)
+	}
+}
+
+func TestConcurrentWritesAcrossNodes(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	c.waitLeader()
+
+	// every Incr is counted once, whichever node planned it on a stale value
+	const perNode = 10
+	results := make(chan int64, 3*perNode)
+	var wg sync.WaitGroup
+	for id, store := range c.stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perNode {
+				n, err := store.Incr("n", 1)
+				if err != nil {
+					t.Errorf("Incr on %s: %v", id, err)
+					return
+				}
+				results <- n
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	seen := make(map[int64]bool)
+	for n := range results {
+		if seen[n] {
+			t.Errorf("Incr returned %d twice", n)
+		}
+		seen[n] = true
+	}
+	c.checkValue("n", strconv.Itoa(3*perNode))
+
+	// and only one of the swaps from the same value goes through
+	if err := c.stores["a"].Set("k", "old"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k", "old")
+	var swaps atomic.Int32
+	for id, store := range c.stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			swapped, err := store.CompareAndSwap("k", "old", id)
+			if err != nil {
+				t.Errorf("CompareAndSwap on %s: %v", id, err)
+			}
+			if swapped {
+				swaps.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := swaps.Load(); n != 1 {
+		t.Errorf("%d swaps went through, want 1", n)
+	}
+}
+
+func TestMaxKeysOnApply(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	c.waitLeader()
+
+	// fill the stores up to one key short of MaxKeys
+	batch := make(map[string]string)
+	for i := range 999 {
+		batch[fmt.Sprintf("k%d", i)] = "v"
+	}
+	if err := c.stores["a"].SetBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k998", "v")
+
+	// each node has room for the key it plans, but only one fits
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for id, store := range c.stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Set("new-"+id, "v")
+			switch {
+			case err == nil:
+				added.Add(1)
+			case !errors.Is(err, keyvalue.ErrMaxKeysReached):
+				t.Errorf("Set on %s: %v", id, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := added.Load(); n != 1 {
+		t.Errorf("%d keys added, want 1", n)
+	}
+	for id, node := range c.nodes {
+		if err := node.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := c.stores[id].Len(); n != 1000 {
+			t.Errorf("%s holds %d keys, want 1000", id, n)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	old := c.waitLeader()
+	if err := c.stores[old].Set("k", "before"); err != nil {
+		t.Fatal(err)
+	}
+	oldTerm := c.nodes[old].Status().Term
+
+	c.stop(old)
+	leader := c.waitLeader()
+	if term := c.nodes[leader].Status().Term; term <= oldTerm {
+		t.Errorf("new leader is in term %d, want past %d", term, oldTerm)
+	}
+	// the acknowledged write survived the leader
+	c.checkValue("k", "before")
+	if err := c.stores[c.other(leader)].Set("k", "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old leader rejoins as a follower and catches up
+	c.start(old)
+	c.waitLeader()
+	c.checkValue("k", "after")
+	if role := c.nodes[old].Status().Role; role != "follower" {
+		t.Errorf("old leader rejoined as a %s", role)
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	c := newCluster(t, Config{WriteTimeout: 500 * time.Millisecond}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	for id := range c.nodes {
+		if id != leader {
+			c.stop(id)
+		}
+	}
+
+	// the leader keeps its role but can't commit without a majority
+	err := c.stores[leader].Set("k", "v")
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrNoLeader) {
+		t.Errorf("got %v from a write without a majority", err)
+	}
+}
+
+func TestRestartRecovery(t *testing.T) {
+	c := newCluster(t, Config{}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	for i := range 10 {
+		if err := c.stores[leader].Set(fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.checkValue("k9", "9")
+	statuses := make(map[string]Status)
+	for id, node := range c.nodes {
+		statuses[id] = node.Status()
+	}
+
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	c.startAll()
+	for id, node := range c.nodes {
+		status := node.Status()
+		// the commit index isn't kept, the node starts from the last entry in
+		// its store that wrote a record
+		if status.Term < statuses[id].Term || status.Index < statuses[id].Index {
+			t.Errorf("%s restarted with %+v, was at %+v", id, status, statuses[id])
+		}
+		if value, _ := c.stores[id].Get("k9"); value != "9" {
+			t.Errorf("%s lost k9 on restart, has %q", id, value)
+		}
+	}
+
+	leader = c.waitLeader()
+	if err := c.stores[c.other(leader)].Set("k10", "10"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k0", "0")
+	c.checkValue("k10", "10")
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, Config{SnapshotThreshold: 4}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	var lagging, fresh string
+	for _, id := range []string{"a", "b", "c"} {
+		switch {
+		case id == leader:
+		case lagging == "":
+			lagging = id
+		default:
+			fresh = id
+		}
+	}
+	c.stop(lagging)
+
+	for i := range 20 {
+		if err := c.stores[leader].Set(fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.stores[leader].Delete("k0"); err != nil {
+		t.Fatal(err)
+	}
+	// the leader cut the entries the lagging node needs from its log
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.nodes[leader].mu.Lock()
+		snapIndex := c.nodes[leader].snapIndex
+		c.nodes[leader].mu.Unlock()
+		if snapIndex > 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader didn't cut its log, snapshot index %d", snapIndex)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the lagging node restarts behind the cut, and a node with no state at
+	// all joins in place of another
+	c.start(lagging)
+	c.stop(fresh)
+	for _, name := range []string{fresh + ".log", fresh + ".raft"} {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.start(fresh)
+
+	c.waitLeader()
+	c.checkValue("k0", "")
+	c.checkValue("k19", "19")
+	for _, id := range []string{lagging, fresh} {
+		if n := c.stores[id].Len(); n != 19 {
+			t.Errorf("%s has %d keys after catching up, want 19", id, n)
+		}
+	}
+}
+
+// a node that never calls an election, for driving its handlers directly
+func newTestNode(t *testing.T, config Config) (*Node, *keyvalue.Store, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := keyvalue.NewStore(filepath.Join(dir, "a.log"), keyvalue.StoreConfig{
+		UseMemory:    true,
+		MaxKeys:      1000,
+		MaxKeySize:   64,
+		MaxValueSize: 1024,
+		Replica:      true,
+		NormalizeKey: strings.ToLower,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ID = "a"
+	config.Peers = map[string]string{"a": "127.0.0.1:1", "b": "127.0.0.1:1", "c": "127.0.0.1:1"}
+	config.ElectionTimeout = time.Hour
+	filename := filepath.Join(dir, "a.raft")
+	node, err := Open(store, filename, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Close()
+		store.Close()
+	})
+	return node, store, filename
+}
+
+// the terms of the entries in a node's log
+func logTerms(n *Node) []uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var terms []uint64
+	for _, entry := range n.entries {
+		terms = append(terms, entry.Term)
+	}
+	return terms
+}
+
+func TestAppendRepairsLog(t *testing.T) {
+	node, store, filename := newTestNode(t, Config{})
+	ctx := context.Background()
+	entry := func(term uint64, records ...keyvalue.Entry) logEntry {
+		return logEntry{Term: term, Records: records}
+	}
+
+	resp := node.handleAppend(ctx, appendRequest{Term: 1, Leader: "b", Entries: []logEntry{entry(1), entry(1)}})
+	if !resp.Success {
+		t.Fatalf("first append failed: %+v", resp)
+	}
+	resp = node.handleAppend(ctx, appendRequest{Term: 2, Leader: "b", PrevIndex: 2, PrevTerm: 1, Entries: []logEntry{
+		entry(2, keyvalue.Entry{Key: "k", Value: "lost"}),
+		entry(2),
+	}})
+	if !resp.Success {
+		t.Fatalf("second append failed: %+v", resp)
+	}
+	if got := fmt.Sprint(logTerms(node)); got != "[1 1 2 2]" {
+		t.Fatalf("log has terms %s", got)
+	}
+
+	// a leader whose entry at 4 has another term is told to go back past
+	// the whole conflicting term
+	resp = node.handleAppend(ctx, appendRequest{Term: 3, Leader: "c", PrevIndex: 4, PrevTerm: 3})
+	if resp.Success || resp.Next != 3 {
+		t.Errorf("got %+v for a conflicting term, want Next 3", resp)
+	}
+	// and one ahead of the log is told where it ends
+	resp = node.handleAppend(ctx, appendRequest{Term: 3, Leader: "c", PrevIndex: 9, PrevTerm: 3})
+	if resp.Success || resp.Next != 5 {
+		t.Errorf("got %+v for a gap, want Next 5", resp)
+	}
+
+	// the uncommitted entries of term 2 are replaced
+	resp = node.handleAppend(ctx, appendRequest{Term: 3, Leader: "c", PrevIndex: 2, PrevTerm: 1, Commit: 3, Entries: []logEntry{
+		entry(3, keyvalue.Entry{Key: "k", Value: "kept"}),
+	}})
+	if !resp.Success {
+		t.Fatalf("repairing append failed: %+v", resp)
+	}
+	if got := fmt.Sprint(logTerms(node)); got != "[1 1 3]" {
+		t.Fatalf("log has terms %s after the repair", got)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := node.waitApplied(waitCtx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := store.Get("k"); value != "kept" {
+		t.Errorf("store has k=%q, want kept", value)
+	}
+
+	// entries already in the log are left alone, even when resent with
+	// others before them
+	resp = node.handleAppend(ctx, appendRequest{Term: 3, Leader: "c", PrevIndex: 1, PrevTerm: 1, Commit: 3, Entries: []logEntry{entry(1), entry(3)}})
+	if !resp.Success || fmt.Sprint(logTerms(node)) != "[1 1 3]" {
+		t.Errorf("resending entries gave %+v and terms %v", resp, logTerms(node))
+	}
+
+	// a leader of an older term is turned away
+	resp = node.handleAppend(ctx, appendRequest{Term: 2, Leader: "b", PrevIndex: 3, PrevTerm: 3})
+	if resp.Success || resp.Term != 3 {
+		t.Errorf("got %+v from a stale leader", resp)
+	}
+
+	// the repaired log is what the node finds on disk
+	node.Close()
+	log, err := openLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	m, entries, err := log.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Term != 3 || len(entries) != 3 || entries[2].Term != 3 || entries[2].Records[0].Value != "kept" {
+		t.Errorf("log on disk has meta %+v and entries %+v", m, entries)
+	}
+}
+
+func TestAppendConflictingWithCommitted(t *testing.T) {
+	node, _, _ := newTestNode(t, Config{})
+	ctx := context.Background()
+	resp := node.handleAppend(ctx, appendRequest{Term: 1, Leader: "b", Commit: 1, Entries: []logEntry{{Term: 1}}})
+	if !resp.Success {
+		t.Fatalf("append failed: %+v", resp)
+	}
+
+	// no leader can hold a different committed entry, so the node stops
+	// rather than lose it
+	resp = node.handleAppend(ctx, appendRequest{Term: 2, Leader: "c", Entries: []logEntry{{Term: 2}}})
+	if resp.Success {
+		t.Fatal("replaced a committed entry")
+	}
+	if err := node.Sync(ctx); err == nil {
+		t.Error("node kept going after a conflict with a committed entry")
+	}
+}
+
+func TestVote(t *testing.T) {
+	node, _, filename := newTestNode(t, Config{})
+	ctx := context.Background()
+
+	if resp := node.handleVote(ctx, voteRequest{Term: 1, Candidate: "b"}); !resp.Granted {
+		t.Fatalf("vote refused to the first candidate: %+v", resp)
+	}
+	if resp := node.handleVote(ctx, voteRequest{Term: 1, Candidate: "b"}); !resp.Granted {
+		t.Error("vote refused when asked again by the same candidate")
+	}
+	if resp := node.handleVote(ctx, voteRequest{Term: 1, Candidate: "c"}); resp.Granted {
+		t.Error("voted twice in a term")
+	}
+	if resp := node.handleVote(ctx, voteRequest{Term: 0, Candidate: "c"}); resp.Granted || resp.Term != 1 {
+		t.Errorf("got %+v from a candidate of an older term", resp)
+	}
+
+	node.handleAppend(ctx, appendRequest{Term: 2, Leader: "b", Entries: []logEntry{{Term: 2}, {Term: 2}}})
+	// a candidate missing entries the node has can't win its vote
+	for _, req := range []voteRequest{
+		{Term: 3, Candidate: "c"},
+		{Term: 3, Candidate: "c", LastIndex: 5, LastTerm: 1},
+		{Term: 3, Candidate: "c", LastIndex: 1, LastTerm: 2},
+	} {
+		if resp := node.handleVote(ctx, req); resp.Granted {
+			t.Errorf("voted for out of date candidate %+v", req)
+		}
+	}
+	if resp := node.handleVote(ctx, voteRequest{Term: 3, Candidate: "c", LastIndex: 1, LastTerm: 3}); !resp.Granted {
+		t.Errorf("vote refused to an up to date candidate: %+v", resp)
+	}
+
+	// the vote outlives a restart, so the node can't vote twice in a term
+	node.Close()
+	log, err := openLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	m, _, err := log.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Term != 3 || m.Vote != "c" {
+		t.Errorf("log on disk has meta %+v, want a vote for c in term 3", m)
+	}
+}
+
+func TestProposeChecksRecords(t *testing.T) {
+	node, _, _ := newTestNode(t, Config{})
+	for name, record := range map[string]keyvalue.Entry{
+		"value too large":    {Key: "k", Value: strings.Repeat("x", 2000)},
+		"key too large":      {Key: strings.Repeat("k", 100), Value: "v"},
+		"not normalized":     {Key: "K", Value: "v"},
+		"deleted append":     {Key: "k", Value: "v", Deleted: true, Append: true},
+		"commit with key":    {Key: "k", Txn: 1, Commit: true},
+		"commit without txn": {Commit: true},
+		"sequence number":    {Key: "k", Value: "v", Seq: 7},
+		"negative expiry":    {Key: "k", Value: "v", ExpiresAt: -1},
+		"delete with data":   {Key: "k", Value: "v", Deleted: true},
+	} {
+		plan := keyvalue.Plan{Records: []keyvalue.Entry{{Key: "ok", Value: "v"}, record}}
+		resp := node.handlePropose(context.Background(), proposeRequest{Plan: plan})
+		if resp.Error == "" {
+			t.Errorf("%s: proposal accepted with %+v", name, resp)
+		}
+	}
+	// valid records get as far as finding out this node isn't the leader
+	resp := node.handlePropose(context.Background(), proposeRequest{Plan: keyvalue.Plan{Records: []keyvalue.Entry{
+		{Key: "k", Value: "v", ExpiresAt: time.Now().Add(time.Hour).UnixNano(), UpdatedAt: time.Now().UnixNano()},
+		{Key: "gone", Deleted: true},
+		{Key: "l", Value: `["v"]`, Op: "rpush", Txn: 1},
+		{Txn: 1, Commit: true},
+	}}})
+	if !resp.NotLeader {
+		t.Errorf("got %+v for valid records, want NotLeader", resp)
+	}
+}
+
+func TestToken(t *testing.T) {
+	c := newCluster(t, Config{Token: "secret"}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	if err := c.stores[c.other(leader)].Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k", "v")
+
+	for _, header := range []string{"", "Bearer wrong", "Bearer secret2", "Basic secret"} {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+c.config.Peers[leader]+"/raft/propose", bytes.NewReader(nil))
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got %s with Authorization %q, want 401", res.Status, header)
+		}
+	}
+}
+
+func TestWrongTokenCantJoin(t *testing.T) {
+	c := newCluster(t, Config{Token: "secret", WriteTimeout: 500 * time.Millisecond}, "a", "b", "c")
+	c.start("a")
+	c.config.Token = "guess"
+	c.start("b")
+	c.start("c")
+
+	// b and c agree with each other, but a can't reach them nor they it
+	leader := ""
+	deadline := time.Now().Add(5 * time.Second)
+	for leader == "" && time.Now().Before(deadline) {
+		for _, id := range []string{"b", "c"} {
+			if c.nodes[id].Status().Role == "leader" {
+				leader = id
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leader == "" {
+		t.Fatal("b and c elected no leader")
+	}
+	if status := c.nodes["a"].Status(); status.Leader != "" || status.Role == "leader" {
+		t.Errorf("a joined the cluster without the token: %+v", status)
+	}
+	if err := c.stores["a"].Set("k", "v"); err == nil {
+		t.Error("a wrote without the token")
+	}
+}
+
+// a certificate for 127.0.0.1 signed by itself, and a pool holding it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestMutualTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	c := newCluster(t, Config{
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ClientTLS: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, "a", "b", "c")
+	c.startAll()
+	leader := c.waitLeader()
+	if err := c.stores[c.other(leader)].Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkValue("k", "v")
+
+	// a client without a certificate is turned away during the handshake
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	res, err := client.Post("https://"+c.config.Peers[leader]+"/raft/vote", "application/x-gob", bytes.NewReader(nil))
+	if err == nil {
+		res.Body.Close()
+		t.Errorf("got %s without a client certificate", res.Status)
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	node, _, _ := newTestNode(t, Config{})
+	srv := httptest.NewServer(node.Handler())
+	defer srv.Close()
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(voteRequest{Candidate: strings.Repeat("x", maxVoteRequest)}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(srv.URL+"/raft/vote", "application/x-gob", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %s for an oversized request, want 413", res.Status)
+	}
+}
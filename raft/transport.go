@@ -0,0 +1,233 @@
+package kvraft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+)
+
+// most bytes a node reads of the requests of each kind, apart from
+// snapshots, see Config.MaxSnapshotSize. a write's plan holds the keys it
+// read as well as its records, and appends are kept under maxAppendBytes
+// past their first entry.
+const (
+	maxVoteRequest    = 1 << 20
+	maxAppendRequest  = maxEntrySize + maxAppendBytes + 1<<20
+	maxProposeRequest = 2 * maxEntrySize
+)
+
+// asks for a node's vote in an election
+type voteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64 // Index and term of the candidate's last entry
+	LastTerm  uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// sent by the leader with the entries after PrevIndex, none for a heartbeat
+type appendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []logEntry
+	Commit    uint64 // The leader's commit index
+}
+
+type appendResponse struct {
+	Term    uint64
+	Success bool
+	Next    uint64 // Where the leader should resume after a failure, skipping past the follower's conflicting term
+}
+
+// sent by the leader to a node that needs entries the leader cut from its
+// log, holding the leader's store as of Index
+type snapshotRequest struct {
+	Term     uint64
+	Leader   string
+	Index    uint64
+	LastTerm uint64 // Term of the entry at Index
+	State    keyvalue.CatchUp
+}
+
+type snapshotResponse struct {
+	Term uint64
+}
+
+// a write on its way to the leader, passed on by another node or proposed by
+// the leader itself. Sync proposes an empty one.
+type proposeRequest struct {
+	ID   uint64 // Picked at random by the node that planned the write, see logEntry
+	Plan keyvalue.Plan
+}
+
+type proposeResponse struct {
+	Index     uint64 // Where the write was committed
+	NotLeader bool   // The node isn't the leader, ask again once there is a new one
+	Error     string
+	Sentinel  int // 1 + the index in storeErrors of the error Error wraps, 0 if none
+}
+
+// errors of the leader's store that a write passed on to it keeps, so
+// servers on the node the write came from can tell them apart
+var storeErrors = []error{
+	keyvalue.ErrStalePlan,
+	keyvalue.ErrKeyTooLarge,
+	keyvalue.ErrValueTooLarge,
+	keyvalue.ErrInvalidKey,
+	keyvalue.ErrInvalidValue,
+	keyvalue.ErrMaxKeysReached,
+	keyvalue.ErrMemoryLimitReached,
+	keyvalue.ErrQuotaExceeded,
+}
+
+// an error returned by the leader for a write passed on to it
+type leaderError struct {
+	msg      string
+	sentinel error // One of storeErrors, or nil
+}
+
+func (e *leaderError) Error() string { return e.msg }
+func (e *leaderError) Unwrap() error { return e.sentinel }
+
+// the response to a write passed on by another node that failed with err
+func errorResponse(err error) proposeResponse {
+	resp := proposeResponse{Error: err.Error()}
+	for i, sentinel := range storeErrors {
+		if errors.Is(err, sentinel) {
+			resp.Sentinel = i + 1
+			break
+		}
+	}
+	return resp
+}
+
+// the error in the response of the leader, see errorResponse
+func (resp proposeResponse) err() error {
+	err := &leaderError{msg: resp.Error}
+	if resp.Sentinel > 0 && resp.Sentinel <= len(storeErrors) {
+		err.sentinel = storeErrors[resp.Sentinel-1]
+	}
+	return err
+}
+
+// serve the other nodes' requests on addr until Close is called, over TLS
+// with Config.TLS
+func (n *Node) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if n.config.TLS != nil {
+		l = tls.NewListener(l, n.config.TLS)
+	}
+	return n.Serve(l)
+}
+
+// serve the other nodes' requests on l until Close is called. a clean
+// shutdown returns nil.
+func (n *Node) Serve(l net.Listener) error {
+	srv := &http.Server{Handler: n.Handler()}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		l.Close()
+		return ErrNodeClosed
+	}
+	n.servers = append(n.servers, srv)
+	n.mu.Unlock()
+
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// the handler of the other nodes' requests, to serve them alongside other
+// handlers instead of with Serve. requests without Config.Token get a 401.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /raft/vote", handle(maxVoteRequest, n.handleVote))
+	mux.Handle("POST /raft/append", handle(maxAppendRequest, n.handleAppend))
+	mux.Handle("POST /raft/snapshot", handle(n.config.MaxSnapshotSize, n.handleSnapshot))
+	mux.Handle("POST /raft/propose", handle(maxProposeRequest, n.handlePropose))
+	if n.config.Token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := auth.BearerToken(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(token), []byte(n.config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid cluster token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// an HTTP handler decoding a gob request of up to limit bytes for fn and
+// encoding its response
+func handle[Req, Resp any](limit int64, fn func(ctx context.Context, req Req) Resp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		err := gob.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&req)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-gob")
+		gob.NewEncoder(w).Encode(fn(r.Context(), req))
+	})
+}
+
+// send a request to the node with the given ID and decode its response into
+// resp
+func (n *Node) call(ctx context.Context, id, path string, req, resp any) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(req); err != nil {
+		return err
+	}
+	scheme := "http://"
+	if n.config.ClientTLS != nil {
+		scheme = "https://"
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+n.config.Peers[id]+path, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-gob")
+	if n.config.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+	res, err := n.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("node %s returned %s", id, res.Status)
+	}
+	if err := gob.NewDecoder(res.Body).Decode(resp); err != nil {
+		return fmt.Errorf("error decoding response from node %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Package ratelimit limits how often each client of a server may make
+// requests, so one misbehaving client can't saturate the store with writes:
+//
+//	limiter := ratelimit.New(100, 200)
+//	if ok, retryAfter := limiter.Allow(clientAddr); !ok {
+//		// reject the request, the client may try again after retryAfter
+//	}
+//
+// every client has a bucket of burst tokens, refilled at rate tokens per
+// second, and each request takes one. the servers take a Limiter with their
+// UseRateLimit methods. they count every request against its IP address
+// before checking its API token, so guessing tokens is limited too, and
+// against the name of its token as well once authenticated.
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// reported to clients whose requests are rejected
+var ErrLimited = errors.New("rate limit exceeded")
+
+// how often buckets that have filled up again are dropped
+const sweepInterval = time.Minute
+
+// the tokens a client has left
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last updated
+}
+
+// a token bucket per client. it is safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// create a limiter allowing each client rate requests a second on average
+// and bursts of up to burst requests. burst is at least 1.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     math.Max(float64(burst), 1),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take a token from client's bucket. if it is empty the request should be
+// rejected, and retryAfter is how long until the bucket has a token again.
+func (l *Limiter) Allow(client string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweepLocked(now)
+	}
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, sweepInterval
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// drop the buckets that have had time to fill up, a new one is the same
+func (l *Limiter) sweepLocked(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
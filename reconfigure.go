@@ -0,0 +1,91 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// change the limits and sync mode of an open store to those in config:
+// MaxKeys, MaxKeySize, MaxValueSize, MaxRecordSize, SyncMode, SyncInterval
+// and CompactionRate, which also paces a compaction already running. its
+// other fields need the store reopened and are ignored.
+// lowering a limit below what the store already holds fails without changing
+// anything, eviction doesn't make room for a lower MaxKeys. MaxRecordSize
+// also bounds the records read from the log, so it only ever grows.
+func (s *Store) Reconfigure(config StoreConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	if s.useMemory {
+		if n := int(s.keys.Load()); n > config.MaxKeys {
+			return fmt.Errorf("store holds %d keys: %w (%d)", n, ErrMaxKeysReached, config.MaxKeys)
+		}
+	}
+	if config.MaxKeySize < s.maxKeySize || config.MaxValueSize < s.maxValueSize {
+		entries, err := s.liveEntries(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if len(entry.Key) > config.MaxKeySize {
+				return fmt.Errorf("%q: %w of %d bytes", entry.Key, ErrKeyTooLarge, config.MaxKeySize)
+			}
+			if len(entry.Value) > config.MaxValueSize {
+				return fmt.Errorf("%q: %w of %d bytes", entry.Key, ErrValueTooLarge, config.MaxValueSize)
+			}
+		}
+	}
+
+	// the sync mode of a store without a log file stays SyncNever, see
+	// NewStore
+	syncMode := config.SyncMode
+	if s.memoryOnly() {
+		syncMode = SyncNever
+	}
+	// writes from now on are synced as they are made, so sync the ones
+	// before them too
+	if syncMode == SyncEveryWrite && s.syncMode != SyncEveryWrite && s.dirty {
+		if err := s.flushBuffer(); err != nil {
+			return err
+		}
+		if err := s.syncLog(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+
+	s.maxKeys = config.MaxKeys
+	s.maxKeySize = config.MaxKeySize
+	s.maxValueSize = config.MaxValueSize
+	recordSize := config.MaxRecordSize
+	if recordSize <= 0 {
+		recordSize = max(recordSizeFor(config.MaxKeySize, config.MaxValueSize), defaultMaxRecordSize)
+	}
+	s.maxRecordSize = max(s.maxRecordSize, recordSize)
+	s.compactRate.Store(config.CompactionRate)
+
+	s.syncMode = syncMode
+	if s.syncStop != nil {
+		close(s.syncStop)
+		s.syncStop = nil
+	}
+	if syncMode == SyncInterval && !s.readOnly {
+		s.startSync(config.SyncInterval)
+	}
+	return nil
+}
+
+// start syncing the log in the background every interval, 1s if it isn't
+// positive. the caller must hold the write lock or be opening the store.
+func (s *Store) startSync(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	s.syncStop = make(chan struct{})
+	s.wg.Add(1)
+	go s.syncLoop(interval, s.syncStop)
+}
@@ -0,0 +1,106 @@
+package keyvalue
+
+import (
+	"fmt"
+	"time"
+)
+
+// why a key was removed from memory, see OnEvict
+type RemovalReason int
+
+const (
+	RemovalDeleted RemovalReason = iota // The key was deleted
+	RemovalExpired                      // The key's expiration time passed
+	RemovalEvicted                      // The key was evicted to make room, see StoreConfig.EvictionPolicy
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalDeleted:
+		return "deleted"
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	default:
+		return fmt.Sprintf("RemovalReason(%d)", int(r))
+	}
+}
+
+// a key removed from memory, delivered to OnEvict callbacks
+type removal struct {
+	key    string
+	value  string
+	reason RemovalReason
+}
+
+// a callback registered with OnEvict
+type hook = relay[removal]
+
+// call fn with the last value of every key removed from memory from now on,
+// and why, to release resources tied to keys or emit events. fn is called
+// from its own goroutine, one key at a time in the order they were removed,
+// so it can use the store and a slow fn never holds up writes. keys are only
+// held in memory in memory mode, so in file-only mode fn is never called.
+// keys replaced by Set, moved by Rename or dropped by RestoreSnapshot aren't
+// reported. call the returned function to unregister fn, calls already queued
+// are then skipped. closing the store also unregisters it.
+func (s *Store) OnEvict(fn func(key, value string, reason RemovalReason)) func() {
+	l := newRelay[removal]()
+	go func() {
+		for r := range l.ch {
+			fn(r.key, r.value, r.reason)
+		}
+	}()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.stop()
+		return func() {}
+	}
+	if s.evictHooks == nil {
+		s.evictHooks = make(map[*hook]struct{})
+	}
+	s.evictHooks[l] = struct{}{}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.evictHooks, l)
+		s.mu.Unlock()
+		l.stop()
+	}
+}
+
+// remove a key from memory and report it to OnEvict callbacks. a key deleted
+// after it expired but before it was purged counts as expired. the caller
+// must hold the write lock.
+func (s *Store) dropLocked(key string, reason RemovalReason) {
+	if entry, ok := s.removeLocked(key); ok {
+		s.reportRemoval(entry, reason)
+	}
+}
+
+// queue a removed entry for every OnEvict callback. safe to call with only
+// the read lock held, see deleteShared.
+func (s *Store) reportRemoval(entry Entry, reason RemovalReason) {
+	if len(s.evictHooks) == 0 {
+		return
+	}
+	if reason == RemovalDeleted && entry.expired(time.Now().UnixNano()) {
+		reason = RemovalExpired
+	}
+	for l := range s.evictHooks {
+		l.push(removal{key: entry.Key, value: entry.Value, reason: reason})
+	}
+}
+
+// unregister every OnEvict callback, when the store is closed. the caller
+// must hold the write lock.
+func (s *Store) stopHooks() {
+	for l := range s.evictHooks {
+		l.stop()
+	}
+	s.evictHooks = nil
+}
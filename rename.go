@@ -0,0 +1,105 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+)
+
+// move the value of oldKey to newKey as a single atomic step, replacing
+// newKey if it exists and keeping the expiration time. the two records are
+// written as a transaction, so replay never sees one without the other.
+// fails with ErrKeyNotFound if oldKey doesn't exist.
+func (s *Store) Rename(oldKey, newKey string) error {
+	_, err := s.rename(oldKey, newKey, true)
+	return err
+}
+
+// like Rename, but leaves both keys alone if newKey already exists. reports
+// whether the key was renamed.
+func (s *Store) RenameIfAbsent(oldKey, newKey string) (bool, error) {
+	return s.rename(oldKey, newKey, false)
+}
+
+func (s *Store) rename(oldKey, newKey string, replace bool) (bool, error) {
+	var renamed bool
+	op := Operation{Type: OpRename, Ctx: context.Background(), Keys: []string{oldKey, newKey}}
+	err := s.runFunc(op, func(context.Context) (err error) {
+		oldKey, newKey := s.normalize(oldKey), s.normalize(newKey)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		renamed, err = s.renameLocked(oldKey, newKey, replace)
+		return err
+	})
+	return renamed, err
+}
+
+// rename a key, replacing newKey only if replace is set. the caller must hold
+// the write lock.
+func (s *Store) renameLocked(oldKey, newKey string, replace bool) (bool, error) {
+	current, exists, err := s.lookupLocked(oldKey)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, fmt.Errorf("%q: %w", oldKey, ErrKeyNotFound)
+	}
+	target, taken, err := s.lookupLocked(newKey)
+	if err != nil {
+		return false, err
+	}
+	if taken && (!replace || oldKey == newKey) {
+		return oldKey == newKey, nil
+	}
+	if err := s.validate(newKey, current.Value); err != nil {
+		return false, err
+	}
+
+	ops := []Entry{
+		{Key: newKey, Value: current.Value, ExpiresAt: current.ExpiresAt},
+		{Key: oldKey, Deleted: true},
+	}
+	evictions := 0
+	if s.useMemory {
+		if err := s.checkQuota(ops...); err != nil {
+			return false, err
+		}
+		newKeys, newBytes := 0, memSize(newKey, current.Value)-memSize(oldKey, current.Value)
+		if taken {
+			newKeys, newBytes = -1, newBytes-memSize(newKey, target.Value)
+		}
+		evicted, err := s.makeRoomLocked(newKeys, newBytes, map[string]bool{oldKey: true, newKey: true})
+		if err != nil {
+			return false, err
+		}
+		ops = append(evicted, ops...)
+		evictions = len(evicted)
+	}
+
+	id := s.nextTxnID()
+	records := make([]Entry, 0, len(ops)+1)
+	for _, op := range ops {
+		op.Txn = id
+		records = append(records, op)
+	}
+	records = append(records, Entry{Txn: id, Commit: true})
+	if err := s.appendEntries(records...); err != nil {
+		return false, err
+	}
+
+	if s.useMemory {
+		// the old key's value lives on under the new one, so only evictions
+		// are reported
+		for i, op := range records[:len(ops)] {
+			switch {
+			case !op.Deleted:
+				s.putLocked(op)
+			case i < evictions:
+				s.dropLocked(op.Key, RemovalEvicted)
+			default:
+				s.removeLocked(op.Key)
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// files that replace the log, a segment or a sidecar are written next to it
+// with this suffix and renamed over it once they are complete and fsynced
+const tempSuffix = ".tmp"
+
+// atomically replace the file at path with data. a crash leaves either the
+// old file or the new one, plus a temp file that removeTempFiles cleans up.
+func replaceFile(path string, data []byte) error {
+	tempFile := path + tempSuffix
+	if err := writeSynced(tempFile, data); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// write data to a new file at path and fsync it
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// append data to the file at path and fsync it
+func appendSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// remove the temp files that a crash while compacting or saving a sidecar
+// left next to the log. the files they were going to replace are intact,
+// since temp files are only renamed once they are complete. the caller must
+// hold the lock on the log, so no other process is writing them.
+func (s *Store) removeTempFiles() error {
+	dir, base := filepath.Split(s.filename)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error listing log directory: %w", err)
+	}
+
+	for _, file := range files {
+		rest, ok := strings.CutPrefix(file.Name(), base)
+		if !ok {
+			continue
+		}
+		replaced, ok := strings.CutSuffix(rest, tempSuffix)
+		if !ok {
+			continue
+		}
+		// the log itself, a segment or a sidecar
+		suffix, dotted := strings.CutPrefix(replaced, ".")
+		isSegment := dotted && len(suffix) >= 6 && strings.Trim(suffix, "0123456789") == ""
+		if replaced != "" && replaced != ".idx" && replaced != ".bloom" && replaced != ".ckpt" && !isSegment {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		s.logger.Warn("removing temp file left by an interrupted write", "path", path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing temp file: %w", err)
+		}
+	}
+	return nil
+}
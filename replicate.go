@@ -0,0 +1,204 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// what a replica needs to catch up with the store, see Subscribe
+type CatchUp struct {
+	Keys    []string // Every live key, the ones a replica holds that aren't here were deleted
+	Entries []Entry  // Live entries set by records after the sequence number the replica asked for
+}
+
+// a subscriber to the batches of records written to the log
+type feed = relay[[]Entry]
+
+// subscribe to the records written to the store, to replicate it. the
+// returned CatchUp brings a replica that has applied the records up to
+// sequence number after up to date, or fills an empty one if after is 0, and
+// the channel then delivers every batch of records written since, in order,
+// to pass to ApplyRecords. batches are queued without limit, so a slow
+// replica never misses one. call the returned function to unsubscribe, which
+// closes the channel. closing the store or restoring a snapshot also closes
+// it, after which the replica has to subscribe again.
+func (s *Store) Subscribe(after uint64) (CatchUp, <-chan []Entry, func(), error) {
+	// the write lock keeps out writers that only take the read lock too, so
+	// no record is both in the catch-up and sent to the channel
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return CatchUp{}, nil, nil, ErrStoreClosed
+	}
+	entries, err := s.liveEntries(context.Background())
+	if err != nil {
+		return CatchUp{}, nil, nil, err
+	}
+	catchUp := CatchUp{Keys: make([]string, len(entries))}
+	for i, entry := range entries {
+		catchUp.Keys[i] = entry.Key
+		if entry.Seq > after || entry.Seq == 0 {
+			catchUp.Entries = append(catchUp.Entries, entry)
+		}
+	}
+
+	f := newRelay[[]Entry]()
+	if s.feeds == nil {
+		s.feeds = make(map[*feed]struct{})
+	}
+	s.feeds[f] = struct{}{}
+	cancel := func() {
+		s.mu.Lock()
+		delete(s.feeds, f)
+		s.mu.Unlock()
+		f.stop()
+	}
+	return catchUp, f.ch, cancel, nil
+}
+
+// queue records that were written to the log for every subscriber. partial
+// records are skipped, their writers feed the whole value they leave instead,
+// see patchLocked. the caller must hold amu or the write lock, so batches are
+// queued in the order they were written.
+func (s *Store) feedEntries(entries []Entry) {
+	if len(s.feeds) == 0 {
+		return
+	}
+	batch := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.partial() {
+			batch = append(batch, entry)
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	for f := range s.feeds {
+		f.push(batch)
+	}
+}
+
+// stop every subscriber, when the store is closed or its contents are
+// replaced. the caller must hold the write lock.
+func (s *Store) stopFeeds() {
+	for f := range s.feeds {
+		f.stop()
+	}
+	s.feeds = nil
+}
+
+// bring the store up to date with a primary's CatchUp, see Subscribe, in a
+// single write. keys that the primary no longer has are deleted.
+func (s *Store) ApplyCatchUp(c CatchUp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.liveEntries(context.Background())
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(c.Keys))
+	for _, key := range c.Keys {
+		keep[key] = true
+	}
+	var records []Entry
+	for _, entry := range current {
+		if !keep[entry.Key] {
+			records = append(records, Entry{Key: entry.Key, Deleted: true})
+		}
+	}
+	for _, entry := range c.Entries {
+		records = append(records, entry.standalone())
+	}
+	return s.applyLocked(records)
+}
+
+// apply a batch of records received from a primary's Subscribe channel in a
+// single write, keeping their sequence numbers
+func (s *Store) ApplyRecords(batch []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applyLocked(slices.Clone(batch))
+}
+
+// write records replicated from a primary and apply them to memory. the
+// caller must hold the write lock.
+func (s *Store) applyLocked(records []Entry) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	// the whole value each partial record leaves its key with
+	wholes := make(map[int]string)
+	values := make(map[string]string)
+	for i, record := range records {
+		switch {
+		case record.Commit:
+		case record.Deleted:
+			values[record.Key] = ""
+		case record.partial():
+			base, ok := values[record.Key]
+			if !ok {
+				current, _, err := s.lookupLocked(record.Key)
+				if err != nil {
+					return err
+				}
+				base = current.Value
+			}
+			value, err := record.applyTo(base)
+			if err != nil {
+				return fmt.Errorf("error applying %q record for %q: %w", record.Op, record.Key, err)
+			}
+			values[record.Key], wholes[i] = value, value
+		default:
+			values[record.Key] = record.Value
+		}
+	}
+
+	if err := s.appendRecords(records, false); err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		switch {
+		case record.Commit:
+			continue
+		case !s.useMemory:
+		case record.Deleted:
+			s.dropLocked(record.Key, RemovalDeleted)
+		case record.partial():
+			s.putLocked(record.standalone().whole(wholes[i]))
+		default:
+			s.putLocked(record.standalone())
+		}
+		// the search index, watchers and subscribers skip partial records, see
+		// patchLocked
+		if record.partial() {
+			if s.search != nil {
+				s.search.set(record.Key, wholes[i])
+			}
+			s.notify(Event{Type: EventSet, Key: record.Key, Value: wholes[i]})
+			s.feedEntries([]Entry{record.whole(wholes[i])})
+		}
+	}
+	return nil
+}
+
+// the highest sequence number among the live entries in the store. a replica
+// subscribes from it to resume where it left off.
+func (s *Store) LastSeq() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := s.liveEntries(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	for _, entry := range entries {
+		seq = max(seq, entry.Seq)
+	}
+	return seq, nil
+}
@@ -0,0 +1,209 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+)
+
+// serves the records written to a store to replicas
+type Primary struct {
+	store  *keyvalue.Store
+	acl    *auth.ACL
+	tls    *tls.Config
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// create a primary for the given store
+func NewPrimary(store *keyvalue.Store) *Primary {
+	return &Primary{
+		store:  store,
+		logger: slog.Default(),
+		conns:  make(map[net.Conn]struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// require replicas to present an admin token checked against acl. call it
+// before serving.
+func (p *Primary) UseACL(acl *auth.ACL) {
+	p.acl = acl
+}
+
+// accept TLS connections with config in ListenAndServe, see
+// auth.TLSConfig. call it before serving.
+func (p *Primary) UseTLS(config *tls.Config) {
+	p.tls = config
+}
+
+// report replicas that are refused or lose their connection to logger
+// instead of slog.Default(). call it before serving.
+func (p *Primary) UseLogger(logger *slog.Logger) {
+	p.logger = logger
+}
+
+// listen on a TCP address and serve until Close is called
+func (p *Primary) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if p.tls != nil {
+		l = tls.NewListener(l, p.tls)
+	}
+	return p.Serve(l)
+}
+
+// accept replicas from l until Close is called. a clean shutdown returns
+// nil.
+func (p *Primary) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		l.Close()
+		return errors.New("replication: primary closed")
+	}
+	p.listener = l
+	p.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		p.mu.Lock()
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.handle(conn)
+	}
+}
+
+// stop accepting replicas, disconnect the connected ones and wait for their
+// handlers
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+// send a replica its catch-up and then every batch of records written, until
+// it disconnects
+func (p *Primary) handle(conn net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		conn.Close()
+	}()
+
+	var h hello
+	conn.SetReadDeadline(time.Now().Add(heartbeatInterval))
+	if err := gob.NewDecoder(io.LimitReader(conn, maxHelloSize)).Decode(&h); err != nil {
+		p.logger.Warn("error reading replica handshake", "addr", conn.RemoteAddr(), "err", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	w := bufio.NewWriter(conn)
+	enc := gob.NewEncoder(w)
+	send := func(msg message) error {
+		conn.SetWriteDeadline(time.Now().Add(3 * heartbeatInterval))
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if err := p.authenticate(h.Token); err != nil {
+		p.logger.Warn("refused replica", "addr", conn.RemoteAddr(), "err", err)
+		send(message{Error: err.Error()})
+		return
+	}
+
+	catchUp, records, cancel, err := p.store.Subscribe(h.After)
+	if err != nil {
+		p.logger.Error("error subscribing replica", "addr", conn.RemoteAddr(), "err", err)
+		return
+	}
+	defer cancel()
+
+	if err := send(message{CatchUp: &catchUp}); err != nil {
+		p.logger.Warn("error sending catch-up to replica", "addr", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var msg message
+		select {
+		case batch, ok := <-records:
+			if !ok {
+				// the store was closed or restored from a snapshot, the
+				// replica catches up again when it reconnects
+				return
+			}
+			msg.Records = batch
+		case <-heartbeat.C:
+		case <-p.done:
+			return
+		}
+		if err := send(msg); err != nil {
+			p.logger.Warn("error sending records to replica", "addr", conn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+}
+
+// check a replica's token against the ACL, replicas read every key so only
+// admins may connect
+func (p *Primary) authenticate(token string) error {
+	if p.acl == nil {
+		return nil
+	}
+	principal, err := p.acl.Authenticate(token)
+	if err != nil {
+		return err
+	}
+	return principal.CheckAdmin()
+}
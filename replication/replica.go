@@ -0,0 +1,149 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// how long a replica waits before reconnecting, doubling up to maxBackoff
+// while the primary stays unreachable
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// keeps a store up to date with a primary
+type Replica struct {
+	store  *keyvalue.Store
+	addr   string
+	token  string
+	tls    *tls.Config
+	logger *slog.Logger
+	seq    atomic.Uint64
+}
+
+// create a replica applying the records of the primary at addr to store,
+// which should be opened with StoreConfig.Replica
+func NewReplica(store *keyvalue.Store, addr string) *Replica {
+	return &Replica{store: store, addr: addr, logger: slog.Default()}
+}
+
+// present token to a primary with an ACL. call it before Run.
+func (r *Replica) UseToken(token string) {
+	r.token = token
+}
+
+// dial the primary over TLS with config, see auth.ClientTLSConfig. call it
+// before Run.
+func (r *Replica) UseTLS(config *tls.Config) {
+	r.tls = config
+}
+
+// report lost connections to the primary to logger instead of
+// slog.Default(). call it before Run.
+func (r *Replica) UseLogger(logger *slog.Logger) {
+	r.logger = logger
+}
+
+// the sequence number of the last record applied from the primary
+func (r *Replica) Seq() uint64 {
+	return r.seq.Load()
+}
+
+// follow the primary until ctx is cancelled, reconnecting whenever the
+// connection is lost. returns ctx.Err() once cancelled, or an error if the
+// store can't be read to find where to resume from.
+func (r *Replica) Run(ctx context.Context) error {
+	seq, err := r.store.LastSeq()
+	if err != nil {
+		return fmt.Errorf("error finding last applied record: %w", err)
+	}
+	r.seq.Store(seq)
+
+	backoff := minBackoff
+	for {
+		connected, err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			backoff = minBackoff
+		}
+		r.logger.Warn("lost connection to primary, reconnecting", "addr", r.addr, "err", err, "in", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect to the primary and apply what it sends until the connection is
+// lost. reports whether it got as far as catching up.
+func (r *Replica) follow(ctx context.Context) (bool, error) {
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		d := tls.Dialer{Config: r.tls}
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	// closing the connection interrupts a read once ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := gob.NewEncoder(conn).Encode(hello{After: r.seq.Load(), Token: r.token}); err != nil {
+		return false, err
+	}
+
+	dec := gob.NewDecoder(bufio.NewReader(conn))
+	connected := false
+	for {
+		// the primary sends heartbeats, so a silent connection is a dead one
+		conn.SetReadDeadline(time.Now().Add(3 * heartbeatInterval))
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return connected, err
+		}
+		switch {
+		case msg.Error != "":
+			return connected, fmt.Errorf("primary refused replica: %s", msg.Error)
+		case msg.CatchUp != nil:
+			if err := r.store.ApplyCatchUp(*msg.CatchUp); err != nil {
+				return connected, fmt.Errorf("error applying catch-up: %w", err)
+			}
+			r.advance(msg.CatchUp.Entries)
+			connected = true
+		case len(msg.Records) > 0:
+			if err := r.store.ApplyRecords(msg.Records); err != nil {
+				return connected, fmt.Errorf("error applying records: %w", err)
+			}
+			r.advance(msg.Records)
+		}
+	}
+}
+
+// move the last applied sequence number past entries
+func (r *Replica) advance(entries []keyvalue.Entry) {
+	seq := r.seq.Load()
+	for _, entry := range entries {
+		seq = max(seq, entry.Seq)
+	}
+	r.seq.Store(seq)
+}
@@ -0,0 +1,49 @@
+// Package replication streams the records written to a keyvalue.Store over
+// TCP to replicas that apply them in order, for reads from more than one
+// machine. the primary serves its store:
+//
+//	primary := replication.NewPrimary(store)
+//	go primary.ListenAndServe(":7000")
+//
+// and each replica, opened with StoreConfig.Replica so it only takes writes
+// from the primary, follows it:
+//
+//	replica := replication.NewReplica(replicaStore, "primary:7000")
+//	go replica.Run(ctx)
+//
+// a replica resumes from the last record it applied when it reconnects or is
+// restarted, see Store.Subscribe. records are sent as gob-encoded batches.
+// replicas receive every key, so unless the primary is on a trusted network
+// give it an ACL with UseACL, which makes replicas present an admin token set
+// with Replica.UseToken, and a TLS config with UseTLS, which replicas dial
+// with Replica.UseTLS.
+package replication
+
+import (
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// how often the primary writes to an idle connection, so replicas notice when
+// it goes away
+const heartbeatInterval = 10 * time.Second
+
+// the most a primary reads of a replica's handshake, which only holds a
+// sequence number and a token
+const maxHelloSize = 64 << 10
+
+// sent by a replica when it connects
+type hello struct {
+	After uint64 // Sequence number of the last record the replica applied
+	Token string // API token checked against the primary's ACL
+}
+
+// sent by the primary. the first message holds the catch-up, the ones after
+// it a batch of records each, and heartbeats neither. a replica the primary
+// refuses is sent only Error.
+type message struct {
+	CatchUp *keyvalue.CatchUp
+	Records []keyvalue.Entry
+	Error   string
+}
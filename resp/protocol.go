@@ -0,0 +1,138 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// limits on what a client may send, to keep a bad client from exhausting
+// memory. maxBulkLen is the default of Server.LimitRequestSize and
+// maxCommandLen of Server.LimitCommandSize, Redis's own query buffer limit.
+const (
+	maxArgs       = 1024 * 1024
+	maxBulkLen    = 512 * 1024 * 1024
+	maxCommandLen = 1024 * 1024 * 1024
+)
+
+// read one command, either a RESP array of bulk strings or an inline command
+// as typed into telnet, whose strings and lines are at most maxBulk bytes
+// and whose strings add up to at most maxTotal. buffers grow as the data
+// arrives rather than to the lengths the client claims.
+func readCommand(r *bufio.Reader, maxBulk, maxTotal int) ([]string, error) {
+	line, err := readLine(r, maxBulk)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, 0, min(max(n, 0), 64))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxBulk)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, errors.New("invalid bulk length")
+		}
+		if total += size; total > maxTotal {
+			return nil, errors.New("command too large")
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			return nil, unexpected(err)
+		}
+		data := buf.Bytes()
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, errors.New("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// read a line of at most limit bytes terminated by CRLF or LF, without the
+// terminator
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit+2 {
+			return "", errors.New("line too long")
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+	}
+}
+
+// an EOF in the middle of a command is an error, not a clean disconnect
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// errors are simple strings, so any line breaks are replaced
+func writeError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBool(w *bufio.Writer, b bool) {
+	if b {
+		writeInt(w, 1)
+	} else {
+		writeInt(w, 0)
+	}
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		writeBulk(w, item)
+	}
+}
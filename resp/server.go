@@ -0,0 +1,580 @@
+// Package resp serves a keyvalue.Store over the Redis serialization protocol,
+// so existing Redis clients can use it. only a small set of commands is
+// supported: PING, ECHO, GET, MGET, SET (with EX/PX), DEL, EXISTS, KEYS,
+// EXPIRE, RENAME, RENAMENX, INCR, INCRBY, DECR and DECRBY, the list commands
+// LPUSH, RPUSH, LPOP, RPOP, LRANGE and LLEN, the set commands SADD, SREM,
+// SMEMBERS and SISMEMBER, and the hash commands HSET (with a single field),
+// HGET, HGETALL and HDEL.
+//
+// with an ACL from UseACL clients have to send AUTH with an API token before
+// anything else, and commands on keys the token can't use fail with NOPERM.
+// KEYS leaves those keys out. with a limiter from UseRateLimit commands from
+// clients sending too many, by IP address and by token, fail with an error.
+// LimitRequestSize caps the size of the strings a command holds, and
+// LimitCommandSize their total.
+package resp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+	"github.com/jere-mie/keyvalue/auth"
+	"github.com/jere-mie/keyvalue/ratelimit"
+)
+
+// a RESP server backed by a store
+type Server struct {
+	store      *keyvalue.Store
+	acl        *auth.ACL
+	tls        *tls.Config
+	limiter    *ratelimit.Limiter
+	maxBulk    int // Largest string in a command
+	maxCommand int // Largest total size of the strings in a command
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// create a server for the given store
+func New(store *keyvalue.Store) *Server {
+	return &Server{store: store, maxBulk: maxBulkLen, maxCommand: maxCommandLen, conns: make(map[net.Conn]struct{})}
+}
+
+// require clients to AUTH with a token checked against acl, see the package
+// docs. call it before serving.
+func (s *Server) UseACL(acl *auth.ACL) {
+	s.acl = acl
+}
+
+// accept TLS connections with config in ListenAndServe, see
+// auth.TLSConfig. call it before serving.
+func (s *Server) UseTLS(config *tls.Config) {
+	s.tls = config
+}
+
+// limit how often each client may send commands, see the ratelimit package.
+// call it before serving.
+func (s *Server) UseRateLimit(limiter *ratelimit.Limiter) {
+	s.limiter = limiter
+}
+
+// drop connections sending a command with a string longer than n bytes,
+// like a value over StoreConfig.MaxValueSize, before reading all of it. 0
+// keeps the default of 512MB. call it before serving.
+func (s *Server) LimitRequestSize(n int) {
+	if n <= 0 {
+		n = maxBulkLen
+	}
+	s.maxBulk = n
+}
+
+// drop connections sending a command whose strings add up to more than n
+// bytes, like an RPUSH of many values, before reading past the limit. 0
+// keeps the default of 1GB. call it before serving.
+func (s *Server) LimitCommandSize(n int) {
+	if n <= 0 {
+		n = maxCommandLen
+	}
+	s.maxCommand = n
+}
+
+// listen on a TCP address and serve until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		l = tls.NewListener(l, s.tls)
+	}
+	return s.Serve(l)
+}
+
+// accept connections from l until Close is called. a clean shutdown returns
+// nil.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errors.New("resp: server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// stop accepting connections, close open ones and wait for their handlers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	// who the connection is authenticated as
+	var principal *auth.Principal
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	for {
+		args, err := readCommand(r, s.maxBulk, s.maxCommand)
+		if err != nil {
+			if err != io.EOF {
+				writeError(w, "ERR protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := strings.EqualFold(args[0], "QUIT")
+		switch {
+		case quit:
+			writeSimple(w, "OK")
+		// limit by address first so AUTH attempts count too
+		case !s.allow(ip):
+			writeError(w, "ERR "+ratelimit.ErrLimited.Error())
+		case strings.EqualFold(args[0], "AUTH"):
+			principal = s.authenticate(w, args[1:], principal)
+		case s.acl != nil && principal == nil:
+			writeError(w, "NOAUTH Authentication required.")
+		case principal != nil && !s.allow("token:"+principal.Name):
+			writeError(w, "ERR "+ratelimit.ErrLimited.Error())
+		default:
+			s.exec(w, args, principal)
+		}
+
+		// flush once the client has no more pipelined commands waiting
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// the minimum and maximum number of arguments for each command, -1 means no
+// maximum
+var arity = map[string][2]int{
+	"PING": {0, 1}, "ECHO": {1, 1}, "COMMAND": {0, -1},
+	"GET": {1, 1}, "MGET": {1, -1}, "SET": {2, 6}, "DEL": {1, -1}, "EXISTS": {1, -1}, "KEYS": {1, 1},
+	"EXPIRE": {2, 2}, "RENAME": {2, 2}, "RENAMENX": {2, 2}, "INCR": {1, 1}, "INCRBY": {2, 2}, "DECR": {1, 1}, "DECRBY": {2, 2},
+	"LPUSH": {2, -1}, "RPUSH": {2, -1}, "LPOP": {1, 1}, "RPOP": {1, 1}, "LRANGE": {3, 3}, "LLEN": {1, 1},
+	"SADD": {2, -1}, "SREM": {2, -1}, "SMEMBERS": {1, 1}, "SISMEMBER": {2, 2},
+	"HSET": {3, 3}, "HGET": {2, 2}, "HGETALL": {1, 1}, "HDEL": {2, -1},
+}
+
+// whether the rate limit lets a command from client through
+func (s *Server) allow(client string) bool {
+	if s.limiter == nil {
+		return true
+	}
+	ok, _ := s.limiter.Allow(client)
+	return ok
+}
+
+// AUTH [username] token, the username is ignored. returns who the connection
+// is authenticated as afterwards.
+func (s *Server) authenticate(w *bufio.Writer, args []string, current *auth.Principal) *auth.Principal {
+	if len(args) < 1 || len(args) > 2 {
+		writeError(w, "ERR wrong number of arguments for 'auth' command")
+		return current
+	}
+	if s.acl == nil {
+		writeError(w, "ERR AUTH called without any password configured")
+		return current
+	}
+	p, err := s.acl.Authenticate(args[len(args)-1])
+	if err != nil {
+		writeError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return current
+	}
+	writeSimple(w, "OK")
+	return p
+}
+
+// the access each command needs and how many of its first arguments are keys
+// it is checked against, -1 for all of them. commands that return a value
+// they change need both read and write access.
+var keyAccess = map[string]struct {
+	access auth.Access
+	keys   int
+}{
+	"GET": {auth.Read, 1}, "MGET": {auth.Read, -1}, "EXISTS": {auth.Read, -1},
+	"LRANGE": {auth.Read, 1}, "LLEN": {auth.Read, 1}, "SMEMBERS": {auth.Read, 1}, "SISMEMBER": {auth.Read, 1},
+	"HGET": {auth.Read, 1}, "HGETALL": {auth.Read, 1},
+	"SET": {auth.Write, 1}, "DEL": {auth.Write, -1}, "EXPIRE": {auth.Write, 1},
+	"LPUSH": {auth.Write, 1}, "RPUSH": {auth.Write, 1}, "SADD": {auth.Write, 1}, "SREM": {auth.Write, 1},
+	"HSET": {auth.Write, 1}, "HDEL": {auth.Write, 1},
+	"RENAME": {auth.ReadWrite, 2}, "RENAMENX": {auth.ReadWrite, 2},
+	"INCR": {auth.ReadWrite, 1}, "INCRBY": {auth.ReadWrite, 1}, "DECR": {auth.ReadWrite, 1}, "DECRBY": {auth.ReadWrite, 1},
+	"LPOP": {auth.ReadWrite, 1}, "RPOP": {auth.ReadWrite, 1},
+}
+
+// run a single command and write its reply. p is who the connection is
+// authenticated as, nil without an ACL.
+func (s *Server) exec(w *bufio.Writer, args []string, p *auth.Principal) {
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	limits, ok := arity[cmd]
+	if !ok {
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", cmd))
+		return
+	}
+	if len(args) < limits[0] || (limits[1] >= 0 && len(args) > limits[1]) {
+		writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+		return
+	}
+	if p != nil {
+		if rule, ok := keyAccess[cmd]; ok {
+			keys := args
+			if rule.keys >= 0 {
+				keys = args[:rule.keys]
+			}
+			for _, key := range keys {
+				if err := p.Check(key, rule.access); err != nil {
+					writeError(w, "NOPERM "+err.Error())
+					return
+				}
+			}
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "ECHO":
+		writeBulk(w, args[0])
+	case "COMMAND":
+		// clients probe this on connect, an empty list is enough for them
+		writeArray(w, nil)
+	case "GET":
+		value, exists := s.store.Get(args[0])
+		if !exists {
+			writeNull(w)
+		} else {
+			writeBulk(w, value)
+		}
+	case "MGET":
+		values, err := s.store.GetMany(args)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		// missing keys are null elements
+		w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, key := range args {
+			if value, ok := values[key]; ok {
+				writeBulk(w, value)
+			} else {
+				writeNull(w)
+			}
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		var existing []string
+		for _, key := range args {
+			if s.store.Exists(key) {
+				existing = append(existing, key)
+			}
+		}
+		if err := s.store.DeleteBatch(existing); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeInt(w, int64(len(existing)))
+	case "EXISTS":
+		var count int64
+		for _, key := range args {
+			if s.store.Exists(key) {
+				count++
+			}
+		}
+		writeInt(w, count)
+	case "KEYS":
+		pattern := args[0]
+		var matches []string
+		for _, key := range s.store.Keys(literalPrefix(pattern)) {
+			if match(pattern, key) && (p == nil || p.Allowed(key, auth.Read)) {
+				matches = append(matches, key)
+			}
+		}
+		writeArray(w, matches)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		if seconds <= 0 {
+			// an expiration in the past deletes the key
+			exists := s.store.Exists(args[0])
+			if exists {
+				if err := s.store.Delete(args[0]); err != nil {
+					writeError(w, "ERR "+err.Error())
+					return
+				}
+			}
+			writeBool(w, exists)
+			return
+		}
+		ok, err := s.store.Expire(args[0], time.Duration(seconds)*time.Second)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeBool(w, ok)
+	case "RENAME", "RENAMENX":
+		renamed := true
+		var err error
+		if cmd == "RENAME" {
+			err = s.store.Rename(args[0], args[1])
+		} else {
+			renamed, err = s.store.RenameIfAbsent(args[0], args[1])
+		}
+		switch {
+		case errors.Is(err, keyvalue.ErrKeyNotFound):
+			writeError(w, "ERR no such key")
+		case err != nil:
+			writeError(w, "ERR "+err.Error())
+		case cmd == "RENAME":
+			writeSimple(w, "OK")
+		default:
+			writeBool(w, renamed)
+		}
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		delta := int64(1)
+		if len(args) == 2 {
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		}
+		var n int64
+		var err error
+		if cmd == "DECR" || cmd == "DECRBY" {
+			n, err = s.store.Decr(args[0], delta)
+		} else {
+			n, err = s.store.Incr(args[0], delta)
+		}
+		if errors.Is(err, keyvalue.ErrNotInteger) {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeInt(w, n)
+	default:
+		s.execContainer(w, cmd, args)
+	}
+}
+
+// run a list, set or hash command and write its reply
+func (s *Server) execContainer(w *bufio.Writer, cmd string, args []string) {
+	key := args[0]
+	var reply any
+	var err error
+	switch cmd {
+	case "LPUSH", "RPUSH":
+		var n int
+		if cmd == "LPUSH" {
+			n, err = s.store.LPush(key, args[1:]...)
+		} else {
+			n, err = s.store.RPush(key, args[1:]...)
+		}
+		reply = int64(n)
+	case "LPOP", "RPOP":
+		var value string
+		var ok bool
+		if cmd == "LPOP" {
+			value, ok, err = s.store.LPop(key)
+		} else {
+			value, ok, err = s.store.RPop(key)
+		}
+		if ok {
+			reply = value
+		}
+	case "LRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		var items []string
+		items, err = s.store.LRange(key, start, stop)
+		reply = items
+	case "LLEN":
+		var n int
+		n, err = s.store.LLen(key)
+		reply = int64(n)
+	case "SADD", "SREM":
+		var n int
+		if cmd == "SADD" {
+			n, err = s.store.SAdd(key, args[1:]...)
+		} else {
+			n, err = s.store.SRem(key, args[1:]...)
+		}
+		reply = int64(n)
+	case "SMEMBERS":
+		var members []string
+		members, err = s.store.SMembers(key)
+		reply = members
+	case "SISMEMBER":
+		var found bool
+		found, err = s.store.SIsMember(key, args[1])
+		reply = found
+	case "HSET":
+		var added bool
+		added, err = s.store.HSet(key, args[1], args[2])
+		// the number of fields added
+		reply = int64(0)
+		if added {
+			reply = int64(1)
+		}
+	case "HGET":
+		var value string
+		var ok bool
+		if value, ok, err = s.store.HGet(key, args[1]); ok {
+			reply = value
+		}
+	case "HGETALL":
+		var hash map[string]string
+		hash, err = s.store.HGetAll(key)
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		pairs := make([]string, 0, 2*len(hash))
+		for _, field := range fields {
+			pairs = append(pairs, field, hash[field])
+		}
+		reply = pairs
+	case "HDEL":
+		var n int
+		n, err = s.store.HDel(key, args[1:]...)
+		reply = int64(n)
+	}
+
+	switch {
+	case errors.Is(err, keyvalue.ErrNotList), errors.Is(err, keyvalue.ErrNotSet), errors.Is(err, keyvalue.ErrNotHash):
+		writeError(w, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	case err != nil:
+		writeError(w, "ERR "+err.Error())
+	default:
+		switch reply := reply.(type) {
+		case int64:
+			writeInt(w, reply)
+		case bool:
+			writeBool(w, reply)
+		case string:
+			writeBulk(w, reply)
+		case []string:
+			writeArray(w, reply)
+		default:
+			writeNull(w)
+		}
+	}
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func (s *Server) set(w *bufio.Writer, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) || ttl != 0 {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		if opt == "EX" {
+			ttl = time.Duration(n) * time.Second
+		} else {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		i++
+	}
+
+	var err error
+	if ttl > 0 {
+		err = s.store.SetWithTTL(key, value, ttl)
+	} else {
+		err = s.store.Set(key, value)
+	}
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	writeSimple(w, "OK")
+}
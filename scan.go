@@ -0,0 +1,232 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// return every entry whose key starts with prefix, sorted by key. in memory
+// mode only the matching range of the sorted key index is visited, in
+// file-only mode the log is read in a single pass.
+func (s *Store) Scan(prefix string) ([]Entry, error) {
+	return s.ScanCtx(context.Background(), prefix)
+}
+
+// like Scan, but gives up with ctx's error once it is done
+func (s *Store) ScanCtx(ctx context.Context, prefix string) ([]Entry, error) {
+	var entries []Entry
+	err := s.runFunc(Operation{Type: OpScan, Ctx: ctx, Key: prefix}, func(ctx context.Context) (err error) {
+		entries, err = s.scan(ctx, prefix)
+		return err
+	})
+	return entries, err
+}
+
+func (s *Store) scan(ctx context.Context, prefix string) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var results []Entry
+
+	if s.useMemory {
+		for _, key := range s.prefixRange(prefix) {
+			if entry, ok := s.memLookup(key, now); ok {
+				results = append(results, Entry{Key: key, Value: entry.Value})
+			}
+		}
+		return results, nil
+	}
+
+	latest := make(map[string]string)
+	err := s.replayContext(ctx, func(entry Entry) bool {
+		if !strings.HasPrefix(entry.Key, prefix) {
+			return true
+		}
+		if entry.Deleted || entry.expired(now) {
+			delete(latest, entry.Key)
+		} else {
+			latest[entry.Key] = entry.Value
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+
+	for key, value := range latest {
+		results = append(results, Entry{Key: key, Value: value})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results, nil
+}
+
+// return the entries whose keys fall in [start, end), sorted by key and at
+// most limit of them (0 or less for no limit). an empty end leaves the range
+// open ended. in memory mode only the range itself is visited, in file-only
+// mode the log is read in a single pass.
+func (s *Store) Range(start, end string, limit int) ([]Entry, error) {
+	return s.rangeEntries(start, end, limit, false)
+}
+
+// like Range, but sorted by key in descending order, so the limit keeps the
+// last keys of the range
+func (s *Store) RangeReverse(start, end string, limit int) ([]Entry, error) {
+	return s.rangeEntries(start, end, limit, true)
+}
+
+// the entries in [start, end) for Range and RangeReverse
+func (s *Store) rangeEntries(start, end string, limit int, reverse bool) ([]Entry, error) {
+	var entries []Entry
+	err := s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(context.Context) (err error) {
+		entries, err = s.readRange(start, end, limit, reverse)
+		return err
+	})
+	return entries, err
+}
+
+func (s *Store) readRange(start, end string, limit int, reverse bool) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	inRange := func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+	var results []Entry
+
+	if s.useMemory {
+		// keys are copied a batch at a time so expired ones can be skipped
+		// without copying the whole range
+		from, to := start, end
+		for {
+			want := 0
+			if limit > 0 {
+				want = limit - len(results)
+			}
+			keys := s.sortedRange(from, to, want, reverse)
+			for _, key := range keys {
+				if entry, ok := s.memLookup(key, now); ok {
+					results = append(results, Entry{Key: key, Value: entry.Value})
+				}
+			}
+			if limit <= 0 || len(results) >= limit || len(keys) < want {
+				return results, nil
+			}
+			if reverse {
+				to = keys[len(keys)-1]
+			} else {
+				from = keys[len(keys)-1] + "\x00"
+			}
+		}
+	}
+
+	latest := make(map[string]string)
+	err := s.replay(func(entry Entry) bool {
+		if !inRange(entry.Key) {
+			return true
+		}
+		if entry.Deleted || entry.expired(now) {
+			delete(latest, entry.Key)
+		} else {
+			latest[entry.Key] = entry.Value
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log file: %w", err)
+	}
+
+	for key, value := range latest {
+		results = append(results, Entry{Key: key, Value: value})
+	}
+	sort.Slice(results, func(i, j int) bool { return (results[i].Key < results[j].Key) != reverse })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// a copy of up to n of the sorted keys in [start, end), all of them if n is
+// 0 or less. an empty end leaves the range open ended. in reverse the last n
+// keys are returned in descending order. the caller must hold at least the
+// read lock.
+func (s *Store) sortedRange(start, end string, n int, reverse bool) []string {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	i := sort.SearchStrings(s.sorted, start)
+	j := len(s.sorted)
+	if end != "" {
+		j = max(i, sort.SearchStrings(s.sorted, end))
+	}
+	if n > 0 && j-i > n {
+		if reverse {
+			i = j - n
+		} else {
+			j = i + n
+		}
+	}
+	keys := append([]string(nil), s.sorted[i:j]...)
+	if reverse {
+		slices.Reverse(keys)
+	}
+	return keys
+}
+
+// a copy of the sorted keys starting with prefix. the caller must hold at
+// least the read lock.
+func (s *Store) prefixRange(prefix string) []string {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	start := sort.SearchStrings(s.sorted, prefix)
+	end := start
+	for end < len(s.sorted) && strings.HasPrefix(s.sorted[end], prefix) {
+		end++
+	}
+	return append([]string(nil), s.sorted[start:end]...)
+}
+
+// add a new key to the sorted index
+func (s *Store) insertSorted(key string) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	i := sort.SearchStrings(s.sorted, key)
+	s.sorted = append(s.sorted, "")
+	copy(s.sorted[i+1:], s.sorted[i:])
+	s.sorted[i] = key
+}
+
+// drop a key from the sorted index
+func (s *Store) removeSorted(key string) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	i := sort.SearchStrings(s.sorted, key)
+	if i < len(s.sorted) && s.sorted[i] == key {
+		s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+	}
+}
+
+// rebuild the sorted index from scratch after bulk changes to memory
+func (s *Store) rebuildSorted() {
+	sorted := make([]string, 0, s.keys.Load())
+	s.rangeMemory(func(entry Entry) {
+		sorted = append(sorted, entry.Key)
+	})
+	sort.Strings(sorted)
+
+	s.smu.Lock()
+	s.sorted = sorted
+	s.smu.Unlock()
+}
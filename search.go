@@ -0,0 +1,212 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// an inverted index from the words in values to the keys holding them. keys
+// that have since expired are only dropped from it when they are purged, so
+// Search checks every match against the store.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{} // Keys whose value holds each word
+	words    map[string][]string            // Words indexed for each key
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]struct{}),
+		words:    make(map[string][]string),
+	}
+}
+
+// split text into distinct lowercase words of letters and digits
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	words := fields[:0]
+	for _, word := range fields {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// index the value of a key in place of what it held before
+func (x *searchIndex) set(key, value string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(key)
+	words := tokenize(value)
+	for _, word := range words {
+		keys := x.postings[word]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			x.postings[word] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	if len(words) > 0 {
+		x.words[key] = words
+	}
+}
+
+func (x *searchIndex) remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(key)
+}
+
+func (x *searchIndex) removeLocked(key string) {
+	for _, word := range x.words[key] {
+		delete(x.postings[word], key)
+		if len(x.postings[word]) == 0 {
+			delete(x.postings, word)
+		}
+	}
+	delete(x.words, key)
+}
+
+// update the index for a record appended to the log
+func (x *searchIndex) apply(entry Entry) {
+	switch {
+	case entry.Commit, entry.partial():
+	case entry.Deleted:
+		x.remove(entry.Key)
+	default:
+		x.set(entry.Key, entry.Value)
+	}
+}
+
+// the keys whose values hold every one of words, sorted
+func (x *searchIndex) match(words []string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	// start from the rarest word so the fewest keys are checked
+	sort.Slice(words, func(i, j int) bool { return len(x.postings[words[i]]) < len(x.postings[words[j]]) })
+	var keys []string
+	for key := range x.postings[words[0]] {
+		found := true
+		for _, word := range words[1:] {
+			if _, found = x.postings[word][key]; !found {
+				break
+			}
+		}
+		if found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// build the search index from the keys that are live in the log. the caller
+// must hold the write lock.
+func (s *Store) buildSearch() error {
+	latest := make(map[string]string)
+	err := s.replay(func(entry Entry) bool {
+		if entry.Deleted {
+			delete(latest, entry.Key)
+		} else {
+			latest[entry.Key] = entry.Value
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+
+	s.search = newSearchIndex()
+	for key, value := range latest {
+		s.search.set(key, value)
+	}
+	return nil
+}
+
+// return every entry whose value holds all the words in query, sorted by
+// key. words are runs of letters and digits and match regardless of case.
+// the store must be opened with StoreConfig.SearchIndex.
+func (s *Store) Search(query string) ([]Entry, error) {
+	var entries []Entry
+	err := s.runFunc(Operation{Type: OpScan, Ctx: context.Background()}, func(ctx context.Context) (err error) {
+		entries, err = s.searchEntries(ctx, query)
+		return err
+	})
+	return entries, err
+}
+
+func (s *Store) searchEntries(ctx context.Context, query string) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.search == nil {
+		return nil, ErrNoSearchIndex
+	}
+	words := tokenize(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	keys := s.search.match(words)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixNano()
+	var results []Entry
+	switch {
+	case s.useMemory:
+		for _, key := range keys {
+			if entry, ok := s.memLookup(key, now); ok {
+				results = append(results, Entry{Key: key, Value: entry.Value})
+			}
+		}
+	case s.index != nil:
+		for _, key := range keys {
+			entry, ok, err := s.lookupIndexed(key, now)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				results = append(results, Entry{Key: key, Value: entry.Value})
+			}
+		}
+	default:
+		// file-only mode: a single pass finds the current value of every match
+		wanted := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			wanted[key] = true
+		}
+		latest := make(map[string]string)
+		err := s.replayContext(ctx, func(entry Entry) bool {
+			if !wanted[entry.Key] {
+				return true
+			}
+			if entry.Deleted || entry.expired(now) {
+				delete(latest, entry.Key)
+			} else {
+				latest[entry.Key] = entry.Value
+			}
+			return true
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading log file: %w", err)
+		}
+		for _, key := range keys {
+			if value, ok := latest[key]; ok {
+				results = append(results, Entry{Key: key, Value: value})
+			}
+		}
+	}
+	return results, nil
+}
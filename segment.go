@@ -0,0 +1,561 @@
+package keyvalue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segments of a log are named after it with a zero padded sequence number,
+// like store.log.000001
+func segmentPath(filename string, n int) string {
+	return fmt.Sprintf("%s.%06d", filename, n)
+}
+
+// find the segments of a log, oldest first. if segmented is set and there
+// are none yet, an existing single log file becomes the first segment. nil is
+// returned for a log that isn't segmented.
+func findSegments(filename string, segmented, readOnly bool) ([]int, error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error listing log segments: %w", err)
+	}
+
+	var segments []int
+	for _, file := range files {
+		suffix, ok := strings.CutPrefix(file.Name(), base+".")
+		if !ok || len(suffix) < 6 || strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		if n, err := strconv.Atoi(suffix); err == nil && n > 0 {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	if len(segments) > 0 || !segmented || readOnly {
+		return segments, nil
+	}
+
+	if err := os.Rename(filename, segmentPath(filename, 1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error converting log file to segments: %w", err)
+	}
+	return []int{1}, nil
+}
+
+// whether the store has no log file, see NewStore
+func (s *Store) memoryOnly() bool {
+	return s.filename == ""
+}
+
+// the file new records are appended to
+func (s *Store) activePath() string {
+	if s.segments == nil {
+		return s.filename
+	}
+	return segmentPath(s.filename, s.segments[len(s.segments)-1])
+}
+
+// every file of the log in the order they are replayed, none for a store
+// that only lives in memory
+func (s *Store) logFiles() []string {
+	if s.memoryOnly() {
+		return nil
+	}
+	if s.segments == nil {
+		return []string{s.filename}
+	}
+	paths := make([]string, 0, len(s.segments))
+	for _, n := range s.segments {
+		paths = append(paths, segmentPath(s.filename, n))
+	}
+	return paths
+}
+
+// the total size of the log files
+func (s *Store) logSize() (int64, error) {
+	if s.memoryOnly() {
+		return 0, nil
+	}
+	if s.segments == nil {
+		info, err := s.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	var size int64
+	for _, path := range s.logFiles() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// seal the active segment and start appending to a new one in the
+// configured format. the sealed segment is fsynced if it has unsynced writes,
+// as only the active one is synced later. the caller must hold the write
+// lock.
+func (s *Store) rollSegment() error {
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+	if s.dirty {
+		if err := s.syncLog(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+
+	n := s.segments[len(s.segments)-1] + 1
+	file, err := os.OpenFile(segmentPath(s.filename, n), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating log segment: %w", err)
+	}
+	header := s.newFormat.header()
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		os.Remove(segmentPath(s.filename, n))
+		return fmt.Errorf("error creating log segment: %w", err)
+	}
+
+	// writeQueued reads file under wmu, holding only the read lock
+	s.wmu.Lock()
+	s.file.Close()
+	s.file = file
+	s.wmu.Unlock()
+	s.resetBuffer()
+	s.format = s.newFormat
+	s.segments = append(s.segments, n)
+	s.activeSize = int64(len(header))
+	return nil
+}
+
+// cut the log at a bad record, dropping any later segments so nothing after
+// it is applied. the caller must hold the write lock.
+func (s *Store) truncateLog(path string, offset int64) error {
+	if err := s.dropCheckpoint(); err != nil {
+		return err
+	}
+	if s.maps != nil {
+		s.maps.dropAll()
+	}
+	if s.segments == nil {
+		if err := s.file.Truncate(offset); err != nil {
+			return err
+		}
+		s.activeSize = offset
+		return nil
+	}
+
+	i := 0
+	for i < len(s.segments) && segmentPath(s.filename, s.segments[i]) != path {
+		i++
+	}
+	if i == len(s.segments) {
+		return fmt.Errorf("unknown log segment %s", path)
+	}
+	if err := os.Truncate(path, offset); err != nil {
+		return err
+	}
+	if i == len(s.segments)-1 {
+		s.activeSize = offset
+		return nil
+	}
+
+	// the truncated segment becomes the active one
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	format, _, err := detectFormat(io.NewSectionReader(file, 0, int64(len(binaryHeader))))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	for _, n := range s.segments[i+1:] {
+		if err := os.Remove(segmentPath(s.filename, n)); err != nil {
+			s.logger.Warn("error removing log segment", "err", err)
+		}
+	}
+	s.file.Close()
+	s.file = file
+	s.resetBuffer()
+	s.format = format
+	s.segments = s.segments[:i+1]
+	s.activeSize = offset
+	return nil
+}
+
+// the position of a record in a segmented log, by index into segments and
+// record number within the segment
+type recordPos struct{ segment, record int }
+
+// what compactSegments keeps, worked out from a pass over the whole log
+type segmentPlan struct {
+	retained map[string][]recordPos // Records kept for each key oldest first, the last holds its final state
+	created  map[recordPos]int64    // Creation time of the key as of each retained record
+	appended map[recordPos]string   // Whole values of retained partial records, like appends
+	bases    map[recordPos]bool     // Records the final partial record of a live key is resolved against
+	live     map[string]bool        // Whether the final state of each key is live
+	first    map[string]int         // The first segment each key appears in
+}
+
+// compact a segmented log one segment at a time. the active segment is
+// sealed first, then every record that a later one supersedes is dropped from
+// its segment, apart from the last keepVersions before the latest record of a
+// live key, and segments left with nothing live are deleted. retained partial
+// records, like appends, are rewritten with the whole value, and the records
+// they were resolved against stay until they are. a tombstone is only kept
+// while an older segment still has a record for its key. the sealed segments
+// are read and their compacted copies written to temp files without the
+// store's lock, while writes go on to the new active segment, and the copies
+// replace them under the write lock once they are all complete. every
+// replacement leaves a log that replays to the same state, so one that fails
+// part way loses nothing. the caller must hold cmu.
+func (s *Store) compactSegments(ctx context.Context) error {
+	s.mu.Lock()
+	if s.activeSize > int64(len(s.format.header())) {
+		if err := s.rollSegment(); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("error compacting log file: %w", err)
+		}
+	}
+	sealed := slices.Clone(s.segments[:len(s.segments)-1])
+	limit := s.maxRecordSize
+	s.mu.Unlock()
+
+	paths := make([]string, len(sealed))
+	for i, n := range sealed {
+		paths[i] = segmentPath(s.filename, n)
+	}
+	t := s.newThrottle()
+	plan, counts, err := s.planSegments(ctx, t, paths, limit)
+	if err != nil {
+		return err
+	}
+
+	// what becomes of each sealed segment: compacted down to kept[i] records,
+	// rewritten from its temp file if rewrite[i] is set, or removed if none
+	// are left
+	kept := make([]int, len(sealed))
+	rewrite := make([]bool, len(sealed))
+	removeTemps := func() {
+		for i, path := range paths {
+			if rewrite[i] {
+				os.Remove(path + tempSuffix)
+			}
+		}
+	}
+	for i, path := range paths {
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			kept[i], rewrite[i], err = s.compactSegment(ctx, t, i, path, plan, limit)
+		}
+	}
+	if err != nil {
+		removeTemps()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		removeTemps()
+		return ErrStoreClosed
+	}
+	if err := s.dropCheckpoint(); err != nil {
+		removeTemps()
+		return err
+	}
+	if s.maps != nil {
+		s.maps.dropAll()
+	}
+	// segments after a failure are kept as they are
+	segments := make([]int, 0, len(s.segments))
+	records := 0
+	for i, n := range sealed {
+		if err == nil {
+			switch {
+			case kept[i] == 0:
+				if err = os.Remove(paths[i]); err != nil {
+					err = fmt.Errorf("error removing log segment: %w", err)
+				}
+			case rewrite[i]:
+				if err = os.Rename(paths[i]+tempSuffix, paths[i]); err != nil {
+					err = fmt.Errorf("error replacing log segment: %w", err)
+				} else {
+					rewrite[i] = false
+				}
+			}
+		}
+		if err != nil {
+			segments = append(segments, n)
+			continue
+		}
+		if kept[i] > 0 {
+			segments = append(segments, n)
+		}
+		records += kept[i] - counts[i]
+	}
+	removeTemps()
+	if syncErr := syncDir(filepath.Dir(s.filename)); err == nil && syncErr != nil {
+		err = fmt.Errorf("error syncing log directory: %w", syncErr)
+	}
+
+	s.segments = append(segments, s.segments[len(sealed):]...)
+	s.records += records
+	if reindexErr := s.reindex(); err == nil {
+		err = reindexErr
+	}
+	if err != nil {
+		return fmt.Errorf("error compacting log file: %w", err)
+	}
+	return nil
+}
+
+// work out what compactSegments keeps of the sealed segments at paths from
+// a pass over all of them, also counting the records in each. it reads them
+// without the store's lock, at the pace of t.
+func (s *Store) planSegments(ctx context.Context, t *throttle, paths []string, limit int) (*segmentPlan, []int, error) {
+	plan := &segmentPlan{
+		retained: make(map[string][]recordPos),
+		created:  make(map[recordPos]int64),
+		appended: make(map[recordPos]string),
+		bases:    make(map[recordPos]bool),
+		live:     make(map[string]bool),
+		first:    make(map[string]int),
+	}
+	last := make(map[string]Entry)
+	appends := newAppendResolver(s.aead, limit)
+	chains := make(map[string][]recordPos) // The last full record of each key and the partial records since
+	counts := make([]int, len(paths))
+	for i, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		var resolveErr error
+		err := t.replayFile(ctx, path, s.aead, limit, func(entry Entry, offset int64) bool {
+			appended := entry.partial()
+			if entry, resolveErr = appends.resolve(entry, path, offset); resolveErr != nil {
+				return false
+			}
+			prev, ok := last[entry.Key]
+			entry.CreatedAt = creationTime(entry, prev, ok)
+			last[entry.Key] = Entry{Deleted: entry.Deleted, ExpiresAt: entry.ExpiresAt, CreatedAt: entry.CreatedAt}
+
+			pos := recordPos{i, counts[i]}
+			history := plan.retained[entry.Key]
+			if len(history) > s.keepVersions {
+				delete(plan.created, history[0])
+				delete(plan.appended, history[0])
+				copy(history, history[1:])
+				history = history[:s.keepVersions]
+			}
+			plan.retained[entry.Key] = append(history, pos)
+			plan.created[pos] = entry.CreatedAt
+			switch {
+			case entry.Deleted:
+				delete(chains, entry.Key)
+			case appended:
+				plan.appended[pos] = entry.Value
+				chains[entry.Key] = append(chains[entry.Key], pos)
+			default:
+				chains[entry.Key] = append(chains[entry.Key][:0], pos)
+			}
+			if _, ok := plan.first[entry.Key]; !ok {
+				plan.first[entry.Key] = i
+			}
+			counts[i]++
+			return true
+		}, nil)
+		if err == nil {
+			err = resolveErr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading log file: %w", err)
+		}
+	}
+	now := time.Now().UnixNano()
+	for key, entry := range last {
+		plan.live[key] = !entry.Deleted && !entry.expired(now)
+	}
+	// until the final partial record of a key is rewritten with its whole
+	// value, the records it is resolved against have to stay
+	for key, chain := range chains {
+		if plan.live[key] {
+			for _, pos := range chain[:len(chain)-1] {
+				plan.bases[pos] = true
+			}
+		}
+	}
+	return plan, counts, nil
+}
+
+// compact the i-th sealed segment down to the records compactSegments keeps,
+// at the pace of t, writing them to a temp file next to it if it has to be
+// rewritten. returns the number of records left, none if it can be removed,
+// and whether it was.
+func (s *Store) compactSegment(ctx context.Context, t *throttle, i int, path string, plan *segmentPlan, limit int) (int, bool, error) {
+	var kept []Entry
+	record := 0
+	resolved := false
+	err := t.replayFile(ctx, path, s.aead, limit, func(entry Entry, _ int64) bool {
+		pos := recordPos{i, record}
+		record++
+		history := plan.retained[entry.Key]
+		live := plan.live[entry.Key]
+		if history[len(history)-1] == pos && !live {
+			if plan.first[entry.Key] < i {
+				kept = append(kept, Entry{Key: entry.Key, Deleted: true, Seq: entry.Seq, UpdatedAt: entry.UpdatedAt})
+			}
+			return true
+		}
+		switch {
+		case live && slices.Contains(history, pos):
+			entry.CreatedAt = plan.created[pos]
+			if value, ok := plan.appended[pos]; ok {
+				entry = entry.whole(value)
+				resolved = true
+			}
+			kept = append(kept, entry.standalone())
+		case live && plan.bases[pos]:
+			kept = append(kept, entry.standalone())
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error reading log file: %w", err)
+	}
+
+	if len(kept) == 0 {
+		return 0, false, nil
+	}
+	format, err := fileFormat(path)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(kept) == record && format == s.newFormat && !resolved {
+		return len(kept), false, nil
+	}
+	buf, err := s.encodeSegment(kept)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := t.writeFile(ctx, path+tempSuffix, buf); err != nil {
+		os.Remove(path + tempSuffix)
+		return 0, false, fmt.Errorf("error writing temp log segment: %w", err)
+	}
+	return len(kept), true, nil
+}
+
+// replace the whole log with one segment holding entries, for
+// RestoreSnapshot. keys that are only in the old segments get tombstones, so
+// the log still replays correctly if removing the old segments is
+// interrupted. the caller must hold the write lock.
+func (s *Store) rewriteSegments(entries []Entry) error {
+	if err := s.dropCheckpoint(); err != nil {
+		return err
+	}
+	live := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		live[entry.Key] = true
+	}
+	var records []Entry
+	err := s.replay(func(entry Entry) bool {
+		if !live[entry.Key] {
+			live[entry.Key] = true
+			records = append(records, Entry{Key: entry.Key, Deleted: true})
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading log file: %w", err)
+	}
+	records = append(records, entries...)
+
+	n := s.segments[len(s.segments)-1] + 1
+	path := segmentPath(s.filename, n)
+	size, err := s.writeSegment(path, records)
+	if err != nil {
+		return err
+	}
+
+	s.flushBuffer()
+	s.file.Close()
+	old := s.segments
+	s.segments = []int{n}
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0644)
+	s.resetBuffer()
+	if err != nil {
+		return s.fail(fmt.Errorf("error reopening log file: %w", err))
+	}
+	for _, m := range old {
+		if err := os.Remove(segmentPath(s.filename, m)); err != nil {
+			s.logger.Warn("error removing log segment", "err", err)
+		}
+	}
+	s.format = s.newFormat
+	s.records = len(records)
+	s.activeSize = size
+	return nil
+}
+
+// atomically replace a segment file with one holding entries in the
+// configured format, returning its size, see replaceFile
+func (s *Store) writeSegment(path string, entries []Entry) (int64, error) {
+	buf, err := s.encodeSegment(entries)
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceFile(path, buf); err != nil {
+		return 0, fmt.Errorf("error replacing log segment: %w", err)
+	}
+	return int64(len(buf)), nil
+}
+
+// the contents of a log file holding entries in the configured format
+func (s *Store) encodeSegment(entries []Entry) ([]byte, error) {
+	buf := s.newFormat.header()
+	for _, entry := range entries {
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// the format of the records in a log file
+func fileFormat(path string) (LogFormat, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	format, _, err := detectFormat(file)
+	if err != nil {
+		return 0, fmt.Errorf("error reading log file: %w", err)
+	}
+	return format, nil
+}
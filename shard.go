@@ -0,0 +1,234 @@
+package keyvalue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// number of shards the in-memory map is split into
+const shardCount = 32
+
+// a slice of the in-memory map. keys are spread over shards by hash, so
+// writes to different keys that only hold the store's read lock don't contend
+// for one lock.
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]string
+	expires map[string]int64     // Expiration times for keys in data
+	meta    map[string]entryMeta // Sequence numbers and times of keys in data
+}
+
+// the shard a key belongs to, picked with FNV-1a
+func (s *Store) shardFor(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h%shardCount]
+}
+
+// empty the in-memory map. the caller must hold the write lock.
+func (s *Store) resetMemory() {
+	for i := range s.shards {
+		s.shards[i].data = make(map[string]string)
+		s.shards[i].expires = make(map[string]int64)
+		s.shards[i].meta = make(map[string]entryMeta)
+	}
+	s.keys.Store(0)
+	s.memBytes.Store(0)
+	for _, q := range s.quotas.Load() {
+		q.used.Store(0)
+	}
+	s.smu.Lock()
+	s.sorted = nil
+	s.smu.Unlock()
+}
+
+// whether Set and Delete can run under the read lock with only the key's
+// shard locked. eviction, the memory limit and quotas weigh up the whole
+// store, so they need the write lock, and so does starting a new segment once
+// the active one fills up, see rollSegment.
+func (s *Store) sharedWrites() bool {
+	return s.useMemory && s.evictor == nil && s.maxMemory == 0 && s.quotas.Load() == nil && s.segmentSize == 0
+}
+
+// set a key under the read lock, see sharedWrites. the shard stays locked
+// from the append until memory is updated, so writes to one key reach the log
+// and memory in the same order.
+func (s *Store) setShared(key, value string, expiresAt int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.validate(key, value); err != nil {
+		return err
+	}
+
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// a new key reserves its place under MaxKeys before it is written
+	_, exists := sh.data[key]
+	if !exists {
+		if s.keys.Add(1) > int64(s.maxKeys) {
+			s.keys.Add(-1)
+			return fmt.Errorf("%w (%d)", ErrMaxKeysReached, s.maxKeys)
+		}
+	}
+	records := []Entry{{Key: key, Value: value, ExpiresAt: expiresAt}}
+	if err := s.appendEntries(records...); err != nil {
+		if !exists {
+			s.keys.Add(-1)
+		}
+		return err
+	}
+	s.putShard(sh, records[0])
+	return nil
+}
+
+// delete a key under the read lock, see setShared
+func (s *Store) deleteShared(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := s.appendEntries(Entry{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	if entry, removed := s.removeShard(sh, key); removed {
+		s.keys.Add(-1)
+		s.reportRemoval(entry, RemovalDeleted)
+	}
+	return nil
+}
+
+// store an entry in a shard, reporting whether the key is new. the key count
+// is left to the caller. the caller must hold the shard's lock and at least
+// the store's read lock.
+func (s *Store) putShard(sh *shard, entry Entry) bool {
+	key := entry.Key
+	old, exists := sh.entry(key)
+	if exists {
+		s.memBytes.Add(-memSize(key, old.Value))
+		s.addUsage(key, -quotaSize(key, old.Value))
+	} else if !s.loading {
+		s.insertSorted(key)
+	}
+	sh.data[key] = entry.Value
+	s.memBytes.Add(memSize(key, entry.Value))
+	s.addUsage(key, quotaSize(key, entry.Value))
+	if s.evictor != nil {
+		s.emu.Lock()
+		s.evictor.add(key)
+		s.emu.Unlock()
+	}
+	if entry.ExpiresAt != 0 {
+		sh.expires[key] = entry.ExpiresAt
+	} else {
+		delete(sh.expires, key)
+	}
+	sh.meta[key] = entryMeta{
+		seq:       entry.Seq,
+		createdAt: creationTime(entry, old, exists),
+		updatedAt: entry.UpdatedAt,
+	}
+	return !exists
+}
+
+// remove a key from a shard, returning its entry if it was there. the key
+// count is left to the caller. the caller must hold the shard's lock and at
+// least the store's read lock.
+func (s *Store) removeShard(sh *shard, key string) (Entry, bool) {
+	entry, exists := sh.entry(key)
+	if !exists {
+		return Entry{}, false
+	}
+	s.memBytes.Add(-memSize(key, entry.Value))
+	s.addUsage(key, -quotaSize(key, entry.Value))
+	delete(sh.data, key)
+	delete(sh.expires, key)
+	delete(sh.meta, key)
+	if s.evictor != nil {
+		s.emu.Lock()
+		s.evictor.remove(key)
+		s.emu.Unlock()
+	}
+	if !s.loading {
+		s.removeSorted(key)
+	}
+	return entry, true
+}
+
+// the entry for a key held in the shard, expired or not. the caller must hold
+// the shard's lock.
+func (sh *shard) entry(key string) (Entry, bool) {
+	value, ok := sh.data[key]
+	if !ok {
+		return Entry{}, false
+	}
+	meta := sh.meta[key]
+	return Entry{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: sh.expires[key],
+		Seq:       meta.seq,
+		CreatedAt: meta.createdAt,
+		UpdatedAt: meta.updatedAt,
+	}, true
+}
+
+// the entry for a key held in memory, unless it is missing or expired. the
+// caller must hold at least the read lock.
+func (s *Store) memLookup(key string, now int64) (Entry, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	entry, ok := sh.entry(key)
+	if !ok || entry.expired(now) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// the value of a key held in memory, expired or not. the caller must hold at
+// least the read lock.
+func (s *Store) memValue(key string) (string, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, ok := sh.data[key]
+	return value, ok
+}
+
+// call fn for every entry held in memory, expired or not, one shard at a
+// time. fn must not call back into the store. the caller must hold at least
+// the read lock.
+func (s *Store) rangeMemory(fn func(entry Entry)) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for key := range sh.data {
+			entry, _ := sh.entry(key)
+			fn(entry)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// every live entry held in memory, in no particular order. the caller must
+// hold at least the read lock.
+func (s *Store) memEntries(now int64) []Entry {
+	entries := make([]Entry, 0, s.keys.Load())
+	s.rangeMemory(func(entry Entry) {
+		if !entry.expired(now) {
+			entries = append(entries, entry)
+		}
+	})
+	return entries
+}
@@ -0,0 +1,112 @@
+package keyvalue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+)
+
+// files saved next to the log, like the index, start with a magic string and
+// a version byte, then the number and size of every log file they were saved
+// for, and end with a CRC32. they are only used while the log files still
+// match.
+
+// save a sidecar file with body for the current log files. the caller must
+// hold the write lock and have flushed the write buffer.
+func (s *Store) saveSidecar(path, magic string, version byte, body []byte) error {
+	buf := []byte(magic)
+	buf = append(buf, version)
+
+	paths := s.logFiles()
+	buf = binary.AppendUvarint(buf, uint64(len(paths)))
+	for i, logPath := range paths {
+		info, err := os.Stat(logPath)
+		if err != nil {
+			return err
+		}
+		segment := 0
+		if s.segments != nil {
+			segment = s.segments[i]
+		}
+		buf = binary.AppendUvarint(buf, uint64(segment))
+		buf = binary.AppendUvarint(buf, uint64(info.Size()))
+	}
+	buf = append(buf, body...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	if err := replaceFile(path, buf); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// read the body of a sidecar file, reporting false if there is none or the
+// log files don't match the ones it was saved for
+func (s *Store) readSidecar(path, magic string, version byte) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) < len(magic)+5 || !bytes.Equal(data[:len(magic)], []byte(magic)) {
+		return nil, false, fmt.Errorf("%s has an unknown format", path)
+	}
+	if data[len(magic)] != version {
+		return nil, false, fmt.Errorf("%s has an unsupported version", path)
+	}
+	body := data[:len(data)-4]
+	if binary.BigEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(body) {
+		return nil, false, fmt.Errorf("%s has a checksum mismatch", path)
+	}
+	buf := body[len(magic)+1:]
+
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return v, true
+	}
+	paths := s.logFiles()
+	count, ok := readUvarint()
+	if !ok {
+		return nil, false, fmt.Errorf("%s is malformed", path)
+	}
+	if count != uint64(len(paths)) {
+		return nil, false, nil
+	}
+	for i, logPath := range paths {
+		segment, ok1 := readUvarint()
+		size, ok2 := readUvarint()
+		if !ok1 || !ok2 {
+			return nil, false, fmt.Errorf("%s is malformed", path)
+		}
+		info, err := os.Stat(logPath)
+		if err != nil {
+			return nil, false, err
+		}
+		if (s.segments != nil && segment != uint64(s.segments[i])) || size != uint64(info.Size()) {
+			return nil, false, nil
+		}
+	}
+	return buf, true, nil
+}
+
+// remove a sidecar file when the store is opened for writing, so a crash
+// can't leave one behind that doesn't match the log
+func (s *Store) removeSidecar(path string) error {
+	if s.readOnly {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing %s: %w", path, err)
+	}
+	return nil
+}
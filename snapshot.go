@@ -0,0 +1,245 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// write a consistent point-in-time copy of the store to w. the snapshot only
+// holds live entries and uses the log format, so it can be restored with
+// RestoreSnapshot or opened directly as a store. values are encrypted with the
+// store's key if it has one.
+func (s *Store) Snapshot(w io.Writer) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(s.newFormat.header()); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	for _, entry := range entries {
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// replace the contents of the store with a snapshot read from r. the new log
+// is written to a temp file and swapped in, so a failed restore leaves the
+// store untouched. subscribers are dropped and have to catch up again, see
+// Subscribe.
+func (s *Store) RestoreSnapshot(r io.Reader) error {
+	return s.runFunc(Operation{Type: OpLoad, Ctx: context.Background()}, func(context.Context) error {
+		return s.restoreSnapshot(r)
+	})
+}
+
+func (s *Store) restoreSnapshot(r io.Reader) error {
+	data := make(map[string]Entry)
+	var applyErr error
+	err := replayReader(r, s.aead, s.maxRecordSize, func(entry Entry) bool {
+		if entry.partial() {
+			var value string
+			if value, applyErr = entry.applyTo(data[entry.Key].Value); applyErr != nil {
+				return false
+			}
+			entry = entry.whole(value)
+		}
+		if entry.Deleted {
+			delete(data, entry.Key)
+		} else {
+			data[entry.Key] = entry
+		}
+		return true
+	}, nil)
+	if err == nil {
+		err = applyErr
+	}
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	now := time.Now().UnixNano()
+	entries := make([]Entry, 0, len(data))
+	var bytes int64
+	for _, entry := range data {
+		if entry.expired(now) {
+			continue
+		}
+		if err := s.validate(entry.Key, entry.Value); err != nil {
+			return err
+		}
+		entries = append(entries, entry.standalone())
+		bytes += memSize(entry.Key, entry.Value)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if s.useMemory && len(entries) > s.maxKeys {
+		return fmt.Errorf("snapshot exceeds max number of keys: %w (%d)", ErrMaxKeysReached, s.maxKeys)
+	}
+	if s.useMemory && s.maxMemory > 0 && bytes > s.maxMemory {
+		return fmt.Errorf("snapshot exceeds max memory: %w (%d bytes)", ErrMemoryLimitReached, s.maxMemory)
+	}
+
+	// a compaction running in the background would splice its copy of the
+	// old log over the restored one
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replica {
+		return ErrReadOnly
+	}
+	// restored entries are new records, so replicas resuming from before the
+	// restore pick them up
+	s.amu.Lock()
+	for i := range entries {
+		entries[i].Seq = s.nextSeq(now)
+	}
+	s.amu.Unlock()
+	if err := s.rewrite(entries); err != nil {
+		return err
+	}
+	if s.cache != nil {
+		s.cache.clear()
+	}
+	s.stopFeeds()
+
+	if s.useMemory {
+		s.resetMemory()
+		s.evictor = newEvictionTracker(s.policy)
+		s.loading = true
+		for _, entry := range entries {
+			s.putLocked(entry)
+		}
+		s.loading = false
+		s.rebuildSorted()
+	}
+	return nil
+}
+
+// collect every live entry in the store, sorted by key, giving up once ctx is
+// done. the caller must hold at least the read lock.
+func (s *Store) liveEntries(ctx context.Context) ([]Entry, error) {
+	now := time.Now().UnixNano()
+	var entries []Entry
+
+	if s.useMemory {
+		entries = s.memEntries(now)
+	} else {
+		latest := make(map[string]Entry)
+		err := s.replayContext(ctx, func(entry Entry) bool {
+			prev, ok := latest[entry.Key]
+			entry.CreatedAt = creationTime(entry, prev, ok)
+			latest[entry.Key] = entry.standalone()
+			return true
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading log file: %w", err)
+		}
+		for _, entry := range latest {
+			if !entry.Deleted && !entry.expired(now) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// replace the log file with one holding only the given entries in the
+// configured format and reopen it for appending. the caller must hold the
+// write lock.
+func (s *Store) rewrite(entries []Entry) error {
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if s.memoryOnly() {
+		return nil
+	}
+	if s.maps != nil {
+		s.maps.dropAll()
+	}
+	if s.segments != nil {
+		if err := s.rewriteSegments(entries); err != nil {
+			return err
+		}
+		return s.reindex()
+	}
+
+	buf := s.newFormat.header()
+	for _, entry := range entries {
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+
+	// the new log is complete and on disk before it replaces the old one, so
+	// a crash at any point leaves one of them, see replaceFile
+	tempFile := s.filename + tempSuffix
+	if err := writeSynced(tempFile, buf); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("error writing temp log file: %w", err)
+	}
+	if err := s.flushBuffer(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err := s.replaceLog(tempFile, int64(len(buf))); err != nil {
+		return err
+	}
+	s.records = len(entries)
+	return s.reindex()
+}
+
+// rename tempFile, a complete and fsynced log of size bytes in the configured
+// format, over the log file and reopen it for appending. the caller must hold
+// the write lock and have flushed the write buffer.
+func (s *Store) replaceLog(tempFile string, size int64) error {
+	if err := s.dropCheckpoint(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	// the old handle is closed before the rename so it also works on
+	// platforms that can't replace open files, and reopened either way
+	if err := s.file.Close(); err != nil {
+		s.logger.Warn("error closing log file before replacing it", "err", err)
+	}
+	renameErr := os.Rename(tempFile, s.filename)
+	var err error
+	s.file, err = os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	s.resetBuffer()
+	if renameErr != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("error replacing log file: %w", renameErr)
+	}
+	if err != nil {
+		return s.fail(fmt.Errorf("error reopening log file: %w", err))
+	}
+	s.format = s.newFormat
+	s.activeSize = size
+	if err := syncDir(filepath.Dir(s.filename)); err != nil {
+		return fmt.Errorf("error syncing log directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+// Package sqldriver exposes a keyvalue.Store to database/sql as a single
+// table called kv with the columns key and value, so scripts and tools that
+// speak SQL can query it:
+//
+//	db, err := sql.Open("keyvalue", "store.log?max_keys=100000")
+//	_, err = db.Exec("INSERT INTO kv (key, value) VALUES (?, ?)", "a", "1")
+//	rows, err := db.Query("SELECT key, value FROM kv WHERE key LIKE 'user:%'")
+//
+// the data source name is the path of the log file, opened when the first
+// connection is made and closed with the sql.DB. an empty path opens a store
+// that only lives in memory. options go in a query string: memory, max_keys,
+// max_key_size and max_value_size, defaulting to kvserver's defaults, and
+// read_only. OpenDB wraps a store that is already open instead.
+//
+// the statements understood are SELECT (of key, value, * or COUNT(*)), INSERT
+// (failing with ErrDuplicateKey for existing keys), INSERT OR REPLACE and
+// REPLACE, UPDATE of a single key and DELETE, filtered by WHERE key = ... or
+// WHERE key LIKE .... transactions aren't supported.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jere-mie/keyvalue"
+)
+
+// the table and its columns
+const (
+	table       = "kv"
+	columnKey   = "key"
+	columnValue = "value"
+)
+
+// returned by INSERT for a key that already exists, use INSERT OR REPLACE to
+// overwrite it
+var ErrDuplicateKey = errors.New("key already exists")
+
+func init() {
+	sql.Register("keyvalue", Driver{})
+}
+
+// the driver registered as "keyvalue"
+type Driver struct{}
+
+// open a connection to the store named by dsn, see the package docs. every
+// connection opens the store again, so use sql.Open rather than calling this
+// directly.
+func (d Driver) Open(dsn string) (driver.Conn, error) {
+	connector, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(context.Background())
+}
+
+// parse dsn, see the package docs. the store is opened by the first Connect.
+func (Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	filename, query, _ := strings.Cut(dsn, "?")
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing data source name: %w", err)
+	}
+	config := keyvalue.StoreConfig{
+		UseMemory:    true,
+		MaxKeys:      10000,
+		MaxKeySize:   256,
+		MaxValueSize: 1 << 20,
+	}
+	for name, values := range options {
+		value := values[len(values)-1]
+		switch name {
+		case "memory":
+			config.UseMemory, err = strconv.ParseBool(value)
+		case "read_only":
+			config.ReadOnly, err = strconv.ParseBool(value)
+		case "max_keys":
+			config.MaxKeys, err = strconv.Atoi(value)
+		case "max_key_size":
+			config.MaxKeySize, err = strconv.Atoi(value)
+		case "max_value_size":
+			config.MaxValueSize, err = strconv.Atoi(value)
+		default:
+			return nil, fmt.Errorf("unknown option %q in data source name", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing option %q: %w", name, err)
+		}
+	}
+	return &fileConnector{filename: filename, config: config}, nil
+}
+
+// opens the store named by a data source name on first use
+type fileConnector struct {
+	filename string
+	config   keyvalue.StoreConfig
+	mu       sync.Mutex
+	store    *keyvalue.Store
+}
+
+func (c *fileConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		store, err := keyvalue.NewStore(c.filename, c.config)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	}
+	return &conn{store: c.store}, nil
+}
+
+func (c *fileConnector) Driver() driver.Driver {
+	return Driver{}
+}
+
+// close the store, called by sql.DB.Close
+func (c *fileConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+	err := c.store.Close()
+	c.store = nil
+	return err
+}
+
+// hands out connections to a store that is already open
+type storeConnector struct {
+	store *keyvalue.Store
+}
+
+// a connector for store, which stays open when the sql.DB is closed
+func NewConnector(store *keyvalue.Store) driver.Connector {
+	return storeConnector{store: store}
+}
+
+// a sql.DB for store, see NewConnector
+func OpenDB(store *keyvalue.Store) *sql.DB {
+	return sql.OpenDB(NewConnector(store))
+}
+
+func (c storeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{store: c.store}, nil
+}
+
+func (storeConnector) Driver() driver.Driver {
+	return Driver{}
+}
+
+// a connection, they all share the store
+type conn struct {
+	store *keyvalue.Store
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing statement: %w", err)
+	}
+	return &preparedStmt{conn: c, stmt: stmt}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions aren't supported")
+}
+
+type preparedStmt struct {
+	conn *conn
+	stmt *statement
+}
+
+func (s *preparedStmt) Close() error {
+	return nil
+}
+
+func (s *preparedStmt) NumInput() int {
+	return s.stmt.params
+}
+
+func (s *preparedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.stmt.kind == stmtSelect {
+		return nil, errors.New("SELECT returns rows, use Query")
+	}
+	n, err := s.stmt.exec(s.conn.store, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *preparedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.stmt.kind != stmtSelect {
+		return nil, errors.New("only SELECT returns rows, use Exec")
+	}
+	return s.stmt.query(s.conn.store, args)
+}
+
+// run an INSERT, UPDATE or DELETE, returning the number of keys changed
+func (stmt *statement) exec(store *keyvalue.Store, args []driver.Value) (int64, error) {
+	switch stmt.kind {
+	case stmtInsert:
+		pairs := make([][2]string, len(stmt.rows))
+		for i, row := range stmt.rows {
+			for j, op := range row {
+				value, err := op.resolve(args)
+				if err != nil {
+					return 0, err
+				}
+				pairs[i][j] = value
+			}
+		}
+		if stmt.replace {
+			batch := make(map[string]string, len(pairs))
+			for _, pair := range pairs {
+				batch[pair[0]] = pair[1]
+			}
+			return int64(len(pairs)), store.SetBatch(batch)
+		}
+		// rows are inserted one at a time, so the ones before a duplicate
+		// stay inserted
+		for i, pair := range pairs {
+			ok, err := store.SetIfAbsent(pair[0], pair[1])
+			if err != nil {
+				return int64(i), err
+			}
+			if !ok {
+				return int64(i), fmt.Errorf("%q: %w", pair[0], ErrDuplicateKey)
+			}
+		}
+		return int64(len(pairs)), nil
+
+	case stmtUpdate:
+		key, err := stmt.where.arg.resolve(args)
+		if err != nil {
+			return 0, err
+		}
+		value, err := stmt.value.resolve(args)
+		if err != nil {
+			return 0, err
+		}
+		var updated bool
+		err = store.Update(key, func(old string, exists bool) (string, bool) {
+			updated = exists
+			return value, exists
+		})
+		if err != nil || !updated {
+			return 0, err
+		}
+		return 1, nil
+
+	case stmtDelete:
+		if stmt.where != nil && !stmt.where.like {
+			key, err := stmt.where.arg.resolve(args)
+			if err != nil {
+				return 0, err
+			}
+			var deleted bool
+			err = store.Update(key, func(old string, exists bool) (string, bool) {
+				deleted = exists
+				return "", false
+			})
+			if err != nil || !deleted {
+				return 0, err
+			}
+			return 1, nil
+		}
+		keys, err := stmt.matchingKeys(store, args)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(keys)), store.DeleteBatch(keys)
+	}
+	return 0, fmt.Errorf("unsupported statement")
+}
+
+// run a SELECT
+func (stmt *statement) query(store *keyvalue.Store, args []driver.Value) (driver.Rows, error) {
+	limit := -1
+	if stmt.limit != nil {
+		value, err := stmt.limit.resolve(args)
+		if err != nil {
+			return nil, err
+		}
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid LIMIT %q", value)
+		}
+	}
+
+	var keys []string
+	if stmt.where != nil && !stmt.where.like {
+		key, err := stmt.where.arg.resolve(args)
+		if err != nil {
+			return nil, err
+		}
+		keys = []string{key}
+	} else {
+		var err error
+		if keys, err = stmt.matchingKeys(store, args); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.desc {
+		slices.Reverse(keys)
+	}
+
+	rows := &rows{columns: stmt.columns}
+	count := int64(0)
+	for _, key := range keys {
+		if limit >= 0 && len(rows.values) >= limit {
+			break
+		}
+		value, ok, err := store.GetCtx(context.Background(), key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if stmt.columns[0] == "count" {
+			count++
+			continue
+		}
+		row := make([]driver.Value, len(stmt.columns))
+		for i, column := range stmt.columns {
+			if column == columnKey {
+				row[i] = key
+			} else {
+				row[i] = value
+			}
+		}
+		rows.values = append(rows.values, row)
+	}
+	if stmt.columns[0] == "count" {
+		rows.values = [][]driver.Value{{count}}
+	}
+	return rows, nil
+}
+
+// the keys matching the WHERE clause in sorted order, or every key without
+// one
+func (stmt *statement) matchingKeys(store *keyvalue.Store, args []driver.Value) ([]string, error) {
+	if stmt.where == nil {
+		return store.Keys(""), nil
+	}
+	pattern, err := stmt.where.arg.resolve(args)
+	if err != nil {
+		return nil, err
+	}
+	keys := store.Keys(literalPrefix(pattern))
+	matched := keys[:0]
+	for _, key := range keys {
+		if like(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	return matched, nil
+}
+
+// the string an operand stands for with the given arguments. keys and values
+// are strings, so other arguments are formatted as text.
+func (op operand) resolve(args []driver.Value) (string, error) {
+	if op.param < 0 {
+		return op.lit, nil
+	}
+	if op.param >= len(args) {
+		return "", fmt.Errorf("missing argument %d", op.param+1)
+	}
+	switch v := args[op.param].(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case nil:
+		return "", fmt.Errorf("argument %d is NULL, keys and values can't be", op.param+1)
+	default:
+		return "", fmt.Errorf("unsupported argument type %T", v)
+	}
+}
+
+// the result of a SELECT, read up front
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,46 @@
+package sqldriver
+
+// the part of a LIKE pattern before its first wildcard, used to narrow the
+// keys that need matching
+func literalPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '%', '_':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// match a key against a LIKE pattern, where % matches any run of bytes and _
+// a single one. unlike most databases the match is case-sensitive.
+func like(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '%':
+			for len(pattern) > 0 && pattern[0] == '%' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if like(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
@@ -0,0 +1,437 @@
+package sqldriver
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// the kinds of statement the driver understands
+type statementKind int
+
+const (
+	stmtSelect statementKind = iota
+	stmtInsert
+	stmtUpdate
+	stmtDelete
+)
+
+// a literal or a ? placeholder in a statement
+type operand struct {
+	param int // Index of the placeholder's argument, -1 for a literal
+	lit   string
+}
+
+// a WHERE clause on the key column
+type condition struct {
+	like bool // Whether the key is matched with LIKE rather than =
+	arg  operand
+}
+
+// a parsed statement
+type statement struct {
+	kind    statementKind
+	columns []string    // Columns a SELECT returns, "count" for COUNT(*)
+	where   *condition  // nil matches every key
+	desc    bool        // ORDER BY key DESC
+	limit   *operand    // nil returns every row
+	rows    [][]operand // Key and value of each row an INSERT adds
+	replace bool        // Whether an INSERT overwrites existing keys
+	value   operand     // The value an UPDATE sets
+	params  int         // Number of placeholders
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokNumber
+	tokParam
+	tokSymbol
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// split a query into tokens. identifiers may be quoted with double quotes or
+// backticks, and strings use single quotes, doubled inside a string to stand
+// for one.
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(query) && (query[j] == '_' || unicode.IsLetter(rune(query[j])) || unicode.IsDigit(rune(query[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, query[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, query[i:j]})
+			i = j
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(query) {
+					return nil, fmt.Errorf("unterminated string at offset %d", i)
+				}
+				if query[j] == '\'' {
+					if j+1 < len(query) && query[j+1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(query[j])
+				j++
+			}
+			tokens = append(tokens, token{tokString, b.String()})
+			i = j + 1
+		case c == '"' || c == '`':
+			j := strings.IndexByte(query[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated identifier at offset %d", i)
+			}
+			tokens = append(tokens, token{tokWord, query[i+1 : i+1+j]})
+			i += j + 2
+		case c == '?':
+			tokens = append(tokens, token{tokParam, "?"})
+			i++
+		case strings.IndexByte("(),=*;", c) >= 0:
+			tokens = append(tokens, token{tokSymbol, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	params int
+}
+
+// parse one of:
+//
+//	SELECT key, value | * | COUNT(*) FROM kv [WHERE ...] [ORDER BY key [ASC|DESC]] [LIMIT n]
+//	INSERT [OR REPLACE] INTO kv [(key, value)] VALUES (k, v) [, (k, v) ...]
+//	REPLACE INTO kv [(key, value)] VALUES (k, v) [, (k, v) ...]
+//	UPDATE kv SET value = v WHERE key = k
+//	DELETE FROM kv [WHERE ...]
+//
+// where a WHERE clause is key = k or key LIKE pattern
+func parse(query string) (*statement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmt *statement
+	switch {
+	case p.keyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.keyword("INSERT"):
+		replace := false
+		if p.keyword("OR") {
+			if err := p.expect("REPLACE"); err != nil {
+				return nil, err
+			}
+			replace = true
+		}
+		stmt, err = p.parseInsert(replace)
+	case p.keyword("REPLACE"):
+		stmt, err = p.parseInsert(true)
+	case p.keyword("UPDATE"):
+		stmt, err = p.parseUpdate()
+	case p.keyword("DELETE"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, p.unexpected()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.symbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	stmt.params = p.params
+	return stmt, nil
+}
+
+func (p *parser) parseSelect() (*statement, error) {
+	stmt := &statement{kind: stmtSelect}
+	switch {
+	case p.symbol("*"):
+		stmt.columns = []string{columnKey, columnValue}
+	case p.keyword("COUNT"):
+		if !p.symbol("(") || !p.symbol("*") || !p.symbol(")") {
+			return nil, p.unexpected()
+		}
+		stmt.columns = []string{"count"}
+	default:
+		for {
+			column, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			stmt.columns = append(stmt.columns, column)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.table("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.parseWhere(stmt); err != nil {
+		return nil, err
+	}
+	if p.keyword("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		if column, err := p.column(); err != nil {
+			return nil, err
+		} else if column != columnKey {
+			return nil, fmt.Errorf("can only order by %s", columnKey)
+		}
+		if !p.keyword("ASC") {
+			stmt.desc = p.keyword("DESC")
+		}
+	}
+	if p.keyword("LIMIT") {
+		limit, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		stmt.limit = &limit
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseInsert(replace bool) (*statement, error) {
+	stmt := &statement{kind: stmtInsert, replace: replace}
+	if err := p.table("INTO"); err != nil {
+		return nil, err
+	}
+	// the value comes first if the columns are listed that way
+	swap := false
+	if p.symbol("(") {
+		first, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(",") {
+			return nil, p.unexpected()
+		}
+		second, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if first == second {
+			return nil, fmt.Errorf("column %s listed twice", first)
+		}
+		if !p.symbol(")") {
+			return nil, p.unexpected()
+		}
+		swap = first == columnValue
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if !p.symbol("(") {
+			return nil, p.unexpected()
+		}
+		key, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(",") {
+			return nil, p.unexpected()
+		}
+		value, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.unexpected()
+		}
+		if swap {
+			key, value = value, key
+		}
+		stmt.rows = append(stmt.rows, []operand{key, value})
+		if !p.symbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) parseUpdate() (*statement, error) {
+	stmt := &statement{kind: stmtUpdate}
+	if err := p.table(""); err != nil {
+		return nil, err
+	}
+	if err := p.expect("SET"); err != nil {
+		return nil, err
+	}
+	if column, err := p.column(); err != nil {
+		return nil, err
+	} else if column != columnValue {
+		return nil, fmt.Errorf("can only set %s", columnValue)
+	}
+	if !p.symbol("=") {
+		return nil, p.unexpected()
+	}
+	value, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	stmt.value = value
+	if err := p.parseWhere(stmt); err != nil {
+		return nil, err
+	}
+	if stmt.where == nil || stmt.where.like {
+		return nil, fmt.Errorf("UPDATE needs WHERE %s = ...", columnKey)
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseDelete() (*statement, error) {
+	stmt := &statement{kind: stmtDelete}
+	if err := p.table("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.parseWhere(stmt); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// an optional WHERE clause
+func (p *parser) parseWhere(stmt *statement) error {
+	if !p.keyword("WHERE") {
+		return nil
+	}
+	if column, err := p.column(); err != nil {
+		return err
+	} else if column != columnKey {
+		return fmt.Errorf("can only filter on %s", columnKey)
+	}
+	cond := &condition{}
+	switch {
+	case p.symbol("="):
+	case p.keyword("LIKE"):
+		cond.like = true
+	default:
+		return p.unexpected()
+	}
+	arg, err := p.operand()
+	if err != nil {
+		return err
+	}
+	cond.arg = arg
+	stmt.where = cond
+	return nil
+}
+
+// the table name, after keyword if it isn't empty
+func (p *parser) table(keyword string) error {
+	if keyword != "" {
+		if err := p.expect(keyword); err != nil {
+			return err
+		}
+	}
+	t := p.next()
+	if t.kind != tokWord || !strings.EqualFold(t.text, table) {
+		return fmt.Errorf("unknown table %q, the only table is %s", t.text, table)
+	}
+	return nil
+}
+
+// a column name, lowercased
+func (p *parser) column() (string, error) {
+	t := p.next()
+	name := strings.ToLower(t.text)
+	if t.kind != tokWord || (name != columnKey && name != columnValue) {
+		return "", fmt.Errorf("unknown column %q, the columns are %s and %s", t.text, columnKey, columnValue)
+	}
+	return name, nil
+}
+
+func (p *parser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokParam:
+		p.params++
+		return operand{param: p.params - 1}, nil
+	case tokString, tokNumber:
+		return operand{param: -1, lit: t.text}, nil
+	}
+	p.pos--
+	return operand{}, p.unexpected()
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// consume the keyword if it is next, in any case
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kw string) error {
+	if !p.keyword(kw) {
+		return fmt.Errorf("expected %s: %w", kw, p.unexpected())
+	}
+	return nil
+}
+
+// consume the symbol if it is next
+func (p *parser) symbol(sym string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of statement")
+	}
+	return fmt.Errorf("unexpected %q", t.text)
+}
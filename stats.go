@@ -0,0 +1,118 @@
+package keyvalue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters and gauges describing a store, see Stats
+type StoreStats struct {
+	Sets         uint64 // Key-value records written by Set, batches, transactions and the like
+	Gets         uint64 // Reads of a single key
+	Hits         uint64 // Reads that found the key
+	Misses       uint64 // Reads that didn't
+	Deletes      uint64 // Tombstones written, including for evicted keys
+	Compactions  uint64 // Compactions that completed
+	BytesWritten uint64 // Bytes appended to the log since the store was opened
+	Keys         int    // Keys in the store, in memory mode including expired keys that weren't purged yet
+	LogSize      int64  // Total size of the log files in bytes
+
+	Records      int       // Records in the log, including stale ones
+	StaleRecords int       // Records compaction would drop, deleted, expired or overwritten ones beyond the versions kept for GetHistory
+	LiveRatio    float64   // Fraction of Records that aren't stale, 1 for an empty log
+	Compacted    time.Time // When the last compaction since the store was opened finished, zero if there was none
+
+	LoadTime time.Duration // How long opening the store took to replay the log and build its indexes
+}
+
+// totals reported by Stats, updated without the store's locks
+type storeCounters struct {
+	sets         atomic.Uint64
+	gets         atomic.Uint64
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	deletes      atomic.Uint64
+	compactions  atomic.Uint64
+	bytesWritten atomic.Uint64
+	compactedAt  atomic.Int64 // Unix nanoseconds, 0 if there was no compaction
+}
+
+// count a read of a single key
+func (c *storeCounters) read(hit bool) {
+	c.gets.Add(1)
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// count a compaction that completed
+func (c *storeCounters) compacted() {
+	c.compactions.Add(1)
+	c.compactedAt.Store(time.Now().UnixNano())
+}
+
+// count records appended to the log
+func (c *storeCounters) written(entries []Entry, bytes int) {
+	for _, entry := range entries {
+		switch {
+		case entry.Commit:
+		case entry.Deleted:
+			c.deletes.Add(1)
+		default:
+			c.sets.Add(1)
+		}
+	}
+	c.bytesWritten.Add(uint64(bytes))
+}
+
+// report the store's counters and its current size. the counters start at
+// zero when the store is opened. counting keys and records is cheap in memory
+// mode, otherwise it reads the whole log.
+func (s *Store) Stats() StoreStats {
+	stats := s.counterStats()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return stats
+	}
+
+	if records, live, err := s.recordCounts(); err == nil {
+		stats.Keys = live
+		stats.Records = records
+		stats.StaleRecords = max(records-s.keptRecords(live), 0)
+		if records > 0 {
+			stats.LiveRatio = float64(records-stats.StaleRecords) / float64(records)
+		}
+	} else {
+		s.logger.Error("error counting log records", "err", err)
+	}
+
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	if size, err := s.logSize(); err == nil {
+		stats.LogSize = size
+	}
+	return stats
+}
+
+// the counters of Stats alone, which don't need the store's locks
+func (s *Store) counterStats() StoreStats {
+	stats := StoreStats{
+		Sets:         s.counters.sets.Load(),
+		Gets:         s.counters.gets.Load(),
+		Hits:         s.counters.hits.Load(),
+		Misses:       s.counters.misses.Load(),
+		Deletes:      s.counters.deletes.Load(),
+		Compactions:  s.counters.compactions.Load(),
+		BytesWritten: s.counters.bytesWritten.Load(),
+		LiveRatio:    1,
+		LoadTime:     s.loadTime,
+	}
+	if at := s.counters.compactedAt.Load(); at != 0 {
+		stats.Compacted = time.Unix(0, at)
+	}
+	return stats
+}
@@ -0,0 +1,84 @@
+package keyvalue
+
+import (
+	"fmt"
+	"time"
+)
+
+// when writes to the log file are fsynced to disk
+type SyncMode int
+
+const (
+	SyncNever      SyncMode = iota // Leave flushing to the OS (default)
+	SyncEveryWrite                 // Fsync after every write, slowest but durable
+	SyncInterval                   // Fsync in the background every StoreConfig.SyncInterval
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNever:
+		return "never"
+	case SyncEveryWrite:
+		return "every-write"
+	case SyncInterval:
+		return "interval"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// flush buffered writes and fsync the log, so everything written so far
+// survives a crash whatever the SyncMode, like before acknowledging a write
+// that mustn't be lost. writes wait while the log is synced. a store without
+// a log file has nothing to sync.
+func (s *Store) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.readOnly || s.memoryOnly() {
+		return nil
+	}
+
+	// appends, which hold amu, set dirty and may move on to a new segment
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	if err := s.Err(); err != nil || !s.dirty {
+		return err
+	}
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+	if err := s.syncLog(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// periodically fsync the log file if anything was written since the last
+// sync, until the store is closed or stop is closed by Reconfigure
+func (s *Store) syncLoop(interval time.Duration, stop <-chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty && !s.closed && s.Err() == nil {
+				// failing the store logs the error
+				if s.flushBuffer() == nil && s.syncLog() == nil {
+					s.dirty = false
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
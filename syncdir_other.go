@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package keyvalue
+
+// directories can't be fsynced on this platform, renames are made durable by
+// the file system itself on windows
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package keyvalue
+
+// a view of a store with the methods of sync.Map, so code written against
+// one can keep its data in a store instead. keys and values are strings.
+// sync.Map can't fail, so errors, like a write refused because the store is
+// full, are logged to StoreConfig.Logger and the method carries on as if the
+// key was missing or the write didn't happen.
+type Map struct {
+	s *Store
+}
+
+// the store as a Map
+func (s *Store) AsMap() *Map {
+	return &Map{s: s}
+}
+
+// the value stored for a key, reporting whether there is one
+func (m *Map) Load(key string) (string, bool) {
+	return m.s.Get(key)
+}
+
+// set the value for a key
+func (m *Map) Store(key, value string) {
+	if err := m.s.Set(key, value); err != nil {
+		m.s.logger.Error("error storing key", "key", key, "err", err)
+	}
+}
+
+// the existing value for a key if there is one, otherwise store and return
+// value. loaded reports whether the value was already there.
+func (m *Map) LoadOrStore(key, value string) (actual string, loaded bool) {
+	actual, loaded, err := m.s.GetOrSet(key, value)
+	if err != nil {
+		m.s.logger.Error("error storing key", "key", key, "err", err)
+		return value, false
+	}
+	return actual, loaded
+}
+
+// delete a key, returning the value it had if there was one
+func (m *Map) LoadAndDelete(key string) (value string, loaded bool) {
+	err := m.s.Update(key, func(old string, exists bool) (string, bool) {
+		value, loaded = old, exists
+		return "", false
+	})
+	if err != nil {
+		m.s.logger.Error("error deleting key", "key", key, "err", err)
+		return "", false
+	}
+	return value, loaded
+}
+
+// delete a key
+func (m *Map) Delete(key string) {
+	if err := m.s.Delete(key); err != nil {
+		m.s.logger.Error("error deleting key", "key", key, "err", err)
+	}
+}
+
+// store value for a key, returning the previous value if there was one
+func (m *Map) Swap(key, value string) (previous string, loaded bool) {
+	err := m.s.Update(key, func(old string, exists bool) (string, bool) {
+		previous, loaded = old, exists
+		return value, true
+	})
+	if err != nil {
+		m.s.logger.Error("error storing key", "key", key, "err", err)
+		return "", false
+	}
+	return previous, loaded
+}
+
+// store new for a key only if its value is old, reporting whether it was
+func (m *Map) CompareAndSwap(key, old, new string) bool {
+	swapped, err := m.s.CompareAndSwap(key, old, new)
+	if err != nil {
+		m.s.logger.Error("error storing key", "key", key, "err", err)
+	}
+	return swapped
+}
+
+// delete a key only if its value is old, reporting whether it was
+func (m *Map) CompareAndDelete(key, old string) bool {
+	deleted, err := m.s.CompareAndDelete(key, old)
+	if err != nil {
+		m.s.logger.Error("error deleting key", "key", key, "err", err)
+	}
+	return deleted
+}
+
+// call f for every key and value until it returns false. like sync.Map the
+// store isn't locked while f runs, so f can change it, and a key's value is
+// read just before f is called with it.
+func (m *Map) Range(f func(key, value string) bool) {
+	for _, key := range m.s.Keys("") {
+		if value, ok := m.s.Get(key); ok && !f(key, value) {
+			return
+		}
+	}
+}
+
+// delete every key, with a single write
+func (m *Map) Clear() {
+	if err := m.s.DeleteBatch(m.s.Keys("")); err != nil {
+		m.s.logger.Error("error clearing store", "err", err)
+	}
+}
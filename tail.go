@@ -0,0 +1,81 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// stream the committed records of the log with sequence numbers of at least
+// fromSeq, for building derived views or audit trails of the store: first
+// the ones still in the log, then every record written from then on as it
+// is written. records from logs written before sequence numbers were kept are
+// only included when fromSeq is 0. values are whole, records that changed a
+// key's value rather than replacing it, like Append, come with the value they
+// left, and commit records are left out. the log is read while holding the
+// write lock, so writes wait for it. call the returned function to stop,
+// which closes the channel. closing the store also closes it.
+func (s *Store) TailLog(fromSeq uint64) (<-chan Entry, func(), error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, nil, ErrStoreClosed
+	}
+	var history []Entry
+	err := s.replayContext(context.Background(), func(entry Entry) bool {
+		if entry.Seq >= fromSeq || fromSeq == 0 {
+			history = append(history, entry)
+		}
+		return true
+	}, nil)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, nil, fmt.Errorf("error reading log file: %w", err)
+	}
+	// subscribing under the same lock as reading the log means no record is
+	// missed or sent twice
+	f := newRelay[[]Entry]()
+	if s.feeds == nil {
+		s.feeds = make(map[*feed]struct{})
+	}
+	s.feeds[f] = struct{}{}
+	s.mu.Unlock()
+
+	ch := make(chan Entry)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		send := func(entry Entry) bool {
+			select {
+			case ch <- entry:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		for _, entry := range history {
+			if !send(entry) {
+				return
+			}
+		}
+		for batch := range f.ch {
+			for _, entry := range batch {
+				if !entry.Commit && !send(entry) {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.feeds, f)
+			s.mu.Unlock()
+			f.stop()
+			close(done)
+		})
+	}
+	return ch, cancel, nil
+}
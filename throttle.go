@@ -0,0 +1,131 @@
+package keyvalue
+
+import (
+	"context"
+	"crypto/cipher"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// largest chunk compaction reads or writes at a time
+const maxCompactionChunk = 1 << 20
+
+// paces the reads and writes of a compaction to StoreConfig.CompactionRate,
+// which Reconfigure may change while it runs. I/O is done in chunks of about
+// a tenth of a second's worth, with a pause after any that get ahead of the
+// rate, so other readers and writers of the disk get their turn.
+type throttle struct {
+	rate  *atomic.Int64
+	last  int64     // Rate the bytes since start were counted at
+	start time.Time // When counting started
+	bytes int64     // Bytes read and written since start
+}
+
+func (s *Store) newThrottle() *throttle {
+	return &throttle{rate: &s.compactRate, start: time.Now()}
+}
+
+// the bytes to read or write before the next pause
+func (t *throttle) chunk() int {
+	rate := t.rate.Load()
+	if rate <= 0 {
+		return maxCompactionChunk
+	}
+	return int(min(max(rate/10, 4<<10), maxCompactionChunk))
+}
+
+// count n bytes of I/O, sleeping until the rate allows for them. gives up
+// with ctx's error once it is done.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	rate := t.rate.Load()
+	if rate != t.last {
+		// start counting afresh at the new rate
+		t.last, t.start, t.bytes = rate, time.Now(), 0
+	}
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	t.bytes += int64(n)
+	delay := time.Until(t.start.Add(time.Duration(float64(t.bytes) / float64(rate) * float64(time.Second))))
+	if delay < -time.Second {
+		// I/O slower than the rate doesn't earn a burst later
+		t.start, t.bytes = time.Now(), 0
+	}
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reads from r a chunk at a time at the pace of t
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if chunk := r.t.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if waitErr := r.t.wait(r.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// replay the log file at path at the pace of t, see replayFile
+func (t *throttle) replayFile(ctx context.Context, path string, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	return t.replayPrefix(ctx, path, -1, aead, limit, fn, onError)
+}
+
+// like replayFile, but stops at offset end unless it is negative
+func (t *throttle) replayPrefix(ctx context.Context, path string, end int64, aead cipher.AEAD, limit int, fn func(Entry, int64) bool, onError func(error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if end >= 0 {
+		r = io.NewSectionReader(file, 0, end)
+	}
+	return replayFrom(&throttledReader{ctx: ctx, r: r, t: t}, path, aead, limit, fn, onError)
+}
+
+// write data to a new file at path a chunk at a time at the pace of t, and
+// fsync it, see writeSynced
+func (t *throttle) writeFile(ctx context.Context, path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), t.chunk())
+		if _, err := file.Write(data[:n]); err != nil {
+			file.Close()
+			return err
+		}
+		data = data[n:]
+		if err := t.wait(ctx, n); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,167 @@
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// a set of staged Set and Delete operations that are committed atomically.
+// on replay either every operation in a transaction is applied or none are.
+type Txn struct {
+	s    *Store
+	ops  []Entry
+	err  error // First invalid operation staged, returned by Commit
+	done bool
+}
+
+// start a new transaction. operations are only staged in the transaction
+// until Commit is called.
+func (s *Store) Txn() *Txn {
+	return &Txn{s: s}
+}
+
+// stage setting a key-value pair
+func (t *Txn) Set(key, value string) {
+	t.ops = append(t.ops, Entry{Key: t.s.normalize(key), Value: value})
+}
+
+// stage setting a key-value pair that expires after the given duration. a
+// ttl that isn't positive fails the whole transaction on Commit.
+func (t *Txn) SetWithTTL(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		if t.err == nil {
+			t.err = ErrInvalidTTL
+		}
+		return
+	}
+	t.ops = append(t.ops, Entry{Key: t.s.normalize(key), Value: value, ExpiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// stage deleting a key
+func (t *Txn) Delete(key string) {
+	t.ops = append(t.ops, Entry{Key: t.s.normalize(key), Deleted: true})
+}
+
+// drop all staged operations without writing anything
+func (t *Txn) Discard() {
+	t.ops = nil
+	t.done = true
+}
+
+// write every staged operation followed by a commit record in a single
+// append, then apply them to memory
+func (t *Txn) Commit() error {
+	if t.done {
+		return fmt.Errorf("transaction already committed or discarded")
+	}
+	t.done = true
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.ops) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(t.ops))
+	for i, op := range t.ops {
+		keys[i] = op.Key
+	}
+	return t.s.runFunc(Operation{Type: OpCommit, Ctx: context.Background(), Keys: keys}, func(context.Context) error {
+		t.s.mu.Lock()
+		defer t.s.mu.Unlock()
+		return t.s.commitLocked(t.ops)
+	})
+}
+
+// write ops followed by a commit record in a single append, then apply them
+// to memory. the caller must hold the write lock.
+func (s *Store) commitLocked(ops []Entry) error {
+	// validate everything up front and work out how many keys and how much
+	// memory the store will hold once the transaction is applied
+	present := make(map[string]bool)
+	final := make(map[string]Entry)
+	count := int(s.keys.Load())
+	for _, op := range ops {
+		if !op.Deleted {
+			if err := s.validate(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+		was, seen := present[op.Key]
+		if !seen {
+			_, was = s.memValue(op.Key)
+		}
+		switch {
+		case op.Deleted && was:
+			count--
+		case !op.Deleted && !was:
+			count++
+		}
+		present[op.Key] = !op.Deleted
+		final[op.Key] = op
+	}
+	// evictions are part of the transaction, so they only happen if it
+	// commits
+	evictions := 0
+	if s.useMemory {
+		if err := s.checkQuota(ops...); err != nil {
+			return err
+		}
+		newBytes := int64(0)
+		keep := make(map[string]bool, len(final))
+		for key, op := range final {
+			keep[key] = true
+			if old, exists := s.memValue(key); exists {
+				newBytes -= memSize(key, old)
+			}
+			if !op.Deleted {
+				newBytes += memSize(key, op.Value)
+			}
+		}
+		evicted, err := s.makeRoomLocked(count-int(s.keys.Load()), newBytes, keep)
+		if err != nil {
+			return err
+		}
+		ops = append(evicted, ops...)
+		evictions = len(evicted)
+	}
+
+	id := s.nextTxnID()
+	records := make([]Entry, 0, len(ops)+1)
+	for _, op := range ops {
+		op.Txn = id
+		records = append(records, op)
+	}
+	records = append(records, Entry{Txn: id, Commit: true})
+	if err := s.appendEntries(records...); err != nil {
+		return err
+	}
+
+	if s.useMemory {
+		for i, op := range records[:len(ops)] {
+			switch {
+			case !op.Deleted:
+				s.putLocked(op)
+			case i < evictions:
+				s.dropLocked(op.Key, RemovalEvicted)
+			default:
+				s.dropLocked(op.Key, RemovalDeleted)
+			}
+		}
+	}
+
+	return nil
+}
+
+// issue a transaction ID, increasing even if the clock doesn't move so a torn
+// transaction from before a restart can't be completed by a later commit
+// record. the caller must hold the write lock.
+func (s *Store) nextTxnID() uint64 {
+	id := uint64(time.Now().UnixNano())
+	if id <= s.lastTxn {
+		id = s.lastTxn + 1
+	}
+	s.lastTxn = id
+	return id
+}
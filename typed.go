@@ -0,0 +1,112 @@
+package keyvalue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jere-mie/keyvalue/internal/msgpack"
+)
+
+// converts typed values to and from the bytes stored in the log. JSONCodec
+// keeps values readable, MsgpackCodec makes them smaller and faster to
+// decode, GobCodec keeps Go types intact, and any other encoding can be
+// plugged in.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// encodes values as JSON, the default codec for Typed. values stay readable
+// in the log and by other clients of the store, at the cost of size and
+// speed.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// encodes values with encoding/gob, which round-trips Go types most
+// faithfully but only Go can read. every value carries a description of its
+// type, so it suits large values better than small ones. concrete types held
+// in interfaces must be registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// encodes values as MessagePack, a compact binary form of JSON's data model
+// that other languages can read too. structs are maps keyed by field name,
+// or by the name in a `msgpack:"name,omitempty"` tag, where "-" leaves a
+// field out. time.Time is a MessagePack timestamp, decoded in the local time
+// zone.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (MsgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+// a view of a store holding values of type T, encoded with a Codec
+type Typed[T any] struct {
+	store *Store
+	codec Codec
+}
+
+// wrap a store to hold values of type T. a nil codec uses JSONCodec.
+func NewTyped[T any](store *Store, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Typed[T]{store: store, codec: codec}
+}
+
+// the underlying store
+func (t *Typed[T]) Store() *Store {
+	return t.store
+}
+
+// encode and set a value
+func (t *Typed[T]) Set(key string, value T) error {
+	data, err := t.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error encoding value: %w", err)
+	}
+	return t.store.SetBytes(key, data)
+}
+
+// encode and set a value that expires after the given duration
+func (t *Typed[T]) SetWithTTL(key string, value T, ttl time.Duration) error {
+	data, err := t.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error encoding value: %w", err)
+	}
+	return t.store.SetWithTTL(key, string(data), ttl)
+}
+
+// retrieve and decode a value by key. a missing key returns the zero value
+// and false with no error.
+func (t *Typed[T]) Get(key string) (T, bool, error) {
+	var value T
+	data, exists := t.store.GetBytes(key)
+	if !exists {
+		return value, false, nil
+	}
+	if err := t.codec.Unmarshal(data, &value); err != nil {
+		return value, true, fmt.Errorf("error decoding value for %q: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// delete a key
+func (t *Typed[T]) Delete(key string) error {
+	return t.store.Delete(key)
+}
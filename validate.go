@@ -0,0 +1,89 @@
+package keyvalue
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// checks a value before it is written to a key under a prefix, see
+// Store.ValidatePrefix
+type ValueValidator func(value string) error
+
+// a validator and the prefix it covers
+type prefixValidator struct {
+	prefix string
+	fn     ValueValidator
+}
+
+// the validators set with ValidatePrefix sorted by prefix, nil without any.
+// a slice is never changed once stored, so writers read it without the
+// store's locks.
+type validatorTable struct {
+	list atomic.Pointer[[]prefixValidator]
+}
+
+func (t *validatorTable) Load() []prefixValidator {
+	if list := t.list.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+func (t *validatorTable) Store(list []prefixValidator) {
+	if len(list) == 0 {
+		t.list.Store(nil)
+	} else {
+		t.list.Store(&list)
+	}
+}
+
+// check the values written to keys starting with prefix with fn before they
+// reach the log, so malformed values never enter it. a write fn rejects
+// fails with ErrInvalidValue and fn's error, and changes nothing. a key under
+// several prefixes with validators must pass all of them, shortest prefix
+// first, and an empty prefix covers every key. values already in the store
+// aren't checked, and neither are deletes or records applied from a primary.
+// a nil fn removes the prefix's validator. validators aren't saved in the
+// log, they have to be set again whenever the store is opened.
+func (s *Store) ValidatePrefix(prefix string, fn ValueValidator) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	list := slices.DeleteFunc(slices.Clone(s.validators.Load()), func(v prefixValidator) bool {
+		return v.prefix == prefix
+	})
+	if fn != nil {
+		i, _ := slices.BinarySearchFunc(list, prefix, func(v prefixValidator, prefix string) int {
+			return strings.Compare(v.prefix, prefix)
+		})
+		list = slices.Insert(list, i, prefixValidator{prefix: prefix, fn: fn})
+	}
+	s.validators.Store(list)
+	return nil
+}
+
+// check that Set would accept value for key, against the size limits,
+// StoreConfig.ValidateKey and the validators of ValidatePrefix, without
+// writing anything. key is checked as it is, see NormalizeKey. ApplyRecords
+// skips these checks, so records should pass them before they are applied.
+func (s *Store) Validate(key, value string) error {
+	return s.validate(key, value)
+}
+
+// check a value written to key against the validators of its prefixes
+func (s *Store) checkValue(key, value string) error {
+	for _, v := range s.validators.Load() {
+		if !strings.HasPrefix(key, v.prefix) {
+			continue
+		}
+		if err := v.fn(value); err != nil {
+			return fmt.Errorf("%q: %w: %w", key, ErrInvalidValue, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package keyvalue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// what VerifyLog found in a log
+type VerifyReport struct {
+	Format      LogFormat
+	Files       int            // Log files read, more than one for a segmented log
+	Size        int64          // Total size of the log files in bytes
+	Records     int            // Records that decoded, including commit records
+	Bad         []*RecordError // Records that didn't, in the order they were read
+	Keys        int            // Live keys the log leaves
+	Duplicates  int            // Records followed by a later record of the same key
+	Uncommitted int            // Records of transactions that have no commit record
+	Dead        int            // Records compaction would drop, see Compact
+	Reclaimable int64          // Bytes compaction would free, estimated by encoding what it keeps
+}
+
+// whether every record of the log decoded
+func (r VerifyReport) OK() bool {
+	return len(r.Bad) == 0
+}
+
+// check every record of the log at logPath, reporting the ones that fail
+// their checksum or don't decode along with how much of the log is dead. the
+// log is opened read-only with config, so this can run while another process
+// owns it, and config.EncryptionKey is needed to check encrypted values. an
+// error means the log couldn't be read at all, bad records are only reported.
+func VerifyLog(logPath string, config StoreConfig) (VerifyReport, error) {
+	config.ReadOnly, config.UseMemory = true, false
+	config.StrictReplay, config.TruncateCorrupt = false, false
+	s, err := NewStore(logPath, config)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer s.Close()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := VerifyReport{Format: s.format}
+	perKey := make(map[string]int)
+	txns := make(map[uint64]int)
+	committed := make(map[uint64]bool)
+	for _, path := range s.logFiles() {
+		size, err := s.verifyFile(path, &report, func(entry Entry) {
+			if entry.Commit {
+				committed[entry.Txn] = true
+				return
+			}
+			if entry.Txn != 0 {
+				txns[entry.Txn]++
+			}
+			perKey[entry.Key]++
+		})
+		if err != nil {
+			return report, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		report.Files++
+		report.Size += size
+	}
+	for _, n := range perKey {
+		report.Duplicates += n - 1
+	}
+	for txn, n := range txns {
+		if !committed[txn] {
+			report.Uncommitted += n
+		}
+	}
+
+	kept, err := s.compactEntries(context.Background())
+	if err != nil {
+		return report, err
+	}
+	keys := make(map[string]struct{}, len(kept))
+	compacted := int64(len(s.newFormat.header()))
+	for _, entry := range kept {
+		keys[entry.Key] = struct{}{}
+		data, err := encodeEntry(s.newFormat, s.aead, entry)
+		if err != nil {
+			return report, err
+		}
+		compacted += int64(len(data))
+	}
+	report.Keys = len(keys)
+	report.Dead = max(report.Records-len(kept), 0)
+	report.Reclaimable = max(report.Size-compacted, 0)
+	return report, nil
+}
+
+// read every record of one log file into report, passing fn the ones that
+// decode. returns the size of the file.
+func (s *Store) verifyFile(path string, report *VerifyReport, fn func(Entry)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader, err := newRecordReader(f, s.aead, s.maxRecordSize)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return info.Size(), nil
+		}
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			recErr.File = path
+			report.Bad = append(report.Bad, recErr)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		report.Records++
+		fn(entry)
+	}
+}
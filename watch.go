@@ -0,0 +1,164 @@
+package keyvalue
+
+import (
+	"strings"
+	"sync"
+)
+
+// the kind of change an Event describes
+type EventType int
+
+const (
+	EventSet    EventType = iota // A key was set
+	EventDelete                  // A key was deleted or expired
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "delete"
+	}
+	return "set"
+}
+
+// a change to a key, delivered to watchers
+type Event struct {
+	Type  EventType
+	Key   string
+	Value string // The new value for EventSet
+}
+
+// a subscriber to changes under a prefix
+type watcher struct {
+	prefix string
+	*relay[Event]
+}
+
+// hands values to a channel in the order they were pushed. they are queued
+// without limit and handed over by their own goroutine, so a slow reader
+// never blocks writes to the store and never misses one.
+type relay[T any] struct {
+	ch    chan T
+	mu    sync.Mutex
+	queue []T
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newRelay[T any]() *relay[T] {
+	r := &relay[T]{
+		ch:   make(chan T),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// subscribe to Set and Delete events for keys starting with prefix. events
+// are delivered in the order they were written. call the returned function to
+// unsubscribe, which closes the channel. closing the store also closes it.
+func (s *Store) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, relay: newRelay[Event]()}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		w.stop()
+		return w.ch, func() {}
+	}
+	if s.watchers == nil {
+		s.watchers = make(map[*watcher]struct{})
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	cancel := func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+		w.stop()
+	}
+	return w.ch, cancel
+}
+
+// queue events for every watcher with a matching prefix. the caller must hold
+// the write lock.
+func (s *Store) notify(events ...Event) {
+	for w := range s.watchers {
+		for _, event := range events {
+			if strings.HasPrefix(event.Key, w.prefix) {
+				w.push(event)
+			}
+		}
+	}
+}
+
+// queue change events for records that were written to the log. the caller
+// must hold the write lock.
+func (s *Store) notifyEntries(entries []Entry) {
+	if len(s.watchers) == 0 {
+		return
+	}
+	events := make([]Event, 0, len(entries))
+	for _, entry := range entries {
+		switch {
+		case entry.Commit, entry.partial():
+			continue
+		case entry.Deleted:
+			events = append(events, Event{Type: EventDelete, Key: entry.Key})
+		default:
+			events = append(events, Event{Type: EventSet, Key: entry.Key, Value: entry.Value})
+		}
+	}
+	s.notify(events...)
+}
+
+// stop every watcher, when the store is closed. the caller must hold the
+// write lock.
+func (s *Store) stopWatchers() {
+	for w := range s.watchers {
+		w.stop()
+	}
+	s.watchers = nil
+}
+
+func (r *relay[T]) push(v T) {
+	r.mu.Lock()
+	r.queue = append(r.queue, v)
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *relay[T]) stop() {
+	r.once.Do(func() { close(r.done) })
+}
+
+// hand queued values to the channel until stopped
+func (r *relay[T]) run() {
+	defer close(r.ch)
+	for {
+		r.mu.Lock()
+		queue := r.queue
+		r.queue = nil
+		r.mu.Unlock()
+
+		for _, v := range queue {
+			select {
+			case r.ch <- v:
+			case <-r.done:
+				return
+			}
+		}
+
+		select {
+		case <-r.wake:
+		case <-r.done:
+			return
+		}
+	}
+}